@@ -167,10 +167,29 @@ func (c *cluster) IsLeader() bool {
 	return server.Server.Leader() == server.Server.ID()
 }
 
+func (c *cluster) LeaderChangedNotify() (<-chan struct{}, error) {
+	server, err := c.getServer()
+	if err != nil {
+		return nil, err
+	}
+
+	return server.Server.LeaderChangedNotify(), nil
+}
+
+func (c *cluster) Endpoints() []string {
+	return c.opt.GetPeerURLs()
+}
+
 // requestContext returns context with request timeout,
 // please use it immediately in case of incorrect timeout.
 func (c *cluster) requestContext() (context.Context, context.CancelFunc) {
-	return context.WithTimeout(context.Background(), c.requestTimeout)
+	return c.requestContextWith(context.Background())
+}
+
+// requestContextWith derives the request context from parent, it ends
+// at the earlier of the deadline of parent and the request timeout.
+func (c *cluster) requestContextWith(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, c.requestTimeout)
 }
 
 // longRequestContext takes 3 times longer than requestContext.
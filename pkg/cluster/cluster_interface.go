@@ -18,6 +18,7 @@
 package cluster
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -32,14 +33,36 @@ type (
 	// Cluster is the open cluster interface.
 	Cluster interface {
 		IsLeader() bool
+		// LeaderChangedNotify returns the channel closed once the leader of the
+		// cluster changes, a new one is needed after every change. It fails
+		// if the member has no embedded etcd server, e.g. a secondary one.
+		LeaderChangedNotify() (<-chan struct{}, error)
 
 		Layout() *Layout
 
+		// Endpoints returns the etcd endpoints the client connects to.
+		Endpoints() []string
+
 		Get(key string) (*string, error)
 		GetPrefix(prefix string) (map[string]string, error)
 		GetRaw(key string) (*mvccpb.KeyValue, error)
 		GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, error)
 		GetWithOp(key string, ops ...ClientOp) (map[string]string, error)
+		// GetPrefixPaged gets at most limit keys of the prefix in key order from fromKey,
+		// the empty fromKey means from the first key. It returns the next fromKey as well,
+		// which is empty once the keys are exhausted.
+		GetPrefixPaged(prefix string, limit int64, fromKey string) (map[string]string, string, error)
+
+		// GetPrefixAt gets the prefix at the revision, which fails
+		// if the revision has been compacted.
+		GetPrefixAt(prefix string, revision int64) (map[string]string, error)
+		CurrentRevision() (int64, error)
+		// CountPrefix counts the keys of the prefix without reading their values.
+		CountPrefix(prefix string) (int64, error)
+		// Exists checks whether the key exists without reading its value.
+		Exists(key string) (bool, error)
+		// ListRevisions lists the mod revisions of the keys of the prefix without reading their values.
+		ListRevisions(prefix string) (map[string]int64, error)
 
 		Put(key, value string) error
 		PutUnderLease(key, value string) error
@@ -48,9 +71,30 @@ type (
 
 		PutUnderTimeout(key, value string, timeout time.Duration) error
 
+		// GrantLease grants a lease independent of the member lease, the data
+		// put with it expires if the lease isn't kept alive within ttl.
+		GrantLease(ttl time.Duration) (clientv3.LeaseID, error)
+		KeepAliveLease(leaseID clientv3.LeaseID) error
+		RevokeLease(leaseID clientv3.LeaseID) error
+		PutWithLease(key, value string, leaseID clientv3.LeaseID) error
+		// ListLeases lists the alive leases with their remaining ttl and attached keys.
+		ListLeases() ([]*clientv3.LeaseTimeToLiveResponse, error)
+
 		Delete(key string) error
 		DeletePrefix(prefix string) error
 
+		// The Ctx variants end at the earlier of the deadline of ctx and
+		// the request timeout, and they are aborted once ctx is cancelled.
+		GetRawCtx(ctx context.Context, key string) (*mvccpb.KeyValue, error)
+		GetRawPrefixCtx(ctx context.Context, prefix string) (map[string]*mvccpb.KeyValue, error)
+		PutCtx(ctx context.Context, key, value string) error
+		PutAndDeleteCtx(ctx context.Context, kvs map[string]*string) error
+		DeleteCtx(ctx context.Context, key string) error
+
+		// Txn commits a transaction, thenOps are applied if all cmps succeed,
+		// otherwise elseOps are applied. It reports whether cmps succeeded.
+		Txn(cmps []clientv3.Cmp, thenOps, elseOps []clientv3.Op) (bool, error)
+
 		// The STM function is used to do cluster-level atomic operations like
 		// increase/decrease an integer by one, which is very useful to create
 		// a cluster-level counter.
@@ -30,6 +30,7 @@ import (
 	"github.com/phayes/freeport"
 	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
 	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/client/v3/concurrency"
 
 	"github.com/megaease/easegress/v2/pkg/env"
@@ -583,6 +584,62 @@ func TestMutexAndOP(t *testing.T) {
 	}
 }
 
+func TestLeaseOps(t *testing.T) {
+	opts, _ := mockMembers(1)
+	cls, err := New(opts[0])
+	if err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+	c := cls.(*cluster)
+	defer closeClusters([]*cluster{c})
+
+	leaseID, err := c.GrantLease(time.Minute)
+	if err != nil {
+		t.Fatalf("grant lease failed: %v", err)
+	}
+	if err := c.PutWithLease("/test/lease/a", "a", leaseID); err != nil {
+		t.Fatalf("put with lease failed: %v", err)
+	}
+	kv, err := c.GetRaw("/test/lease/a")
+	if err != nil || kv == nil || clientv3.LeaseID(kv.Lease) != leaseID {
+		t.Fatalf("want key attached to lease %x, got %v: %v", leaseID, kv, err)
+	}
+	if err := c.KeepAliveLease(leaseID); err != nil {
+		t.Fatalf("keep alive lease failed: %v", err)
+	}
+
+	leases, err := c.ListLeases()
+	if err != nil {
+		t.Fatalf("list leases failed: %v", err)
+	}
+	found := false
+	for _, lease := range leases {
+		if lease.ID != leaseID {
+			continue
+		}
+		found = true
+		if lease.TTL <= 0 || len(lease.Keys) != 1 || string(lease.Keys[0]) != "/test/lease/a" {
+			t.Fatalf("want lease with ttl and key /test/lease/a, got %+v", lease)
+		}
+	}
+	if !found {
+		t.Fatalf("want lease %x listed, got %v", leaseID, leases)
+	}
+
+	if err := c.RevokeLease(leaseID); err != nil {
+		t.Fatalf("revoke lease failed: %v", err)
+	}
+	if value, err := c.Get("/test/lease/a"); err != nil || value != nil {
+		t.Fatalf("want key deleted with revoked lease, got %v: %v", value, err)
+	}
+	if err := c.KeepAliveLease(leaseID); err == nil {
+		t.Fatalf("want error keeping alive revoked lease")
+	}
+	if err := c.PutWithLease("/test/lease/a", "a", leaseID); err == nil {
+		t.Fatalf("want error putting with revoked lease")
+	}
+}
+
 func TestUtilEqual(t *testing.T) {
 	equal := isKeyValueEqual(&mvccpb.KeyValue{
 		Key: []byte("abc"),
@@ -19,6 +19,7 @@
 package clustertest
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -31,19 +32,38 @@ import (
 // MockedCluster defines a mocked cluster
 type MockedCluster struct {
 	MockedIsLeader               func() bool
+	MockedLeaderChangedNotify    func() (<-chan struct{}, error)
 	MockedLayout                 func() *cluster.Layout
+	MockedEndpoints              func() []string
 	MockedGet                    func(key string) (*string, error)
 	MockedGetPrefix              func(prefix string) (map[string]string, error)
 	MockedGetRaw                 func(key string) (*mvccpb.KeyValue, error)
 	MockedGetRawPrefix           func(prefix string) (map[string]*mvccpb.KeyValue, error)
 	MockedGetWithOp              func(key string, ops ...cluster.ClientOp) (map[string]string, error)
+	MockedGetPrefixAt            func(prefix string, revision int64) (map[string]string, error)
+	MockedGetPrefixPaged         func(prefix string, limit int64, fromKey string) (map[string]string, string, error)
+	MockedCurrentRevision        func() (int64, error)
+	MockedCountPrefix            func(prefix string) (int64, error)
+	MockedExists                 func(key string) (bool, error)
+	MockedListRevisions          func(prefix string) (map[string]int64, error)
 	MockedPut                    func(key, value string) error
 	MockedPutUnderTimeout        func(key, value string, timeout time.Duration) error
 	MockedPutUnderLease          func(key, value string) error
 	MockedPutAndDelete           func(map[string]*string) error
 	MockedPutAndDeleteUnderLease func(map[string]*string) error
+	MockedGrantLease             func(ttl time.Duration) (clientv3.LeaseID, error)
+	MockedKeepAliveLease         func(leaseID clientv3.LeaseID) error
+	MockedRevokeLease            func(leaseID clientv3.LeaseID) error
+	MockedPutWithLease           func(key, value string, leaseID clientv3.LeaseID) error
+	MockedListLeases             func() ([]*clientv3.LeaseTimeToLiveResponse, error)
+	MockedTxn                    func(cmps []clientv3.Cmp, thenOps, elseOps []clientv3.Op) (bool, error)
 	MockedDelete                 func(key string) error
 	MockedDeletePrefix           func(prefix string) error
+	MockedGetRawCtx              func(ctx context.Context, key string) (*mvccpb.KeyValue, error)
+	MockedGetRawPrefixCtx        func(ctx context.Context, prefix string) (map[string]*mvccpb.KeyValue, error)
+	MockedPutCtx                 func(ctx context.Context, key, value string) error
+	MockedPutAndDeleteCtx        func(ctx context.Context, kvs map[string]*string) error
+	MockedDeleteCtx              func(ctx context.Context, key string) error
 	MockedSTM                    func(apply func(concurrency.STM) error) error
 	MockedWatcher                func() (cluster.Watcher, error)
 	MockedSyncer                 func(pullInterval time.Duration) (cluster.Syncer, error)
@@ -69,6 +89,14 @@ func (mc *MockedCluster) IsLeader() bool {
 	return true
 }
 
+// LeaderChangedNotify implements interface function LeaderChangedNotify
+func (mc *MockedCluster) LeaderChangedNotify() (<-chan struct{}, error) {
+	if mc.MockedLeaderChangedNotify != nil {
+		return mc.MockedLeaderChangedNotify()
+	}
+	return nil, nil
+}
+
 // Layout implements interface function Layout
 func (mc *MockedCluster) Layout() *cluster.Layout {
 	if mc.MockedLayout != nil {
@@ -77,6 +105,14 @@ func (mc *MockedCluster) Layout() *cluster.Layout {
 	return nil
 }
 
+// Endpoints implements interface function Endpoints
+func (mc *MockedCluster) Endpoints() []string {
+	if mc.MockedEndpoints != nil {
+		return mc.MockedEndpoints()
+	}
+	return nil
+}
+
 // Get implements interface function Get
 func (mc *MockedCluster) Get(key string) (*string, error) {
 	if mc.MockedGet != nil {
@@ -117,6 +153,54 @@ func (mc *MockedCluster) GetWithOp(key string, ops ...cluster.ClientOp) (map[str
 	return nil, nil
 }
 
+// GetPrefixAt implements interface function GetPrefixAt
+func (mc *MockedCluster) GetPrefixAt(prefix string, revision int64) (map[string]string, error) {
+	if mc.MockedGetPrefixAt != nil {
+		return mc.MockedGetPrefixAt(prefix, revision)
+	}
+	return nil, nil
+}
+
+// GetPrefixPaged implements interface function GetPrefixPaged
+func (mc *MockedCluster) GetPrefixPaged(prefix string, limit int64, fromKey string) (map[string]string, string, error) {
+	if mc.MockedGetPrefixPaged != nil {
+		return mc.MockedGetPrefixPaged(prefix, limit, fromKey)
+	}
+	return nil, "", nil
+}
+
+// CurrentRevision implements interface function CurrentRevision
+func (mc *MockedCluster) CurrentRevision() (int64, error) {
+	if mc.MockedCurrentRevision != nil {
+		return mc.MockedCurrentRevision()
+	}
+	return 0, nil
+}
+
+// CountPrefix implements interface function CountPrefix
+func (mc *MockedCluster) CountPrefix(prefix string) (int64, error) {
+	if mc.MockedCountPrefix != nil {
+		return mc.MockedCountPrefix(prefix)
+	}
+	return 0, nil
+}
+
+// Exists implements interface function Exists
+func (mc *MockedCluster) Exists(key string) (bool, error) {
+	if mc.MockedExists != nil {
+		return mc.MockedExists(key)
+	}
+	return false, nil
+}
+
+// ListRevisions implements interface function ListRevisions
+func (mc *MockedCluster) ListRevisions(prefix string) (map[string]int64, error) {
+	if mc.MockedListRevisions != nil {
+		return mc.MockedListRevisions(prefix)
+	}
+	return nil, nil
+}
+
 // Put implements interface function Put
 func (mc *MockedCluster) Put(key, value string) error {
 	if mc.MockedPut != nil {
@@ -157,6 +241,54 @@ func (mc *MockedCluster) PutAndDeleteUnderLease(m map[string]*string) error {
 	return nil
 }
 
+// GrantLease implements interface function GrantLease
+func (mc *MockedCluster) GrantLease(ttl time.Duration) (clientv3.LeaseID, error) {
+	if mc.MockedGrantLease != nil {
+		return mc.MockedGrantLease(ttl)
+	}
+	return 1, nil
+}
+
+// KeepAliveLease implements interface function KeepAliveLease
+func (mc *MockedCluster) KeepAliveLease(leaseID clientv3.LeaseID) error {
+	if mc.MockedKeepAliveLease != nil {
+		return mc.MockedKeepAliveLease(leaseID)
+	}
+	return nil
+}
+
+// RevokeLease implements interface function RevokeLease
+func (mc *MockedCluster) RevokeLease(leaseID clientv3.LeaseID) error {
+	if mc.MockedRevokeLease != nil {
+		return mc.MockedRevokeLease(leaseID)
+	}
+	return nil
+}
+
+// PutWithLease implements interface function PutWithLease
+func (mc *MockedCluster) PutWithLease(key, value string, leaseID clientv3.LeaseID) error {
+	if mc.MockedPutWithLease != nil {
+		return mc.MockedPutWithLease(key, value, leaseID)
+	}
+	return nil
+}
+
+// ListLeases implements interface function ListLeases
+func (mc *MockedCluster) ListLeases() ([]*clientv3.LeaseTimeToLiveResponse, error) {
+	if mc.MockedListLeases != nil {
+		return mc.MockedListLeases()
+	}
+	return nil, nil
+}
+
+// Txn implements interface function Txn
+func (mc *MockedCluster) Txn(cmps []clientv3.Cmp, thenOps, elseOps []clientv3.Op) (bool, error) {
+	if mc.MockedTxn != nil {
+		return mc.MockedTxn(cmps, thenOps, elseOps)
+	}
+	return true, nil
+}
+
 // Delete implements interface function Delete
 func (mc *MockedCluster) Delete(key string) error {
 	if mc.MockedDelete != nil {
@@ -165,6 +297,66 @@ func (mc *MockedCluster) Delete(key string) error {
 	return nil
 }
 
+// GetRawCtx implements interface function GetRawCtx,
+// it falls back to GetRaw if ctx isn't done.
+func (mc *MockedCluster) GetRawCtx(ctx context.Context, key string) (*mvccpb.KeyValue, error) {
+	if mc.MockedGetRawCtx != nil {
+		return mc.MockedGetRawCtx(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return mc.GetRaw(key)
+}
+
+// GetRawPrefixCtx implements interface function GetRawPrefixCtx,
+// it falls back to GetRawPrefix if ctx isn't done.
+func (mc *MockedCluster) GetRawPrefixCtx(ctx context.Context, prefix string) (map[string]*mvccpb.KeyValue, error) {
+	if mc.MockedGetRawPrefixCtx != nil {
+		return mc.MockedGetRawPrefixCtx(ctx, prefix)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return mc.GetRawPrefix(prefix)
+}
+
+// PutCtx implements interface function PutCtx,
+// it falls back to Put if ctx isn't done.
+func (mc *MockedCluster) PutCtx(ctx context.Context, key, value string) error {
+	if mc.MockedPutCtx != nil {
+		return mc.MockedPutCtx(ctx, key, value)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mc.Put(key, value)
+}
+
+// PutAndDeleteCtx implements interface function PutAndDeleteCtx,
+// it falls back to PutAndDelete if ctx isn't done.
+func (mc *MockedCluster) PutAndDeleteCtx(ctx context.Context, kvs map[string]*string) error {
+	if mc.MockedPutAndDeleteCtx != nil {
+		return mc.MockedPutAndDeleteCtx(ctx, kvs)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mc.PutAndDelete(kvs)
+}
+
+// DeleteCtx implements interface function DeleteCtx,
+// it falls back to Delete if ctx isn't done.
+func (mc *MockedCluster) DeleteCtx(ctx context.Context, key string) error {
+	if mc.MockedDeleteCtx != nil {
+		return mc.MockedDeleteCtx(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mc.Delete(key)
+}
+
 // DeletePrefix implements interface function DeletePrefix
 func (mc *MockedCluster) DeletePrefix(prefix string) error {
 	if mc.MockedDeletePrefix != nil {
@@ -0,0 +1,349 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package clustertest
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+type (
+	// MemCluster is a mocked cluster keeping its data in memory, the keys,
+	// revisions, leases and transactions behave like the ones of etcd,
+	// except that the leases never expire by themselves, every put and
+	// delete takes a revision, and the revisions are never compacted.
+	MemCluster struct {
+		*MockedCluster
+
+		mutex  sync.Mutex
+		kvs    map[string]*mvccpb.KeyValue
+		rev    int64
+		leases map[clientv3.LeaseID]*memLease
+		// history is the changes in revision order, for reading at a revision.
+		history []memChange
+	}
+
+	// memChange is a change of key, nil kv means the key is deleted.
+	memChange struct {
+		rev int64
+		key string
+		kv  *mvccpb.KeyValue
+	}
+
+	memLease struct {
+		ttl      time.Duration
+		deadline time.Time
+	}
+)
+
+// NewMemCluster creates a mocked cluster keeping its data in memory.
+func NewMemCluster() *MemCluster {
+	mc := &MemCluster{
+		MockedCluster: NewMockedCluster(),
+		kvs:           map[string]*mvccpb.KeyValue{},
+		leases:        map[clientv3.LeaseID]*memLease{},
+	}
+
+	mc.MockedGetRaw = func(key string) (*mvccpb.KeyValue, error) {
+		mc.mutex.Lock()
+		defer mc.mutex.Unlock()
+		return mc.kvs[key], nil
+	}
+	mc.MockedGet = func(key string) (*string, error) {
+		kv, _ := mc.MockedGetRaw(key)
+		if kv == nil {
+			return nil, nil
+		}
+		value := string(kv.Value)
+		return &value, nil
+	}
+	mc.MockedExists = func(key string) (bool, error) {
+		kv, _ := mc.MockedGetRaw(key)
+		return kv != nil, nil
+	}
+	mc.MockedGetRawPrefix = func(prefix string) (map[string]*mvccpb.KeyValue, error) {
+		mc.mutex.Lock()
+		defer mc.mutex.Unlock()
+		kvs := map[string]*mvccpb.KeyValue{}
+		for k, v := range mc.kvs {
+			if strings.HasPrefix(k, prefix) {
+				kvs[k] = v
+			}
+		}
+		return kvs, nil
+	}
+	mc.MockedCountPrefix = func(prefix string) (int64, error) {
+		rawKVs, _ := mc.MockedGetRawPrefix(prefix)
+		return int64(len(rawKVs)), nil
+	}
+	mc.MockedListRevisions = func(prefix string) (map[string]int64, error) {
+		rawKVs, _ := mc.MockedGetRawPrefix(prefix)
+		revs := map[string]int64{}
+		for k, v := range rawKVs {
+			revs[k] = v.ModRevision
+		}
+		return revs, nil
+	}
+	mc.MockedGetPrefix = func(prefix string) (map[string]string, error) {
+		rawKVs, _ := mc.MockedGetRawPrefix(prefix)
+		kvs := map[string]string{}
+		for k, v := range rawKVs {
+			kvs[k] = string(v.Value)
+		}
+		return kvs, nil
+	}
+	mc.MockedPut = func(key, value string) error {
+		mc.mutex.Lock()
+		defer mc.mutex.Unlock()
+		mc.put(key, value, 0)
+		return nil
+	}
+	mc.MockedGrantLease = func(ttl time.Duration) (clientv3.LeaseID, error) {
+		mc.mutex.Lock()
+		defer mc.mutex.Unlock()
+		leaseID := clientv3.LeaseID(len(mc.leases) + 1)
+		for mc.leases[leaseID] != nil {
+			leaseID++
+		}
+		mc.leases[leaseID] = &memLease{ttl: ttl, deadline: time.Now().Add(ttl)}
+		return leaseID, nil
+	}
+	mc.MockedKeepAliveLease = func(leaseID clientv3.LeaseID) error {
+		mc.mutex.Lock()
+		defer mc.mutex.Unlock()
+		lease := mc.leases[leaseID]
+		if lease == nil {
+			return fmt.Errorf("lease %x not found", leaseID)
+		}
+		lease.deadline = time.Now().Add(lease.ttl)
+		return nil
+	}
+	mc.MockedRevokeLease = func(leaseID clientv3.LeaseID) error {
+		mc.mutex.Lock()
+		defer mc.mutex.Unlock()
+		delete(mc.leases, leaseID)
+		for k, v := range mc.kvs {
+			if clientv3.LeaseID(v.Lease) == leaseID {
+				mc.delete(k)
+			}
+		}
+		return nil
+	}
+	mc.MockedPutWithLease = func(key, value string, leaseID clientv3.LeaseID) error {
+		mc.mutex.Lock()
+		defer mc.mutex.Unlock()
+		if mc.leases[leaseID] == nil {
+			return fmt.Errorf("lease %x not found", leaseID)
+		}
+		mc.put(key, value, leaseID)
+		return nil
+	}
+	mc.MockedDelete = func(key string) error {
+		mc.mutex.Lock()
+		defer mc.mutex.Unlock()
+		mc.delete(key)
+		return nil
+	}
+	mc.MockedDeletePrefix = func(prefix string) error {
+		mc.mutex.Lock()
+		defer mc.mutex.Unlock()
+		for k := range mc.kvs {
+			if strings.HasPrefix(k, prefix) {
+				mc.delete(k)
+			}
+		}
+		return nil
+	}
+	mc.MockedPutAndDelete = func(kvs map[string]*string) error {
+		mc.mutex.Lock()
+		defer mc.mutex.Unlock()
+		for k, v := range kvs {
+			if v == nil {
+				mc.delete(k)
+			} else {
+				mc.put(k, *v, 0)
+			}
+		}
+		return nil
+	}
+	mc.MockedTxn = func(cmps []clientv3.Cmp, thenOps, elseOps []clientv3.Op) (bool, error) {
+		mc.mutex.Lock()
+		defer mc.mutex.Unlock()
+
+		succeeded := true
+		for _, cmp := range cmps {
+			if !mc.compare(cmp) {
+				succeeded = false
+				break
+			}
+		}
+
+		ops := thenOps
+		if !succeeded {
+			ops = elseOps
+		}
+		for _, op := range ops {
+			if leaseID := opLease(op); op.IsPut() && leaseID != 0 && mc.leases[leaseID] == nil {
+				return false, fmt.Errorf("lease %x not found", leaseID)
+			}
+		}
+		for _, op := range ops {
+			switch {
+			case op.IsPut():
+				mc.put(string(op.KeyBytes()), string(op.ValueBytes()), opLease(op))
+			case op.IsDelete():
+				mc.delete(string(op.KeyBytes()))
+			}
+		}
+		return succeeded, nil
+	}
+
+	mc.MockedCurrentRevision = func() (int64, error) {
+		mc.mutex.Lock()
+		defer mc.mutex.Unlock()
+		return mc.rev, nil
+	}
+	mc.MockedGetPrefixAt = func(prefix string, revision int64) (map[string]string, error) {
+		mc.mutex.Lock()
+		defer mc.mutex.Unlock()
+		if revision > mc.rev {
+			return nil, fmt.Errorf("revision %d is a future revision", revision)
+		}
+
+		kvs := map[string]string{}
+		for _, change := range mc.history {
+			if change.rev > revision {
+				break
+			}
+			if !strings.HasPrefix(change.key, prefix) {
+				continue
+			}
+			if change.kv == nil {
+				delete(kvs, change.key)
+			} else {
+				kvs[change.key] = string(change.kv.Value)
+			}
+		}
+		return kvs, nil
+	}
+
+	return mc
+}
+
+// opLease returns the lease of the put operation, which clientv3 doesn't expose.
+func opLease(op clientv3.Op) clientv3.LeaseID {
+	return clientv3.LeaseID(reflect.ValueOf(op).FieldByName("leaseID").Int())
+}
+
+// KeyValue returns the raw key value of key, nil if it doesn't exist.
+func (mc *MemCluster) KeyValue(key string) *mvccpb.KeyValue {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	return mc.kvs[key]
+}
+
+// LeaseDeadline returns the time the lease expires at unless kept alive,
+// zero if the lease doesn't exist.
+func (mc *MemCluster) LeaseDeadline(leaseID clientv3.LeaseID) time.Time {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	if lease := mc.leases[leaseID]; lease != nil {
+		return lease.deadline
+	}
+	return time.Time{}
+}
+
+// SetLeaseDeadline sets the time the lease expires at.
+func (mc *MemCluster) SetLeaseDeadline(leaseID clientv3.LeaseID, deadline time.Time) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	if lease := mc.leases[leaseID]; lease != nil {
+		lease.deadline = deadline
+	}
+}
+
+// compare supports the value, create revision and mod revision conditions.
+func (mc *MemCluster) compare(cmp clientv3.Cmp) bool {
+	kv := mc.kvs[string(cmp.Key)]
+	if cmp.Target == etcdserverpb.Compare_VALUE {
+		equal := kv != nil && string(kv.Value) == string(cmp.ValueBytes())
+		return equal == (cmp.Result == etcdserverpb.Compare_EQUAL)
+	}
+
+	var got, want int64
+	switch target := cmp.TargetUnion.(type) {
+	case *etcdserverpb.Compare_CreateRevision:
+		want = target.CreateRevision
+		if kv != nil {
+			got = kv.CreateRevision
+		}
+	case *etcdserverpb.Compare_ModRevision:
+		want = target.ModRevision
+		if kv != nil {
+			got = kv.ModRevision
+		}
+	}
+
+	switch cmp.Result {
+	case etcdserverpb.Compare_EQUAL:
+		return got == want
+	case etcdserverpb.Compare_GREATER:
+		return got > want
+	case etcdserverpb.Compare_LESS:
+		return got < want
+	default:
+		return got != want
+	}
+}
+
+// put puts the key at the next revision, like etcd, the key is detached
+// from its lease unless put with one.
+func (mc *MemCluster) put(key, value string, leaseID clientv3.LeaseID) {
+	mc.rev++
+	kv := &mvccpb.KeyValue{
+		Key:            []byte(key),
+		Value:          []byte(value),
+		CreateRevision: mc.rev,
+		ModRevision:    mc.rev,
+		Version:        1,
+		Lease:          int64(leaseID),
+	}
+	if old := mc.kvs[key]; old != nil {
+		kv.CreateRevision = old.CreateRevision
+		kv.Version = old.Version + 1
+	}
+	mc.kvs[key] = kv
+	mc.history = append(mc.history, memChange{rev: mc.rev, key: key, kv: kv})
+}
+
+// delete deletes the key at the next revision if it exists.
+func (mc *MemCluster) delete(key string) {
+	if mc.kvs[key] == nil {
+		return
+	}
+	mc.rev++
+	delete(mc.kvs, key)
+	mc.history = append(mc.history, memChange{rev: mc.rev, key: key})
+}
@@ -37,7 +37,8 @@ const (
 	// 8GB
 	quotaBackendBytes = 8 * 1024 * 1024 * 1024
 
-	maxTxnOps       = 10240
+	// MaxTxnOps is the maximum number of the operations in a transaction.
+	MaxTxnOps       = 10240
 	maxRequestBytes = 10 * 1024 * 1024 // 10MB
 
 	// Threshold for number of changes etcd stores in memory before creating a new snapshot.
@@ -91,7 +92,7 @@ func CreateStaticClusterEtcdConfig(opt *option.Options) (*embed.Config, error) {
 	ec.AutoCompactionMode = autoCompactionMode
 	ec.AutoCompactionRetention = autoCompactionRetention
 	ec.QuotaBackendBytes = quotaBackendBytes
-	ec.MaxTxnOps = maxTxnOps
+	ec.MaxTxnOps = MaxTxnOps
 	ec.MaxRequestBytes = maxRequestBytes
 	ec.SnapshotCount = snapshotCount
 	ec.Logger = "zap"
@@ -19,7 +19,6 @@ package cluster
 
 import (
 	"context"
-	"sync"
 	"time"
 
 	"go.etcd.io/etcd/client/v3/concurrency"
@@ -29,30 +28,64 @@ import (
 type Mutex interface {
 	Lock() error
 	Unlock() error
+	// TryLock waits at most timeout for the Mutex, it returns false
+	// without error if the Mutex is still held by others by then.
+	TryLock(timeout time.Duration) (bool, error)
 }
 
 type mutex struct {
-	// concurrency.Mutex is a session level mutex, so sync.Mutex is
-	// required to make it goroutine safe
-	lock    sync.Mutex
+	// concurrency.Mutex is a session level mutex, so a local lock is
+	// required to make it goroutine safe, it's a channel rather than
+	// sync.Mutex to be able to give up waiting for it.
+	lock    chan struct{}
 	m       *concurrency.Mutex
 	timeout time.Duration
 }
 
-func (m *mutex) Lock() (err error) {
-	panicked := true
+func (m *mutex) Lock() error {
+	m.lock <- struct{}{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	return m.lockRemote(ctx)
+}
+
+func (m *mutex) TryLock(timeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	select {
+	case m.lock <- struct{}{}:
+	case <-ctx.Done():
+		return false, nil
+	}
 
-	m.lock.Lock()
+	err := m.lockRemote(ctx)
+	if err == context.DeadlineExceeded {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// lockRemote acquires the etcd lock with the local lock held, and
+// releases the local lock if it fails. The key of the attempt is
+// deleted on the timeout, so that nothing is left waiting for the
+// lock behind the caller.
+func (m *mutex) lockRemote(ctx context.Context) (err error) {
+	panicked := true
 	defer func() {
 		if panicked || err != nil {
-			m.lock.Unlock()
+			<-m.lock
 		}
 	}()
 
-	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
-	defer cancel()
-
 	err = m.m.Lock(ctx)
+	if err == context.DeadlineExceeded {
+		unlockCtx, cancel := context.WithTimeout(context.Background(), m.timeout)
+		defer cancel()
+		m.m.Unlock(unlockCtx)
+	}
 	panicked = false
 	return
 }
@@ -60,7 +93,7 @@ func (m *mutex) Lock() (err error) {
 func (m *mutex) Unlock() error {
 	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
 	defer cancel()
-	defer m.lock.Unlock()
+	defer func() { <-m.lock }()
 
 	return m.m.Unlock(ctx)
 }
@@ -72,6 +105,7 @@ func (c *cluster) Mutex(name string) (Mutex, error) {
 	}
 
 	return &mutex{
+		lock:    make(chan struct{}, 1),
 		m:       concurrency.NewMutex(session, name),
 		timeout: c.requestTimeout,
 	}, nil
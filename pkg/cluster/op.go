@@ -18,6 +18,9 @@
 package cluster
 
 import (
+	"context"
+	"fmt"
+	"strings"
 	"time"
 
 	"go.etcd.io/etcd/api/v3/mvccpb"
@@ -45,7 +48,84 @@ func (c *cluster) PutUnderLease(key, value string) error {
 	return err
 }
 
-func (c *cluster) Put(key, value string) error {
+func (c *cluster) GrantLease(ttl time.Duration) (clientv3.LeaseID, error) {
+	client, err := c.getClient()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	resp, err := client.Lease.Grant(ctx, int64(ttl.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.ID, nil
+}
+
+// KeepAliveLease renews the lease once.
+func (c *cluster) KeepAliveLease(leaseID clientv3.LeaseID) error {
+	client, err := c.getClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	_, err = client.Lease.KeepAliveOnce(ctx, leaseID)
+	return err
+}
+
+// RevokeLease revokes the lease, and all data put with it is deleted.
+func (c *cluster) RevokeLease(leaseID clientv3.LeaseID) error {
+	client, err := c.getClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	_, err = client.Lease.Revoke(ctx, leaseID)
+	return err
+}
+
+// ListLeases lists the alive leases, the ones expired while listing are skipped.
+func (c *cluster) ListLeases() ([]*clientv3.LeaseTimeToLiveResponse, error) {
+	client, err := c.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := func() (*clientv3.LeaseLeasesResponse, error) {
+		ctx, cancel := c.requestContext()
+		defer cancel()
+		return client.Lease.Leases(ctx)
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	leases := make([]*clientv3.LeaseTimeToLiveResponse, 0, len(resp.Leases))
+	for _, lease := range resp.Leases {
+		ttl, err := func() (*clientv3.LeaseTimeToLiveResponse, error) {
+			ctx, cancel := c.requestContext()
+			defer cancel()
+			return client.Lease.TimeToLive(ctx, lease.ID, clientv3.WithAttachedKeys())
+		}()
+		if err != nil {
+			return nil, err
+		}
+		if ttl.TTL < 0 {
+			continue
+		}
+		leases = append(leases, ttl)
+	}
+
+	return leases, nil
+}
+
+func (c *cluster) PutWithLease(key, value string, leaseID clientv3.LeaseID) error {
 	client, err := c.getClient()
 	if err != nil {
 		return err
@@ -53,19 +133,39 @@ func (c *cluster) Put(key, value string) error {
 
 	ctx, cancel := c.requestContext()
 	defer cancel()
+	_, err = client.Put(ctx, key, value, clientv3.WithLease(leaseID))
+	return err
+}
+
+func (c *cluster) Put(key, value string) error {
+	return c.PutCtx(context.Background(), key, value)
+}
+
+func (c *cluster) PutCtx(ctx context.Context, key, value string) error {
+	client, err := c.getClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := c.requestContextWith(ctx)
+	defer cancel()
 	_, err = client.Put(ctx, key, value)
 	return err
 }
 
 func (c *cluster) PutAndDeleteUnderLease(kvs map[string]*string) error {
-	return c.putAndDelete(kvs, true)
+	return c.putAndDelete(context.Background(), kvs, true)
 }
 
 func (c *cluster) PutAndDelete(kvs map[string]*string) error {
-	return c.putAndDelete(kvs, false)
+	return c.putAndDelete(context.Background(), kvs, false)
 }
 
-func (c *cluster) putAndDelete(kvs map[string]*string, underLease bool) error {
+func (c *cluster) PutAndDeleteCtx(ctx context.Context, kvs map[string]*string) error {
+	return c.putAndDelete(ctx, kvs, false)
+}
+
+func (c *cluster) putAndDelete(ctx context.Context, kvs map[string]*string, underLease bool) error {
 	client, err := c.getClient()
 	if err != nil {
 		return err
@@ -89,19 +189,39 @@ func (c *cluster) putAndDelete(kvs map[string]*string, underLease bool) error {
 		}
 	}
 
-	ctx, cancel := c.requestContext()
+	ctx, cancel := c.requestContextWith(ctx)
 	defer cancel()
 	_, err = client.Txn(ctx).Then(ops...).Commit()
 	return err
 }
 
+func (c *cluster) Txn(cmps []clientv3.Cmp, thenOps, elseOps []clientv3.Op) (bool, error) {
+	client, err := c.getClient()
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	resp, err := client.Txn(ctx).If(cmps...).Then(thenOps...).Else(elseOps...).Commit()
+	if err != nil {
+		return false, err
+	}
+
+	return resp.Succeeded, nil
+}
+
 func (c *cluster) Delete(key string) error {
+	return c.DeleteCtx(context.Background(), key)
+}
+
+func (c *cluster) DeleteCtx(ctx context.Context, key string) error {
 	client, err := c.getClient()
 	if err != nil {
 		return err
 	}
 
-	ctx, cancel := c.requestContext()
+	ctx, cancel := c.requestContextWith(ctx)
 	defer cancel()
 	_, err = client.Delete(ctx, key)
 	return err
@@ -131,12 +251,16 @@ func (c *cluster) Get(key string) (*string, error) {
 }
 
 func (c *cluster) GetRaw(key string) (*mvccpb.KeyValue, error) {
+	return c.GetRawCtx(context.Background(), key)
+}
+
+func (c *cluster) GetRawCtx(ctx context.Context, key string) (*mvccpb.KeyValue, error) {
 	client, err := c.getClient()
 	if err != nil {
 		return nil, err
 	}
 
-	ctx, cancel := c.requestContext()
+	ctx, cancel := c.requestContextWith(ctx)
 	defer cancel()
 	resp, err := client.Get(ctx, key)
 	if err != nil {
@@ -164,7 +288,50 @@ func (c *cluster) GetPrefix(prefix string) (map[string]string, error) {
 	return kvs, nil
 }
 
+func (c *cluster) GetPrefixPaged(prefix string, limit int64, fromKey string) (map[string]string, string, error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	if fromKey == "" {
+		fromKey = prefix
+	} else if !strings.HasPrefix(fromKey, prefix) {
+		return nil, "", fmt.Errorf("key %s out of prefix %s", fromKey, prefix)
+	}
+
+	client, err := c.getClient()
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := func() (*clientv3.GetResponse, error) {
+		ctx, cancel := c.requestContext()
+		defer cancel()
+		return client.Get(ctx, fromKey, clientv3.WithRange(clientv3.GetPrefixRangeEnd(prefix)),
+			clientv3.WithLimit(limit), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	}()
+	if err != nil {
+		return nil, "", err
+	}
+
+	kvs := make(map[string]string, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvs[string(kv.Key)] = string(kv.Value)
+	}
+
+	nextKey := ""
+	if resp.More && len(resp.Kvs) > 0 {
+		// NOTE: The smallest key after the last one.
+		nextKey = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+
+	return kvs, nextKey, nil
+}
+
 func (c *cluster) GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, error) {
+	return c.GetRawPrefixCtx(context.Background(), prefix)
+}
+
+func (c *cluster) GetRawPrefixCtx(ctx context.Context, prefix string) (map[string]*mvccpb.KeyValue, error) {
 	kvs := make(map[string]*mvccpb.KeyValue)
 
 	client, err := c.getClient()
@@ -173,7 +340,7 @@ func (c *cluster) GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, erro
 	}
 
 	resp, err := func() (*clientv3.GetResponse, error) {
-		ctx, cancel := c.requestContext()
+		ctx, cancel := c.requestContextWith(ctx)
 		defer cancel()
 		return client.Get(ctx, prefix, clientv3.WithPrefix())
 	}()
@@ -188,6 +355,103 @@ func (c *cluster) GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, erro
 	return kvs, nil
 }
 
+func (c *cluster) GetPrefixAt(prefix string, revision int64) (map[string]string, error) {
+	kvs := make(map[string]string)
+
+	client, err := c.getClient()
+	if err != nil {
+		return kvs, err
+	}
+
+	resp, err := func() (*clientv3.GetResponse, error) {
+		ctx, cancel := c.requestContext()
+		defer cancel()
+		return client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(revision))
+	}()
+	if err != nil {
+		return kvs, err
+	}
+
+	for _, kv := range resp.Kvs {
+		kvs[string(kv.Key)] = string(kv.Value)
+	}
+
+	return kvs, nil
+}
+
+func (c *cluster) CurrentRevision() (int64, error) {
+	client, err := c.getClient()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	resp, err := client.Get(ctx, "/", clientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.Header.Revision, nil
+}
+
+func (c *cluster) CountPrefix(prefix string) (int64, error) {
+	client, err := c.getClient()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	resp, err := client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.Count, nil
+}
+
+func (c *cluster) Exists(key string) (bool, error) {
+	client, err := c.getClient()
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+	resp, err := client.Get(ctx, key, clientv3.WithCountOnly())
+	if err != nil {
+		return false, err
+	}
+
+	return resp.Count > 0, nil
+}
+
+func (c *cluster) ListRevisions(prefix string) (map[string]int64, error) {
+	revisions := make(map[string]int64)
+
+	client, err := c.getClient()
+	if err != nil {
+		return revisions, err
+	}
+
+	resp, err := func() (*clientv3.GetResponse, error) {
+		ctx, cancel := c.requestContext()
+		defer cancel()
+		// NOTE: Keys-only responses keep the revisions of the keys.
+		return client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	}()
+	if err != nil {
+		return revisions, err
+	}
+
+	for _, kv := range resp.Kvs {
+		revisions[string(kv.Key)] = kv.ModRevision
+	}
+
+	return revisions, nil
+}
+
 func (c *cluster) GetWithOp(key string, op ...ClientOp) (map[string]string, error) {
 	kvs := make(map[string]string)
 
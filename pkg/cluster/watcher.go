@@ -63,7 +63,12 @@ func (w *watcher) Watch(key string) (<-chan *string, error) {
 			select {
 			case <-w.done:
 				return
-			case resp := <-watchResp:
+			case resp, ok := <-watchResp:
+				// NOTE: The channel is closed once the client is closed or disconnected.
+				if !ok {
+					logger.Infof("watch key %s closed", key)
+					return
+				}
 				if resp.Canceled {
 					logger.Infof("watch key %s canceled: %v", key, resp.Err())
 					return
@@ -104,7 +109,11 @@ func (w *watcher) WatchRaw(key string) (<-chan *clientv3.Event, error) {
 			select {
 			case <-w.done:
 				return
-			case resp := <-watchResp:
+			case resp, ok := <-watchResp:
+				if !ok {
+					logger.Infof("watch raw key %s closed", key)
+					return
+				}
 				if resp.Canceled {
 					logger.Infof("watch raw key %s canceled: %v", key, resp.Err())
 					return
@@ -145,7 +154,11 @@ func (w *watcher) WatchPrefix(prefix string) (<-chan map[string]*string, error)
 			select {
 			case <-w.done:
 				return
-			case resp := <-watchResp:
+			case resp, ok := <-watchResp:
+				if !ok {
+					logger.Errorf("watch prefix %s closed", prefix)
+					return
+				}
 				if resp.Canceled {
 					logger.Errorf("watch prefix %s canceled: %v", prefix, resp.Err())
 					return
@@ -190,7 +203,11 @@ func (w *watcher) WatchRawPrefix(prefix string) (<-chan map[string]*clientv3.Eve
 			select {
 			case <-w.done:
 				return
-			case resp := <-watchResp:
+			case resp, ok := <-watchResp:
+				if !ok {
+					logger.Errorf("watch raw prefix %s closed", prefix)
+					return
+				}
 				if resp.Canceled {
 					logger.Errorf("watch raw prefix %s canceled: %v", prefix, resp.Err())
 					return
@@ -241,7 +258,11 @@ func (w *watcher) WatchWithOp(key string, ops ...ClientOp) (<-chan map[string]*s
 			select {
 			case <-w.done:
 				return
-			case resp := <-watchResp:
+			case resp, ok := <-watchResp:
+				if !ok {
+					logger.Errorf("watch %s with ops %v closed", key, ops)
+					return
+				}
 				if resp.Canceled {
 					logger.Errorf("watch %s with ops %v canceled: %v", key, ops, resp.Err())
 					return
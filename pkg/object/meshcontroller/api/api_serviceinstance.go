@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"net/http"
 	"sort"
+	"strconv"
 
 	"github.com/go-chi/chi/v5"
 
@@ -33,6 +34,13 @@ import (
 
 type serviceInstancesByOrder []*spec.ServiceInstanceSpec
 
+// serviceInstance is the pb spec of the service instance along with
+// its annotations, which aren't carried by the pb spec.
+type serviceInstance struct {
+	*v2alpha1.ServiceInstance
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
 func (s serviceInstancesByOrder) Less(i, j int) bool {
 	return s[i].ServiceName < s[j].ServiceName || s[i].InstanceID < s[j].InstanceID
 }
@@ -53,12 +61,29 @@ func (a *API) readServiceInstanceInfo(w http.ResponseWriter, r *http.Request) (s
 	return serviceName, instanceID, nil
 }
 
+// listServiceInstanceSpecs lists the service instances, the tombstones
+// of the deleted ones are listed only with ?includeDeleted=true.
 func (a *API) listServiceInstanceSpecs(w http.ResponseWriter, r *http.Request) {
-	specs := a.service.ListAllServiceInstanceSpecs()
+	includeDeleted := false
+	if value := r.URL.Query().Get("includeDeleted"); value != "" {
+		flag, err := strconv.ParseBool(value)
+		if err != nil {
+			api.HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid includeDeleted %s, %v", value, err))
+			return
+		}
+		includeDeleted = flag
+	}
+
+	var specs []*spec.ServiceInstanceSpec
+	if includeDeleted {
+		specs = a.service.ListAllServiceInstanceSpecsWithTombstones()
+	} else {
+		specs = a.service.ListAllServiceInstanceSpecs()
+	}
 
 	sort.Sort(serviceInstancesByOrder(specs))
 
-	var apiSpecs []*v2alpha1.ServiceInstance
+	var apiSpecs []*serviceInstance
 	for _, v := range specs {
 		instance := &v2alpha1.ServiceInstance{}
 		err := a.convertSpecToPB(v, instance)
@@ -66,7 +91,7 @@ func (a *API) listServiceInstanceSpecs(w http.ResponseWriter, r *http.Request) {
 			logger.Errorf("convert spec %#v to pb spec failed: %v", v, err)
 			continue
 		}
-		apiSpecs = append(apiSpecs, instance)
+		apiSpecs = append(apiSpecs, &serviceInstance{ServiceInstance: instance, Annotations: v.Annotations})
 	}
 
 	buff := codectool.MustMarshalJSON(apiSpecs)
@@ -92,7 +117,10 @@ func (a *API) getServiceInstanceSpec(w http.ResponseWriter, r *http.Request) {
 		panic(fmt.Errorf("convert spec %#v to pb failed: %v", instanceSpec, err))
 	}
 
-	buff := codectool.MustMarshalJSON(pbInstanceSpec)
+	buff := codectool.MustMarshalJSON(&serviceInstance{
+		ServiceInstance: pbInstanceSpec,
+		Annotations:     instanceSpec.Annotations,
+	})
 	a.writeJSONBody(w, buff)
 }
 
@@ -113,5 +141,13 @@ func (a *API) offlineServiceInstance(w http.ResponseWriter, r *http.Request) {
 	}
 
 	instanceSpec.Status = spec.ServiceStatusOutOfService
-	a.service.PutServiceInstanceSpec(instanceSpec)
+	instanceSpec.StatusHold = spec.StatusHoldAdmin
+	err = a.service.RewriteServiceInstanceSpec(instanceSpec)
+	switch err {
+	case nil:
+	case spec.ErrServiceInstanceNotFound:
+		api.HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("%s/%s not found", serviceName, instanceID))
+	default:
+		api.ClusterPanic(err)
+	}
 }
@@ -33,6 +33,11 @@ const (
 	serviceInstanceSpec            = "/mesh/service-instances/spec/%s/%s"   // +serviceName +instanceID
 	serviceInstanceStatus          = "/mesh/service-instances/status/%s/%s" // +serviceName +instanceID
 
+	serviceLeader = "/mesh/service-leader/%s" // +serviceName
+
+	serviceInstanceHistoryPrefix = "/mesh/service-instances/history/%s/"         // +serviceName
+	serviceInstanceHistory       = "/mesh/service-instances/history/%s/%020d-%s" // +serviceName +deleteTime +instanceID
+
 	allIngressControllerInstanceSpecPrefix = "/mesh/ingresscontroller/spec/"
 	ingressControllerInstanceSpecKey       = "/mesh/ingresscontroller/spec/%s" //+instanceID
 
@@ -43,6 +48,7 @@ const (
 	ingressPrefix = "/mesh/ingress/"
 
 	serviceInstanceCert                    = "/mesh/cert/service-cert/%s/%s" // +serviceName +instanceID
+	serviceInstanceCertPrefix              = "/mesh/cert/service-cert/%s/"   // +serviceName
 	allServiceCertPrefix                   = "/mesh/cert/service-cert/"
 	rootCert                               = "/mesh/cert/root-cert"
 	ingressControllerInstanceCertKey       = "/mesh/cert/ingress-controller-cert/%s"
@@ -93,6 +99,22 @@ func ServiceInstanceStatusPrefix(serviceName string) string {
 	return fmt.Sprintf(serviceInstanceStatusPrefix, serviceName)
 }
 
+// ServiceLeaderKey returns the key of the leader instance of service.
+func ServiceLeaderKey(serviceName string) string {
+	return fmt.Sprintf(serviceLeader, serviceName)
+}
+
+// ServiceInstanceHistoryPrefix returns the prefix of the history of service instances.
+func ServiceInstanceHistoryPrefix(serviceName string) string {
+	return fmt.Sprintf(serviceInstanceHistoryPrefix, serviceName)
+}
+
+// ServiceInstanceHistoryKey returns the key of the deregistered service instance,
+// the keys of a service are sorted by the delete time in unix nanoseconds.
+func ServiceInstanceHistoryKey(serviceName, instanceID string, deleteTime int64) string {
+	return fmt.Sprintf(serviceInstanceHistory, serviceName, deleteTime, instanceID)
+}
+
 // AllServiceInstanceSpecPrefix returns the prefix of all service instance specs.
 func AllServiceInstanceSpecPrefix() string {
 	return allServiceInstanceSpecPrefix
@@ -173,6 +195,11 @@ func ServiceInstanceCertKey(serviceName, instanceID string) string {
 	return fmt.Sprintf(serviceInstanceCert, serviceName, instanceID)
 }
 
+// ServiceInstanceCertPrefix returns the prefix of the instance certs of the service.
+func ServiceInstanceCertPrefix(serviceName string) string {
+	return fmt.Sprintf(serviceInstanceCertPrefix, serviceName)
+}
+
 // AllServiceCertPrefix returns the prefix of all service's cert.
 func AllServiceCertPrefix() string {
 	return allServiceCertPrefix
@@ -20,6 +20,7 @@ package master
 
 import (
 	"runtime/debug"
+	"sync"
 	"time"
 
 	"github.com/megaease/easegress/v2/pkg/api"
@@ -30,11 +31,11 @@ import (
 	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
 	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/storage"
 	"github.com/megaease/easegress/v2/pkg/supervisor"
-	"github.com/megaease/easegress/v2/pkg/util/codectool"
 )
 
 const (
 	defaultDeadRecordExistTime time.Duration = 20 * time.Minute
+	defaultProbeConcurrency                  = 8
 )
 
 type (
@@ -46,12 +47,37 @@ type (
 		heartbeatInterval time.Duration
 		certManager       *certmanager.CertManager
 
-		store   storage.Storage
-		service *service.Service
+		// tombstoneRetention is zero if soft-deleting is disabled.
+		tombstoneRetention time.Duration
+		// maxClockSkew is zero if clock skew checking is disabled.
+		maxClockSkew time.Duration
+
+		store      storage.Storage
+		service    *service.Service
+		hysteresis *healthHysteresis
+		metrics    *instanceMetrics
 
 		done chan struct{}
 	}
 
+	// healthHysteresis counts consecutive same-result checks of instances,
+	// the status of an instance only changes after enough of them.
+	healthHysteresis struct {
+		healthyThreshold   int
+		unhealthyThreshold int
+		// failureGrace is zero if failing instances are brought down at once.
+		failureGrace time.Duration
+
+		mutex    sync.Mutex
+		counters map[string]*healthCounter
+	}
+
+	healthCounter struct {
+		healthy bool
+		count   int
+		since   time.Time
+	}
+
 	// Status is the status of mesh master.
 	Status struct{}
 )
@@ -66,8 +92,10 @@ func New(superSpec *supervisor.Spec) *Master {
 		superSpec: superSpec,
 		spec:      adminSpec,
 
-		store:   store,
-		service: service.New(superSpec),
+		store:      store,
+		service:    service.New(superSpec),
+		hysteresis: newHealthHysteresis(adminSpec.HealthyThreshold, adminSpec.UnhealthyThreshold),
+		metrics:    newInstanceMetrics(adminSpec),
 
 		done: make(chan struct{}),
 	}
@@ -80,12 +108,86 @@ func New(superSpec *supervisor.Spec) *Master {
 	}
 	m.heartbeatInterval = heartbeat
 
+	if m.spec.TombstoneRetention != "" {
+		retention, err := time.ParseDuration(m.spec.TombstoneRetention)
+		if err != nil {
+			logger.Errorf("failed to parse tombstone retention '%s', fallback to hard deleting", m.spec.TombstoneRetention)
+		} else {
+			m.tombstoneRetention = retention
+		}
+	}
+
+	if m.spec.FailureGrace != "" {
+		grace, err := time.ParseDuration(m.spec.FailureGrace)
+		if err != nil {
+			logger.Errorf("failed to parse failure grace '%s', fallback to no grace", m.spec.FailureGrace)
+		} else {
+			m.hysteresis.failureGrace = grace
+		}
+	}
+
+	if m.spec.MaxClockSkew != "" {
+		skew, err := time.ParseDuration(m.spec.MaxClockSkew)
+		if err != nil {
+			logger.Errorf("failed to parse max clock skew '%s', fallback to no checking", m.spec.MaxClockSkew)
+		} else {
+			m.maxClockSkew = skew
+		}
+	}
+
 	m.initMTLS()
 	go m.run()
 
 	return m
 }
 
+func newHealthHysteresis(healthyThreshold, unhealthyThreshold int) *healthHysteresis {
+	if healthyThreshold <= 0 {
+		healthyThreshold = 1
+	}
+	if unhealthyThreshold <= 0 {
+		unhealthyThreshold = 1
+	}
+
+	return &healthHysteresis{
+		healthyThreshold:   healthyThreshold,
+		unhealthyThreshold: unhealthyThreshold,
+		counters:           map[string]*healthCounter{},
+	}
+}
+
+// observe records one check result of the instance, it returns true
+// if the result has been seen for enough consecutive times.
+func (h *healthHysteresis) observe(key string, healthy bool) bool {
+	return h.observeAt(key, healthy, time.Now())
+}
+
+// observeAt is observe at the time now, the unhealthy result also
+// needs to last beyond the failure grace.
+func (h *healthHysteresis) observeAt(key string, healthy bool, now time.Time) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	counter, exists := h.counters[key]
+	if !exists || counter.healthy != healthy {
+		counter = &healthCounter{healthy: healthy, since: now}
+		h.counters[key] = counter
+	}
+	counter.count++
+
+	if healthy {
+		return counter.count >= h.healthyThreshold
+	}
+	return counter.count >= h.unhealthyThreshold && now.Sub(counter.since) >= h.failureGrace
+}
+
+func (h *healthHysteresis) forget(key string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	delete(h.counters, key)
+}
+
 func (m *Master) initMTLS() error {
 	if !m.spec.EnablemTLS() {
 		return nil
@@ -136,31 +238,71 @@ func (m *Master) checkServiceInstances() {
 		}
 	}()
 
-	statuses := m.service.ListAllServiceInstanceStatuses()
-	specs := m.service.ListAllServiceInstanceSpecs()
+	statuses := map[string]*spec.ServiceInstanceStatus{}
+	for _, s := range m.service.ListAllServiceInstanceStatuses() {
+		statuses[layout.ServiceInstanceStatusKey(s.ServiceName, s.InstanceID)] = s
+	}
+	specs := m.service.ListAllServiceInstanceSpecsWithTombstones()
+
+	// NOTE: The checks run in a bounded number of workers, so they keep up
+	// with the interval for many instances.
+	jobs := make(chan *spec.ServiceInstanceSpec)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < m.probeConcurrency(len(specs)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _spec := range jobs {
+				m.checkServiceInstance(_spec, statuses[layout.ServiceInstanceStatusKey(_spec.ServiceName, _spec.InstanceID)])
+			}
+		}()
+	}
 
 	for _, _spec := range specs {
-		if !m.isMeshRegistryName(_spec.RegistryName) {
-			continue
+		if m.isMeshRegistryName(_spec.RegistryName) {
+			jobs <- _spec
 		}
+	}
+	close(jobs)
+	wg.Wait()
 
-		// TODO: improve search performance
-		var status *spec.ServiceInstanceStatus
-		for _, s := range statuses {
-			if s.ServiceName == _spec.ServiceName && s.InstanceID == _spec.InstanceID {
-				status = s
-			}
-		}
+	m.metrics.publish(m.service.ListAllServiceInstanceSpecsWithTombstones())
+}
 
-		if status == nil {
-			format := "status of %s/%s not found, need to delete"
-			logger.Warnf(format, _spec.ServiceName, _spec.InstanceID)
-			m.deleteInstance(_spec)
-			continue
+func (m *Master) probeConcurrency(instances int) int {
+	concurrency := m.spec.ProbeConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultProbeConcurrency
+	}
+	if concurrency > instances {
+		concurrency = instances
+	}
+	return concurrency
+}
+
+func (m *Master) checkServiceInstance(_spec *spec.ServiceInstanceSpec, status *spec.ServiceInstanceStatus) {
+	defer func() {
+		if err := recover(); err != nil {
+			format := "failed to check instance %s: %v, stack trace: \n%s\n"
+			logger.Errorf(format, _spec.Key(), err, debug.Stack())
 		}
+	}()
 
-		m.checkLastHeartbeatTime(_spec, status.LastHeartbeatTime)
+	if _spec.Status == spec.ServiceStatusDeleted {
+		m.checkTombstone(_spec)
+		return
 	}
+
+	m.checkClockSkew(_spec, time.Now())
+
+	if status == nil {
+		format := "status of %s/%s not found, need to delete"
+		logger.Warnf(format, _spec.ServiceName, _spec.InstanceID)
+		m.deleteInstance(_spec)
+		return
+	}
+
+	m.checkLastHeartbeatTime(_spec, status.LastHeartbeatTime)
 }
 
 func (m *Master) checkLastHeartbeatTime(_spec *spec.ServiceInstanceSpec, lastHeartbeatTime string) {
@@ -181,21 +323,111 @@ func (m *Master) checkLastHeartbeatTime(_spec *spec.ServiceInstanceSpec, lastHea
 	}
 
 	// Bring it down if no heartbeat in 2 heartbeat interval
-	if gap > m.heartbeatInterval*2 {
-		if _spec.Status != spec.ServiceStatusOutOfService {
+	healthy := gap <= m.heartbeatInterval*2
+	if !m.hysteresis.observe(_spec.Key(), healthy) {
+		return
+	}
+
+	if !healthy {
+		switch {
+		case _spec.Status == spec.ServiceStatusOutOfService, _spec.Status == spec.ServiceStatusDown:
+			// Already brought down.
+		case _spec.Status == spec.ServiceStatusStarting && m.spec.AutoUpStarting:
+			logger.Warnf("%s/%s failed health checks while starting, make it DOWN", _spec.ServiceName, _spec.InstanceID)
+			m.updateInstanceStatus(_spec, spec.ServiceStatusDown)
+		default:
 			logger.Warnf("%s/%s expired for %s", _spec.ServiceName, _spec.InstanceID, gap.String())
 			m.updateInstanceStatus(_spec, spec.ServiceStatusOutOfService)
 		}
 		return
 	}
 
-	if _spec.Status == spec.ServiceStatusOutOfService {
-		logger.Infof("%s/%s heartbeat recovered, make it UP", _spec.ServiceName, _spec.InstanceID)
-		m.updateInstanceStatus(_spec, spec.ServiceStatusUp)
+	switch _spec.Status {
+	case spec.ServiceStatusOutOfService:
+		// NOTE: Only the one brought down by the master is brought up, the held one
+		// stays OUT_OF_SERVICE until its status is flipped explicitly.
+		if _spec.StatusHold == "" && !m.isStandby(_spec) {
+			logger.Infof("%s/%s heartbeat recovered, make it UP", _spec.ServiceName, _spec.InstanceID)
+			m.updateInstanceStatus(_spec, spec.ServiceStatusUp)
+		}
+	case spec.ServiceStatusStarting, spec.ServiceStatusDown:
+		if m.spec.AutoUpStarting {
+			logger.Infof("%s/%s passed health checks, make it UP", _spec.ServiceName, _spec.InstanceID)
+			m.updateInstanceStatus(_spec, spec.ServiceStatusUp)
+		}
+	}
+}
+
+// checkClockSkew flags the instance whose registry time is ahead of now beyond
+// maxClockSkew, which is clamped to now if ClampClockSkew is set.
+// It returns true if the instance is flagged.
+func (m *Master) checkClockSkew(_spec *spec.ServiceInstanceSpec, now time.Time) bool {
+	if m.maxClockSkew <= 0 {
+		return false
+	}
+
+	t, err := time.Parse(time.RFC3339, _spec.RegistryTime)
+	if err != nil {
+		return false
+	}
+
+	skew := t.Sub(now)
+	if skew <= m.maxClockSkew {
+		return false
+	}
+
+	logger.Warnf("registry time %s of %s/%s is %s ahead of local clock, the clock of its node may be skewed",
+		_spec.RegistryTime, _spec.ServiceName, _spec.InstanceID, skew.String())
+	if m.spec.ClampClockSkew {
+		_spec.RegistryTime = now.Format(time.RFC3339)
+		m.putInstanceSpec(_spec)
+	}
+
+	return true
+}
+
+// checkTombstone hard-deletes the tombstone beyond the retention.
+func (m *Master) checkTombstone(_spec *spec.ServiceInstanceSpec) {
+	t, err := time.Parse(time.RFC3339, _spec.DeleteTime)
+	if err != nil {
+		logger.Errorf("BUG: parse delete time %s failed: %v", _spec.DeleteTime, err)
+		return
+	}
+
+	if gap := time.Since(t); gap > m.tombstoneRetention {
+		logger.Infof("tombstone of %s/%s retained for %s, need to be deleted",
+			_spec.ServiceName, _spec.InstanceID, gap.String())
+		m.hardDeleteInstance(_spec)
 	}
 }
 
+// deleteInstance writes a tombstone of the instance if soft-deleting is enabled,
+// otherwise it deletes the instance.
 func (m *Master) deleteInstance(_spec *spec.ServiceInstanceSpec) {
+	if m.tombstoneRetention <= 0 {
+		m.hardDeleteInstance(_spec)
+		return
+	}
+
+	m.hysteresis.forget(_spec.Key())
+
+	_spec.DeleteTime = time.Now().Format(time.RFC3339)
+	_spec.Status = spec.ServiceStatusDeleted
+	_spec.StatusHold = ""
+	err := m.service.PutServiceInstanceTombstone(_spec)
+	switch err {
+	case nil:
+		logger.Infof("soft delete instance spec: %s", _spec.Key())
+	case spec.ErrServiceInstanceNotFound:
+		logger.Warnf("%s/%s disappeared before soft deleted, skip it", _spec.ServiceName, _spec.InstanceID)
+	default:
+		api.ClusterPanic(err)
+	}
+}
+
+func (m *Master) hardDeleteInstance(_spec *spec.ServiceInstanceSpec) {
+	m.hysteresis.forget(_spec.Key())
+
 	specKey := layout.ServiceInstanceSpecKey(_spec.ServiceName, _spec.InstanceID)
 	err := m.store.Delete(specKey)
 	if err != nil {
@@ -212,6 +444,17 @@ func (m *Master) deleteInstance(_spec *spec.ServiceInstanceSpec) {
 	}
 }
 
+// isStandby returns whether the instance is a standby of the elected leader
+// of its service, which is kept OUT_OF_SERVICE by itself.
+func (m *Master) isStandby(_spec *spec.ServiceInstanceSpec) bool {
+	leader, err := m.store.Get(layout.ServiceLeaderKey(_spec.ServiceName))
+	if err != nil {
+		api.ClusterPanic(err)
+	}
+
+	return leader != nil && *leader != _spec.InstanceID
+}
+
 func (m *Master) isMeshRegistryName(registryName string) bool {
 	// NOTE: Empty registry name means it is an internal mesh service by default.
 	switch registryName {
@@ -222,18 +465,23 @@ func (m *Master) isMeshRegistryName(registryName string) bool {
 	}
 }
 
+// updateInstanceStatus changes the status of the instance, and releases its hold,
+// since the status isn't the held one anymore.
 func (m *Master) updateInstanceStatus(_spec *spec.ServiceInstanceSpec, status string) {
 	_spec.Status = status
+	_spec.StatusHold = ""
+	m.putInstanceSpec(_spec)
+}
 
-	buff, err := codectool.MarshalJSON(_spec)
-	if err != nil {
-		logger.Errorf("BUG: marshal %#v to json failed: %v", _spec, err)
-		return
-	}
-
-	key := layout.ServiceInstanceSpecKey(_spec.ServiceName, _spec.InstanceID)
-	err = m.store.Put(key, string(buff))
-	if err != nil {
+// putInstanceSpec rewrites the record of the instance, which keeps its lease,
+// so the record of a crashed sidecar still expires after its status is changed.
+func (m *Master) putInstanceSpec(_spec *spec.ServiceInstanceSpec) {
+	err := m.service.RewriteServiceInstanceSpec(_spec)
+	switch err {
+	case nil:
+	case spec.ErrServiceInstanceNotFound:
+		logger.Warnf("%s/%s disappeared before rewritten, skip it", _spec.ServiceName, _spec.InstanceID)
+	default:
 		api.ClusterPanic(err)
 	}
 }
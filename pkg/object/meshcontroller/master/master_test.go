@@ -0,0 +1,388 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package master
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/cluster/clustertest"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/service"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/storage"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func TestHealthHysteresis(t *testing.T) {
+	h := newHealthHysteresis(3, 2)
+
+	// Oscillating results never reach the thresholds.
+	for i := 0; i < 9; i++ {
+		if h.observe("order/01", i%2 == 0) {
+			t.Fatalf("status flapped at check %d", i)
+		}
+	}
+
+	if h.observe("order/01", false) {
+		t.Fatalf("one unhealthy check should not bring it down")
+	}
+	if !h.observe("order/01", false) {
+		t.Fatalf("two unhealthy checks should bring it down")
+	}
+
+	for i := 0; i < 2; i++ {
+		if h.observe("order/01", true) {
+			t.Fatalf("%d healthy checks should not bring it up", i+1)
+		}
+	}
+	if !h.observe("order/01", true) {
+		t.Fatalf("three healthy checks should bring it up")
+	}
+
+	h = newHealthHysteresis(0, 0)
+	if !h.observe("order/01", false) || !h.observe("order/01", true) {
+		t.Fatalf("default thresholds should change status at once")
+	}
+}
+
+func TestFailureGrace(t *testing.T) {
+	h := newHealthHysteresis(1, 1)
+	h.failureGrace = 10 * time.Second
+	start := time.Now()
+
+	// The instance recovering within the grace is spared.
+	if h.observeAt("order/01", false, start) {
+		t.Fatalf("failure within grace should not bring it down")
+	}
+	if h.observeAt("order/01", false, start.Add(5*time.Second)) {
+		t.Fatalf("failure within grace should not bring it down")
+	}
+	if !h.observeAt("order/01", true, start.Add(6*time.Second)) {
+		t.Fatalf("healthy check should keep it up")
+	}
+
+	// The grace restarts at the next failure, and the instance keeping
+	// failing beyond it is brought down.
+	if h.observeAt("order/01", false, start.Add(8*time.Second)) {
+		t.Fatalf("failure within grace should not bring it down")
+	}
+	if h.observeAt("order/01", false, start.Add(17*time.Second)) {
+		t.Fatalf("failure within grace should not bring it down")
+	}
+	if !h.observeAt("order/01", false, start.Add(18*time.Second)) {
+		t.Fatalf("failure beyond grace should bring it down")
+	}
+}
+
+func TestSoftDeleteInstance(t *testing.T) {
+	store := storage.New("test", clustertest.NewMemCluster())
+	m := &Master{
+		spec:               &spec.Admin{},
+		heartbeatInterval:  time.Second,
+		tombstoneRetention: time.Hour,
+		store:              store,
+		service:            service.NewWithStorage(store),
+		hysteresis:         newHealthHysteresis(1, 1),
+	}
+
+	m.service.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-01", Status: spec.ServiceStatusUp})
+	m.service.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-02", Status: spec.ServiceStatusUp})
+	status := &spec.ServiceInstanceStatus{ServiceName: "order", InstanceID: "order-01", LastHeartbeatTime: time.Now().Format(time.RFC3339)}
+	buff, _ := codectool.MarshalJSON(status)
+	store.Put(layout.ServiceInstanceStatusKey("order", "order-01"), string(buff))
+
+	// order-02 has no heartbeat status, so it's soft-deleted.
+	m.checkServiceInstances()
+	tombstone := m.service.GetServiceInstanceSpecWithTombstone("order", "order-02")
+	if tombstone == nil || tombstone.Status != spec.ServiceStatusDeleted || tombstone.DeleteTime == "" {
+		t.Fatalf("want tombstone of order-02, got %+v", tombstone)
+	}
+	if specs := m.service.ListServiceInstanceSpecs("order"); len(specs) != 1 || specs[0].InstanceID != "order-01" {
+		t.Fatalf("tombstone should be excluded from listing, got %v", specs)
+	}
+
+	// The tombstone within retention is kept.
+	m.checkServiceInstances()
+	if m.service.GetServiceInstanceSpecWithTombstone("order", "order-02") == nil {
+		t.Fatalf("tombstone within retention should be kept")
+	}
+
+	tombstone.DeleteTime = time.Now().Add(-2 * time.Hour).Format(time.RFC3339)
+	m.service.PutServiceInstanceSpec(tombstone)
+	m.checkServiceInstances()
+	if m.service.GetServiceInstanceSpecWithTombstone("order", "order-02") != nil {
+		t.Fatalf("tombstone beyond retention should be hard deleted")
+	}
+	if m.service.GetServiceInstanceSpec("order", "order-01") == nil {
+		t.Fatalf("healthy instance should be kept")
+	}
+
+	m.tombstoneRetention = 0
+	m.deleteInstance(m.service.GetServiceInstanceSpec("order", "order-01"))
+	if m.service.GetServiceInstanceSpecWithTombstone("order", "order-01") != nil {
+		t.Fatalf("instance should be hard deleted without retention")
+	}
+}
+
+func TestSoftDeleteLeasedInstance(t *testing.T) {
+	store := storage.New("test", clustertest.NewMemCluster())
+	m := &Master{
+		spec:               &spec.Admin{},
+		heartbeatInterval:  time.Second,
+		tombstoneRetention: time.Hour,
+		store:              store,
+		service:            service.NewWithStorage(store),
+		hysteresis:         newHealthHysteresis(1, 1),
+	}
+
+	leaseID, err := m.service.GrantLease(time.Minute)
+	if err != nil {
+		t.Fatalf("grant lease failed: %v", err)
+	}
+	instance := &spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-01", Status: spec.ServiceStatusUp}
+	m.service.PutServiceInstanceSpecWithLease(instance, leaseID)
+
+	// order-01 has no heartbeat status, so it's soft-deleted.
+	m.checkServiceInstances()
+
+	// The tombstone outlives the lease of the crashed instance until the retention.
+	if err := m.service.RevokeLease(leaseID); err != nil {
+		t.Fatalf("revoke lease failed: %v", err)
+	}
+	tombstone := m.service.GetServiceInstanceSpecWithTombstone("order", "order-01")
+	if tombstone == nil || tombstone.Status != spec.ServiceStatusDeleted {
+		t.Fatalf("want tombstone of order-01 kept after the lease expired, got %+v", tombstone)
+	}
+	m.checkServiceInstances()
+	if m.service.GetServiceInstanceSpecWithTombstone("order", "order-01") == nil {
+		t.Fatalf("tombstone within retention should be kept")
+	}
+}
+
+func TestAutoUpStarting(t *testing.T) {
+	store := storage.New("test", clustertest.NewMemCluster())
+	m := &Master{
+		spec:              &spec.Admin{AutoUpStarting: true},
+		heartbeatInterval: time.Second,
+		store:             store,
+		service:           service.NewWithStorage(store),
+		hysteresis:        newHealthHysteresis(2, 2),
+	}
+
+	check := func(instanceID string, lastHeartbeat time.Time) string {
+		m.checkLastHeartbeatTime(m.service.GetServiceInstanceSpec("order", instanceID), lastHeartbeat.Format(time.RFC3339))
+		return m.service.GetServiceInstanceSpec("order", instanceID).Status
+	}
+
+	m.service.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-01", Status: spec.ServiceStatusStarting})
+	if status := check("order-01", time.Now()); status != spec.ServiceStatusStarting {
+		t.Fatalf("one healthy check should not bring it up, got %s", status)
+	}
+	if status := check("order-01", time.Now()); status != spec.ServiceStatusUp {
+		t.Fatalf("want STARTING instance UP after passing checks, got %s", status)
+	}
+
+	m.service.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-02", Status: spec.ServiceStatusStarting})
+	stale := time.Now().Add(-time.Minute)
+	check("order-02", stale)
+	if status := check("order-02", stale); status != spec.ServiceStatusDown {
+		t.Fatalf("want STARTING instance DOWN after failing checks, got %s", status)
+	}
+	check("order-02", time.Now())
+	if status := check("order-02", time.Now()); status != spec.ServiceStatusUp {
+		t.Fatalf("want DOWN instance UP after passing checks, got %s", status)
+	}
+
+	m.spec.AutoUpStarting = false
+	m.service.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-03", Status: spec.ServiceStatusStarting})
+	check("order-03", time.Now())
+	if status := check("order-03", time.Now()); status != spec.ServiceStatusStarting {
+		t.Fatalf("STARTING instance should be kept without auto up, got %s", status)
+	}
+}
+
+func TestProbeConcurrency(t *testing.T) {
+	mc := clustertest.NewMemCluster()
+	store := storage.New("test", mc)
+	m := &Master{
+		spec:              &spec.Admin{ProbeConcurrency: 5},
+		heartbeatInterval: time.Second,
+		store:             store,
+		service:           service.NewWithStorage(store),
+		hysteresis:        newHealthHysteresis(1, 1),
+	}
+
+	// All instances miss their heartbeats, so each check brings one down.
+	heartbeat := time.Now().Add(-5 * time.Second).Format(time.RFC3339)
+	for i := 0; i < 50; i++ {
+		id := fmt.Sprintf("order-%02d", i)
+		m.service.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: id, Status: spec.ServiceStatusUp})
+		buff, _ := codectool.MarshalJSON(&spec.ServiceInstanceStatus{ServiceName: "order", InstanceID: id, LastHeartbeatTime: heartbeat})
+		store.Put(layout.ServiceInstanceStatusKey("order", id), string(buff))
+	}
+
+	var inflight, maxInflight int32
+	put := mc.MockedPut
+	mc.MockedPut = func(key, value string) error {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInflight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInflight, max, n) {
+				break
+			}
+		}
+		time.Sleep(30 * time.Millisecond)
+		return put(key, value)
+	}
+
+	start := time.Now()
+	m.checkServiceInstances()
+	if elapsed := time.Since(start); elapsed > m.heartbeatInterval {
+		t.Fatalf("checks took %s, beyond the interval %s", elapsed, m.heartbeatInterval)
+	}
+	if max := atomic.LoadInt32(&maxInflight); max > 5 || max < 2 {
+		t.Fatalf("want checks in parallel bounded by 5, got %d", max)
+	}
+	if n := len(m.service.ListActiveServiceInstanceSpecs("order")); n != 0 {
+		t.Fatalf("want all instances brought down, %d still active", n)
+	}
+}
+
+func TestCheckClockSkew(t *testing.T) {
+	store := storage.New("test", clustertest.NewMemCluster())
+	m := &Master{
+		spec:         &spec.Admin{},
+		maxClockSkew: time.Minute,
+		store:        store,
+		service:      service.NewWithStorage(store),
+	}
+
+	now := time.Now()
+	future := now.Add(time.Hour).Format(time.RFC3339)
+	ins := &spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-01", RegistryTime: future}
+	m.service.PutServiceInstanceSpec(ins)
+
+	if m.checkClockSkew(&spec.ServiceInstanceSpec{RegistryTime: now.Add(30 * time.Second).Format(time.RFC3339)}, now) {
+		t.Fatalf("skew within the tolerance should not be flagged")
+	}
+
+	if !m.checkClockSkew(ins, now) {
+		t.Fatalf("future registry time should be flagged")
+	}
+	if got := m.service.GetServiceInstanceSpec("order", "order-01"); got.RegistryTime != future {
+		t.Fatalf("registry time should not be clamped by default, got %s", got.RegistryTime)
+	}
+
+	m.spec.ClampClockSkew = true
+	if !m.checkClockSkew(ins, now) {
+		t.Fatalf("future registry time should be flagged")
+	}
+	if got := m.service.GetServiceInstanceSpec("order", "order-01"); got.RegistryTime != now.Format(time.RFC3339) {
+		t.Fatalf("want registry time clamped to now, got %s", got.RegistryTime)
+	}
+
+	m.maxClockSkew = 0
+	if m.checkClockSkew(&spec.ServiceInstanceSpec{RegistryTime: future}, now) {
+		t.Fatalf("checking should be disabled without max clock skew")
+	}
+}
+
+func TestStatusChangeKeepsLease(t *testing.T) {
+	mc := clustertest.NewMemCluster()
+	store := storage.New("test", mc)
+	m := &Master{
+		spec:              &spec.Admin{},
+		heartbeatInterval: time.Second,
+		store:             store,
+		service:           service.NewWithStorage(store),
+		hysteresis:        newHealthHysteresis(1, 1),
+	}
+
+	leaseID, err := store.GrantLease(time.Minute)
+	if err != nil {
+		t.Fatalf("grant lease failed: %v", err)
+	}
+	m.service.PutServiceInstanceSpecWithLease(&spec.ServiceInstanceSpec{
+		ServiceName: "order", InstanceID: "order-01", Status: spec.ServiceStatusUp}, leaseID)
+
+	heartbeat := time.Now().Add(-5 * time.Second).Format(time.RFC3339)
+	m.checkLastHeartbeatTime(m.service.GetServiceInstanceSpec("order", "order-01"), heartbeat)
+
+	key := layout.ServiceInstanceSpecKey("order", "order-01")
+	if ins := m.service.GetServiceInstanceSpec("order", "order-01"); ins.Status != spec.ServiceStatusOutOfService {
+		t.Fatalf("want %s, got %s", spec.ServiceStatusOutOfService, ins.Status)
+	}
+	if got := mc.KeyValue(key).Lease; got != int64(leaseID) {
+		t.Fatalf("want lease %x kept after status changed, got %x", leaseID, got)
+	}
+
+	// The record of the crashed sidecar expires with its lease.
+	store.RevokeLease(leaseID)
+	if ins := m.service.GetServiceInstanceSpec("order", "order-01"); ins != nil {
+		t.Fatalf("want record gone with the lease, got %+v", ins)
+	}
+
+	// The record gone is not recreated by the status change.
+	m.updateInstanceStatus(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-01"}, spec.ServiceStatusUp)
+	if mc.KeyValue(key) != nil {
+		t.Fatalf("want record not recreated")
+	}
+}
+
+func TestHeldStatusNotPromoted(t *testing.T) {
+	store := storage.New("test", clustertest.NewMemCluster())
+	m := &Master{
+		spec:              &spec.Admin{},
+		heartbeatInterval: time.Second,
+		store:             store,
+		service:           service.NewWithStorage(store),
+		hysteresis:        newHealthHysteresis(1, 1),
+	}
+
+	// order-01 is pre-warming, order-02 was brought down by the master for expiring.
+	m.service.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-01",
+		Status: spec.ServiceStatusOutOfService, StatusHold: spec.StatusHoldPreWarm})
+	m.service.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-02",
+		Status: spec.ServiceStatusOutOfService})
+	heartbeat := time.Now().Format(time.RFC3339)
+	for _, id := range []string{"order-01", "order-02"} {
+		buff, _ := codectool.MarshalJSON(&spec.ServiceInstanceStatus{ServiceName: "order", InstanceID: id, LastHeartbeatTime: heartbeat})
+		store.Put(layout.ServiceInstanceStatusKey("order", id), string(buff))
+	}
+
+	m.checkServiceInstances()
+
+	if ins := m.service.GetServiceInstanceSpec("order", "order-01"); ins.Status != spec.ServiceStatusOutOfService {
+		t.Fatalf("want pre-warming instance kept %s, got %s", spec.ServiceStatusOutOfService, ins.Status)
+	}
+	if ins := m.service.GetServiceInstanceSpec("order", "order-02"); ins.Status != spec.ServiceStatusUp {
+		t.Fatalf("want recovered instance %s, got %s", spec.ServiceStatusUp, ins.Status)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package master
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/v2/pkg/util/prometheushelper"
+)
+
+const (
+	defaultZoneLabel = "zone"
+	defaultMaxZones  = 10
+
+	unknownZone = "unknown"
+	otherZone   = "other"
+)
+
+type (
+	// instanceMetrics publishes the instance counts by service, zone and status.
+	instanceMetrics struct {
+		zoneLabel string
+		maxZones  int
+		instances *prometheus.GaugeVec
+	}
+
+	instanceCountKey struct {
+		service string
+		zone    string
+		status  string
+	}
+)
+
+func newInstanceMetrics(adminSpec *spec.Admin) *instanceMetrics {
+	zoneLabel := adminSpec.InstanceMetricsZoneLabel
+	if zoneLabel == "" {
+		zoneLabel = defaultZoneLabel
+	}
+	maxZones := adminSpec.InstanceMetricsMaxZones
+	if maxZones <= 0 {
+		maxZones = defaultMaxZones
+	}
+
+	return &instanceMetrics{
+		zoneLabel: zoneLabel,
+		maxZones:  maxZones,
+		instances: prometheushelper.NewGauge("mesh_service_instances",
+			"the number of service instances by service, zone and status",
+			[]string{"service", "zone", "status"}),
+	}
+}
+
+func (im *instanceMetrics) zoneOf(_spec *spec.ServiceInstanceSpec) string {
+	if zone := _spec.Labels[im.zoneLabel]; zone != "" {
+		return zone
+	}
+	return unknownZone
+}
+
+// keptZones returns the zones exported as they are, which are the ones
+// with most instances, ties are broken by names.
+func (im *instanceMetrics) keptZones(specs []*spec.ServiceInstanceSpec) map[string]bool {
+	counts := map[string]int{}
+	for _, _spec := range specs {
+		counts[im.zoneOf(_spec)]++
+	}
+
+	zones := make([]string, 0, len(counts))
+	for zone := range counts {
+		zones = append(zones, zone)
+	}
+	sort.Slice(zones, func(i, j int) bool {
+		if counts[zones[i]] != counts[zones[j]] {
+			return counts[zones[i]] > counts[zones[j]]
+		}
+		return zones[i] < zones[j]
+	})
+	if len(zones) > im.maxZones {
+		zones = zones[:im.maxZones]
+	}
+
+	kept := make(map[string]bool, len(zones))
+	for _, zone := range zones {
+		kept[zone] = true
+	}
+	return kept
+}
+
+// publish replaces all instance counts with the ones of the specs.
+func (im *instanceMetrics) publish(specs []*spec.ServiceInstanceSpec) {
+	if im == nil || im.instances == nil {
+		return
+	}
+
+	kept := im.keptZones(specs)
+	counts := map[instanceCountKey]int{}
+	for _, _spec := range specs {
+		zone := im.zoneOf(_spec)
+		if !kept[zone] {
+			zone = otherZone
+		}
+		counts[instanceCountKey{service: _spec.ServiceName, zone: zone, status: _spec.Status}]++
+	}
+
+	// NOTE: Reset drops the series of the gone instances.
+	im.instances.Reset()
+	for key, count := range counts {
+		im.instances.WithLabelValues(key.service, key.zone, key.status).Set(float64(count))
+	}
+}
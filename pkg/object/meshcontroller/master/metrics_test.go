@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package master
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/megaease/easegress/v2/pkg/cluster/clustertest"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/service"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/storage"
+)
+
+func TestInstanceMetrics(t *testing.T) {
+	store := storage.New("test", clustertest.NewMemCluster())
+	s := service.NewWithStorage(store)
+
+	seeds := []struct {
+		service string
+		zone    string
+		status  string
+		count   int
+	}{
+		{"order", "us-east", spec.ServiceStatusUp, 3},
+		{"order", "us-east", spec.ServiceStatusOutOfService, 1},
+		{"order", "us-west", spec.ServiceStatusUp, 2},
+		{"order", "", spec.ServiceStatusUp, 1},
+		{"payment", "us-west", spec.ServiceStatusOutOfService, 2},
+		{"payment", "eu-central", spec.ServiceStatusUp, 1},
+	}
+	for _, seed := range seeds {
+		for i := 0; i < seed.count; i++ {
+			s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+				ServiceName: seed.service,
+				InstanceID:  fmt.Sprintf("%s-%s-%s-%d", seed.service, seed.zone, seed.status, i),
+				Status:      seed.status,
+				Labels:      map[string]string{"zone": seed.zone},
+			})
+		}
+	}
+
+	im := newInstanceMetrics(&spec.Admin{})
+	im.publish(s.ListAllServiceInstanceSpecs())
+
+	for _, seed := range seeds {
+		zone := seed.zone
+		if zone == "" {
+			zone = unknownZone
+		}
+		got := testutil.ToFloat64(im.instances.WithLabelValues(seed.service, zone, seed.status))
+		if got != float64(seed.count) {
+			t.Errorf("want %d instances of %s/%s/%s, got %v", seed.count, seed.service, zone, seed.status, got)
+		}
+	}
+	if n := testutil.CollectAndCount(im.instances); n != len(seeds) {
+		t.Errorf("want %d series, got %d", len(seeds), n)
+	}
+
+	// Only the 2 zones with most instances are kept, the others are merged.
+	im.maxZones = 2
+	im.publish(s.ListAllServiceInstanceSpecs())
+	if n := testutil.CollectAndCount(im.instances); n != 6 {
+		t.Errorf("want 6 series, got %d", n)
+	}
+	if got := testutil.ToFloat64(im.instances.WithLabelValues("order", otherZone, spec.ServiceStatusUp)); got != 1 {
+		t.Errorf("want 1 instance of order in zone other, got %v", got)
+	}
+	if got := testutil.ToFloat64(im.instances.WithLabelValues("payment", otherZone, spec.ServiceStatusUp)); got != 1 {
+		t.Errorf("want 1 instance of payment in zone other, got %v", got)
+	}
+	if got := testutil.ToFloat64(im.instances.WithLabelValues("payment", "us-west", spec.ServiceStatusOutOfService)); got != 2 {
+		t.Errorf("want 2 instances of payment in us-west, got %v", got)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	// AddressModeDev accepts any instance address, it's the default mode.
+	AddressModeDev = "dev"
+	// AddressModeStrict rejects instance addresses of the rejected classes.
+	AddressModeStrict = "strict"
+
+	// AddressClassLoopback is the class of loopback addresses, e.g. 127.0.0.1.
+	AddressClassLoopback = "loopback"
+	// AddressClassLinkLocal is the class of link-local addresses, e.g. 169.254.0.1.
+	AddressClassLinkLocal = "linkLocal"
+	// AddressClassPrivate is the class of private addresses, e.g. 10.0.0.1.
+	AddressClassPrivate = "private"
+)
+
+// defaultRejectedAddressClasses doesn't contain private addresses,
+// since pods are usually assigned ones of them.
+var defaultRejectedAddressClasses = []string{AddressClassLoopback, AddressClassLinkLocal}
+
+func (rcs *Server) rejectedAddressClasses() []string {
+	if len(rcs.RejectedAddressClasses) == 0 {
+		return defaultRejectedAddressClasses
+	}
+	return rcs.RejectedAddressClasses
+}
+
+// checkAddress checks whether the instance address is acceptable in current address mode.
+func (rcs *Server) checkAddress(ip string) error {
+	if rcs.AddressMode != AddressModeStrict {
+		return nil
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return fmt.Errorf("invalid instance ip: %s", ip)
+	}
+
+	for _, class := range rcs.rejectedAddressClasses() {
+		var matched bool
+		switch class {
+		case AddressClassLoopback:
+			matched = addr.IsLoopback()
+		case AddressClassLinkLocal:
+			matched = addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast()
+		case AddressClassPrivate:
+			matched = addr.IsPrivate()
+		default:
+			return fmt.Errorf("unknown address class: %s", class)
+		}
+
+		if matched {
+			return fmt.Errorf("%s address %s is not allowed in %s mode", class, ip, AddressModeStrict)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"sync/atomic"
+
+	"github.com/buraksezer/consistent"
+	"github.com/spaolacci/murmur3"
+
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+)
+
+type (
+	// AffinitySelector maps sticky keys to instances by consistent hashing,
+	// so a key keeps mapping to the same instance while the instance exists,
+	// and only a small part of keys are remapped when the instances change.
+	AffinitySelector struct {
+		consistentHash atomic.Pointer[consistent.Consistent]
+	}
+
+	affinityMember struct {
+		ins *spec.ServiceInstanceSpec
+	}
+
+	affinityHasher struct{}
+)
+
+// String implements consistent.Member interface
+func (m affinityMember) String() string {
+	return m.ins.Key()
+}
+
+// Sum64 implements consistent.Hasher interface using murmur3
+func (h affinityHasher) Sum64(data []byte) uint64 {
+	return murmur3.Sum64(data)
+}
+
+// NewAffinitySelector creates an affinity selector of the instances.
+func NewAffinitySelector(instances []*spec.ServiceInstanceSpec) *AffinitySelector {
+	as := &AffinitySelector{}
+	as.Update(instances)
+	return as
+}
+
+// Update updates the instances to select from.
+func (as *AffinitySelector) Update(instances []*spec.ServiceInstanceSpec) {
+	if len(instances) == 0 {
+		as.consistentHash.Store(nil)
+		return
+	}
+
+	members := make([]consistent.Member, len(instances))
+	for i, ins := range instances {
+		members[i] = affinityMember{ins: ins}
+	}
+
+	cfg := consistent.Config{
+		PartitionCount:    1024,
+		ReplicationFactor: 50,
+		Load:              1.25,
+		Hasher:            affinityHasher{},
+	}
+
+	as.consistentHash.Store(consistent.New(members, cfg))
+}
+
+// Select selects the instance of the sticky key, it returns nil if there's no instance.
+func (as *AffinitySelector) Select(key string) *spec.ServiceInstanceSpec {
+	ch := as.consistentHash.Load()
+	if ch == nil {
+		return nil
+	}
+
+	return ch.LocateKey([]byte(key)).(affinityMember).ins
+}
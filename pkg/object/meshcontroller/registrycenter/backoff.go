@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	// DefaultRegisterInterval is the interval of the default backoff strategy.
+	DefaultRegisterInterval = 5 * time.Second
+
+	// DefaultBackoffMax is the cap of the backoff enabled by Server.BackoffBase.
+	DefaultBackoffMax = 30 * time.Second
+	// DefaultBackoffJitter is the jitter of the backoff enabled by Server.BackoffBase.
+	DefaultBackoffJitter = 0.2
+)
+
+type (
+	// BackoffStrategy decides the interval before the next registration,
+	// attempt is the number of consecutive failures, 0 means succeeded.
+	BackoffStrategy interface {
+		Next(attempt int) time.Duration
+	}
+
+	// ConstantBackoff waits the same interval for all attempts.
+	ConstantBackoff struct {
+		Interval time.Duration
+	}
+
+	// ExponentialBackoff doubles the interval from Base for every failed attempt,
+	// up to Max if it's positive. Jitter adds a random fraction of the interval up
+	// to it, so that the instances starting at once don't retry in lockstep.
+	ExponentialBackoff struct {
+		Base   time.Duration
+		Max    time.Duration
+		Jitter float64
+	}
+)
+
+func defaultBackoff() BackoffStrategy {
+	return &ConstantBackoff{Interval: DefaultRegisterInterval}
+}
+
+// Next implements BackoffStrategy.
+func (b *ConstantBackoff) Next(attempt int) time.Duration {
+	return b.Interval
+}
+
+// Next implements BackoffStrategy.
+func (b *ExponentialBackoff) Next(attempt int) time.Duration {
+	interval := b.Base
+	for i := 1; i < attempt; i++ {
+		interval *= 2
+		if b.Max > 0 && interval >= b.Max {
+			interval = b.Max
+			break
+		}
+	}
+
+	if b.Jitter > 0 {
+		interval += time.Duration(rand.Float64() * b.Jitter * float64(interval))
+	}
+	if b.Max > 0 && interval > b.Max {
+		return b.Max
+	}
+	return interval
+}
+
+// backoffStrategy returns the jittered exponential backoff if BackoffBase is set,
+// otherwise the backoff strategy of the server.
+func (rcs *Server) backoffStrategy() BackoffStrategy {
+	if rcs.BackoffBase <= 0 {
+		return rcs.backoff
+	}
+
+	max := rcs.BackoffMax
+	if max <= 0 {
+		max = DefaultBackoffMax
+	}
+	return &ExponentialBackoff{Base: rcs.BackoffBase, Max: max, Jitter: DefaultBackoffJitter}
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+)
+
+const (
+	// EvictionPolicyRejectNew rejects the new instances at the limit, it's the default one.
+	EvictionPolicyRejectNew = "reject-new"
+	// EvictionPolicyEvictOldestStale evicts the oldest stale instances at the limit
+	// to make room for the new ones, and rejects them if there are not enough.
+	EvictionPolicyEvictOldestStale = "evict-oldest-stale"
+)
+
+// DefaultEvictionStaleThreshold is the default heartbeat age of evictable instances.
+const DefaultEvictionStaleThreshold = time.Minute
+
+func (rcs *Server) evictionStaleThreshold() time.Duration {
+	if rcs.EvictionStaleThreshold <= 0 {
+		return DefaultEvictionStaleThreshold
+	}
+	return rcs.EvictionStaleThreshold
+}
+
+// checkCapacity enforces MaxInstances before registering the instance,
+// the updates of existing instances are always allowed.
+func (rcs *Server) checkCapacity(ins *spec.ServiceInstanceSpec) error {
+	if rcs.MaxInstances <= 0 {
+		return nil
+	}
+
+	exists, err := rcs.service.ServiceInstanceSpecExists(ins.ServiceName, ins.InstanceID)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	count, err := rcs.service.CountAllServiceInstanceSpecs()
+	if err != nil {
+		return err
+	}
+	if count < int64(rcs.MaxInstances) {
+		return nil
+	}
+
+	if rcs.EvictionPolicy != EvictionPolicyEvictOldestStale {
+		return fmt.Errorf("register %s with %d instances: %v", ins.Key(), count, spec.ErrRegistryFull)
+	}
+
+	return rcs.evictOldestStale(ins, int(count)-rcs.MaxInstances+1)
+}
+
+// evictOldestStale evicts n stale instances with the oldest registry time.
+func (rcs *Server) evictOldestStale(ins *spec.ServiceInstanceSpec, n int) error {
+	instances, err := rcs.service.StaleInstances(rcs.evictionStaleThreshold())
+	if err != nil {
+		return err
+	}
+
+	registryTime := func(ins *spec.ServiceInstanceSpec) time.Time {
+		t, _ := time.Parse(time.RFC3339, ins.RegistryTime)
+		return t
+	}
+
+	// NOTE: The instances registered just now may have no heartbeat yet.
+	cutoff := time.Now().Add(-rcs.evictionStaleThreshold())
+	stale := make([]*spec.ServiceInstanceSpec, 0, len(instances))
+	for _, e := range instances {
+		if registryTime(e).After(cutoff) {
+			continue
+		}
+		stale = append(stale, e)
+	}
+	if len(stale) < n {
+		return fmt.Errorf("register %s with %d stale instances to evict, want %d: %v",
+			ins.Key(), len(stale), n, spec.ErrRegistryFull)
+	}
+
+	sort.Slice(stale, func(i, j int) bool {
+		return registryTime(stale[i]).Before(registryTime(stale[j]))
+	})
+	evicted := stale[:n]
+	if err = rcs.service.DeleteServiceInstances(evicted); err != nil {
+		return err
+	}
+
+	for _, e := range evicted {
+		logger.Warnf("registry reached its limit %d, evict stale instance %s for %s",
+			rcs.MaxInstances, e.Key(), ins.Key())
+	}
+
+	return nil
+}
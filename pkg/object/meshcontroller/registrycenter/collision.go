@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"fmt"
+
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+)
+
+const (
+	// CollisionPolicyLastWriterWins overwrites the record of the instanceID, it's the default one.
+	CollisionPolicyLastWriterWins = "last-writer-wins"
+	// CollisionPolicyReject rejects the instance whose instanceID is taken.
+	CollisionPolicyReject = "reject"
+	// CollisionPolicyAutoSuffix suffixes the taken instanceID with the first free number,
+	// e.g. order-01-2, so that both instances are registered.
+	CollisionPolicyAutoSuffix = "auto-suffix"
+)
+
+// maxCollisionSuffix limits the numbers tried by CollisionPolicyAutoSuffix.
+const maxCollisionSuffix = 1000
+
+func (rcs *Server) collisionPolicy() string {
+	switch rcs.CollisionPolicy {
+	case CollisionPolicyReject, CollisionPolicyAutoSuffix:
+		return rcs.CollisionPolicy
+	default:
+		return CollisionPolicyLastWriterWins
+	}
+}
+
+// collides checks whether the instanceID is taken by another address,
+// the tombstones never collide.
+func (rcs *Server) collides(ins *spec.ServiceInstanceSpec, instanceID string) bool {
+	origin := rcs.service.GetServiceInstanceSpec(ins.ServiceName, instanceID)
+	return origin != nil && origin.Status != spec.ServiceStatusDeleted &&
+		instanceAddress(origin) != instanceAddress(ins)
+}
+
+// resolveCollision applies CollisionPolicy to the instance whose instanceID
+// is taken by another address. It only works with IdentityKeyInstanceID,
+// since the instances are never matched by instanceID with IdentityKeyAddress.
+func (rcs *Server) resolveCollision(ins *spec.ServiceInstanceSpec) error {
+	policy := rcs.collisionPolicy()
+	if policy == CollisionPolicyLastWriterWins || rcs.identityKey() != IdentityKeyInstanceID {
+		return nil
+	}
+
+	if !rcs.collides(ins, ins.InstanceID) {
+		return nil
+	}
+
+	if policy == CollisionPolicyReject {
+		return fmt.Errorf("register instance %s/%s at %s: %v",
+			ins.ServiceName, ins.InstanceID, instanceAddress(ins), spec.ErrInstanceIDTaken)
+	}
+
+	for i := 2; i <= maxCollisionSuffix; i++ {
+		instanceID := fmt.Sprintf("%s-%d", ins.InstanceID, i)
+		if !rcs.collides(ins, instanceID) {
+			ins.InstanceID = instanceID
+			return nil
+		}
+	}
+
+	return fmt.Errorf("register instance %s/%s at %s: no free suffix: %v",
+		ins.ServiceName, ins.InstanceID, instanceAddress(ins), spec.ErrInstanceIDTaken)
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"fmt"
+	"time"
+)
+
+// configRetryAttempts is the number of retry intervals reported in ServerConfig.
+const configRetryAttempts = 5
+
+// ServerConfig is the effective config of the registry center server,
+// after the defaults applied.
+type ServerConfig struct {
+	RegistryType string `json:"registryType"`
+	ServiceName  string `json:"serviceName"`
+	InstanceID   string `json:"instanceID"`
+
+	InitialStatus          string   `json:"initialStatus"`
+	AddressMode            string   `json:"addressMode"`
+	RejectedAddressClasses []string `json:"rejectedAddressClasses"`
+	AbortBatchOnError      bool     `json:"abortBatchOnError"`
+	StrictDecode           bool     `json:"strictDecode"`
+	UnknownServiceMode     string   `json:"unknownServiceMode"`
+	FallbackPort           bool     `json:"fallbackPort"`
+	SingleShot             bool     `json:"singleShot"`
+	MaxRegisterAttempts    int      `json:"maxRegisterAttempts"`
+	MaxConsecutivePanics   int      `json:"maxConsecutivePanics"`
+	Persistent             bool     `json:"persistent"`
+	IdentityKey            string   `json:"identityKey"`
+	CollisionPolicy        string   `json:"collisionPolicy"`
+	ConfirmWrites          bool     `json:"confirmWrites"`
+	DeregisterOnClose      bool     `json:"deregisterOnClose"`
+	MaxDeregisterAttempts  int      `json:"maxDeregisterAttempts"`
+
+	LabelKeyNormalization LabelKeyNormalization `json:"labelKeyNormalization"`
+
+	// EmptyResultModes are the modes of the registry types configured.
+	EmptyResultModes map[string]string `json:"emptyResultModes,omitempty"`
+
+	// LeaseTTL is zero in Persistent mode.
+	LeaseTTL time.Duration `json:"leaseTTL"`
+
+	// MaxInstances is zero if the registry is unlimited.
+	MaxInstances   int    `json:"maxInstances"`
+	EvictionPolicy string `json:"evictionPolicy"`
+
+	// HistoryRetention is zero if the history is disabled.
+	HistoryRetention time.Duration `json:"historyRetention"`
+
+	// DeregisterTimeout is zero if the retries of the deregistration are unbounded.
+	DeregisterTimeout time.Duration `json:"deregisterTimeout"`
+
+	// IngressReadyTimeout and EgressReadyTimeout are zero if no grace period.
+	IngressReadyTimeout time.Duration `json:"ingressReadyTimeout"`
+	EgressReadyTimeout  time.Duration `json:"egressReadyTimeout"`
+
+	ReconcileInterval time.Duration `json:"reconcileInterval"`
+
+	// Backoff is the type of the backoff strategy, RetryIntervals are
+	// the intervals after the first consecutive failures.
+	Backoff        string          `json:"backoff"`
+	RetryIntervals []time.Duration `json:"retryIntervals"`
+}
+
+// Config returns the effective config of the server.
+func (rcs *Server) Config() ServerConfig {
+	config := ServerConfig{
+		RegistryType: rcs.registryType,
+		ServiceName:  rcs.serviceName,
+		InstanceID:   rcs.instanceSpec.InstanceID,
+
+		InitialStatus:          rcs.initialStatus(),
+		AddressMode:            AddressModeDev,
+		RejectedAddressClasses: append([]string(nil), rcs.rejectedAddressClasses()...),
+		AbortBatchOnError:      rcs.AbortBatchOnError,
+		StrictDecode:           rcs.StrictDecode,
+		UnknownServiceMode:     rcs.UnknownServiceMode,
+		FallbackPort:           rcs.FallbackPort,
+		SingleShot:             rcs.SingleShot,
+		MaxRegisterAttempts:    rcs.MaxRegisterAttempts,
+		MaxConsecutivePanics:   rcs.MaxConsecutivePanics,
+		Persistent:             rcs.Persistent,
+		IdentityKey:            rcs.identityKey(),
+		CollisionPolicy:        rcs.collisionPolicy(),
+		ConfirmWrites:          rcs.ConfirmWrites,
+		DeregisterOnClose:      rcs.DeregisterOnClose,
+		MaxDeregisterAttempts:  rcs.MaxDeregisterAttempts,
+
+		LabelKeyNormalization: rcs.LabelKeyNormalization,
+		EmptyResultModes:      map[string]string{},
+		MaxInstances:          rcs.MaxInstances,
+		EvictionPolicy:        EvictionPolicyRejectNew,
+		HistoryRetention:      rcs.HistoryRetention,
+		DeregisterTimeout:     rcs.DeregisterTimeout,
+		IngressReadyTimeout:   rcs.IngressReadyTimeout,
+		EgressReadyTimeout:    rcs.EgressReadyTimeout,
+		ReconcileInterval:     rcs.reconcileInterval(),
+
+		Backoff: fmt.Sprintf("%T", rcs.backoffStrategy()),
+	}
+
+	for registryType := range rcs.EmptyResultModes {
+		config.EmptyResultModes[registryType] = rcs.EmptyResultMode(registryType)
+	}
+
+	if rcs.AddressMode == AddressModeStrict {
+		config.AddressMode = AddressModeStrict
+	}
+
+	if rcs.EvictionPolicy == EvictionPolicyEvictOldestStale {
+		config.EvictionPolicy = EvictionPolicyEvictOldestStale
+	}
+
+	if !rcs.Persistent {
+		config.LeaseTTL = rcs.leaseTTL()
+	}
+
+	for attempt := 1; attempt <= configRetryAttempts; attempt++ {
+		config.RetryIntervals = append(config.RetryIntervals, rcs.backoffStrategy().Next(attempt))
+	}
+
+	return config
+}
@@ -18,15 +18,23 @@
 package registrycenter
 
 import (
+	"strings"
+
 	"github.com/hashicorp/consul/api"
+
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
 )
 
-// ToConsulCatalogService transforms service registry info to consul's service
+// ToConsulCatalogService transforms service registry info to consul's service,
+// the nil info of the service without instances is transformed to the empty listing.
 func (rcs *Server) ToConsulCatalogService(serviceInfo *ServiceRegistryInfo) []*api.CatalogService {
 	var (
-		svcs []*api.CatalogService
+		svcs = []*api.CatalogService{}
 		svc  api.CatalogService
 	)
+	if serviceInfo == nil {
+		return svcs
+	}
 
 	svc.Address = serviceInfo.Ins.IP
 	svc.ServiceName = serviceInfo.Ins.ServiceName
@@ -38,12 +46,16 @@ func (rcs *Server) ToConsulCatalogService(serviceInfo *ServiceRegistryInfo) []*a
 	return svcs
 }
 
-// ToConsulHealthService transforms service registry info to consul's serviceEntry
+// ToConsulHealthService transforms service registry info to consul's serviceEntry,
+// the nil info of the service without instances is transformed to the empty listing.
 func (rcs *Server) ToConsulHealthService(serviceInfo *ServiceRegistryInfo) []*api.ServiceEntry {
 	var (
 		svc  api.ServiceEntry
-		svcs []*api.ServiceEntry
+		svcs = []*api.ServiceEntry{}
 	)
+	if serviceInfo == nil {
+		return svcs
+	}
 
 	svc.Service = &api.AgentService{
 		ID:      serviceInfo.Ins.InstanceID,
@@ -51,11 +63,42 @@ func (rcs *Server) ToConsulHealthService(serviceInfo *ServiceRegistryInfo) []*ap
 		Address: serviceInfo.Ins.IP,
 		Service: serviceInfo.Ins.ServiceName,
 	}
-	svc.Checks = make(api.HealthChecks, 0)
+	svc.Checks = api.HealthChecks{
+		&api.HealthCheck{
+			CheckID:     "service:" + serviceInfo.Ins.InstanceID,
+			Name:        "Service '" + serviceInfo.Ins.ServiceName + "' check",
+			Status:      ToRegistryStatus(spec.RegistryTypeConsul, serviceInfo.Ins.Status),
+			ServiceID:   serviceInfo.Ins.InstanceID,
+			ServiceName: serviceInfo.Ins.ServiceName,
+		},
+	}
 	svcs = append(svcs, &svc)
 	return svcs
 }
 
+// ToConsulRegistration transforms the instance to consul's registration,
+// the labels except the system ones are the meta.
+func (rcs *Server) ToConsulRegistration(ins *spec.ServiceInstanceSpec) *api.AgentServiceRegistration {
+	reg := &api.AgentServiceRegistration{
+		ID:      ins.InstanceID,
+		Name:    ins.ServiceName,
+		Address: ins.IP,
+		Port:    int(ins.Port),
+	}
+
+	for k, v := range ins.Labels {
+		if strings.HasPrefix(k, ReservedLabelPrefix) {
+			continue
+		}
+		if reg.Meta == nil {
+			reg.Meta = map[string]string{}
+		}
+		reg.Meta[k] = v
+	}
+
+	return reg
+}
+
 // ToConsulServices transforms registry center's service info to map[string][]string structure
 func (rcs *Server) ToConsulServices(serviceInfos []*ServiceRegistryInfo) map[string][]string {
 	var (
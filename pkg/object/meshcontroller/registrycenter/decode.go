@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"github.com/ArthurHlt/go-eureka-client/eureka"
+	consul "github.com/hashicorp/consul/api"
+
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+// eurekaInstances is the XML body of a batch of Eureka registrations.
+type eurekaInstances struct {
+	Instances []eureka.InstanceInfo `xml:"instance"`
+}
+
+// unmarshalJSON decodes the JSON body, which mustn't have unknown fields in StrictDecode mode.
+func (rcs *Server) unmarshalJSON(body []byte, v interface{}) error {
+	if rcs.StrictDecode {
+		return codectool.UnmarshalJSONStrict(body, v)
+	}
+	return codectool.UnmarshalJSON(body, v)
+}
+
+// DecodeRegistryBatch decodes the Eureka/Consul/Zookeeper register request body according to the
+// registry type. The body could be either one registration or an array of them: JSON array,
+// XML <instances> containing <instance> elements for Eureka, or newline-separated Dubbo provider URLs for Zookeeper.
+func (rcs *Server) DecodeRegistryBatch(contentType string, reqBody []byte) ([]*spec.ServiceInstanceSpec, error) {
+	switch rcs.registryType {
+	case spec.RegistryTypeEureka:
+		infos, err := decodeEurekaBatch(contentType, reqBody)
+		if err != nil {
+			return nil, err
+		}
+		specs := make([]*spec.ServiceInstanceSpec, 0, len(infos))
+		for i := range infos {
+			ins := eurekaToInstanceSpec(&infos[i])
+			ins.Labels = rcs.clientLabels(ins.Labels)
+			ins.RegistryType = rcs.registryType
+			specs = append(specs, ins)
+		}
+		return specs, nil
+	case spec.RegistryTypeConsul:
+		regs, err := decodeConsulBatch(reqBody)
+		if err != nil {
+			return nil, err
+		}
+		specs := make([]*spec.ServiceInstanceSpec, 0, len(regs))
+		for _, reg := range regs {
+			ins := consulToInstanceSpec(reg)
+			ins.Labels = rcs.clientLabels(ins.Labels)
+			ins.RegistryType = rcs.registryType
+			specs = append(specs, ins)
+		}
+		return specs, nil
+	case spec.RegistryTypeZookeeper:
+		var specs []*spec.ServiceInstanceSpec
+		for _, provider := range strings.Fields(string(reqBody)) {
+			ins, err := rcs.decodeByZookeeperFormat([]byte(provider))
+			if err != nil {
+				return nil, err
+			}
+			ins.Labels = rcs.clientLabels(ins.Labels)
+			ins.RegistryType = rcs.registryType
+			specs = append(specs, ins)
+		}
+		return specs, nil
+	default:
+		return nil, fmt.Errorf("BUG: can't recognize registry type: %s req body: %s",
+			rcs.registryType, reqBody)
+	}
+}
+
+// ListInstancesByOrigin lists instances of the service registered with
+// the registry type origin, e.g. for the mesh accepting several protocols.
+func (rcs *Server) ListInstancesByOrigin(serviceName, origin string) ([]*spec.ServiceInstanceSpec, error) {
+	instances, err := rcs.ListInstances(serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := []*spec.ServiceInstanceSpec{}
+	for _, ins := range instances {
+		if ins.RegistryType == origin {
+			filtered = append(filtered, ins)
+		}
+	}
+	return filtered, nil
+}
+
+func isJSONArray(body []byte) bool {
+	body = bytes.TrimSpace(body)
+	return len(body) != 0 && body[0] == '['
+}
+
+func decodeEurekaBatch(contentType string, body []byte) ([]eureka.InstanceInfo, error) {
+	if contentType == ContentTypeJSON {
+		if isJSONArray(body) {
+			var infos []eureka.InstanceInfo
+			if err := codectool.UnmarshalJSON(body, &infos); err != nil {
+				return nil, fmt.Errorf("decode eureka batch body failed: %v", err)
+			}
+			return infos, nil
+		}
+
+		var info eureka.InstanceInfo
+		if err := codectool.UnmarshalJSON(body, &info); err != nil {
+			return nil, fmt.Errorf("decode eureka body failed: %v", err)
+		}
+		return []eureka.InstanceInfo{info}, nil
+	}
+
+	root, err := xmlRootName(body)
+	if err != nil {
+		return nil, fmt.Errorf("decode eureka body failed: %v", err)
+	}
+
+	if root == "instances" {
+		var batch eurekaInstances
+		if err = xml.Unmarshal(body, &batch); err != nil {
+			return nil, fmt.Errorf("decode eureka batch body failed: %v", err)
+		}
+		return batch.Instances, nil
+	}
+
+	var info eureka.InstanceInfo
+	if err = xml.Unmarshal(body, &info); err != nil {
+		return nil, fmt.Errorf("decode eureka body failed: %v", err)
+	}
+	return []eureka.InstanceInfo{info}, nil
+}
+
+func xmlRootName(body []byte) (string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local, nil
+		}
+	}
+}
+
+func decodeConsulBatch(body []byte) ([]*consul.AgentServiceRegistration, error) {
+	if isJSONArray(body) {
+		var regs []*consul.AgentServiceRegistration
+		if err := codectool.UnmarshalJSON(body, &regs); err != nil {
+			return nil, fmt.Errorf("decode consul batch body failed: %v", err)
+		}
+		return regs, nil
+	}
+
+	reg := &consul.AgentServiceRegistration{}
+	if err := codectool.UnmarshalJSON(body, reg); err != nil {
+		return nil, fmt.Errorf("decode consul body failed: %v", err)
+	}
+	return []*consul.AgentServiceRegistration{reg}, nil
+}
+
+func eurekaToInstanceSpec(info *eureka.InstanceInfo) *spec.ServiceInstanceSpec {
+	// NOTE: Eureka uppercases the app name, the vip address keeps the original service name.
+	serviceName := info.VipAddress
+	if serviceName == "" {
+		serviceName = strings.ToLower(info.App)
+	}
+
+	instanceID := info.InstanceID
+	if instanceID == "" {
+		instanceID = info.HostName
+	}
+
+	ins := &spec.ServiceInstanceSpec{
+		ServiceName: serviceName,
+		InstanceID:  instanceID,
+		IP:          info.IpAddr,
+	}
+	if info.Port != nil {
+		ins.Port = uint32(info.Port.Port)
+	}
+	if info.Metadata != nil {
+		ins.Labels = info.Metadata.Map
+	}
+
+	return ins
+}
+
+func consulToInstanceSpec(reg *consul.AgentServiceRegistration) *spec.ServiceInstanceSpec {
+	instanceID := reg.ID
+	if instanceID == "" {
+		instanceID = reg.Name
+	}
+
+	return &spec.ServiceInstanceSpec{
+		ServiceName: reg.Name,
+		InstanceID:  instanceID,
+		IP:          reg.Address,
+		Port:        uint32(reg.Port),
+		Labels:      reg.Meta,
+	}
+}
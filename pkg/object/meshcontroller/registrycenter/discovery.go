@@ -72,7 +72,7 @@ func (rcs *Server) DiscoveryService(serviceName string) (*ServiceRegistryInfo, e
 		}
 	}()
 
-	if !rcs.registered {
+	if !rcs.Registered() {
 		return nil, spec.ErrNoRegisteredYet
 	}
 
@@ -144,7 +144,7 @@ func (rcs *Server) Discovery() ([]*ServiceRegistryInfo, error) {
 	)
 
 	visibleServices = make(map[string]bool)
-	if !rcs.registered {
+	if !rcs.Registered() {
 		return serviceInfos, spec.ErrNoRegisteredYet
 	}
 	self := rcs.service.GetServiceSpec(rcs.serviceName)
@@ -22,6 +22,8 @@ import (
 	"strings"
 
 	"github.com/ArthurHlt/go-eureka-client/eureka"
+
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
 )
 
 // ToEurekaInstanceInfo transforms service registry info to eureka's instance
@@ -31,7 +33,7 @@ func (rcs *Server) ToEurekaInstanceInfo(serviceInfo *ServiceRegistryInfo) *eurek
 	ins.HostName = serviceInfo.Ins.IP
 	ins.IpAddr = serviceInfo.Ins.IP
 	ins.App = strings.ToUpper(serviceInfo.Service.Name)
-	ins.Status = eureka.UP
+	ins.Status = ToRegistryStatus(spec.RegistryTypeEureka, serviceInfo.Ins.Status)
 	ins.InstanceID = serviceInfo.Ins.InstanceID
 	ins.DataCenterInfo = &eureka.DataCenterInfo{
 		Name:  "MyOwn",
@@ -61,7 +63,7 @@ func (rcs *Server) ToEurekaApp(serviceInfo *ServiceRegistryInfo) *eureka.Applica
 
 // ToEurekaApps transforms registry center's service info to eureka's apps
 func (rcs *Server) ToEurekaApps(serviceInfos []*ServiceRegistryInfo) *eureka.Applications {
-	var apps eureka.Applications
+	apps := eureka.Applications{Applications: []eureka.Application{}}
 	for _, v := range serviceInfos {
 		app := rcs.ToEurekaApp(v)
 		apps.Applications = append(apps.Applications, *app)
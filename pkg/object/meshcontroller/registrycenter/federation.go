@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"fmt"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+)
+
+// OriginLabel is the system label of the upstream registry which the instance comes from.
+const OriginLabel = ReservedLabelPrefix + "origin"
+
+// Resolver resolves service instances from an upstream registry, e.g.
+// the registry of another region for federation.
+type Resolver interface {
+	// Name is the name of the upstream registry.
+	Name() string
+	ListInstances(serviceName string) ([]*spec.ServiceInstanceSpec, error)
+}
+
+// ListInstances lists instances of the service. If Upstream is set, the instances
+// of the upstream registry are merged into the local ones, tagged with OriginLabel.
+// The local instance wins if both registries have the same instanceID.
+func (rcs *Server) ListInstances(serviceName string) (instances []*spec.ServiceInstanceSpec, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("list instances of %s failed: %v", serviceName, r)
+		}
+	}()
+
+	instances = rcs.service.ListServiceInstanceSpecs(serviceName)
+	if rcs.Upstream == nil {
+		return instances, nil
+	}
+
+	upstreamInstances, err := rcs.Upstream.ListInstances(serviceName)
+	if err != nil {
+		if len(instances) == 0 {
+			return nil, fmt.Errorf("list instances of %s from upstream %s failed: %v",
+				serviceName, rcs.Upstream.Name(), err)
+		}
+		logger.Warnf("list instances of %s from upstream %s failed, use local ones only: %v",
+			serviceName, rcs.Upstream.Name(), err)
+		return instances, nil
+	}
+
+	local := make(map[string]bool, len(instances))
+	for _, ins := range instances {
+		local[ins.InstanceID] = true
+	}
+
+	for _, ins := range upstreamInstances {
+		if local[ins.InstanceID] {
+			continue
+		}
+
+		tagged := *ins
+		tagged.Labels = make(map[string]string, len(ins.Labels)+1)
+		for k, v := range ins.Labels {
+			tagged.Labels[k] = v
+		}
+		tagged.Labels[OriginLabel] = rcs.Upstream.Name()
+		instances = append(instances, &tagged)
+	}
+
+	return instances, nil
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// EncodeForm encodes v in form encoding for the legacy consumers, the fields are
+// flattened by their JSON names joined with dots, e.g. "instance.0.ipAddr". The array
+// of scalars are encoded as repeated keys, the ones of objects are indexed, and the
+// null values are omitted.
+func EncodeForm(v interface{}) ([]byte, error) {
+	buff, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("marshal %#v to json failed: %v", v, err)
+	}
+
+	// NOTE: The numbers are kept as they are, instead of being formatted from float64.
+	decoder := json.NewDecoder(bytes.NewReader(buff))
+	decoder.UseNumber()
+	var tree interface{}
+	if err := decoder.Decode(&tree); err != nil {
+		return nil, fmt.Errorf("unmarshal %s to json failed: %v", buff, err)
+	}
+
+	values := url.Values{}
+	flattenForm(values, "", tree)
+	return []byte(values.Encode()), nil
+}
+
+func flattenForm(values url.Values, key string, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+	case map[string]interface{}:
+		for k, child := range v {
+			flattenForm(values, joinFormKey(key, k), child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			switch child.(type) {
+			case map[string]interface{}, []interface{}:
+				flattenForm(values, joinFormKey(key, strconv.Itoa(i)), child)
+			default:
+				flattenForm(values, key, child)
+			}
+		}
+	case string:
+		values.Add(key, v)
+	default:
+		values.Add(key, fmt.Sprint(v))
+	}
+}
+
+func joinFormKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
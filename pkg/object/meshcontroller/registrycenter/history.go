@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+)
+
+// History returns the deregistered instances of the service within HistoryRetention,
+// sorted by their DeleteTime. It returns nothing if the history is disabled.
+func (rcs *Server) History(serviceName string) ([]*spec.ServiceInstanceSpec, error) {
+	if rcs.HistoryRetention <= 0 {
+		return nil, nil
+	}
+
+	specs, err := rcs.service.ListServiceInstanceHistory(serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	// NOTE: The history is only trimmed while recording,
+	// so the expired records may be still there.
+	cutoff := time.Now().Add(-rcs.HistoryRetention)
+	history := make([]*spec.ServiceInstanceSpec, 0, len(specs))
+	for _, _spec := range specs {
+		deleteTime, err := time.Parse(time.RFC3339, _spec.DeleteTime)
+		if err != nil || deleteTime.Before(cutoff) {
+			continue
+		}
+		history = append(history, _spec)
+	}
+
+	return history, nil
+}
+
+// recordHistory records the deregistered instance and trims the history
+// of its service, if the history is enabled.
+func (rcs *Server) recordHistory(ins *spec.ServiceInstanceSpec, deleteTime time.Time) {
+	if rcs.HistoryRetention <= 0 {
+		return
+	}
+
+	if err := rcs.service.PutServiceInstanceHistory(ins, deleteTime); err != nil {
+		logger.Errorf("record history of %s failed: %v", ins.Key(), err)
+		return
+	}
+
+	cutoff := deleteTime.Add(-rcs.HistoryRetention)
+	if _, err := rcs.service.TrimServiceInstanceHistory(ins.ServiceName, cutoff); err != nil {
+		logger.Errorf("trim history of service %s failed: %v", ins.ServiceName, err)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import "github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+
+// OnRegistered sets the hook called once the server becomes registered,
+// e.g. for starting serving traffic. It isn't called again by the
+// re-registrations until deregistered.
+// NOTE: The hook runs in the registration, so it must not call Register or Deregister.
+func (rcs *Server) OnRegistered(fn func()) {
+	rcs.mutex.Lock()
+	defer rcs.mutex.Unlock()
+	rcs.onRegistered = fn
+}
+
+// OnDeregistered sets the hook called once the registered server is deregistered,
+// e.g. for pausing serving traffic.
+// NOTE: The hook runs in the deregistration, so it must not call Register or Deregister.
+func (rcs *Server) OnDeregistered(fn func()) {
+	rcs.mutex.Lock()
+	defer rcs.mutex.Unlock()
+	rcs.onDeregistered = fn
+}
+
+// setRegistered sets the registered state of the instance.
+func (rcs *Server) setRegistered(ins *spec.ServiceInstanceSpec, registered bool) {
+	rcs.updateRegistered(func() {
+		if rcs.registered == nil {
+			rcs.registered = map[*spec.ServiceInstanceSpec]bool{}
+		}
+		rcs.registered[ins] = registered
+	})
+}
+
+// resetRegistered sets all the instances not registered.
+func (rcs *Server) resetRegistered() {
+	rcs.updateRegistered(func() {
+		rcs.registered = map[*spec.ServiceInstanceSpec]bool{}
+	})
+}
+
+// updateRegistered updates the registered states under the mutex, and notifies
+// RegisteredC and calls the hook if the state of the server is changed.
+func (rcs *Server) updateRegistered(update func()) {
+	rcs.mutex.Lock()
+	before := rcs.allRegistered()
+	update()
+	registered := rcs.allRegistered()
+	changed := before != registered
+	hook := rcs.onDeregistered
+	if registered {
+		hook = rcs.onRegistered
+	}
+	if changed {
+		rcs.notifyRegistered(registered)
+	}
+	rcs.mutex.Unlock()
+
+	if changed && hook != nil {
+		hook()
+	}
+}
+
+// notifyRegistered sends the registered state to RegisteredC without blocking,
+// the caller must hold the mutex, which serializes it with closing the channel.
+func (rcs *Server) notifyRegistered(registered bool) {
+	select {
+	case <-rcs.done:
+		return
+	default:
+	}
+
+	select {
+	case rcs.registeredC <- registered:
+	default:
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+)
+
+const (
+	// IdentityKeyInstanceID identifies instances by their instanceID.
+	IdentityKeyInstanceID = "instanceID"
+	// IdentityKeyAddress identifies instances by their IP:port.
+	IdentityKeyAddress = "address"
+)
+
+func (rcs *Server) identityKey() string {
+	if rcs.IdentityKey == IdentityKeyAddress {
+		return IdentityKeyAddress
+	}
+	return IdentityKeyInstanceID
+}
+
+func instanceAddress(ins *spec.ServiceInstanceSpec) string {
+	return net.JoinHostPort(ins.IP, strconv.Itoa(int(ins.Port)))
+}
+
+// addressInstanceID derives the instanceID from the address, for the
+// instance whose instanceID is missing or taken by another address.
+func addressInstanceID(ins *spec.ServiceInstanceSpec) string {
+	address := strings.NewReplacer(":", "-", "[", "", "]", "").Replace(instanceAddress(ins))
+	return fmt.Sprintf("%s-%s", ins.ServiceName, address)
+}
+
+// resolveIdentity finds the registered record of the instance by IdentityKey.
+// In address mode, the instance takes over the instanceID of the record, so
+// it's updated in place instead of registered as a new instance.
+func (rcs *Server) resolveIdentity(ins *spec.ServiceInstanceSpec) *spec.ServiceInstanceSpec {
+	if rcs.identityKey() == IdentityKeyInstanceID {
+		return rcs.service.GetServiceInstanceSpec(ins.ServiceName, ins.InstanceID)
+	}
+
+	address := instanceAddress(ins)
+	for _, origin := range rcs.service.ListServiceInstanceSpecs(ins.ServiceName) {
+		if instanceAddress(origin) == address {
+			ins.InstanceID = origin.InstanceID
+			return origin
+		}
+	}
+
+	// NOTE: The tombstone of the instanceID can be taken over.
+	taken := false
+	if ins.InstanceID != "" {
+		origin := rcs.service.GetServiceInstanceSpec(ins.ServiceName, ins.InstanceID)
+		taken = origin != nil && origin.Status != spec.ServiceStatusDeleted
+	}
+	if ins.InstanceID == "" || taken {
+		ins.InstanceID = addressInstanceID(ins)
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+)
+
+// ReservedLabelPrefix is the prefix of system-managed instance labels,
+// which can't be set by registry clients.
+const ReservedLabelPrefix = "mesh."
+
+// sanitizeLabels returns the client labels without the reserved ones.
+func sanitizeLabels(labels map[string]string) map[string]string {
+	result := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if strings.HasPrefix(k, ReservedLabelPrefix) {
+			logger.Warnf("drop client label %s: prefix %s is reserved", k, ReservedLabelPrefix)
+			continue
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// LabelKeyNormalization is the normalization of client label keys applied
+// while decoding, for label consumers sensitive to the keys, e.g. Prometheus.
+type LabelKeyNormalization struct {
+	// Lowercase lowercases the keys.
+	Lowercase bool `json:"lowercase"`
+	// Sanitize replaces the characters other than letters, digits and underscores
+	// of the keys with underscores.
+	Sanitize bool `json:"sanitize"`
+	// PreserveOriginal keeps the labels of the original keys as well.
+	PreserveOriginal bool `json:"preserveOriginal"`
+}
+
+// sanitizeLabelKey replaces the characters other than letters, digits
+// and underscores with underscores.
+func sanitizeLabelKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+func (n LabelKeyNormalization) normalizeKey(key string) string {
+	if n.Lowercase {
+		key = strings.ToLower(key)
+	}
+	if n.Sanitize {
+		key = sanitizeLabelKey(key)
+	}
+	return key
+}
+
+// normalizeLabels normalizes the label keys. If several keys are normalized into the
+// same one, the key already normalized wins, otherwise the first of them in order.
+func (n LabelKeyNormalization) normalizeLabels(labels map[string]string) map[string]string {
+	if !n.Lowercase && !n.Sanitize {
+		return labels
+	}
+
+	keys := make([]string, 0, len(labels))
+	result := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if n.normalizeKey(k) == k {
+			result[k] = v
+		} else {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		normalized := n.normalizeKey(k)
+		if _, exists := result[normalized]; exists {
+			logger.Warnf("drop label %s: normalized key %s exists", k, normalized)
+		} else {
+			result[normalized] = labels[k]
+		}
+
+		// NOTE: The normalization is idempotent, so the original key
+		// never collides with the normalized ones.
+		if n.PreserveOriginal {
+			result[k] = labels[k]
+		}
+	}
+
+	return result
+}
+
+// clientLabels normalizes the client labels and drops the reserved ones,
+// which could be made by the normalization as well.
+func (rcs *Server) clientLabels(labels map[string]string) map[string]string {
+	return sanitizeLabels(rcs.LabelKeyNormalization.normalizeLabels(labels))
+}
+
+// mergeClientLabels merges the client labels into the instance labels,
+// the existing labels are kept.
+func (rcs *Server) mergeClientLabels(labels map[string]string) {
+	labels = rcs.clientLabels(labels)
+	if len(labels) == 0 {
+		return
+	}
+
+	merged := make(map[string]string, len(rcs.instanceSpec.Labels)+len(labels))
+	for k, v := range labels {
+		merged[k] = v
+	}
+	for k, v := range rcs.instanceSpec.Labels {
+		merged[k] = v
+	}
+	rcs.instanceSpec.Labels = merged
+}
+
+// SetSystemLabel sets a system-managed label of the instance, the key
+// is prefixed with ReservedLabelPrefix if it's not.
+func (rcs *Server) SetSystemLabel(key, value string) {
+	if !strings.HasPrefix(key, ReservedLabelPrefix) {
+		key = ReservedLabelPrefix + key
+	}
+
+	labels := make(map[string]string, len(rcs.instanceSpec.Labels)+1)
+	for k, v := range rcs.instanceSpec.Labels {
+		labels[k] = v
+	}
+	labels[key] = value
+	rcs.instanceSpec.Labels = labels
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+)
+
+// RegisterLeader registers itself into mesh like Register, and the instances of
+// the service elect a leader among them: only the leader is UP, the standbys are
+// OUT_OF_SERVICE. A standby takes over once the instance record of the leader is gone.
+func (rcs *Server) RegisterLeader(serviceSpec *spec.Service, ingressReady ReadyFunc, egressReady ReadyFunc) error {
+	if rcs.Registered() {
+		return nil
+	}
+
+	rcs.mutex.Lock()
+	rcs.leaderElection = true
+	rcs.mutex.Unlock()
+
+	if err := rcs.Register(serviceSpec, ingressReady, egressReady); err != nil {
+		return err
+	}
+
+	rcs.registerMutex.Lock()
+	stop := rcs.stopRegister
+	rcs.registerMutex.Unlock()
+
+	go rcs.runLeaderElection(stop)
+
+	return nil
+}
+
+// IsLeader returns whether the instance is the elected leader of RegisterLeader.
+func (rcs *Server) IsLeader() bool {
+	rcs.mutex.RLock()
+	defer rcs.mutex.RUnlock()
+	return rcs.leader
+}
+
+// registerStatus returns the status of the instance to register,
+// which is OUT_OF_SERVICE for the standby of leader election.
+func (rcs *Server) registerStatus() string {
+	rcs.mutex.RLock()
+	defer rcs.mutex.RUnlock()
+
+	if rcs.leaderElection && !rcs.leader {
+		return spec.ServiceStatusOutOfService
+	}
+	return rcs.initialStatus()
+}
+
+func (rcs *Server) runLeaderElection(stop chan struct{}) {
+	ticker := time.NewTicker(rcs.leaseTTL() / 3)
+	defer ticker.Stop()
+
+	for {
+		err := rcs.elect(stop)
+		if err == errRegisterStopped {
+			return
+		}
+		if err != nil {
+			logger.Errorf("leader election failed: %v", err)
+		}
+
+		select {
+		case <-rcs.done:
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// elect campaigns for the leadership once the instance is registered,
+// and updates the status of its record according to the result.
+func (rcs *Server) elect(stop chan struct{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	rcs.registerMutex.Lock()
+	defer rcs.registerMutex.Unlock()
+
+	select {
+	case <-stop:
+		return errRegisterStopped
+	default:
+	}
+
+	if !rcs.Registered() {
+		return nil
+	}
+
+	ins := rcs.instanceSpec
+	leader, err := rcs.service.CampaignServiceLeader(ins.ServiceName, ins.InstanceID)
+	if err != nil {
+		return err
+	}
+
+	isLeader := leader == ins.InstanceID
+	rcs.mutex.Lock()
+	changed := rcs.leader != isLeader
+	rcs.leader = isLeader
+	rcs.mutex.Unlock()
+
+	if changed && isLeader {
+		logger.Infof("instance %s becomes the leader of service %s", ins.InstanceID, ins.ServiceName)
+	} else if changed {
+		logger.Infof("instance %s becomes a standby of leader %s of service %s", ins.InstanceID, leader, ins.ServiceName)
+	}
+
+	status := rcs.registerStatus()
+	if origin := rcs.service.GetServiceInstanceSpec(ins.ServiceName, ins.InstanceID); origin != nil && origin.Status == status {
+		return nil
+	}
+
+	ins.Status = status
+	rcs.holdStatus(ins)
+	return rcs.putInstanceSpec(ins)
+}
+
+// resign gives up the leadership of leader election.
+func (rcs *Server) resign() {
+	rcs.mutex.Lock()
+	leaderElection, leader := rcs.leaderElection, rcs.leader
+	rcs.leader = false
+	rcs.mutex.Unlock()
+
+	if !leaderElection || !leader {
+		return
+	}
+
+	if err := rcs.service.ResignServiceLeader(rcs.instanceSpec.ServiceName, rcs.instanceSpec.InstanceID); err != nil {
+		logger.Errorf("resign leader of service %s failed: %v", rcs.instanceSpec.ServiceName, err)
+	}
+}
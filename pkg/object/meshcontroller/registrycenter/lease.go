@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+// DefaultLeaseTTL is the default TTL of the lease backing instance records.
+const DefaultLeaseTTL = 30 * time.Second
+
+func (rcs *Server) leaseTTL() time.Duration {
+	if rcs.LeaseTTL <= 0 {
+		return DefaultLeaseTTL
+	}
+	return rcs.LeaseTTL
+}
+
+// confirmWriteAttempts is the number of attempts putting the instance spec in ConfirmWrites mode.
+const confirmWriteAttempts = 3
+
+// putInstanceSpec puts the instance spec. In ConfirmWrites mode, it's read back
+// after written and put again if it doesn't match.
+func (rcs *Server) putInstanceSpec(ins *spec.ServiceInstanceSpec) error {
+	if !rcs.ConfirmWrites {
+		return rcs.writeInstanceSpec(ins)
+	}
+
+	for attempt := 1; attempt <= confirmWriteAttempts; attempt++ {
+		if err := rcs.writeInstanceSpec(ins); err != nil {
+			return err
+		}
+
+		got := rcs.service.GetServiceInstanceSpec(ins.ServiceName, ins.InstanceID)
+		if sameInstanceSpec(got, ins) {
+			return nil
+		}
+		logger.Warnf("confirm instance spec %s failed at attempt %d, read back: %+v",
+			ins.Key(), attempt, got)
+	}
+
+	return fmt.Errorf("confirm instance spec %s failed after %d attempts", ins.Key(), confirmWriteAttempts)
+}
+
+// sameInstanceSpec compares the specs by their JSON encodings,
+// since the empty fields are omitted from the stored one.
+func sameInstanceSpec(a, b *spec.ServiceInstanceSpec) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	buffA, errA := codectool.MarshalJSON(a)
+	buffB, errB := codectool.MarshalJSON(b)
+	return errA == nil && errB == nil && bytes.Equal(buffA, buffB)
+}
+
+// writeInstanceSpec puts the instance spec with the lease of the server,
+// or without any lease in Persistent mode.
+func (rcs *Server) writeInstanceSpec(ins *spec.ServiceInstanceSpec) error {
+	if rcs.Persistent {
+		rcs.service.PutServiceInstanceSpec(ins)
+		return nil
+	}
+
+	leaseID, err := rcs.instanceLease()
+	if err != nil {
+		return err
+	}
+
+	rcs.service.PutServiceInstanceSpecWithLease(ins, leaseID)
+	return nil
+}
+
+// instanceLease returns the lease of the server, grants a new one if there isn't.
+// The lease is kept alive in the background except in SingleShot mode.
+func (rcs *Server) instanceLease() (clientv3.LeaseID, error) {
+	rcs.mutex.Lock()
+	defer rcs.mutex.Unlock()
+
+	if rcs.leaseID != 0 {
+		return rcs.leaseID, nil
+	}
+
+	leaseID, err := rcs.service.GrantLease(rcs.leaseTTL())
+	if err != nil {
+		return 0, err
+	}
+	rcs.leaseID = leaseID
+
+	if !rcs.SingleShot {
+		go rcs.keepAliveLease(leaseID)
+	}
+
+	return leaseID, nil
+}
+
+func (rcs *Server) keepAliveLease(leaseID clientv3.LeaseID) {
+	ticker := time.NewTicker(rcs.leaseTTL() / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rcs.done:
+			return
+		case <-ticker.C:
+		}
+
+		if err := rcs.renewLease(leaseID); err != nil {
+			logger.Errorf("%v", err)
+			return
+		}
+	}
+}
+
+// RefreshLeases renews the lease backing the instance records at once,
+// instead of waiting for the background keeping alive.
+func (rcs *Server) RefreshLeases() error {
+	if rcs.Persistent {
+		return nil
+	}
+
+	rcs.mutex.RLock()
+	leaseID := rcs.leaseID
+	rcs.mutex.RUnlock()
+
+	if leaseID == 0 {
+		return spec.ErrNoRegisteredYet
+	}
+
+	return rcs.renewLease(leaseID)
+}
+
+func (rcs *Server) renewLease(leaseID clientv3.LeaseID) error {
+	err := rcs.service.KeepAliveLease(leaseID)
+	if err == nil {
+		return nil
+	}
+
+	// NOTE: The records expire with the lease, so a new lease will
+	// be granted while registering them again.
+	rcs.mutex.Lock()
+	if rcs.leaseID == leaseID {
+		rcs.leaseID = 0
+	}
+	rcs.mutex.Unlock()
+
+	return fmt.Errorf("keep alive lease %x failed: %v", leaseID, err)
+}
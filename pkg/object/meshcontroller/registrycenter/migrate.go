@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+)
+
+// consulMetaKey converts the label key to a valid meta key of Consul,
+// which only contains letters, digits, '_' and '-'.
+func consulMetaKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+}
+
+// eurekaToConsulInstance maps the Eureka-origin instance to the Consul one,
+// e.g. the metadata key management.port becomes the meta key management_port.
+// It fails rather than dropping a label whose converted key is taken by another value.
+func eurekaToConsulInstance(ins *spec.ServiceInstanceSpec) (*spec.ServiceInstanceSpec, error) {
+	migrated := *ins
+	migrated.RegistryType = spec.RegistryTypeConsul
+	migrated.Labels = make(map[string]string, len(ins.Labels))
+
+	for k, v := range ins.Labels {
+		key := k
+		if !strings.HasPrefix(k, ReservedLabelPrefix) {
+			key = consulMetaKey(k)
+		}
+		if old, exists := migrated.Labels[key]; exists && old != v {
+			return nil, fmt.Errorf("migrate label %s of %s: meta key %s taken by another value",
+				k, ins.Key(), key)
+		}
+		migrated.Labels[key] = v
+	}
+	if len(migrated.Labels) == 0 {
+		migrated.Labels = nil
+	}
+
+	return &migrated, nil
+}
+
+// MigrateEurekaToConsul rewrites the Eureka-origin instances of the service into the
+// Consul representation in place, e.g. for a protocol migration. The instances not of
+// Eureka origin are left as they are, so it's idempotent. It returns the number of the
+// migrated instances, and the first failure after trying all of them.
+func (rcs *Server) MigrateEurekaToConsul(serviceName string) (n int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("migrate instances of service %s failed: %v", serviceName, r)
+		}
+	}()
+
+	var firstErr error
+	for _, ins := range rcs.service.ListServiceInstanceSpecs(serviceName) {
+		if ins.RegistryType != spec.RegistryTypeEureka {
+			continue
+		}
+
+		migrated, err := eurekaToConsulInstance(ins)
+		if err == nil {
+			err = rcs.service.RewriteServiceInstanceSpec(migrated)
+		}
+		if err != nil {
+			logger.Errorf("migrate instance %s from eureka to consul failed: %v", ins.Key(), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		n++
+	}
+
+	return n, firstErr
+}
@@ -19,14 +19,92 @@ package registrycenter
 
 import (
 	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/nacos-group/nacos-sdk-go/model"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
 )
 
 const defaultGroup = "DEFAULT_GROUP"
 
+// ContentTypeForm is the content type of the Nacos register request body,
+// and the one of the instance listings encoded by EncodeForm.
+const ContentTypeForm = "application/x-www-form-urlencoded"
+
+// nacosRegistration is the register request of Nacos POST /nacos/v1/ns/instance.
+type nacosRegistration struct {
+	ServiceName string `json:"serviceName"`
+	IP          string `json:"ip"`
+	Port        string `json:"port"`
+	Metadata    string `json:"metadata"`
+	Ephemeral   string `json:"ephemeral"`
+}
+
+// decodeByNacosFormat decodes the Nacos register request body, which is form-encoded
+// by Nacos clients, or a JSON object of the same fields. The metadata is the labels.
+// NOTE: The ephemeral field is only validated, the instance record always lives with the sidecar.
+func (rcs *Server) decodeByNacosFormat(contentType string, body []byte) (*spec.ServiceInstanceSpec, error) {
+	reg := &nacosRegistration{}
+	if strings.HasPrefix(contentType, ContentTypeJSON) {
+		if err := rcs.unmarshalJSON(body, reg); err != nil {
+			return nil, fmt.Errorf("decode nacos body failed: %v", err)
+		}
+	} else {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, fmt.Errorf("decode nacos form body failed: %v", err)
+		}
+		reg.ServiceName = values.Get("serviceName")
+		reg.IP = values.Get("ip")
+		reg.Port = values.Get("port")
+		reg.Metadata = values.Get("metadata")
+		reg.Ephemeral = values.Get("ephemeral")
+	}
+
+	if reg.ServiceName == "" || reg.IP == "" || reg.Port == "" {
+		return nil, fmt.Errorf("invalid register parameters, ip: %s, port: %s, serviceName: %s",
+			reg.IP, reg.Port, reg.ServiceName)
+	}
+	port, err := strconv.ParseUint(reg.Port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid register port: %s", reg.Port)
+	}
+	if reg.Ephemeral != "" {
+		if _, err := strconv.ParseBool(reg.Ephemeral); err != nil {
+			return nil, fmt.Errorf("invalid register ephemeral: %s", reg.Ephemeral)
+		}
+	}
+
+	serviceName, err := rcs.SplitNacosServiceName(reg.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	var metadata map[string]string
+	if reg.Metadata != "" {
+		if err := codectool.UnmarshalJSON([]byte(reg.Metadata), &metadata); err != nil {
+			return nil, fmt.Errorf("decode nacos metadata %s failed: %v", reg.Metadata, err)
+		}
+	}
+
+	logger.Infof("decode nacos body SUCC contentType: %s body: %s", contentType, string(body))
+
+	ins := &spec.ServiceInstanceSpec{
+		ServiceName: serviceName,
+		IP:          reg.IP,
+		Port:        uint32(port),
+		Labels:      metadata,
+	}
+	ins.InstanceID = addressInstanceID(ins)
+
+	return ins, nil
+}
+
 // ToNacosInstanceInfo transforms service registry info to nacos' instance
 func (rcs *Server) ToNacosInstanceInfo(serviceInfo *ServiceRegistryInfo) *model.Instance {
 	var ins model.Instance
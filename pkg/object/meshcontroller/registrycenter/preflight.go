@@ -0,0 +1,44 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"fmt"
+
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+)
+
+// Preflight validates the settings of the server, and checks the storage is
+// reachable, so the misconfigurations fail fast at startup.
+func (rcs *Server) Preflight() error {
+	switch rcs.registryType {
+	case spec.RegistryTypeConsul, spec.RegistryTypeEureka, spec.RegistryTypeNacos:
+	default:
+		return fmt.Errorf("unsupported registry center type: %s", rcs.registryType)
+	}
+
+	if err := validateStatus(rcs.initialStatus()); err != nil {
+		return err
+	}
+
+	if err := rcs.service.Ping(); err != nil {
+		return fmt.Errorf("ping storage failed: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+)
+
+// prometheusMetaPrefix is the prefix of the labels exported to Prometheus,
+// which are available in relabeling and dropped afterwards.
+const prometheusMetaPrefix = "__meta_easegress_"
+
+// PrometheusTargetGroup is a target group of Prometheus file-based service discovery.
+type PrometheusTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// ExportPrometheusSD exports the UP instances of the registry in the
+// Prometheus file_sd format, one target group per instance.
+func (rcs *Server) ExportPrometheusSD() (data []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("export prometheus sd failed: %v", r)
+		}
+	}()
+
+	instances := rcs.service.ListAllServiceInstanceSpecs()
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Key() < instances[j].Key()
+	})
+
+	groups := []*PrometheusTargetGroup{}
+	for _, ins := range instances {
+		if ins.Status != spec.ServiceStatusUp {
+			continue
+		}
+
+		labels := map[string]string{
+			prometheusMetaPrefix + "service":     ins.ServiceName,
+			prometheusMetaPrefix + "instance_id": ins.InstanceID,
+		}
+		if ins.Group != "" {
+			labels[prometheusMetaPrefix+"group"] = ins.Group
+		}
+		for k, v := range ins.Labels {
+			labels[prometheusMetaPrefix+"label_"+sanitizeLabelKey(k)] = v
+		}
+
+		groups = append(groups, &PrometheusTargetGroup{
+			Targets: []string{net.JoinHostPort(ins.IP, strconv.Itoa(int(ins.Port)))},
+			Labels:  labels,
+		})
+	}
+
+	return json.Marshal(groups)
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+)
+
+// readinessError is the error of the registration attempt while
+// ingress or egress is not ready.
+type readinessError struct {
+	ingressOnly  bool
+	ingressReady bool
+	egressReady  bool
+}
+
+func (e *readinessError) Error() string {
+	if e.ingressOnly {
+		return fmt.Sprintf("ingress ready: %v", e.ingressReady)
+	}
+	return fmt.Sprintf("ingress ready: %v egress ready: %v", e.ingressReady, e.egressReady)
+}
+
+// readinessGrace checks the failed registration attempt against IngressReadyTimeout and
+// EgressReadyTimeout, elapsed is the time since the registration started. The attempts
+// failed only for the readiness within the grace periods are tolerated, which don't count
+// for MaxRegisterAttempts. Once a grace period is exceeded, the timeout error is returned.
+func (rcs *Server) readinessGrace(err error, elapsed time.Duration) (bool, error) {
+	re, ok := err.(*readinessError)
+	if !ok {
+		return false, nil
+	}
+
+	tolerated := true
+	check := func(name string, ready bool, timeout time.Duration) error {
+		if ready {
+			return nil
+		}
+		if timeout <= 0 {
+			tolerated = false
+			return nil
+		}
+		if elapsed > timeout {
+			return fmt.Errorf("%s not ready in %s", name, timeout)
+		}
+		return nil
+	}
+
+	if err := check("ingress", re.ingressReady, rcs.IngressReadyTimeout); err != nil {
+		return false, err
+	}
+	if !re.ingressOnly {
+		if err := check("egress", re.egressReady, rcs.EgressReadyTimeout); err != nil {
+			return false, err
+		}
+	}
+
+	return tolerated, nil
+}
+
+// readinessLogger logs the results of the registration attempts. The attempts failed for
+// the readiness are logged only once the readiness changes, instead of at every attempt
+// of every sidecar starting.
+type readinessLogger struct {
+	notReady string
+}
+
+// log logs the result of the attempt, and reports whether it's logged.
+func (l *readinessLogger) log(err error) bool {
+	if re, ok := err.(*readinessError); ok {
+		msg := re.Error()
+		if msg == l.notReady {
+			return false
+		}
+		l.notReady = msg
+		logger.Errorf("register failed: %s", msg)
+		return true
+	}
+
+	logged := false
+	if l.notReady != "" {
+		logger.Infof("ready to register, formerly %s", l.notReady)
+		l.notReady, logged = "", true
+	}
+	if err != nil {
+		logger.Errorf("register failed: %v", err)
+		logged = true
+	}
+	return logged
+}
@@ -19,10 +19,12 @@
 package registrycenter
 
 import (
+	"context"
 	"encoding/xml"
 	"fmt"
 	"net/http"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -30,15 +32,32 @@ import (
 	"github.com/ArthurHlt/go-eureka-client/eureka"
 	"github.com/go-chi/chi/v5"
 	consul "github.com/hashicorp/consul/api"
+	clientv3 "go.etcd.io/etcd/client/v3"
 
 	"github.com/megaease/easegress/v2/pkg/logger"
 	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/informer"
 	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/service"
 	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
-	"github.com/megaease/easegress/v2/pkg/util/codectool"
 	"github.com/megaease/easegress/v2/pkg/util/jmxtool"
 )
 
+const (
+	// UnknownServiceModeStrict rejects instances of unknown services.
+	UnknownServiceModeStrict = "strict"
+	// UnknownServiceModeLenient creates a default service for instances of unknown services.
+	UnknownServiceModeLenient = "lenient"
+)
+
+const (
+	// EmptyResultModeEmpty responds the empty discovery results as the empty listings.
+	EmptyResultModeEmpty = "empty"
+	// EmptyResultModeNoContent responds the empty discovery results with 204 No Content.
+	EmptyResultModeNoContent = "noContent"
+)
+
+// errRegisterStopped is returned by the registration attempt after deregistered.
+var errRegisterStopped = fmt.Errorf("register stopped")
+
 const (
 	// ContentTypeXML is xml content type
 	ContentTypeXML = "text/xml"
@@ -55,60 +74,713 @@ type (
 		service      *service.Service
 		informer     informer.Informer
 		jmxClient    *jmxtool.AgentClient
+		backoff      BackoffStrategy
+
+		// InitialStatus is the status of the instance once registered, UP by default.
+		// e.g. OUT_OF_SERVICE for pre-warming and flipping to UP later, or STARTING
+		// for being brought UP by the master once it passes health checks.
+		InitialStatus string
+
+		// AddressMode is AddressModeDev or AddressModeStrict, in strict mode
+		// addresses of RejectedAddressClasses can't be registered.
+		AddressMode string
+		// RejectedAddressClasses defaults to loopback and link-local addresses.
+		RejectedAddressClasses []string
+
+		// AbortBatchOnError makes RegisterBatch stop at the first failed instance,
+		// otherwise the remaining instances are still registered.
+		AbortBatchOnError bool
+
+		// StrictDecode makes DecodeRegistryBody reject the JSON bodies with unknown
+		// fields, which are dropped silently by default, e.g. for catching the version
+		// mismatches of the clients. The XML and form bodies are decoded as they are.
+		StrictDecode bool
+
+		// UnknownServiceMode is UnknownServiceModeStrict or UnknownServiceModeLenient,
+		// by default instances of unknown services are registered as they are.
+		UnknownServiceMode string
+
+		// EmptyResultModes maps the registry types to EmptyResultModeEmpty or
+		// EmptyResultModeNoContent, e.g. for the clients of a registry type expecting
+		// 204 if the service has no instances. It's EmptyResultModeEmpty by default.
+		EmptyResultModes map[string]string
+
+		// FallbackPort makes the registration keep the port of the instance given
+		// at construction if the service spec has no sidecar ingress port, otherwise
+		// the registration fails.
+		FallbackPort bool
+
+		// SingleShot makes Register attempt the registration exactly once
+		// instead of retrying it in the background, e.g. for short-lived processes.
+		SingleShot bool
+
+		// BackoffBase replaces the backoff strategy with the exponential backoff
+		// from it with jitter, up to BackoffMax, which defaults to DefaultBackoffMax.
+		// The interval is reset to BackoffBase once registered.
+		BackoffBase time.Duration
+		BackoffMax  time.Duration
+
+		// IngressReadyTimeout and EgressReadyTimeout are the grace periods of the
+		// readiness since the registration started, e.g. a longer one for egress
+		// connecting to many upstreams. The attempts failed only for the readiness
+		// within them don't count for MaxRegisterAttempts, and the registration
+		// gives up once any of them is exceeded. 0 means no grace period.
+		IngressReadyTimeout time.Duration
+		EgressReadyTimeout  time.Duration
+
+		// ReconcileInterval is the interval of registering the instance again while
+		// watching its record, defaults to DefaultReconcileInterval. The record is
+		// polled at the interval of the backoff instead if it can't be watched.
+		ReconcileInterval time.Duration
+
+		// MaxRegisterAttempts makes the registration give up after the number of
+		// consecutive failed attempts before registered, 0 means never giving up.
+		// The background registration reports it by FatalError.
+		MaxRegisterAttempts int
+
+		// MaxConsecutivePanics makes the background registration give up after
+		// the number of consecutive panics, 0 means never giving up.
+		MaxConsecutivePanics int
+
+		// Persistent makes instance records survive the process, e.g. for
+		// external services. Otherwise they are put with a lease of LeaseTTL,
+		// and expire if the process dies.
+		Persistent bool
+		// LeaseTTL defaults to DefaultLeaseTTL.
+		LeaseTTL time.Duration
+
+		// ConfirmWrites makes the instance spec read back after written,
+		// and written again if it doesn't match, against silent write failures.
+		ConfirmWrites bool
+
+		// IdentityKey is IdentityKeyInstanceID or IdentityKeyAddress, it decides
+		// whether a registration updates an existing instance or adds a new one.
+		IdentityKey string
+
+		// CollisionPolicy decides what to do when the instanceID is taken
+		// by another address, CollisionPolicyLastWriterWins by default.
+		CollisionPolicy string
+
+		// LabelKeyNormalization normalizes the label keys of registry clients.
+		LabelKeyNormalization LabelKeyNormalization
+
+		// Upstream enables federation, instances are read through it
+		// in addition to the local registry.
+		Upstream Resolver
+
+		// MaxInstances limits the total instances of the mesh registered through
+		// the server, 0 means unlimited. EvictionPolicy decides what to do at the limit.
+		MaxInstances   int
+		EvictionPolicy string
+		// EvictionStaleThreshold defaults to DefaultEvictionStaleThreshold.
+		EvictionStaleThreshold time.Duration
+
+		// DeregisterOnClose makes Close deregister the instance, so its record
+		// doesn't linger until the lease expires, or forever in Persistent mode.
+		DeregisterOnClose bool
+
+		// MaxDeregisterAttempts makes Deregister retry deleting the records with
+		// the backoff until the number of attempts, 0 means no retries.
+		// DeregisterTimeout bounds the retries, e.g. within the shutdown deadline,
+		// 0 means unbounded.
+		MaxDeregisterAttempts int
+		DeregisterTimeout     time.Duration
+
+		// HistoryRetention enables recording the deregistered instances into
+		// the history of their services, which is trimmed to the retention.
+		HistoryRetention time.Duration
 
 		serviceName        string
-		registered         bool
+		instances          []*spec.ServiceInstanceSpec
+		registered         map[*spec.ServiceInstanceSpec]bool
+		registeredC        chan bool
+		leaseID            clientv3.LeaseID
+		fatalErr           error
+		lastErr            error
+		closed             bool
+		expiryTimer        *time.Timer
+		ingressOnly        bool
+		leaderElection     bool
+		leader             bool
+		onRegistered       func()
+		onDeregistered     func()
 		done               chan struct{}
 		mutex              sync.RWMutex
 		accessableServices atomic.Value
+
+		// registerMutex serializes the registration attempts and
+		// the deregistration, stopRegister stops the attempts.
+		registerMutex sync.Mutex
+		stopRegister  chan struct{}
 	}
 
 	// ReadyFunc is a function to check Ingress/Egress ready to work
 	ReadyFunc func() bool
+
+	// panicError is the error of the recovered panic while registering.
+	panicError struct {
+		value interface{}
+	}
 )
 
+func (e *panicError) Error() string {
+	return fmt.Sprintf("%v", e.value)
+}
+
 // NewRegistryCenterServer creates an initialized registry center server.
+// The nil backoff means retrying the registration every DefaultRegisterInterval.
 func NewRegistryCenterServer(registryType string, instanceSpec *spec.ServiceInstanceSpec,
 	service *service.Service, informer informer.Informer, jmxAgent *jmxtool.AgentClient,
+	backoff BackoffStrategy,
 ) *Server {
+	if backoff == nil {
+		backoff = defaultBackoff()
+	}
+
 	return &Server{
 		registryType: registryType,
 		instanceSpec: instanceSpec,
 		service:      service,
 		informer:     informer,
 		jmxClient:    jmxAgent,
+		backoff:      backoff,
 
 		serviceName: instanceSpec.ServiceName,
 		done:        make(chan struct{}),
+		registeredC: make(chan bool, 1),
 	}
 }
 
-// Registered checks whether service registry or not.
+// NewRegistryCenterServerWithContext creates a registry center server like
+// NewRegistryCenterServer, which is closed once the context is done, e.g. for
+// aborting the registration with its retries at a deadline.
+func NewRegistryCenterServerWithContext(ctx context.Context, registryType string,
+	instanceSpec *spec.ServiceInstanceSpec, service *service.Service, informer informer.Informer,
+	jmxAgent *jmxtool.AgentClient, backoff BackoffStrategy,
+) *Server {
+	rcs := NewRegistryCenterServer(registryType, instanceSpec, service, informer, jmxAgent, backoff)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			logger.Infof("close registry center of %s/%s: %v", instanceSpec.ServiceName, instanceSpec.InstanceID, ctx.Err())
+			rcs.Close()
+		case <-rcs.done:
+		}
+	}()
+
+	return rcs
+}
+
+// Registered checks whether service registry or not,
+// which means all the instances are registered.
 func (rcs *Server) Registered() bool {
 	rcs.mutex.RLock()
 	defer rcs.mutex.RUnlock()
-	return rcs.registered
+	return rcs.allRegistered()
 }
 
-// Close closes the registry center.
+// allRegistered checks whether all the instances are registered,
+// the caller must hold the mutex.
+func (rcs *Server) allRegistered() bool {
+	if len(rcs.instances) == 0 {
+		return false
+	}
+
+	for _, ins := range rcs.instances {
+		if !rcs.registered[ins] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RegisteredC returns the channel receiving the new value of Registered once it changes.
+// The value is dropped if the former one is not received yet, so the receivers should
+// check Registered for the latest one. The channel is closed by Close.
+func (rcs *Server) RegisteredC() <-chan bool {
+	return rcs.registeredC
+}
+
+// FatalError returns the error which made the background registration give up.
+func (rcs *Server) FatalError() error {
+	rcs.mutex.RLock()
+	defer rcs.mutex.RUnlock()
+	return rcs.fatalErr
+}
+
+// RegisterError returns the error of the last registration attempt,
+// which is nil once an attempt succeeded.
+func (rcs *Server) RegisterError() error {
+	rcs.mutex.RLock()
+	defer rcs.mutex.RUnlock()
+	return rcs.lastErr
+}
+
+// giveUp stops the background registration with the fatal error.
+func (rcs *Server) giveUp(err error) {
+	rcs.mutex.Lock()
+	rcs.fatalErr = err
+	rcs.mutex.Unlock()
+	logger.Errorf("%v", err)
+}
+
+// Close closes the registry center, and deregisters the instance in DeregisterOnClose mode.
+// It's safe to call it more than once, the later calls are no-ops.
 func (rcs *Server) Close() {
+	rcs.mutex.Lock()
+	closed := rcs.closed
+	rcs.closed = true
+	rcs.mutex.Unlock()
+
+	if closed {
+		return
+	}
+
+	if rcs.DeregisterOnClose {
+		if err := rcs.Deregister(); err != nil {
+			logger.Errorf("deregister on close failed: %v", err)
+		}
+	}
+
+	rcs.mutex.Lock()
+	defer rcs.mutex.Unlock()
+	if rcs.expiryTimer != nil {
+		rcs.expiryTimer.Stop()
+	}
 	close(rcs.done)
+	close(rcs.registeredC)
 }
 
-// Register registers itself into mesh
-func (rcs *Server) Register(serviceSpec *spec.Service, ingressReady ReadyFunc, egressReady ReadyFunc) {
+// Register registers itself into mesh. It retries in the background until
+// succeeded, the returned error is only about the attempt in SingleShot mode.
+func (rcs *Server) Register(serviceSpec *spec.Service, ingressReady ReadyFunc, egressReady ReadyFunc) error {
 	if rcs.Registered() {
-		return
+		return nil
+	}
+
+	if err := rcs.fillInstanceSpec(serviceSpec); err != nil {
+		logger.Errorf("register failed: %v", err)
+		return err
+	}
+	if err := rcs.RegisterInstances([]*spec.ServiceInstanceSpec{rcs.instanceSpec}, ingressReady, egressReady); err != nil {
+		return err
 	}
 
-	rcs.instanceSpec.Port = uint32(serviceSpec.Sidecar.IngressPort)
+	rcs.watchLocalInfo()
 
-	go rcs.register(rcs.instanceSpec, ingressReady, egressReady)
+	return nil
+}
 
+// RegisterInstances registers the instances into mesh like Register, e.g. for several
+// logical ports behind one sidecar. Each instance is registered and retried on its own,
+// and the server is registered once all of them are. In SingleShot mode, the error of
+// the first failed instance is returned.
+func (rcs *Server) RegisterInstances(specs []*spec.ServiceInstanceSpec, ingressReady ReadyFunc, egressReady ReadyFunc) error {
+	if len(specs) == 0 {
+		return fmt.Errorf("no instances to register")
+	}
+
+	stop, err := rcs.prepareRegister(specs)
+	if err != nil {
+		return err
+	}
+
+	for _, ins := range specs {
+		if !rcs.SingleShot {
+			go rcs.register(stop, ins, ingressReady, egressReady)
+			continue
+		}
+
+		if err := rcs.registerAttempt(stop, ins, ingressReady, egressReady); err != nil {
+			logger.Errorf("register instance %s/%s failed: %v", ins.ServiceName, ins.InstanceID, err)
+			return err
+		}
+		logger.Infof("register instance spec %s/%s succeed", ins.ServiceName, ins.InstanceID)
+	}
+
+	return nil
+}
+
+// RegisterWithContext registers itself into mesh like Register, but blocks until the
+// registration succeeded, the context is done, or MaxRegisterAttempts consecutive
+// attempts failed, the last error is returned. It goes on registering in the
+// background once succeeded, e.g. for the health check reporting the registration.
+func (rcs *Server) RegisterWithContext(ctx context.Context, serviceSpec *spec.Service,
+	ingressReady ReadyFunc, egressReady ReadyFunc) error {
+	if rcs.Registered() {
+		return nil
+	}
+
+	if err := rcs.fillInstanceSpec(serviceSpec); err != nil {
+		logger.Errorf("register failed: %v", err)
+		return err
+	}
+	stop, err := rcs.prepareRegister([]*spec.ServiceInstanceSpec{rcs.instanceSpec})
+	if err != nil {
+		return err
+	}
+
+	var readiness readinessLogger
+	start, failures := time.Now(), 0
+	for attempt := 1; ; attempt++ {
+		err := rcs.registerAttempt(stop, rcs.instanceSpec, ingressReady, egressReady)
+		if err == errRegisterStopped {
+			return err
+		}
+		readiness.log(err)
+		if err == nil {
+			logger.Infof("register instance spec succeed")
+			break
+		}
+
+		tolerated, timeoutErr := rcs.readinessGrace(err, time.Since(start))
+		if timeoutErr != nil {
+			return fmt.Errorf("register gave up: %v", timeoutErr)
+		}
+		if !tolerated {
+			failures++
+		}
+		if rcs.MaxRegisterAttempts > 0 && failures >= rcs.MaxRegisterAttempts {
+			return fmt.Errorf("register gave up after %d attempts: %v", failures, err)
+		}
+
+		timer := time.NewTimer(rcs.backoffStrategy().Next(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("register canceled after %d attempts: %v, last error: %v", attempt, ctx.Err(), err)
+		case <-rcs.done:
+			timer.Stop()
+			return errRegisterStopped
+		case <-stop:
+			timer.Stop()
+			return errRegisterStopped
+		case <-timer.C:
+		}
+	}
+
+	go rcs.register(stop, rcs.instanceSpec, ingressReady, egressReady)
+	rcs.watchLocalInfo()
+
+	return nil
+}
+
+// fillInstanceSpec fills the instance with the service spec, it fails
+// rather than registering the instance without any port.
+func (rcs *Server) fillInstanceSpec(serviceSpec *spec.Service) error {
+	if serviceSpec == nil {
+		return fmt.Errorf("no service spec of %s", rcs.serviceName)
+	}
+
+	switch {
+	case serviceSpec.Sidecar != nil && serviceSpec.Sidecar.IngressPort > 0:
+		rcs.instanceSpec.Port = uint32(serviceSpec.Sidecar.IngressPort)
+	case rcs.FallbackPort && rcs.instanceSpec.Port > 0:
+		logger.Warnf("service %s has no sidecar ingress port, fallback to port %d",
+			serviceSpec.Name, rcs.instanceSpec.Port)
+	default:
+		return fmt.Errorf("service %s has no sidecar ingress port", serviceSpec.Name)
+	}
+
+	rcs.instanceSpec.Group = serviceSpec.Group
+	rcs.setIngressOnly(serviceSpec.IngressOnly)
+	return nil
+}
+
+// prepareRegister sets the instances to register,
+// and returns the channel stopping the registration attempts.
+func (rcs *Server) prepareRegister(specs []*spec.ServiceInstanceSpec) (chan struct{}, error) {
+	if err := validateStatus(rcs.initialStatus()); err != nil {
+		logger.Errorf("register failed: %v", err)
+		return nil, err
+	}
+
+	rcs.mutex.Lock()
+	rcs.instances = specs
+	rcs.registered = make(map[*spec.ServiceInstanceSpec]bool, len(specs))
+	rcs.mutex.Unlock()
+
+	stop := make(chan struct{})
+	rcs.registerMutex.Lock()
+	rcs.stopRegister = stop
+	rcs.registerMutex.Unlock()
+
+	return stop, nil
+}
+
+func (rcs *Server) watchLocalInfo() {
 	rcs.informer.OnPartOfServiceSpec(rcs.serviceName, rcs.onUpdateLocalInfo)
 	rcs.informer.OnAllTrafficTargetSpecs(rcs.onAllTrafficTargetSpecs)
 }
 
+// RegisterUntil registers itself into mesh like Register, and deregisters it
+// automatically at expiry, e.g. for workloads knowing their lifetime in advance.
+// A zero expiry means never expiring.
+func (rcs *Server) RegisterUntil(serviceSpec *spec.Service, ingressReady ReadyFunc, egressReady ReadyFunc, expiry time.Time) error {
+	if err := rcs.Register(serviceSpec, ingressReady, egressReady); err != nil {
+		return err
+	}
+
+	if expiry.IsZero() {
+		return nil
+	}
+
+	rcs.mutex.Lock()
+	defer rcs.mutex.Unlock()
+	if rcs.expiryTimer != nil {
+		rcs.expiryTimer.Stop()
+	}
+	rcs.expiryTimer = time.AfterFunc(time.Until(expiry), func() {
+		logger.Infof("instance %s/%s expired at %s, deregister it",
+			rcs.instanceSpec.ServiceName, rcs.instanceSpec.InstanceID, expiry.Format(time.RFC3339))
+		if err := rcs.Deregister(); err != nil {
+			logger.Errorf("deregister expired instance failed: %v", err)
+		}
+	})
+
+	return nil
+}
+
+// deleteInstanceSpecs deletes the records of the instances, the failed ones
+// are retried with the backoff for MaxDeregisterAttempts within DeregisterTimeout.
+func (rcs *Server) deleteInstanceSpecs(instances []*spec.ServiceInstanceSpec) error {
+	ctx := context.Background()
+	if rcs.DeregisterTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rcs.DeregisterTimeout)
+		defer cancel()
+	}
+
+	for attempt := 1; ; attempt++ {
+		var failed []*spec.ServiceInstanceSpec
+		var err error
+		for _, ins := range instances {
+			if e := rcs.deleteInstanceSpec(ins); e != nil {
+				failed, err = append(failed, ins), e
+			}
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+		if attempt >= rcs.MaxDeregisterAttempts {
+			return fmt.Errorf("deregister gave up after %d attempts: %v", attempt, err)
+		}
+
+		logger.Warnf("deregister %d instances failed at attempt %d: %v", len(failed), attempt, err)
+		instances = failed
+
+		timer := time.NewTimer(rcs.backoffStrategy().Next(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("deregister canceled after %d attempts: %v, last error: %v", attempt, ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+}
+
+func (rcs *Server) deleteInstanceSpec(ins *spec.ServiceInstanceSpec) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("delete %s failed: %v", ins.Key(), r)
+		}
+	}()
+
+	rcs.service.DeleteServiceInstanceSpec(ins.ServiceName, ins.InstanceID)
+	return nil
+}
+
+// Deregister stops registering itself and deletes the records of its registered instances,
+// the scheduled deregistration of RegisterUntil is canceled, the
+// leadership of RegisterLeader is given up, and then the hook of
+// OnDeregistered is called. Only the retries are stopped if not registered yet.
+func (rcs *Server) Deregister() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("deregister failed: %v", r)
+		}
+	}()
+
+	rcs.registerMutex.Lock()
+	defer rcs.registerMutex.Unlock()
+
+	if rcs.stopRegister != nil {
+		close(rcs.stopRegister)
+		rcs.stopRegister = nil
+	}
+
+	rcs.mutex.Lock()
+	if rcs.expiryTimer != nil {
+		rcs.expiryTimer.Stop()
+		rcs.expiryTimer = nil
+	}
+	var registered []*spec.ServiceInstanceSpec
+	for _, ins := range rcs.instances {
+		if rcs.registered[ins] {
+			registered = append(registered, ins)
+		}
+	}
+	rcs.mutex.Unlock()
+
+	if len(registered) == 0 {
+		return nil
+	}
+
+	// NOTE: It's deregistered even if deleting the records fails.
+	defer rcs.resetRegistered()
+
+	if err := rcs.deleteInstanceSpecs(registered); err != nil {
+		return err
+	}
+	rcs.resign()
+	now := time.Now()
+	for _, ins := range registered {
+		rcs.recordHistory(ins, now)
+	}
+
+	return nil
+}
+
+// RegisterBatch registers several instances at once, e.g. for a node-level agent
+// managing several local applications. The readiness is checked only once, and
+// the failed instances are reported in the returned error.
+func (rcs *Server) RegisterBatch(specs []*spec.ServiceInstanceSpec, ingressReady ReadyFunc, egressReady ReadyFunc) error {
+	inReady, eReady := ingressReady(), egressReady()
+	if !inReady || !eReady {
+		return fmt.Errorf("ingress ready: %v egress ready: %v", inReady, eReady)
+	}
+
+	var failures []string
+	for _, ins := range specs {
+		err := rcs.registerOne(ins)
+		if err == nil {
+			continue
+		}
+
+		if rcs.AbortBatchOnError {
+			return fmt.Errorf("register instance %s/%s failed: %v", ins.ServiceName, ins.InstanceID, err)
+		}
+		failures = append(failures, fmt.Sprintf("%s/%s: %v", ins.ServiceName, ins.InstanceID, err))
+	}
+
+	if len(failures) != 0 {
+		return fmt.Errorf("register %d of %d instances failed: %s",
+			len(failures), len(specs), strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+func (rcs *Server) registerOne(ins *spec.ServiceInstanceSpec) (err error) {
+	defer func() {
+		if err1 := recover(); err1 != nil {
+			err = fmt.Errorf("%v", err1)
+		}
+	}()
+
+	if err = validateInstanceSpec(ins); err != nil {
+		return err
+	}
+	if rcs.identityKey() == IdentityKeyAddress {
+		rcs.resolveIdentity(ins)
+	}
+	if err = rcs.resolveCollision(ins); err != nil {
+		return err
+	}
+	if err = rcs.checkAddress(ins.IP); err != nil {
+		return err
+	}
+	if err = validateStatus(rcs.initialStatus()); err != nil {
+		return err
+	}
+	if err = rcs.checkService(ins.ServiceName); err != nil {
+		return err
+	}
+	if err = rcs.checkCapacity(ins); err != nil {
+		return err
+	}
+
+	ins.Status = rcs.initialStatus()
+	rcs.holdStatus(ins)
+	ins.RegistryTime = time.Now().Format(time.RFC3339)
+
+	return rcs.putInstanceSpec(ins)
+}
+
+func validateInstanceSpec(ins *spec.ServiceInstanceSpec) error {
+	if ins == nil {
+		return fmt.Errorf("nil instance spec")
+	}
+
+	if ins.ServiceName == "" || ins.InstanceID == "" || ins.IP == "" || ins.Port == 0 {
+		return fmt.Errorf("invalid instance spec, serviceName: %s, instanceID: %s, ip: %s, port: %d",
+			ins.ServiceName, ins.InstanceID, ins.IP, ins.Port)
+	}
+
+	return nil
+}
+
+// EmptyResultMode returns the mode responding the empty discovery results of the registry type.
+func (rcs *Server) EmptyResultMode(registryType string) string {
+	if rcs.EmptyResultModes[registryType] == EmptyResultModeNoContent {
+		return EmptyResultModeNoContent
+	}
+	return EmptyResultModeEmpty
+}
+
+// checkService handles the unknown service according to UnknownServiceMode.
+func (rcs *Server) checkService(serviceName string) error {
+	if rcs.UnknownServiceMode != UnknownServiceModeStrict &&
+		rcs.UnknownServiceMode != UnknownServiceModeLenient {
+		return nil
+	}
+
+	if rcs.service.GetServiceSpec(serviceName) != nil {
+		return nil
+	}
+
+	if rcs.UnknownServiceMode == UnknownServiceModeStrict {
+		return fmt.Errorf("registry to unknown service %s: %v", serviceName, spec.ErrServiceNotFound)
+	}
+
+	// NOTE: The sidecar of the default service needs to be completed by the operator.
+	logger.Warnf("create default service %s in tenant %s for unknown service", serviceName, spec.GlobalTenant)
+	rcs.service.PutServiceSpec(&spec.Service{
+		Name:           serviceName,
+		RegisterTenant: spec.GlobalTenant,
+		Sidecar:        &spec.Sidecar{},
+	})
+
+	return nil
+}
+
+func (rcs *Server) initialStatus() string {
+	if rcs.InitialStatus == "" {
+		return spec.ServiceStatusUp
+	}
+	return rcs.InitialStatus
+}
+
+// holdStatus holds the OUT_OF_SERVICE status of the instance registered for pre-warm,
+// so the master doesn't bring it up once its heartbeats arrive.
+func (rcs *Server) holdStatus(ins *spec.ServiceInstanceSpec) {
+	ins.StatusHold = ""
+	if ins.Status == spec.ServiceStatusOutOfService && rcs.initialStatus() == spec.ServiceStatusOutOfService {
+		ins.StatusHold = spec.StatusHoldPreWarm
+	}
+}
+
+func validateStatus(status string) error {
+	switch status {
+	case spec.ServiceStatusUp, spec.ServiceStatusOutOfService, spec.ServiceStatusStarting:
+		return nil
+	default:
+		return fmt.Errorf("invalid instance status: %s", status)
+	}
+}
+
 func (rcs *Server) updateAgentType() {
 	if rcs.instanceSpec.AgentType == "" {
 		rcs.instanceSpec.AgentType = "None"
@@ -152,97 +824,233 @@ func (rcs *Server) onUpdateLocalInfo(event informer.Event, serviceSpec *spec.Ser
 	case informer.EventDelete:
 		return false
 	case informer.EventUpdate:
+		rcs.setIngressOnly(serviceSpec.IngressOnly)
 	}
 
 	return true
 }
 
+func (rcs *Server) setIngressOnly(ingressOnly bool) {
+	rcs.mutex.Lock()
+	defer rcs.mutex.Unlock()
+	rcs.ingressOnly = ingressOnly
+}
+
+// checkReady checks both the ingress and egress are ready,
+// or only the ingress for the IngressOnly service.
+func (rcs *Server) checkReady(ingressReady ReadyFunc, egressReady ReadyFunc) error {
+	rcs.mutex.RLock()
+	ingressOnly := rcs.ingressOnly
+	rcs.mutex.RUnlock()
+
+	inReady := ingressReady()
+	if ingressOnly {
+		if !inReady {
+			return &readinessError{ingressOnly: true, ingressReady: inReady}
+		}
+		return nil
+	}
+
+	eReady := egressReady()
+	if !inReady || !eReady {
+		return &readinessError{ingressReady: inReady, egressReady: eReady}
+	}
+
+	return nil
+}
+
 func needUpdateRecord(originIns, ins *spec.ServiceInstanceSpec) bool {
-	if originIns == nil {
+	if originIns == nil || originIns.Status == spec.ServiceStatusDeleted {
 		return true
 	}
 
-	if originIns.IP != ins.IP || originIns.Port != ins.Port {
+	if originIns.IP != ins.IP || originIns.Port != ins.Port || originIns.Group != ins.Group {
 		return true
 	}
 
 	return false
 }
 
-func (rcs *Server) register(ins *spec.ServiceInstanceSpec, ingressReady ReadyFunc, egressReady ReadyFunc) {
-	routine := func() (err error) {
-		defer func() {
-			if err1 := recover(); err1 != nil {
-				logger.Errorf("registry center recover from: %v, stack trace:\n%s\n",
-					err, debug.Stack())
-				err = fmt.Errorf("%v", err1)
-			}
-		}()
+func (rcs *Server) registerRoutine(ins *spec.ServiceInstanceSpec, ingressReady ReadyFunc, egressReady ReadyFunc) (err error) {
+	defer func() {
+		if err1 := recover(); err1 != nil {
+			logger.Errorf("registry center recover from: %v, stack trace:\n%s\n",
+				err1, debug.Stack())
+			err = &panicError{value: err1}
+		}
+	}()
 
-		rcs.updateAgentType()
+	rcs.updateAgentType()
 
-		inReady, eReady := ingressReady(), egressReady()
-		if !inReady || !eReady {
-			return fmt.Errorf("ingress ready: %v egress ready: %v", inReady, eReady)
-		}
+	if err := rcs.checkReady(ingressReady, egressReady); err != nil {
+		return err
+	}
 
-		if originIns := rcs.service.GetServiceInstanceSpec(rcs.instanceSpec.ServiceName,
-			rcs.instanceSpec.InstanceID); originIns != nil {
-			if !needUpdateRecord(originIns, ins) {
-				rcs.mutex.Lock()
-				rcs.registered = true
-				rcs.mutex.Unlock()
-				return nil
-			}
+	// NOTE: The address is checked before the record is found unchanged, so the
+	// one registered before the check or under a looser mode is rejected as well.
+	if err := rcs.checkAddress(ins.IP); err != nil {
+		return err
+	}
+	if err := rcs.resolveCollision(ins); err != nil {
+		return err
+	}
+	if originIns := rcs.resolveIdentity(ins); originIns != nil {
+		if !needUpdateRecord(originIns, ins) {
+			rcs.setRegistered(ins, true)
+			return nil
 		}
+	}
 
-		ins.Status = spec.ServiceStatusUp
-		ins.RegistryTime = time.Now().Format(time.RFC3339)
-		rcs.service.PutServiceInstanceSpec(ins)
+	if err := rcs.checkCapacity(ins); err != nil {
+		return err
+	}
 
-		rcs.mutex.Lock()
-		rcs.registered = true
-		rcs.mutex.Unlock()
+	ins.Status = rcs.registerStatus()
+	rcs.holdStatus(ins)
+	ins.RegistryTime = time.Now().Format(time.RFC3339)
+	if err := rcs.putInstanceSpec(ins); err != nil {
+		return err
+	}
 
-		return nil
+	rcs.setRegistered(ins, true)
+
+	return nil
+}
+
+// registerAttempt runs one registration attempt unless it's stopped.
+func (rcs *Server) registerAttempt(stop chan struct{}, ins *spec.ServiceInstanceSpec,
+	ingressReady ReadyFunc, egressReady ReadyFunc) error {
+	rcs.registerMutex.Lock()
+	defer rcs.registerMutex.Unlock()
+
+	select {
+	case <-stop:
+		return errRegisterStopped
+	default:
 	}
 
-	var firstSucceed bool
-	ticker := time.NewTicker(5 * time.Second)
+	err := rcs.registerRoutine(ins, ingressReady, egressReady)
+	rcs.mutex.Lock()
+	rcs.lastErr = err
+	rcs.mutex.Unlock()
+
+	return err
+}
+
+// register registers the instance until succeeded, then watches its record and registers
+// it again only if the watched record diverges, or at every ReconcileInterval.
+func (rcs *Server) register(stop chan struct{}, ins *spec.ServiceInstanceSpec, ingressReady ReadyFunc, egressReady ReadyFunc) {
+	var (
+		firstSucceed bool
+		watch        *instanceWatch
+		tryWatch     = true
+	)
+	defer func() {
+		watch.close()
+	}()
+
+	var readiness readinessLogger
+	start := time.Now()
+	attempt, failures, panics := 0, 0, 0
 	for {
-		err := routine()
+		err := rcs.registerAttempt(stop, ins, ingressReady, egressReady)
+		if err == errRegisterStopped {
+			return
+		}
+		readiness.log(err)
 		if err != nil {
-			logger.Errorf("register failed: %v", err)
-		} else if !firstSucceed {
-			logger.Infof("register instance spec succeed")
-			firstSucceed = true
+			attempt++
+
+			// NOTE: The grace periods of the readiness and MaxRegisterAttempts
+			// only apply before registered.
+			if !firstSucceed {
+				tolerated, timeoutErr := rcs.readinessGrace(err, time.Since(start))
+				if timeoutErr != nil {
+					rcs.giveUp(fmt.Errorf("register gave up: %v", timeoutErr))
+					return
+				}
+				if !tolerated {
+					failures++
+				}
+				if rcs.MaxRegisterAttempts > 0 && failures >= rcs.MaxRegisterAttempts {
+					rcs.giveUp(fmt.Errorf("register gave up after %d attempts: %v", failures, err))
+					return
+				}
+			}
+
+			if _, ok := err.(*panicError); ok {
+				panics++
+			} else {
+				panics = 0
+			}
+			if rcs.MaxConsecutivePanics > 0 && panics >= rcs.MaxConsecutivePanics {
+				rcs.giveUp(fmt.Errorf("register gave up after %d consecutive panics: %v", panics, err))
+				return
+			}
+		} else {
+			panics = 0
+			if !firstSucceed {
+				logger.Infof("register instance spec succeed")
+				firstSucceed = true
+			}
+			attempt = 0
+
+			if tryWatch {
+				watch = rcs.watchInstance(watch, ins)
+				tryWatch = watch != nil
+			}
 		}
 
-		select {
-		case <-rcs.done:
-			ticker.Stop()
-			return
-		case <-ticker.C:
+		interval := rcs.backoffStrategy().Next(attempt)
+		var events <-chan *spec.ServiceInstanceSpec
+		if attempt == 0 && watch != nil {
+			interval, events = rcs.reconcileInterval(), watch.ch
+		}
+
+		timer := time.NewTimer(interval)
+	wait:
+		for {
+			select {
+			case <-rcs.done:
+				timer.Stop()
+				return
+			case <-stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+				break wait
+			case watched, ok := <-events:
+				if ok && !needUpdateRecord(watched, ins) {
+					continue
+				}
+				if !ok {
+					// NOTE: The watch is opened again after the next registration.
+					watch.close()
+					watch, tryWatch = nil, true
+				}
+				timer.Stop()
+				break wait
+			}
 		}
 	}
 }
 
-func (rcs *Server) decodeByConsulFormat(body []byte) error {
+func (rcs *Server) decodeByConsulFormat(body []byte) (*spec.ServiceInstanceSpec, error) {
 	var (
 		err error
 		reg consul.AgentServiceRegistration
 	)
 
-	err = codectool.UnmarshalJSON(body, &reg)
+	err = rcs.unmarshalJSON(body, &reg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	logger.Infof("decode consul body SUCC body: %s", string(body))
-	return err
+	return consulToInstanceSpec(&reg), err
 }
 
-func (rcs *Server) decodeByEurekaFormat(contentType string, body []byte) error {
+func (rcs *Server) decodeByEurekaFormat(contentType string, body []byte) (*spec.ServiceInstanceSpec, error) {
 	var (
 		err       error
 		eurekaIns eureka.InstanceInfo
@@ -250,37 +1058,74 @@ func (rcs *Server) decodeByEurekaFormat(contentType string, body []byte) error {
 
 	switch contentType {
 	case ContentTypeJSON:
-		if err = codectool.UnmarshalJSON(body, &eurekaIns); err != nil {
+		if err = rcs.unmarshalJSON(body, &eurekaIns); err != nil {
 			logger.Errorf("decode eureka contentType: %s body: %s failed: %v", contentType, string(body), err)
-			return err
+			return nil, err
 		}
 	default:
 		if err = xml.Unmarshal(body, &eurekaIns); err != nil {
 			logger.Errorf("decode eureka contentType: %s body: %s failed: %v", contentType, string(body), err)
-			return err
+			return nil, err
 		}
 	}
 	logger.Infof("decode eureka body SUCC contentType: %s body: %s", contentType, string(body))
 
-	return err
+	return eurekaToInstanceSpec(&eurekaIns), err
 }
 
-// CheckRegistryBody tries to decode Eureka/Consul register request body according to the
-// registry type.
-func (rcs *Server) CheckRegistryBody(contentType string, reqBody []byte) error {
-	var err error
+// DecodeRegistryBody decodes the Eureka/Consul/Nacos/Zookeeper register request body according
+// to the registry type into the instance declared by the client, with its address and labels.
+// It doesn't touch the instance of the server, the callers decide whether to register it.
+func (rcs *Server) DecodeRegistryBody(contentType string, reqBody []byte) (*spec.ServiceInstanceSpec, error) {
+	var (
+		err error
+		ins *spec.ServiceInstanceSpec
+	)
 
 	switch rcs.registryType {
 	case spec.RegistryTypeEureka:
-		err = rcs.decodeByEurekaFormat(contentType, reqBody)
+		ins, err = rcs.decodeByEurekaFormat(contentType, reqBody)
 	case spec.RegistryTypeConsul:
-		err = rcs.decodeByConsulFormat(reqBody)
+		ins, err = rcs.decodeByConsulFormat(reqBody)
+	case spec.RegistryTypeNacos:
+		ins, err = rcs.decodeByNacosFormat(contentType, reqBody)
+	case spec.RegistryTypeZookeeper:
+		ins, err = rcs.decodeByZookeeperFormat(reqBody)
 	default:
-		return fmt.Errorf("BUG: can't recognize registry type: %s req body: %s",
+		return nil, fmt.Errorf("BUG: can't recognize registry type: %s req body: %s",
 			rcs.registryType, (reqBody))
 	}
 
-	return err
+	if err != nil {
+		return nil, err
+	}
+
+	ins.Labels = rcs.clientLabels(ins.Labels)
+	ins.RegistryType = rcs.registryType
+
+	return ins, nil
+}
+
+// CheckRegistryBody tries to decode Eureka/Consul/Nacos/Zookeeper register request body according to the
+// registry type. The metadata of the body is merged into the instance labels, except the
+// ones under ReservedLabelPrefix.
+func (rcs *Server) CheckRegistryBody(contentType string, reqBody []byte) error {
+	ins, err := rcs.DecodeRegistryBody(contentType, reqBody)
+	if err != nil {
+		return err
+	}
+
+	switch rcs.registryType {
+	case spec.RegistryTypeNacos, spec.RegistryTypeZookeeper:
+		if ins.ServiceName != rcs.serviceName {
+			return fmt.Errorf("registry to unknown service %s, want: %s", ins.ServiceName, rcs.serviceName)
+		}
+	}
+
+	rcs.mergeClientLabels(ins.Labels)
+	rcs.instanceSpec.RegistryType = rcs.registryType
+
+	return nil
 }
 
 // CheckRegistryURL tries to decode Nacos register request URL parameters.
@@ -300,5 +1145,7 @@ func (rcs *Server) CheckRegistryURL(w http.ResponseWriter, r *http.Request) erro
 	if serviceName != rcs.instanceSpec.ServiceName || err != nil {
 		return fmt.Errorf("invalid register serviceName: %s want: %s, err: %v", serviceName, rcs.serviceName, err)
 	}
+
+	rcs.instanceSpec.RegistryType = rcs.registryType
 	return err
 }
@@ -0,0 +1,2274 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/megaease/easegress/v2/pkg/cluster"
+	"github.com/megaease/easegress/v2/pkg/cluster/clustertest"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/informer"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/service"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/storage"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+// nopInformer is an informer ignoring all subscriptions.
+type nopInformer struct {
+	informer.Informer
+}
+
+func (inf *nopInformer) OnPartOfServiceSpec(serviceName string, fn informer.ServiceSpecFunc) error {
+	return nil
+}
+
+func (inf *nopInformer) OnAllTrafficTargetSpecs(fn informer.TrafficTargetSpecsFunc) error {
+	return nil
+}
+
+func ready() bool    { return true }
+func notReady() bool { return false }
+
+func newTestServer(registryType string) (*Server, *service.Service) {
+	return newTestServerOnCluster(registryType, clustertest.NewMemCluster())
+}
+
+func newTestServerOnCluster(registryType string, mc *clustertest.MemCluster) (*Server, *service.Service) {
+	svc := service.NewWithStorage(storage.New("test", mc))
+	ins := &spec.ServiceInstanceSpec{
+		AgentType:   "EaseAgent",
+		ServiceName: "order",
+		InstanceID:  "order-01",
+		IP:          "10.0.0.1",
+	}
+	return NewRegistryCenterServer(registryType, ins, svc, &nopInformer{}, nil, nil), svc
+}
+
+func TestRegisterBatch(t *testing.T) {
+	rcs, svc := newTestServer(spec.RegistryTypeEureka)
+
+	specs := []*spec.ServiceInstanceSpec{
+		{ServiceName: "order", InstanceID: "order-01", IP: "10.0.0.1", Port: 8080},
+		{ServiceName: "delivery", InstanceID: "delivery-01", IP: "10.0.0.1", Port: 8081},
+		{ServiceName: "payment", InstanceID: "payment-01", IP: "10.0.0.1", Port: 8082},
+	}
+	if err := rcs.RegisterBatch(specs, ready, ready); err != nil {
+		t.Fatalf("register batch failed: %v", err)
+	}
+
+	for _, ins := range specs {
+		got := svc.GetServiceInstanceSpec(ins.ServiceName, ins.InstanceID)
+		if got == nil || got.Status != spec.ServiceStatusUp {
+			t.Fatalf("instance %s/%s not registered", ins.ServiceName, ins.InstanceID)
+		}
+	}
+
+	if err := rcs.RegisterBatch(specs, ready, notReady); err == nil {
+		t.Fatalf("want error when egress is not ready")
+	}
+
+	specs = []*spec.ServiceInstanceSpec{
+		{ServiceName: "user", InstanceID: "user-01", IP: "10.0.0.1"},
+		{ServiceName: "user", InstanceID: "user-02", IP: "10.0.0.1", Port: 8083},
+	}
+	if err := rcs.RegisterBatch(specs, ready, ready); err == nil {
+		t.Fatalf("want error for invalid instance")
+	}
+	if svc.GetServiceInstanceSpec("user", "user-02") == nil {
+		t.Fatalf("valid instance should be registered despite the failed one")
+	}
+
+	rcs.AbortBatchOnError = true
+	specs[1].InstanceID = "user-03"
+	if err := rcs.RegisterBatch(specs, ready, ready); err == nil {
+		t.Fatalf("want error for invalid instance")
+	}
+	if svc.GetServiceInstanceSpec("user", "user-03") != nil {
+		t.Fatalf("instance after the failed one should not be registered")
+	}
+}
+
+func testServiceSpec() *spec.Service {
+	return &spec.Service{
+		Name:           "order",
+		RegisterTenant: "shop",
+		Sidecar: &spec.Sidecar{
+			Address:     "127.0.0.1",
+			IngressPort: 13001,
+			EgressPort:  13002,
+		},
+	}
+}
+
+func waitRegistered(t *testing.T, rcs *Server) {
+	for i := 0; i < 100; i++ {
+		if rcs.Registered() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("instance not registered in time")
+}
+
+func TestRegisterServiceSpecValidation(t *testing.T) {
+	rcs, _ := newTestServer(spec.RegistryTypeEureka)
+	defer rcs.Close()
+	if err := rcs.Register(nil, ready, ready); err == nil {
+		t.Fatalf("want error for nil service spec")
+	}
+
+	serviceSpec := testServiceSpec()
+	serviceSpec.Sidecar = nil
+	if err := rcs.Register(serviceSpec, ready, ready); err == nil {
+		t.Fatalf("want error for service spec without sidecar")
+	}
+	if rcs.instanceSpec.Port != 0 {
+		t.Fatalf("want no port filled, got %d", rcs.instanceSpec.Port)
+	}
+
+	rcs.FallbackPort = true
+	if err := rcs.Register(serviceSpec, ready, ready); err == nil {
+		t.Fatalf("want error for no port to fall back to")
+	}
+
+	rcs.instanceSpec.Port = 8080
+	rcs.SingleShot = true
+	if err := rcs.Register(serviceSpec, ready, ready); err != nil {
+		t.Fatalf("register with fallback port failed: %v", err)
+	}
+	if rcs.instanceSpec.Port != 8080 {
+		t.Fatalf("want fallback port 8080, got %d", rcs.instanceSpec.Port)
+	}
+
+	rcs, svc := newTestServer(spec.RegistryTypeEureka)
+	defer rcs.Close()
+	rcs.SingleShot = true
+	if err := rcs.Register(testServiceSpec(), ready, ready); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	ins := svc.GetServiceInstanceSpec("order", "order-01")
+	if ins == nil || ins.Port != 13001 {
+		t.Fatalf("want instance registered with sidecar port 13001, got %+v", ins)
+	}
+}
+
+func TestRegisterInitialStatus(t *testing.T) {
+	rcs, svc := newTestServer(spec.RegistryTypeEureka)
+	rcs.InitialStatus = spec.ServiceStatusOutOfService
+	rcs.Register(testServiceSpec(), ready, ready)
+	defer rcs.Close()
+	waitRegistered(t, rcs)
+
+	ins := svc.GetServiceInstanceSpec("order", "order-01")
+	if ins == nil || ins.Status != spec.ServiceStatusOutOfService {
+		t.Fatalf("want instance registered as %s, got %#v", spec.ServiceStatusOutOfService, ins)
+	}
+	if ins.StatusHold != spec.StatusHoldPreWarm {
+		t.Fatalf("want status held for %s, got %q", spec.StatusHoldPreWarm, ins.StatusHold)
+	}
+	if len(svc.ListActiveServiceInstanceSpecs("order")) != 0 {
+		t.Fatalf("out of service instance should not be active")
+	}
+
+	ins.Status = spec.ServiceStatusUp
+	svc.PutServiceInstanceSpec(ins)
+	if len(svc.ListActiveServiceInstanceSpecs("order")) != 1 {
+		t.Fatalf("flipped instance should be active")
+	}
+
+	rcs, _ = newTestServer(spec.RegistryTypeEureka)
+	rcs.InitialStatus = "UNKNOWN"
+	rcs.Register(testServiceSpec(), ready, ready)
+	time.Sleep(50 * time.Millisecond)
+	if rcs.Registered() {
+		t.Fatalf("invalid initial status should be rejected")
+	}
+}
+
+func TestCheckAddress(t *testing.T) {
+	rcs, _ := newTestServer(spec.RegistryTypeEureka)
+
+	for _, ip := range []string{"127.0.0.1", "169.254.0.1", "10.0.0.1", "::1"} {
+		if err := rcs.checkAddress(ip); err != nil {
+			t.Fatalf("%s should be accepted in dev mode: %v", ip, err)
+		}
+	}
+
+	rcs.AddressMode = AddressModeStrict
+	for _, ip := range []string{"127.0.0.1", "169.254.0.1", "::1", "localhost"} {
+		if err := rcs.checkAddress(ip); err == nil {
+			t.Fatalf("%s should be rejected in strict mode", ip)
+		}
+	}
+	if err := rcs.checkAddress("10.0.0.1"); err != nil {
+		t.Fatalf("private address should be accepted by default: %v", err)
+	}
+
+	rcs.RejectedAddressClasses = []string{AddressClassPrivate}
+	if err := rcs.checkAddress("10.0.0.1"); err == nil {
+		t.Fatalf("private address should be rejected")
+	}
+	if err := rcs.checkAddress("8.8.8.8"); err != nil {
+		t.Fatalf("public address should be accepted: %v", err)
+	}
+
+	specs := []*spec.ServiceInstanceSpec{
+		{ServiceName: "order", InstanceID: "order-02", IP: "127.0.0.1", Port: 8080},
+	}
+	rcs.RejectedAddressClasses = nil
+	if err := rcs.RegisterBatch(specs, ready, ready); err == nil {
+		t.Fatalf("loopback address should be rejected in strict mode")
+	}
+	rcs.AddressMode = AddressModeDev
+	if err := rcs.RegisterBatch(specs, ready, ready); err != nil {
+		t.Fatalf("loopback address should be accepted in dev mode: %v", err)
+	}
+
+	// The unchanged record accepted under the looser mode is checked again.
+	rcs.instanceSpec.IP = "127.0.0.1"
+	rcs.SingleShot = true
+	if err := rcs.Register(testServiceSpec(), ready, ready); err != nil || !rcs.Registered() {
+		t.Fatalf("register in dev mode failed: %v", err)
+	}
+	rcs.AddressMode = AddressModeStrict
+	if err := rcs.registerRoutine(rcs.instanceSpec, ready, ready); err == nil {
+		t.Fatalf("loopback address should be rejected at re-registration in strict mode")
+	}
+}
+
+func TestRegisterSingleShot(t *testing.T) {
+	rcs, svc := newTestServer(spec.RegistryTypeEureka)
+	rcs.SingleShot = true
+
+	var attempts int32
+	countedNotReady := func() bool {
+		atomic.AddInt32(&attempts, 1)
+		return false
+	}
+
+	goroutines := runtime.NumGoroutine()
+	if err := rcs.Register(testServiceSpec(), countedNotReady, ready); err == nil {
+		t.Fatalf("want error when ingress is not ready")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Fatalf("want 1 attempt, got %d", n)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Fatalf("want no lingering goroutine, got %d more", n-goroutines)
+	}
+	if rcs.Registered() {
+		t.Fatalf("instance should not be registered")
+	}
+
+	if err := rcs.Register(testServiceSpec(), ready, ready); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if !rcs.Registered() || svc.GetServiceInstanceSpec("order", "order-01") == nil {
+		t.Fatalf("instance should be registered")
+	}
+}
+
+func TestClientLabels(t *testing.T) {
+	rcs, _ := newTestServer(spec.RegistryTypeConsul)
+	rcs.instanceSpec.Labels = map[string]string{"version": "v1"}
+	rcs.SetSystemLabel("zone", "zone-a")
+
+	body := []byte(`{"Name": "order", "Meta": {"mesh.zone": "spoofed", "mesh.foo": "bar", "version": "v2", "team": "shop"}}`)
+	if err := rcs.CheckRegistryBody(ContentTypeJSON, body); err != nil {
+		t.Fatalf("check registry body failed: %v", err)
+	}
+
+	labels := rcs.instanceSpec.Labels
+	if _, ok := labels["mesh.foo"]; ok {
+		t.Fatalf("reserved client label should be dropped")
+	}
+	if labels["mesh.zone"] != "zone-a" {
+		t.Fatalf("want system label zone-a, got %s", labels["mesh.zone"])
+	}
+	if labels["team"] != "shop" {
+		t.Fatalf("user label should survive")
+	}
+	if labels["version"] != "v1" {
+		t.Fatalf("existing label should be kept, got %s", labels["version"])
+	}
+
+	rcs, _ = newTestServer(spec.RegistryTypeEureka)
+	body = []byte(`<instance><app>order</app><metadata><mesh.foo>bar</mesh.foo><team>shop</team></metadata></instance>`)
+	if err := rcs.CheckRegistryBody(ContentTypeXML, body); err != nil {
+		t.Fatalf("check registry body failed: %v", err)
+	}
+	labels = rcs.instanceSpec.Labels
+	if _, ok := labels["mesh.foo"]; ok || labels["team"] != "shop" {
+		t.Fatalf("unexpected labels: %v", labels)
+	}
+}
+
+func TestRegisterWithLease(t *testing.T) {
+	rcs, svc := newTestServer(spec.RegistryTypeEureka)
+	serviceSpec := testServiceSpec()
+	serviceSpec.Group = "east"
+	rcs.Register(serviceSpec, ready, ready)
+	defer rcs.Close()
+	waitRegistered(t, rcs)
+
+	if ins := svc.GetServiceInstanceSpec("order", "order-01"); ins == nil || ins.Group != "east" {
+		t.Fatalf("instance should be registered in the group of its service, got %#v", ins)
+	}
+	leaseID, err := rcs.instanceLease()
+	if err != nil {
+		t.Fatalf("get lease failed: %v", err)
+	}
+	if err = svc.RevokeLease(leaseID); err != nil {
+		t.Fatalf("revoke lease failed: %v", err)
+	}
+	if svc.GetServiceInstanceSpec("order", "order-01") != nil {
+		t.Fatalf("leased instance should expire with the lease")
+	}
+
+	rcs, svc = newTestServer(spec.RegistryTypeEureka)
+	rcs.Persistent = true
+	rcs.Register(testServiceSpec(), ready, ready)
+	defer rcs.Close()
+	waitRegistered(t, rcs)
+
+	if rcs.leaseID != 0 {
+		t.Fatalf("persistent instance should not be leased")
+	}
+	if svc.GetServiceInstanceSpec("order", "order-01") == nil {
+		t.Fatalf("persistent instance should be registered")
+	}
+}
+
+func TestUnknownServiceMode(t *testing.T) {
+	rcs, svc := newTestServer(spec.RegistryTypeEureka)
+	specs := []*spec.ServiceInstanceSpec{
+		{ServiceName: "unknown", InstanceID: "unknown-01", IP: "10.0.0.1", Port: 8080},
+	}
+
+	rcs.UnknownServiceMode = UnknownServiceModeStrict
+	err := rcs.RegisterBatch(specs, ready, ready)
+	if err == nil || !strings.Contains(err.Error(), "unknown service unknown") {
+		t.Fatalf("want unknown service error, got %v", err)
+	}
+	if svc.GetServiceInstanceSpec("unknown", "unknown-01") != nil {
+		t.Fatalf("instance of unknown service should not be registered")
+	}
+
+	svc.PutServiceSpec(&spec.Service{Name: "unknown", RegisterTenant: "shop"})
+	if err = rcs.RegisterBatch(specs, ready, ready); err != nil {
+		t.Fatalf("register to known service failed: %v", err)
+	}
+
+	rcs, svc = newTestServer(spec.RegistryTypeEureka)
+	rcs.UnknownServiceMode = UnknownServiceModeLenient
+	if err = rcs.RegisterBatch(specs, ready, ready); err != nil {
+		t.Fatalf("register in lenient mode failed: %v", err)
+	}
+	serviceSpec := svc.GetServiceSpec("unknown")
+	if serviceSpec == nil || serviceSpec.RegisterTenant != spec.GlobalTenant {
+		t.Fatalf("want default service created, got %#v", serviceSpec)
+	}
+	if svc.GetServiceInstanceSpec("unknown", "unknown-01") == nil {
+		t.Fatalf("instance should be registered in lenient mode")
+	}
+}
+
+func TestRegistryStatusMapping(t *testing.T) {
+	rcs, _ := newTestServer(spec.RegistryTypeEureka)
+
+	for _, c := range []struct {
+		status string
+		eureka string
+		consul string
+	}{
+		{"", "UP", "passing"},
+		{spec.ServiceStatusUp, "UP", "passing"},
+		{spec.ServiceStatusOutOfService, "OUT_OF_SERVICE", "critical"},
+		{"UNKNOWN", "DOWN", "critical"},
+	} {
+		info := &ServiceRegistryInfo{
+			Service: &spec.Service{Name: "order"},
+			Ins:     &spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-01", Status: c.status},
+		}
+
+		if got := rcs.ToEurekaInstanceInfo(info).Status; got != c.eureka {
+			t.Fatalf("status %q: want eureka status %s, got %s", c.status, c.eureka, got)
+		}
+
+		entries := rcs.ToConsulHealthService(info)
+		if len(entries[0].Checks) != 1 {
+			t.Fatalf("want 1 consul check, got %d", len(entries[0].Checks))
+		}
+		if got := entries[0].Checks.AggregatedStatus(); got != c.consul {
+			t.Fatalf("status %q: want consul status %s, got %s", c.status, c.consul, got)
+		}
+	}
+
+	if got := ToRegistryStatus(spec.RegistryTypeNacos, spec.ServiceStatusUp); got != spec.ServiceStatusUp {
+		t.Fatalf("want status without mapping kept, got %s", got)
+	}
+}
+
+func TestRefreshLeases(t *testing.T) {
+	mc := clustertest.NewMemCluster()
+	rcs, _ := newTestServerOnCluster(spec.RegistryTypeEureka, mc)
+	rcs.LeaseTTL = time.Minute
+
+	if err := rcs.RefreshLeases(); err != spec.ErrNoRegisteredYet {
+		t.Fatalf("want %v, got %v", spec.ErrNoRegisteredYet, err)
+	}
+
+	rcs.Register(testServiceSpec(), ready, ready)
+	defer rcs.Close()
+	waitRegistered(t, rcs)
+
+	mc.SetLeaseDeadline(rcs.leaseID, time.Now().Add(time.Second))
+
+	if err := rcs.RefreshLeases(); err != nil {
+		t.Fatalf("refresh leases failed: %v", err)
+	}
+
+	remaining := time.Until(mc.LeaseDeadline(rcs.leaseID))
+	if remaining < 50*time.Second {
+		t.Fatalf("want lease TTL reset to 1m, got %s remaining", remaining)
+	}
+
+	mc.MockedRevokeLease(rcs.leaseID)
+	if err := rcs.RefreshLeases(); err == nil {
+		t.Fatalf("want error refreshing revoked lease")
+	}
+	if rcs.leaseID != 0 {
+		t.Fatalf("revoked lease should be dropped")
+	}
+}
+
+func TestBackoffStrategy(t *testing.T) {
+	ms := time.Millisecond
+	for _, c := range []struct {
+		name    string
+		backoff BackoffStrategy
+		want    []time.Duration
+	}{
+		{"default", defaultBackoff(), []time.Duration{5 * time.Second, 5 * time.Second, 5 * time.Second}},
+		{"constant", &ConstantBackoff{Interval: 100 * ms}, []time.Duration{100 * ms, 100 * ms, 100 * ms, 100 * ms}},
+		{"exponential", &ExponentialBackoff{Base: 100 * ms, Max: 500 * ms},
+			[]time.Duration{100 * ms, 100 * ms, 200 * ms, 400 * ms, 500 * ms, 500 * ms}},
+		{"unlimited", &ExponentialBackoff{Base: 100 * ms}, []time.Duration{100 * ms, 100 * ms, 200 * ms, 400 * ms, 800 * ms}},
+	} {
+		for attempt, want := range c.want {
+			if got := c.backoff.Next(attempt); got != want {
+				t.Fatalf("%s: attempt %d want %s, got %s", c.name, attempt, want, got)
+			}
+		}
+	}
+}
+
+func TestJitteredBackoff(t *testing.T) {
+	rcs, _ := newTestServer(spec.RegistryTypeEureka)
+	rcs.BackoffBase = 500 * time.Millisecond
+	backoff := rcs.backoffStrategy()
+
+	for i := 0; i < 100; i++ {
+		last := time.Duration(0)
+		for attempt := 1; attempt <= 12; attempt++ {
+			interval := backoff.Next(attempt)
+			if interval > DefaultBackoffMax {
+				t.Fatalf("attempt %d: interval %s over the cap", attempt, interval)
+			}
+			if interval < last || (interval == last && interval != DefaultBackoffMax) {
+				t.Fatalf("attempt %d: interval %s not increased from %s", attempt, interval, last)
+			}
+			last = interval
+		}
+		if last != DefaultBackoffMax {
+			t.Fatalf("want interval capped at %s, got %s", DefaultBackoffMax, last)
+		}
+		if interval := backoff.Next(0); interval < rcs.BackoffBase || interval > rcs.BackoffBase*6/5 {
+			t.Fatalf("want interval reset to the base once registered, got %s", interval)
+		}
+	}
+
+	// The jitter tells the instances apart.
+	intervals := map[time.Duration]bool{}
+	for i := 0; i < 10; i++ {
+		intervals[backoff.Next(3)] = true
+	}
+	if len(intervals) == 1 {
+		t.Fatalf("want jittered intervals, got %v", intervals)
+	}
+
+	rcs.BackoffMax = 2 * time.Second
+	if interval := rcs.backoffStrategy().Next(10); interval != 2*time.Second {
+		t.Fatalf("want interval capped at 2s, got %s", interval)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	rcs, _ := newTestServer(spec.RegistryTypeConsul)
+
+	config := rcs.Config()
+	if config.RegistryType != spec.RegistryTypeConsul || config.ServiceName != "order" || config.InstanceID != "order-01" {
+		t.Fatalf("unexpected identity: %#v", config)
+	}
+	if config.InitialStatus != spec.ServiceStatusUp || config.AddressMode != AddressModeDev {
+		t.Fatalf("defaults not applied: %#v", config)
+	}
+	if len(config.RejectedAddressClasses) != 2 || config.LeaseTTL != DefaultLeaseTTL {
+		t.Fatalf("defaults not applied: %#v", config)
+	}
+	if len(config.RetryIntervals) != 5 || config.RetryIntervals[0] != DefaultRegisterInterval {
+		t.Fatalf("want default retry intervals, got %v", config.RetryIntervals)
+	}
+
+	ins := &spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-02", IP: "10.0.0.1"}
+	rcs = NewRegistryCenterServer(spec.RegistryTypeEureka, ins, nil, &nopInformer{}, nil,
+		&ExponentialBackoff{Base: time.Second, Max: 4 * time.Second})
+	rcs.InitialStatus = spec.ServiceStatusOutOfService
+	rcs.AddressMode = AddressModeStrict
+	rcs.RejectedAddressClasses = []string{AddressClassPrivate}
+	rcs.UnknownServiceMode = UnknownServiceModeStrict
+	rcs.Persistent = true
+
+	config = rcs.Config()
+	if config.InitialStatus != spec.ServiceStatusOutOfService || config.AddressMode != AddressModeStrict {
+		t.Fatalf("options not reflected: %#v", config)
+	}
+	if len(config.RejectedAddressClasses) != 1 || config.RejectedAddressClasses[0] != AddressClassPrivate {
+		t.Fatalf("want rejected private addresses, got %v", config.RejectedAddressClasses)
+	}
+	if config.UnknownServiceMode != UnknownServiceModeStrict || !config.Persistent || config.LeaseTTL != 0 {
+		t.Fatalf("options not reflected: %#v", config)
+	}
+	if config.Backoff != "*registrycenter.ExponentialBackoff" {
+		t.Fatalf("unexpected backoff: %s", config.Backoff)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second, 4 * time.Second}
+	for i, interval := range config.RetryIntervals {
+		if interval != want[i] {
+			t.Fatalf("want retry intervals %v, got %v", want, config.RetryIntervals)
+		}
+	}
+}
+
+func TestEmptyResultModes(t *testing.T) {
+	rcs, _ := newTestServer(spec.RegistryTypeEureka)
+
+	for _, registryType := range []string{spec.RegistryTypeEureka, spec.RegistryTypeConsul} {
+		if mode := rcs.EmptyResultMode(registryType); mode != EmptyResultModeEmpty {
+			t.Fatalf("want empty mode of %s by default, got %s", registryType, mode)
+		}
+	}
+
+	apps := rcs.ToEurekaApps(nil)
+	if apps.Applications == nil || len(apps.Applications) != 0 || apps.AppsHashcode != "UP_0_" {
+		t.Fatalf("want empty eureka apps, got %#v", apps)
+	}
+	if buff, _ := json.Marshal(rcs.ToConsulHealthService(nil)); string(buff) != "[]" {
+		t.Fatalf("want empty consul health services, got %s", buff)
+	}
+	if buff, _ := json.Marshal(rcs.ToConsulCatalogService(nil)); string(buff) != "[]" {
+		t.Fatalf("want empty consul catalog services, got %s", buff)
+	}
+
+	rcs.EmptyResultModes = map[string]string{
+		spec.RegistryTypeEureka: EmptyResultModeNoContent,
+		spec.RegistryTypeConsul: "unknown",
+	}
+	if mode := rcs.EmptyResultMode(spec.RegistryTypeEureka); mode != EmptyResultModeNoContent {
+		t.Fatalf("want no content mode of eureka, got %s", mode)
+	}
+	if mode := rcs.EmptyResultMode(spec.RegistryTypeConsul); mode != EmptyResultModeEmpty {
+		t.Fatalf("want empty mode of consul for unknown mode, got %s", mode)
+	}
+
+	config := rcs.Config()
+	if config.EmptyResultModes[spec.RegistryTypeEureka] != EmptyResultModeNoContent ||
+		config.EmptyResultModes[spec.RegistryTypeConsul] != EmptyResultModeEmpty {
+		t.Fatalf("modes not reflected: %v", config.EmptyResultModes)
+	}
+}
+
+func TestDecodeRegistryBatch(t *testing.T) {
+	rcs, _ := newTestServer(spec.RegistryTypeConsul)
+
+	specs, err := rcs.DecodeRegistryBatch(ContentTypeJSON, []byte(`[
+		{"ID": "order-01", "Name": "order", "Address": "10.0.0.1", "Port": 8080, "Meta": {"mesh.foo": "bar"}},
+		{"ID": "order-02", "Name": "order", "Address": "10.0.0.2", "Port": 8080}
+	]`))
+	if err != nil {
+		t.Fatalf("decode consul batch failed: %v", err)
+	}
+	if len(specs) != 2 || specs[1].InstanceID != "order-02" || specs[1].IP != "10.0.0.2" || specs[1].Port != 8080 {
+		t.Fatalf("unexpected consul specs: %v", specs)
+	}
+	if _, ok := specs[0].Labels["mesh.foo"]; ok {
+		t.Fatalf("reserved label should be dropped")
+	}
+
+	specs, err = rcs.DecodeRegistryBatch(ContentTypeJSON, []byte(`{"ID": "order-03", "Name": "order", "Address": "10.0.0.3", "Port": 8080}`))
+	if err != nil {
+		t.Fatalf("decode consul body failed: %v", err)
+	}
+	if len(specs) != 1 || specs[0].ServiceName != "order" || specs[0].InstanceID != "order-03" {
+		t.Fatalf("unexpected consul specs: %v", specs)
+	}
+
+	rcs, _ = newTestServer(spec.RegistryTypeEureka)
+	specs, err = rcs.DecodeRegistryBatch(ContentTypeXML, []byte(`<instances>
+		<instance><instanceId>order-01</instanceId><app>ORDER</app><ipAddr>10.0.0.1</ipAddr><port enabled="true">8080</port></instance>
+		<instance><instanceId>order-02</instanceId><app>ORDER</app><vipAddress>order</vipAddress><ipAddr>10.0.0.2</ipAddr><port enabled="true">8081</port></instance>
+	</instances>`))
+	if err != nil {
+		t.Fatalf("decode eureka batch failed: %v", err)
+	}
+	if len(specs) != 2 || specs[0].ServiceName != "order" || specs[1].Port != 8081 || specs[1].IP != "10.0.0.2" {
+		t.Fatalf("unexpected eureka specs: %v", specs)
+	}
+
+	specs, err = rcs.DecodeRegistryBatch(ContentTypeJSON, []byte(`[
+		{"instanceId": "order-01", "app": "ORDER", "ipAddr": "10.0.0.1", "port": {"$": 8080, "@enabled": true}},
+		{"instanceId": "order-02", "app": "ORDER", "ipAddr": "10.0.0.2", "port": {"$": 8080, "@enabled": true}}
+	]`))
+	if err != nil {
+		t.Fatalf("decode eureka json batch failed: %v", err)
+	}
+	if len(specs) != 2 || specs[1].InstanceID != "order-02" || specs[1].Port != 8080 {
+		t.Fatalf("unexpected eureka specs: %v", specs)
+	}
+
+	specs, err = rcs.DecodeRegistryBatch(ContentTypeXML, []byte(
+		`<instance><instanceId>order-03</instanceId><app>ORDER</app><ipAddr>10.0.0.3</ipAddr><port enabled="true">8080</port></instance>`))
+	if err != nil {
+		t.Fatalf("decode eureka body failed: %v", err)
+	}
+	if len(specs) != 1 || specs[0].InstanceID != "order-03" || specs[0].Port != 8080 {
+		t.Fatalf("unexpected eureka specs: %v", specs)
+	}
+}
+
+func TestDecodeRegistryBody(t *testing.T) {
+	rcs, _ := newTestServer(spec.RegistryTypeConsul)
+	origin := *rcs.instanceSpec
+
+	ins, err := rcs.DecodeRegistryBody(ContentTypeJSON,
+		[]byte(`{"ID": "order-09", "Name": "order", "Address": "10.0.0.9", "Port": 8089, "Meta": {"mesh.foo": "bar", "team": "shop"}}`))
+	if err != nil {
+		t.Fatalf("decode consul body failed: %v", err)
+	}
+	if ins.InstanceID != "order-09" || ins.IP != "10.0.0.9" || ins.Port != 8089 || ins.ServiceName != "order" {
+		t.Fatalf("want the declared consul instance, got %+v", ins)
+	}
+	if _, ok := ins.Labels["mesh.foo"]; ok || ins.Labels["team"] != "shop" {
+		t.Fatalf("unexpected consul labels: %v", ins.Labels)
+	}
+	if ins.RegistryType != spec.RegistryTypeConsul {
+		t.Fatalf("want consul origin, got %s", ins.RegistryType)
+	}
+	if !reflect.DeepEqual(*rcs.instanceSpec, origin) {
+		t.Fatalf("decoding should not touch the instance of the server")
+	}
+
+	rcs, _ = newTestServer(spec.RegistryTypeEureka)
+	body := `<instance><instanceId>order-09</instanceId><app>ORDER</app><vipAddress>order</vipAddress>` +
+		`<ipAddr>10.0.0.9</ipAddr><port enabled="true">8089</port><metadata><team>shop</team></metadata></instance>`
+	ins, err = rcs.DecodeRegistryBody(ContentTypeXML, []byte(body))
+	if err != nil {
+		t.Fatalf("decode eureka body failed: %v", err)
+	}
+	if ins.InstanceID != "order-09" || ins.IP != "10.0.0.9" || ins.Port != 8089 || ins.ServiceName != "order" {
+		t.Fatalf("want the declared eureka instance, got %+v", ins)
+	}
+	if ins.Labels["team"] != "shop" || ins.RegistryType != spec.RegistryTypeEureka {
+		t.Fatalf("unexpected eureka instance: %+v", ins)
+	}
+
+	rcs, _ = newTestServer(spec.RegistryTypeNacos)
+	ins, err = rcs.DecodeRegistryBody(ContentTypeForm, []byte("serviceName=DEFAULT_GROUP%40%40order&ip=10.0.0.9&port=8089"))
+	if err != nil {
+		t.Fatalf("decode nacos body failed: %v", err)
+	}
+	if ins.ServiceName != "order" || ins.IP != "10.0.0.9" || ins.Port != 8089 || ins.InstanceID == "" {
+		t.Fatalf("want the declared nacos instance, got %+v", ins)
+	}
+
+	if _, err := rcs.DecodeRegistryBody(ContentTypeForm, []byte("serviceName=order")); err == nil {
+		t.Fatalf("want error for invalid nacos body")
+	}
+}
+
+func TestDecodeRegistryBodyStrict(t *testing.T) {
+	cases := []struct {
+		registryType string
+		contentType  string
+		body         string
+	}{
+		{spec.RegistryTypeConsul, ContentTypeJSON,
+			`{"ID": "order-09", "Name": "order", "Address": "10.0.0.9", "Port": 8089, "Unknown": 1}`},
+		{spec.RegistryTypeEureka, ContentTypeJSON,
+			`{"instanceId": "order-09", "app": "ORDER", "ipAddr": "10.0.0.9", "port": {"$": 8089}, "unknown": 1}`},
+		{spec.RegistryTypeNacos, ContentTypeJSON,
+			`{"serviceName": "order", "ip": "10.0.0.9", "port": "8089", "unknown": "1"}`},
+	}
+
+	for _, c := range cases {
+		rcs, _ := newTestServer(c.registryType)
+		if _, err := rcs.DecodeRegistryBody(c.contentType, []byte(c.body)); err != nil {
+			t.Fatalf("%s: decode body with unknown field in lenient mode failed: %v", c.registryType, err)
+		}
+
+		rcs.StrictDecode = true
+		_, err := rcs.DecodeRegistryBody(c.contentType, []byte(c.body))
+		if err == nil || !strings.Contains(err.Error(), "unknown field") {
+			t.Fatalf("%s: want error of unknown field in strict mode, got %v", c.registryType, err)
+		}
+	}
+
+	rcs, _ := newTestServer(spec.RegistryTypeConsul)
+	rcs.StrictDecode = true
+	if _, err := rcs.DecodeRegistryBody(ContentTypeJSON,
+		[]byte(`{"ID": "order-09", "Name": "order", "Address": "10.0.0.9", "Port": 8089}`)); err != nil {
+		t.Fatalf("decode body without unknown fields in strict mode failed: %v", err)
+	}
+}
+
+func TestRegisterWithContext(t *testing.T) {
+	newServer := func() (*Server, *service.Service) {
+		svc := service.NewWithStorage(storage.New("test", clustertest.NewMemCluster()))
+		ins := &spec.ServiceInstanceSpec{AgentType: "EaseAgent", ServiceName: "order", InstanceID: "order-01", IP: "10.0.0.1"}
+		rcs := NewRegistryCenterServer(spec.RegistryTypeEureka, ins, svc, &nopInformer{}, nil,
+			&ConstantBackoff{Interval: 5 * time.Millisecond})
+		return rcs, svc
+	}
+
+	rcs, svc := newServer()
+	var attempts int32
+	readyLater := func() bool {
+		return atomic.AddInt32(&attempts, 1) >= 3
+	}
+	if err := rcs.RegisterWithContext(context.Background(), testServiceSpec(), readyLater, ready); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if !rcs.Registered() || svc.GetServiceInstanceSpec("order", "order-01") == nil {
+		t.Fatalf("instance should be registered once returned")
+	}
+	if n := atomic.LoadInt32(&attempts); n < 3 {
+		t.Fatalf("want at least 3 attempts, got %d", n)
+	}
+	rcs.Close()
+
+	rcs, _ = newServer()
+	rcs.MaxRegisterAttempts = 2
+	err := rcs.RegisterWithContext(context.Background(), testServiceSpec(), notReady, ready)
+	if err == nil || !strings.Contains(err.Error(), "gave up after 2 attempts") {
+		t.Fatalf("want error after max attempts, got %v", err)
+	}
+	if rcs.Registered() {
+		t.Fatalf("instance should not be registered")
+	}
+	rcs.Close()
+
+	rcs, _ = newServer()
+	defer rcs.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = rcs.RegisterWithContext(ctx, testServiceSpec(), notReady, ready)
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Fatalf("want error of the context, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("want returned at the deadline, took %v", elapsed)
+	}
+}
+
+func TestRegisterWatchesRecord(t *testing.T) {
+	mc := clustertest.NewMemCluster()
+	key := layout.ServiceInstanceSpecKey("order", "order-01")
+
+	var reads int32
+	getRaw := mc.MockedGetRaw
+	mc.MockedGetRaw = func(k string) (*mvccpb.KeyValue, error) {
+		if k == key {
+			atomic.AddInt32(&reads, 1)
+		}
+		return getRaw(k)
+	}
+	values := make(chan *string, 10)
+	mc.MockedSyncer = func(pullInterval time.Duration) (cluster.Syncer, error) {
+		syncer := clustertest.NewMockedSyncer()
+		syncer.MockedSync = func(string) (<-chan *string, error) {
+			return values, nil
+		}
+		return syncer, nil
+	}
+
+	svc := service.NewWithStorage(storage.New("test", mc))
+	ins := &spec.ServiceInstanceSpec{AgentType: "EaseAgent", ServiceName: "order", InstanceID: "order-01", IP: "10.0.0.1"}
+	rcs := NewRegistryCenterServer(spec.RegistryTypeEureka, ins, svc, &nopInformer{}, nil,
+		&ConstantBackoff{Interval: 5 * time.Millisecond})
+	defer rcs.Close()
+	rcs.Persistent = true
+	rcs.Register(testServiceSpec(), ready, ready)
+	waitRegistered(t, rcs)
+
+	// The record isn't polled while watched.
+	time.Sleep(20 * time.Millisecond)
+	n := atomic.LoadInt32(&reads)
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(&reads); got != n {
+		t.Fatalf("want no reads while watching, got %d more", got-n)
+	}
+
+	// The record matching the desired spec is left as it is.
+	record := svc.GetServiceInstanceSpec("order", "order-01")
+	record.Status = spec.ServiceStatusOutOfService
+	svc.PutServiceInstanceSpec(record)
+	buff, _ := json.Marshal(record)
+	value := string(buff)
+	values <- &value
+	time.Sleep(20 * time.Millisecond)
+	if got := svc.GetServiceInstanceSpec("order", "order-01"); got.Status != spec.ServiceStatusOutOfService {
+		t.Fatalf("want the matching record untouched, got %#v", got)
+	}
+
+	// The deleted record is registered again.
+	svc.DeleteServiceInstanceSpec("order", "order-01")
+	values <- nil
+	for i := 0; i < 100 && svc.GetServiceInstanceSpec("order", "order-01") == nil; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := svc.GetServiceInstanceSpec("order", "order-01"); got == nil || got.Status != spec.ServiceStatusUp {
+		t.Fatalf("want the deleted record registered again, got %#v", got)
+	}
+
+	// The deletion without any event is caught by the reconciliation.
+	rcs.Close()
+	rcs = NewRegistryCenterServer(spec.RegistryTypeEureka, ins, svc, &nopInformer{}, nil,
+		&ConstantBackoff{Interval: 5 * time.Millisecond})
+	defer rcs.Close()
+	rcs.Persistent = true
+	rcs.ReconcileInterval = 30 * time.Millisecond
+	rcs.Register(testServiceSpec(), ready, ready)
+	waitRegistered(t, rcs)
+	svc.DeleteServiceInstanceSpec("order", "order-01")
+	for i := 0; i < 100 && svc.GetServiceInstanceSpec("order", "order-01") == nil; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if svc.GetServiceInstanceSpec("order", "order-01") == nil {
+		t.Fatalf("want the deleted record reconciled")
+	}
+}
+
+func TestRegisterInstances(t *testing.T) {
+	svc := service.NewWithStorage(storage.New("test", clustertest.NewMemCluster()))
+	ins := &spec.ServiceInstanceSpec{AgentType: "EaseAgent", ServiceName: "order", InstanceID: "order-01", IP: "10.0.0.1"}
+	rcs := NewRegistryCenterServer(spec.RegistryTypeEureka, ins, svc, &nopInformer{}, nil,
+		&ConstantBackoff{Interval: 5 * time.Millisecond})
+	defer rcs.Close()
+	rcs.CollisionPolicy = CollisionPolicyReject
+
+	// The gRPC instance collides with the existing record until it's deleted.
+	svc.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+		ServiceName: "order", InstanceID: "order-grpc", IP: "10.0.0.2", Port: 9090, Status: spec.ServiceStatusUp,
+	})
+	specs := []*spec.ServiceInstanceSpec{
+		{AgentType: "EaseAgent", ServiceName: "order", InstanceID: "order-http", IP: "10.0.0.1", Port: 8080},
+		{AgentType: "EaseAgent", ServiceName: "order", InstanceID: "order-grpc", IP: "10.0.0.1", Port: 9090},
+	}
+	if err := rcs.RegisterInstances(nil, ready, ready); err == nil {
+		t.Fatalf("want error of no instances")
+	}
+	if err := rcs.RegisterInstances(specs, ready, ready); err != nil {
+		t.Fatalf("register instances failed: %v", err)
+	}
+
+	for i := 0; i < 100 && svc.GetServiceInstanceSpec("order", "order-http") == nil; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if svc.GetServiceInstanceSpec("order", "order-http") == nil {
+		t.Fatalf("http instance should be registered")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if rcs.Registered() {
+		t.Fatalf("server should not be registered until all instances are")
+	}
+
+	svc.DeleteServiceInstanceSpec("order", "order-grpc")
+	waitRegistered(t, rcs)
+	if got := svc.GetServiceInstanceSpec("order", "order-grpc"); got == nil || got.IP != "10.0.0.1" {
+		t.Fatalf("want grpc instance registered, got %#v", got)
+	}
+
+	if err := rcs.Deregister(); err != nil {
+		t.Fatalf("deregister failed: %v", err)
+	}
+	if rcs.Registered() || len(svc.ListServiceInstanceSpecs("order")) != 0 {
+		t.Fatalf("want all instances deregistered, got %v", svc.ListServiceInstanceSpecs("order"))
+	}
+}
+
+func TestMaxRegisterAttempts(t *testing.T) {
+	svc := service.NewWithStorage(storage.New("test", clustertest.NewMemCluster()))
+	ins := &spec.ServiceInstanceSpec{AgentType: "EaseAgent", ServiceName: "order", InstanceID: "order-01", IP: "10.0.0.1"}
+	rcs := NewRegistryCenterServer(spec.RegistryTypeEureka, ins, svc, &nopInformer{}, nil,
+		&ConstantBackoff{Interval: 5 * time.Millisecond})
+	defer rcs.Close()
+	rcs.MaxRegisterAttempts = 3
+
+	var attempts int32
+	countingNotReady := func() bool {
+		atomic.AddInt32(&attempts, 1)
+		return false
+	}
+	rcs.Register(testServiceSpec(), countingNotReady, ready)
+	for i := 0; i < 100 && rcs.FatalError() == nil; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := rcs.FatalError(); err == nil || !strings.Contains(err.Error(), "gave up after 3 attempts") {
+		t.Fatalf("want the registration given up after 3 attempts, got %v", err)
+	}
+	if err := rcs.RegisterError(); err == nil || !strings.Contains(err.Error(), "ingress ready: false") {
+		t.Fatalf("want the error of the last attempt, got %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Fatalf("want the loop exited after 3 attempts, got %d", n)
+	}
+	if rcs.Registered() {
+		t.Fatalf("instance should not be registered")
+	}
+}
+
+func TestReadinessLogger(t *testing.T) {
+	var l readinessLogger
+	ingressNotReady := &readinessError{ingressReady: false, egressReady: true}
+	egressNotReady := &readinessError{ingressReady: true, egressReady: false}
+
+	cases := []struct {
+		err    error
+		logged bool
+	}{
+		{ingressNotReady, true},
+		{ingressNotReady, false},
+		{ingressNotReady, false},
+		{egressNotReady, true},
+		{egressNotReady, false},
+		{nil, true},
+		{nil, false},
+		{fmt.Errorf("put failed"), true},
+		{fmt.Errorf("put failed"), true},
+		{egressNotReady, true},
+	}
+	for i, c := range cases {
+		if got := l.log(c.err); got != c.logged {
+			t.Fatalf("case %d: want logged %v, got %v", i, c.logged, got)
+		}
+	}
+}
+
+func TestReadinessTimeouts(t *testing.T) {
+	newServer := func() *Server {
+		svc := service.NewWithStorage(storage.New("test", clustertest.NewMemCluster()))
+		ins := &spec.ServiceInstanceSpec{AgentType: "EaseAgent", ServiceName: "order", InstanceID: "order-01", IP: "10.0.0.1"}
+		return NewRegistryCenterServer(spec.RegistryTypeEureka, ins, svc, &nopInformer{}, nil,
+			&ConstantBackoff{Interval: 5 * time.Millisecond})
+	}
+
+	// The slow egress within its grace period doesn't count for MaxRegisterAttempts.
+	rcs := newServer()
+	rcs.MaxRegisterAttempts = 2
+	rcs.IngressReadyTimeout = 10 * time.Millisecond
+	rcs.EgressReadyTimeout = time.Second
+	readyAt := time.Now().Add(60 * time.Millisecond)
+	slowEgress := func() bool {
+		return time.Now().After(readyAt)
+	}
+	start := time.Now()
+	if err := rcs.RegisterWithContext(context.Background(), testServiceSpec(), ready, slowEgress); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Fatalf("want registration waited for egress, took %v", elapsed)
+	}
+	if !rcs.Registered() {
+		t.Fatalf("instance should be registered once returned")
+	}
+	rcs.Close()
+
+	// Without the grace period, the slow egress trips MaxRegisterAttempts.
+	rcs = newServer()
+	rcs.MaxRegisterAttempts = 2
+	readyAt = time.Now().Add(60 * time.Millisecond)
+	err := rcs.RegisterWithContext(context.Background(), testServiceSpec(), ready, slowEgress)
+	if err == nil || !strings.Contains(err.Error(), "gave up after 2 attempts") {
+		t.Fatalf("want error after max attempts, got %v", err)
+	}
+	rcs.Close()
+
+	// The egress grace period exceeded.
+	rcs = newServer()
+	rcs.EgressReadyTimeout = 30 * time.Millisecond
+	err = rcs.RegisterWithContext(context.Background(), testServiceSpec(), ready, notReady)
+	if err == nil || !strings.Contains(err.Error(), "egress not ready in 30ms") {
+		t.Fatalf("want error of egress timeout, got %v", err)
+	}
+	rcs.Close()
+
+	// The slow ingress isn't covered by the egress grace period.
+	rcs = newServer()
+	rcs.MaxRegisterAttempts = 2
+	rcs.EgressReadyTimeout = time.Second
+	err = rcs.RegisterWithContext(context.Background(), testServiceSpec(), notReady, ready)
+	if err == nil || !strings.Contains(err.Error(), "gave up after 2 attempts") {
+		t.Fatalf("want error after max attempts, got %v", err)
+	}
+	rcs.Close()
+
+	// The background registration gives up once the grace period exceeded.
+	rcs = newServer()
+	defer rcs.Close()
+	rcs.EgressReadyTimeout = 30 * time.Millisecond
+	rcs.Register(testServiceSpec(), ready, notReady)
+	deadline := time.Now().Add(time.Second)
+	for rcs.FatalError() == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := rcs.FatalError(); err == nil || !strings.Contains(err.Error(), "egress not ready") {
+		t.Fatalf("want fatal error of egress timeout, got %v", err)
+	}
+}
+
+func TestRegistryCenterServerWithContext(t *testing.T) {
+	svc := service.NewWithStorage(storage.New("test", clustertest.NewMemCluster()))
+	ins := &spec.ServiceInstanceSpec{AgentType: "EaseAgent", ServiceName: "order", InstanceID: "order-01", IP: "10.0.0.1"}
+	ctx, cancel := context.WithCancel(context.Background())
+	rcs := NewRegistryCenterServerWithContext(ctx, spec.RegistryTypeEureka, ins, svc, &nopInformer{}, nil,
+		&ConstantBackoff{Interval: 5 * time.Millisecond})
+
+	var attempts int32
+	countingNotReady := func() bool {
+		atomic.AddInt32(&attempts, 1)
+		return false
+	}
+	rcs.Register(testServiceSpec(), countingNotReady, ready)
+	time.Sleep(30 * time.Millisecond)
+	if atomic.LoadInt32(&attempts) == 0 {
+		t.Fatalf("want the registration retried before canceled")
+	}
+
+	cancel()
+	select {
+	case <-rcs.done:
+	case <-time.After(time.Second):
+		t.Fatalf("server should be closed once the context is canceled")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	n := atomic.LoadInt32(&attempts)
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(&attempts); got != n {
+		t.Fatalf("want the registration stopped, got %d more attempts", got-n)
+	}
+
+	// Closing it again is a no-op.
+	rcs.Close()
+}
+
+func TestRegisterMaxConsecutivePanics(t *testing.T) {
+	svc := service.NewWithStorage(storage.New("test", clustertest.NewMemCluster()))
+	ins := &spec.ServiceInstanceSpec{AgentType: "EaseAgent", ServiceName: "order", InstanceID: "order-01", IP: "10.0.0.1"}
+	rcs := NewRegistryCenterServer(spec.RegistryTypeEureka, ins, svc, &nopInformer{}, nil,
+		&ConstantBackoff{Interval: time.Millisecond})
+	rcs.MaxConsecutivePanics = 3
+	defer rcs.Close()
+
+	var attempts int32
+	panicReady := func() bool {
+		atomic.AddInt32(&attempts, 1)
+		panic("broken readiness")
+	}
+	rcs.Register(testServiceSpec(), panicReady, ready)
+
+	for i := 0; i < 100 && rcs.FatalError() == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := rcs.FatalError(); err == nil || !strings.Contains(err.Error(), "broken readiness") {
+		t.Fatalf("want fatal error of the panic, got %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Fatalf("want 3 attempts before giving up, got %d", n)
+	}
+	if rcs.Registered() {
+		t.Fatalf("instance should not be registered")
+	}
+}
+
+func TestExportPrometheusSD(t *testing.T) {
+	rcs, svc := newTestServer(spec.RegistryTypeEureka)
+	svc.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+		ServiceName: "order", InstanceID: "order-01", IP: "10.0.0.1", Port: 8080,
+		Group: "blue", Labels: map[string]string{"version": "v1", "app.kubernetes.io/name": "order"},
+		Status: spec.ServiceStatusUp,
+	})
+	svc.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+		ServiceName: "order", InstanceID: "order-02", IP: "10.0.0.2", Port: 8080,
+		Status: spec.ServiceStatusOutOfService,
+	})
+	svc.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+		ServiceName: "payment", InstanceID: "payment-01", IP: "10.0.0.3", Port: 9090,
+		Status: spec.ServiceStatusUp,
+	})
+
+	data, err := rcs.ExportPrometheusSD()
+	if err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+
+	var groups []*PrometheusTargetGroup
+	if err = json.Unmarshal(data, &groups); err != nil {
+		t.Fatalf("invalid file_sd json %s: %v", data, err)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("want 2 UP target groups, got %s", data)
+	}
+
+	want := map[string]string{
+		"__meta_easegress_service":                      "order",
+		"__meta_easegress_instance_id":                  "order-01",
+		"__meta_easegress_group":                        "blue",
+		"__meta_easegress_label_version":                "v1",
+		"__meta_easegress_label_app_kubernetes_io_name": "order",
+	}
+	if !reflect.DeepEqual(groups[0].Targets, []string{"10.0.0.1:8080"}) || !reflect.DeepEqual(groups[0].Labels, want) {
+		t.Fatalf("unexpected target group %+v", groups[0])
+	}
+	if !reflect.DeepEqual(groups[1].Targets, []string{"10.0.0.3:9090"}) {
+		t.Fatalf("unexpected targets %v", groups[1].Targets)
+	}
+}
+
+func TestIdentityKey(t *testing.T) {
+	register := func(rcs *Server, instanceID, ip string) {
+		ins := &spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: instanceID, IP: ip, Port: 8080}
+		if err := rcs.RegisterBatch([]*spec.ServiceInstanceSpec{ins}, ready, ready); err != nil {
+			t.Fatalf("register failed: %v", err)
+		}
+	}
+
+	rcs, svc := newTestServer(spec.RegistryTypeEureka)
+	register(rcs, "order-a", "10.0.0.1")
+	register(rcs, "order-a", "10.0.0.2")
+	if n := len(svc.ListServiceInstanceSpecs("order")); n != 1 {
+		t.Fatalf("same instanceID should update the instance, got %d instances", n)
+	}
+	if ins := svc.GetServiceInstanceSpec("order", "order-a"); ins.IP != "10.0.0.2" {
+		t.Fatalf("want instance updated to the new address, got %s", ins.IP)
+	}
+	register(rcs, "order-b", "10.0.0.2")
+	if n := len(svc.ListServiceInstanceSpecs("order")); n != 2 {
+		t.Fatalf("new instanceID should add an instance, got %d instances", n)
+	}
+
+	rcs, svc = newTestServer(spec.RegistryTypeEureka)
+	rcs.IdentityKey = IdentityKeyAddress
+	register(rcs, "order-a", "10.0.0.1")
+	register(rcs, "order-b", "10.0.0.1")
+	instances := svc.ListServiceInstanceSpecs("order")
+	if len(instances) != 1 || instances[0].InstanceID != "order-a" {
+		t.Fatalf("same address should update the instance, got %+v", instances)
+	}
+	register(rcs, "order-a", "10.0.0.2")
+	if n := len(svc.ListServiceInstanceSpecs("order")); n != 2 {
+		t.Fatalf("new address should add an instance, got %d instances", n)
+	}
+	if ins := svc.GetServiceInstanceSpec("order", "order-a"); ins.IP != "10.0.0.1" {
+		t.Fatalf("instance of another address should not be overwritten, got %s", ins.IP)
+	}
+	if svc.GetServiceInstanceSpec("order", "order-10.0.0.2-8080") == nil {
+		t.Fatalf("want instanceID derived from the address")
+	}
+}
+
+type stubResolver struct {
+	instances map[string][]*spec.ServiceInstanceSpec
+	err       error
+}
+
+func (r *stubResolver) Name() string { return "us-east" }
+
+func (r *stubResolver) ListInstances(serviceName string) ([]*spec.ServiceInstanceSpec, error) {
+	return r.instances[serviceName], r.err
+}
+
+func TestListInstancesFederation(t *testing.T) {
+	rcs, svc := newTestServer(spec.RegistryTypeEureka)
+	svc.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-01", IP: "10.0.0.1", Port: 8080})
+
+	upstream := &stubResolver{instances: map[string][]*spec.ServiceInstanceSpec{
+		"order": {
+			{ServiceName: "order", InstanceID: "order-01", IP: "10.1.0.1", Port: 8080},
+			{ServiceName: "order", InstanceID: "order-02", IP: "10.1.0.2", Port: 8080},
+		},
+		"payment": {
+			{ServiceName: "payment", InstanceID: "payment-01", IP: "10.1.0.3", Port: 9090, Labels: map[string]string{"version": "v1"}},
+		},
+	}}
+
+	if instances, _ := rcs.ListInstances("payment"); len(instances) != 0 {
+		t.Fatalf("want no instances without upstream, got %v", instances)
+	}
+
+	rcs.Upstream = upstream
+	instances, err := rcs.ListInstances("payment")
+	if err != nil {
+		t.Fatalf("list instances failed: %v", err)
+	}
+	if len(instances) != 1 || instances[0].Labels[OriginLabel] != "us-east" || instances[0].Labels["version"] != "v1" {
+		t.Fatalf("want upstream instance tagged with its origin, got %+v", instances)
+	}
+	if _, exists := upstream.instances["payment"][0].Labels[OriginLabel]; exists {
+		t.Fatalf("upstream instance should not be modified")
+	}
+
+	instances, _ = rcs.ListInstances("order")
+	if len(instances) != 2 {
+		t.Fatalf("want local and upstream instances merged, got %+v", instances)
+	}
+	for _, ins := range instances {
+		if ins.InstanceID == "order-01" && (ins.IP != "10.0.0.1" || ins.Labels[OriginLabel] != "") {
+			t.Fatalf("local instance should win, got %+v", ins)
+		}
+	}
+
+	upstream.err = fmt.Errorf("upstream unavailable")
+	if instances, err = rcs.ListInstances("order"); err != nil || len(instances) != 1 {
+		t.Fatalf("want local instances on upstream failure, got %v, %v", instances, err)
+	}
+	if _, err = rcs.ListInstances("payment"); err == nil {
+		t.Fatalf("want error without any instances")
+	}
+}
+
+func TestRegisterUntil(t *testing.T) {
+	svc := service.NewWithStorage(storage.New("test", clustertest.NewMemCluster()))
+	ins := &spec.ServiceInstanceSpec{AgentType: "EaseAgent", ServiceName: "order", InstanceID: "order-01", IP: "10.0.0.1"}
+	rcs := NewRegistryCenterServer(spec.RegistryTypeEureka, ins, svc, &nopInformer{}, nil,
+		&ConstantBackoff{Interval: 10 * time.Millisecond})
+	defer rcs.Close()
+
+	if err := rcs.RegisterUntil(testServiceSpec(), ready, ready, time.Now().Add(100*time.Millisecond)); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	waitRegistered(t, rcs)
+	if svc.GetServiceInstanceSpec("order", "order-01") == nil {
+		t.Fatalf("instance should be registered before expiry")
+	}
+
+	for i := 0; i < 100 && rcs.Registered(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rcs.Registered() {
+		t.Fatalf("instance should be deregistered at expiry")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if svc.GetServiceInstanceSpec("order", "order-01") != nil {
+		t.Fatalf("expired instance should be removed and not registered again")
+	}
+
+	// An explicit deregistration cancels the scheduled one.
+	rcs.RegisterUntil(testServiceSpec(), ready, ready, time.Now().Add(100*time.Millisecond))
+	waitRegistered(t, rcs)
+	if err := rcs.Deregister(); err != nil {
+		t.Fatalf("deregister failed: %v", err)
+	}
+	if svc.GetServiceInstanceSpec("order", "order-01") != nil {
+		t.Fatalf("deregistered instance should be removed")
+	}
+	rcs.Register(testServiceSpec(), ready, ready)
+	waitRegistered(t, rcs)
+	time.Sleep(200 * time.Millisecond)
+	if !rcs.Registered() || svc.GetServiceInstanceSpec("order", "order-01") == nil {
+		t.Fatalf("canceled expiry should not deregister the instance registered again")
+	}
+}
+
+func TestDeregisterOnClose(t *testing.T) {
+	rcs, svc := newTestServer(spec.RegistryTypeEureka)
+	rcs.SingleShot = true
+	rcs.HistoryRetention = time.Hour
+
+	// Deregistering the instance not registered is a no-op.
+	if err := rcs.Deregister(); err != nil {
+		t.Fatalf("deregister failed: %v", err)
+	}
+	if history, _ := rcs.History("order"); len(history) != 0 {
+		t.Fatalf("want no history of the instance not registered, got %v", history)
+	}
+
+	if err := rcs.Register(testServiceSpec(), ready, ready); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	rcs.Close()
+	if svc.GetServiceInstanceSpec("order", "order-01") == nil {
+		t.Fatalf("instance should be kept on close by default")
+	}
+
+	rcs, svc = newTestServer(spec.RegistryTypeEureka)
+	rcs.SingleShot = true
+	rcs.DeregisterOnClose = true
+	if err := rcs.Register(testServiceSpec(), ready, ready); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	rcs.Close()
+	if rcs.Registered() || svc.GetServiceInstanceSpec("order", "order-01") != nil {
+		t.Fatalf("instance should be deregistered on close")
+	}
+}
+
+func TestDeregisterRetry(t *testing.T) {
+	mc := clustertest.NewMemCluster()
+	deleteKey, failures := mc.MockedDelete, 0
+	mc.MockedDelete = func(key string) error {
+		if failures > 0 {
+			failures--
+			return fmt.Errorf("etcd unavailable")
+		}
+		return deleteKey(key)
+	}
+
+	rcs, svc := newTestServerOnCluster(spec.RegistryTypeEureka, mc)
+	rcs.SingleShot = true
+	rcs.BackoffBase = 10 * time.Millisecond
+	register := func() {
+		if err := rcs.Register(testServiceSpec(), ready, ready); err != nil {
+			t.Fatalf("register failed: %v", err)
+		}
+	}
+
+	register()
+	failures = 1
+	if err := rcs.Deregister(); err == nil {
+		t.Fatalf("want error without retries")
+	}
+	if rcs.Registered() || svc.GetServiceInstanceSpec("order", "order-01") == nil {
+		t.Fatalf("instance should be deregistered with its record left")
+	}
+
+	rcs.MaxDeregisterAttempts = 3
+	register()
+	failures = 1
+	if err := rcs.Deregister(); err != nil {
+		t.Fatalf("deregister failed: %v", err)
+	}
+	if svc.GetServiceInstanceSpec("order", "order-01") != nil {
+		t.Fatalf("record should be deleted by the retry")
+	}
+
+	rcs.MaxDeregisterAttempts = 100
+	rcs.DeregisterTimeout = 50 * time.Millisecond
+	register()
+	failures = 100
+	start := time.Now()
+	if err := rcs.Deregister(); err == nil || !strings.Contains(err.Error(), "canceled") {
+		t.Fatalf("want canceled error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("retries should end within the timeout, took %v", elapsed)
+	}
+}
+
+func TestSelfHeal(t *testing.T) {
+	rcs, svc := newTestServer(spec.RegistryTypeEureka)
+	defer rcs.Close()
+	if repaired, err := rcs.SelfHeal(); err != nil || repaired != 0 {
+		t.Fatalf("want nothing repaired before registered, got %d, %v", repaired, err)
+	}
+
+	rcs.SingleShot = true
+	if err := rcs.Register(testServiceSpec(), ready, ready); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if repaired, err := rcs.SelfHeal(); err != nil || repaired != 0 {
+		t.Fatalf("want nothing repaired if consistent, got %d, %v", repaired, err)
+	}
+
+	svc.DeleteServiceInstanceSpec("order", "order-01")
+	if repaired, err := rcs.SelfHeal(); err != nil || repaired != 1 {
+		t.Fatalf("want the missing record repaired, got %d, %v", repaired, err)
+	}
+	if ins := svc.GetServiceInstanceSpec("order", "order-01"); ins == nil || ins.Port != 13001 {
+		t.Fatalf("want the record put again, got %+v", ins)
+	}
+
+	svc.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+		ServiceName: "order", InstanceID: "order-stale", IP: "10.0.0.1", Port: 13001, Status: spec.ServiceStatusUp,
+	})
+	svc.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+		ServiceName: "order", InstanceID: "order-other", IP: "10.0.0.1", Port: 13003, Status: spec.ServiceStatusUp,
+	})
+	if repaired, err := rcs.SelfHeal(); err != nil || repaired != 1 {
+		t.Fatalf("want the stale record repaired, got %d, %v", repaired, err)
+	}
+	if svc.GetServiceInstanceSpec("order", "order-stale") != nil {
+		t.Fatalf("orphaned record at the address of the instance should be deleted")
+	}
+	if svc.GetServiceInstanceSpec("order", "order-other") == nil {
+		t.Fatalf("record at another address should be kept")
+	}
+
+	if repaired, err := rcs.SelfHeal(); err != nil || repaired != 0 {
+		t.Fatalf("want nothing repaired again, got %d, %v", repaired, err)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("close more than once panics: %v", r)
+		}
+	}()
+
+	rcs, _ := newTestServer(spec.RegistryTypeEureka)
+	rcs.Register(testServiceSpec(), ready, ready)
+	waitRegistered(t, rcs)
+	for i := 0; i < 3; i++ {
+		rcs.Close()
+	}
+
+	rcs, _ = newTestServer(spec.RegistryTypeEureka)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rcs.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPreflight(t *testing.T) {
+	mc := clustertest.NewMemCluster()
+	rcs, _ := newTestServerOnCluster(spec.RegistryTypeEureka, mc)
+	if err := rcs.Preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+
+	rcs, _ = newTestServerOnCluster("zookeeper", mc)
+	if err := rcs.Preflight(); err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Fatalf("want unsupported registry type error, got %v", err)
+	}
+
+	mc.MockedCurrentRevision = func() (int64, error) {
+		return 0, fmt.Errorf("etcd unavailable")
+	}
+	rcs, _ = newTestServerOnCluster(spec.RegistryTypeConsul, mc)
+	if err := rcs.Preflight(); err == nil || !strings.Contains(err.Error(), "etcd unavailable") {
+		t.Fatalf("want storage down error, got %v", err)
+	}
+}
+
+func TestLabelKeyNormalization(t *testing.T) {
+	labels := map[string]string{
+		"Version":                "v1",
+		"app.kubernetes.io/Name": "order",
+		"team":                   "shop",
+		"Team":                   "dropped",
+		"MESH.zone":              "spoofed",
+	}
+
+	rcs, _ := newTestServer(spec.RegistryTypeConsul)
+	if got := rcs.clientLabels(labels); !reflect.DeepEqual(got, labels) {
+		t.Fatalf("labels should not be normalized by default, got %v", got)
+	}
+
+	rcs.LabelKeyNormalization = LabelKeyNormalization{Lowercase: true, Sanitize: true}
+	want := map[string]string{
+		"version":                "v1",
+		"app_kubernetes_io_name": "order",
+		"team":                   "shop",
+		"mesh_zone":              "spoofed",
+	}
+	if got := rcs.clientLabels(labels); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	rcs.LabelKeyNormalization = LabelKeyNormalization{Lowercase: true, PreserveOriginal: true}
+	got := rcs.clientLabels(labels)
+	if got["version"] != "v1" || got["Version"] != "v1" || got["app.kubernetes.io/name"] != "order" {
+		t.Fatalf("want both normalized and original keys, got %v", got)
+	}
+	if _, exists := got["mesh.zone"]; exists {
+		t.Fatalf("reserved key made by the normalization should be dropped, got %v", got)
+	}
+
+	rcs.LabelKeyNormalization = LabelKeyNormalization{Lowercase: true, Sanitize: true}
+	body := []byte(`[{"Name": "order", "ID": "order-01", "Address": "10.0.0.1", "Port": 8080, "Meta": {"Git.Commit": "abc"}}]`)
+	specs, err := rcs.DecodeRegistryBatch(ContentTypeJSON, body)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if specs[0].Labels["git_commit"] != "abc" || len(specs[0].Labels) != 1 {
+		t.Fatalf("want normalized labels while decoding, got %v", specs[0].Labels)
+	}
+}
+
+func TestConfirmWrites(t *testing.T) {
+	mc := clustertest.NewMemCluster()
+	rcs, svc := newTestServerOnCluster(spec.RegistryTypeEureka, mc)
+	rcs.ConfirmWrites = true
+
+	// The first write is lost silently.
+	var writes int32
+	putWithLease := mc.MockedPutWithLease
+	mc.MockedPutWithLease = func(key, value string, leaseID clientv3.LeaseID) error {
+		if atomic.AddInt32(&writes, 1) == 1 {
+			return nil
+		}
+		return putWithLease(key, value, leaseID)
+	}
+
+	ins := &spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-02", IP: "10.0.0.2", Port: 8080}
+	if err := rcs.RegisterBatch([]*spec.ServiceInstanceSpec{ins}, ready, ready); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if n := atomic.LoadInt32(&writes); n != 2 {
+		t.Fatalf("want the lost write retried once, got %d writes", n)
+	}
+	if svc.GetServiceInstanceSpec("order", "order-02") == nil {
+		t.Fatalf("instance should be registered after retrying")
+	}
+
+	// All writes are lost.
+	mc.MockedPutWithLease = func(key, value string, leaseID clientv3.LeaseID) error {
+		atomic.AddInt32(&writes, 1)
+		return nil
+	}
+	ins = &spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-03", IP: "10.0.0.3", Port: 8080}
+	if err := rcs.RegisterBatch([]*spec.ServiceInstanceSpec{ins}, ready, ready); err == nil {
+		t.Fatalf("want error if writes are never confirmed")
+	}
+	if n := atomic.LoadInt32(&writes); n != 2+confirmWriteAttempts {
+		t.Fatalf("want %d attempts, got %d writes", confirmWriteAttempts, n-2)
+	}
+}
+
+func TestAffinitySelector(t *testing.T) {
+	var instances []*spec.ServiceInstanceSpec
+	for i := 0; i < 5; i++ {
+		instances = append(instances, &spec.ServiceInstanceSpec{
+			ServiceName: "order", InstanceID: fmt.Sprintf("order-%02d", i),
+		})
+	}
+
+	as := NewAffinitySelector(instances)
+	mapping := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("session-%d", i)
+		mapping[key] = as.Select(key).InstanceID
+	}
+	for key, id := range mapping {
+		if got := as.Select(key).InstanceID; got != id {
+			t.Fatalf("key %s mapped to %s, then to %s", key, id, got)
+		}
+	}
+
+	removed := instances[2].InstanceID
+	as.Update(append(instances[:2:2], instances[3:]...))
+	moved := 0
+	for key, id := range mapping {
+		got := as.Select(key).InstanceID
+		if got == removed {
+			t.Fatalf("key %s mapped to removed instance", key)
+		}
+		if id != removed && got != id {
+			moved++
+		}
+	}
+	if moved > len(mapping)/10 {
+		t.Fatalf("want keys of remaining instances mostly kept, %d of %d moved", moved, len(mapping))
+	}
+
+	as.Update(nil)
+	if as.Select("session-0") != nil {
+		t.Fatalf("want nil without instances")
+	}
+}
+
+func TestRegisterIngressOnly(t *testing.T) {
+	rcs, svc := newTestServer(spec.RegistryTypeEureka)
+	rcs.SingleShot = true
+	if err := rcs.Register(testServiceSpec(), ready, notReady); err == nil {
+		t.Fatalf("want error if egress is not ready by default")
+	}
+	if svc.GetServiceInstanceSpec("order", "order-01") != nil {
+		t.Fatalf("instance should not be registered")
+	}
+
+	serviceSpec := testServiceSpec()
+	serviceSpec.IngressOnly = true
+	if err := rcs.Register(serviceSpec, notReady, ready); err == nil {
+		t.Fatalf("want error if ingress is not ready")
+	}
+	if err := rcs.Register(serviceSpec, ready, notReady); err != nil {
+		t.Fatalf("ingress only service should be registered despite egress: %v", err)
+	}
+	if !rcs.Registered() || svc.GetServiceInstanceSpec("order", "order-01") == nil {
+		t.Fatalf("instance should be registered")
+	}
+}
+
+func TestRegistrationHooks(t *testing.T) {
+	rcs, _ := newTestServer(spec.RegistryTypeEureka)
+	rcs.SingleShot = true
+	defer rcs.Close()
+
+	var registered, deregistered int32
+	rcs.OnRegistered(func() {
+		if !rcs.Registered() {
+			t.Errorf("want registered in hook")
+		}
+		atomic.AddInt32(&registered, 1)
+	})
+	rcs.OnDeregistered(func() { atomic.AddInt32(&deregistered, 1) })
+
+	assertHooks := func(wantRegistered, wantDeregistered int32) {
+		t.Helper()
+		if got := atomic.LoadInt32(&registered); got != wantRegistered {
+			t.Fatalf("want registered hook called %d times, got %d", wantRegistered, got)
+		}
+		if got := atomic.LoadInt32(&deregistered); got != wantDeregistered {
+			t.Fatalf("want deregistered hook called %d times, got %d", wantDeregistered, got)
+		}
+	}
+
+	if err := rcs.Deregister(); err != nil {
+		t.Fatalf("deregister failed: %v", err)
+	}
+	assertHooks(0, 0)
+
+	if err := rcs.Register(testServiceSpec(), notReady, ready); err == nil {
+		t.Fatalf("want error for not ready ingress")
+	}
+	assertHooks(0, 0)
+
+	if err := rcs.Register(testServiceSpec(), ready, ready); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	assertHooks(1, 0)
+
+	// The re-registrations keep it registered without calling the hook.
+	for i := 0; i < 3; i++ {
+		if err := rcs.registerRoutine(rcs.instanceSpec, ready, ready); err != nil {
+			t.Fatalf("re-register failed: %v", err)
+		}
+	}
+	rcs.instanceSpec.Labels = map[string]string{"version": "v2"}
+	if err := rcs.registerRoutine(rcs.instanceSpec, ready, ready); err != nil {
+		t.Fatalf("re-register failed: %v", err)
+	}
+	if err := rcs.Register(testServiceSpec(), ready, ready); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	assertHooks(1, 0)
+
+	if err := rcs.Deregister(); err != nil {
+		t.Fatalf("deregister failed: %v", err)
+	}
+	assertHooks(1, 1)
+	if err := rcs.Deregister(); err != nil {
+		t.Fatalf("deregister failed: %v", err)
+	}
+	assertHooks(1, 1)
+
+	if err := rcs.Register(testServiceSpec(), ready, ready); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	assertHooks(2, 1)
+}
+
+func TestRegisteredC(t *testing.T) {
+	rcs, _ := newTestServer(spec.RegistryTypeEureka)
+	rcs.SingleShot = true
+
+	receive := func() (bool, bool) {
+		select {
+		case registered, ok := <-rcs.RegisteredC():
+			if !ok {
+				return false, false
+			}
+			return registered, true
+		default:
+			t.Fatalf("want registered state sent")
+			return false, false
+		}
+	}
+	assertNothing := func() {
+		select {
+		case registered := <-rcs.RegisteredC():
+			t.Fatalf("want nothing sent, got %v", registered)
+		default:
+		}
+	}
+
+	if err := rcs.Register(testServiceSpec(), ready, ready); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if registered, _ := receive(); !registered {
+		t.Fatalf("want registered sent")
+	}
+	if err := rcs.registerRoutine(rcs.instanceSpec, ready, ready); err != nil {
+		t.Fatalf("re-register failed: %v", err)
+	}
+	assertNothing()
+
+	if err := rcs.Deregister(); err != nil {
+		t.Fatalf("deregister failed: %v", err)
+	}
+	if registered, _ := receive(); registered {
+		t.Fatalf("want deregistered sent")
+	}
+
+	// The value not received blocks neither the registration nor the deregistration.
+	rcs.Register(testServiceSpec(), ready, ready)
+	rcs.Deregister()
+	if registered, _ := receive(); !registered {
+		t.Fatalf("want the first change kept")
+	}
+	assertNothing()
+
+	rcs.Close()
+	if _, ok := receive(); ok {
+		t.Fatalf("want channel closed by Close")
+	}
+}
+
+func TestRegisterLeader(t *testing.T) {
+	mc := clustertest.NewMemCluster()
+	rcs1, svc := newTestServerOnCluster(spec.RegistryTypeEureka, mc)
+	rcs2, _ := newTestServerOnCluster(spec.RegistryTypeEureka, mc)
+	rcs2.instanceSpec.InstanceID = "order-02"
+	rcs2.instanceSpec.IP = "10.0.0.2"
+	for _, rcs := range []*Server{rcs1, rcs2} {
+		rcs.LeaseTTL = 300 * time.Millisecond
+		if err := rcs.RegisterLeader(testServiceSpec(), ready, ready); err != nil {
+			t.Fatalf("register leader failed: %v", err)
+		}
+		waitRegistered(t, rcs)
+	}
+	defer rcs2.Close()
+
+	waitStatus := func(instanceID, status string) {
+		for i := 0; i < 100; i++ {
+			ins := svc.GetServiceInstanceSpec("order", instanceID)
+			if ins != nil && ins.Status == status {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("instance %s not %s in time", instanceID, status)
+	}
+
+	waitStatus("order-01", spec.ServiceStatusUp)
+	waitStatus("order-02", spec.ServiceStatusOutOfService)
+	if !rcs1.IsLeader() || rcs2.IsLeader() {
+		t.Fatalf("want order-01 to be the leader")
+	}
+
+	// The leader dies, and its record expires with the lease.
+	leaseID, err := rcs1.instanceLease()
+	if err != nil {
+		t.Fatalf("get lease failed: %v", err)
+	}
+	rcs1.Close()
+	if err = svc.RevokeLease(leaseID); err != nil {
+		t.Fatalf("revoke lease failed: %v", err)
+	}
+
+	waitStatus("order-02", spec.ServiceStatusUp)
+	if !rcs2.IsLeader() {
+		t.Fatalf("want order-02 to take over the leadership")
+	}
+
+	// The leadership is handed over to the new standby once resigned.
+	rcs3, _ := newTestServerOnCluster(spec.RegistryTypeEureka, mc)
+	rcs3.LeaseTTL = 300 * time.Millisecond
+	rcs3.RegisterLeader(testServiceSpec(), ready, ready)
+	defer rcs3.Close()
+	waitRegistered(t, rcs3)
+	waitStatus("order-01", spec.ServiceStatusOutOfService)
+
+	if err = rcs2.Deregister(); err != nil {
+		t.Fatalf("deregister failed: %v", err)
+	}
+	waitStatus("order-01", spec.ServiceStatusUp)
+	if !rcs3.IsLeader() {
+		t.Fatalf("want order-01 to take over the leadership after resigned")
+	}
+}
+
+func TestInstanceHistory(t *testing.T) {
+	rcs, svc := newTestServer(spec.RegistryTypeEureka)
+	rcs.SingleShot = true
+	if err := rcs.Register(testServiceSpec(), ready, ready); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if err := rcs.Deregister(); err != nil {
+		t.Fatalf("deregister failed: %v", err)
+	}
+	if history, _ := rcs.History("order"); len(history) != 0 {
+		t.Fatalf("want no history if disabled, got %v", history)
+	}
+
+	rcs, svc = newTestServer(spec.RegistryTypeEureka)
+	rcs.SingleShot = true
+	rcs.HistoryRetention = time.Hour
+
+	old := &spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-00", IP: "10.0.0.1", Port: 13001}
+	rcs.recordHistory(old, time.Now().Add(-2*time.Hour))
+	if history, _ := rcs.History("order"); len(history) != 0 {
+		t.Fatalf("want expired history excluded, got %v", history)
+	}
+
+	if err := rcs.Register(testServiceSpec(), ready, ready); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if err := rcs.Deregister(); err != nil {
+		t.Fatalf("deregister failed: %v", err)
+	}
+
+	history, err := rcs.History("order")
+	if err != nil {
+		t.Fatalf("get history failed: %v", err)
+	}
+	if len(history) != 1 || history[0].InstanceID != "order-01" || history[0].Port != 13001 || history[0].DeleteTime == "" {
+		t.Fatalf("want deregistered order-01 in history, got %+v", history)
+	}
+
+	// The expired record is trimmed while recording the new one.
+	records, _ := svc.ListServiceInstanceHistory("order")
+	if len(records) != 1 {
+		t.Fatalf("want expired history trimmed, got %d records", len(records))
+	}
+}
+
+func TestListInstancesByOrigin(t *testing.T) {
+	mc := clustertest.NewMemCluster()
+	eurekaServer, _ := newTestServerOnCluster(spec.RegistryTypeEureka, mc)
+	consulServer, _ := newTestServerOnCluster(spec.RegistryTypeConsul, mc)
+
+	specs, err := eurekaServer.DecodeRegistryBatch(ContentTypeJSON, []byte(`[
+		{"instanceId": "order-01", "app": "ORDER", "ipAddr": "10.0.0.1", "port": {"$": 8080, "@enabled": true}},
+		{"instanceId": "order-02", "app": "ORDER", "ipAddr": "10.0.0.2", "port": {"$": 8080, "@enabled": true}}
+	]`))
+	if err != nil {
+		t.Fatalf("decode eureka batch failed: %v", err)
+	}
+	if err = eurekaServer.RegisterBatch(specs, ready, ready); err != nil {
+		t.Fatalf("register eureka batch failed: %v", err)
+	}
+
+	specs, err = consulServer.DecodeRegistryBatch(ContentTypeJSON, []byte(
+		`{"ID": "order-03", "Name": "order", "Address": "10.0.0.3", "Port": 8080}`))
+	if err != nil {
+		t.Fatalf("decode consul body failed: %v", err)
+	}
+	if err = consulServer.RegisterBatch(specs, ready, ready); err != nil {
+		t.Fatalf("register consul batch failed: %v", err)
+	}
+
+	ids := func(origin string) []string {
+		instances, err := eurekaServer.ListInstancesByOrigin("order", origin)
+		if err != nil {
+			t.Fatalf("list instances by origin %s failed: %v", origin, err)
+		}
+		ids := []string{}
+		for _, ins := range instances {
+			ids = append(ids, ins.InstanceID)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	if got := ids(spec.RegistryTypeEureka); !reflect.DeepEqual(got, []string{"order-01", "order-02"}) {
+		t.Fatalf("want eureka instances order-01 and order-02, got %v", got)
+	}
+	if got := ids(spec.RegistryTypeConsul); !reflect.DeepEqual(got, []string{"order-03"}) {
+		t.Fatalf("want consul instance order-03, got %v", got)
+	}
+	if got := ids(spec.RegistryTypeNacos); len(got) != 0 {
+		t.Fatalf("want no nacos instances, got %v", got)
+	}
+}
+
+func TestCheckNacosRegistryBody(t *testing.T) {
+	rcs, _ := newTestServer(spec.RegistryTypeNacos)
+
+	form := url.Values{
+		"serviceName": {"DEFAULT_GROUP@@order"},
+		"ip":          {"10.0.0.1"},
+		"port":        {"8080"},
+		"metadata":    {`{"version":"v2","mesh.foo":"bar"}`},
+		"ephemeral":   {"true"},
+	}
+	if err := rcs.CheckRegistryBody(ContentTypeForm, []byte(form.Encode())); err != nil {
+		t.Fatalf("check nacos form body failed: %v", err)
+	}
+	labels := rcs.instanceSpec.Labels
+	if labels["version"] != "v2" {
+		t.Fatalf("want metadata merged into labels, got %v", labels)
+	}
+	if _, ok := labels["mesh.foo"]; ok {
+		t.Fatalf("reserved client label should be dropped")
+	}
+	if rcs.instanceSpec.RegistryType != spec.RegistryTypeNacos {
+		t.Fatalf("want nacos origin, got %s", rcs.instanceSpec.RegistryType)
+	}
+
+	body := []byte(`{"serviceName": "order", "ip": "10.0.0.1", "port": "8080", "metadata": "{\"team\":\"shop\"}"}`)
+	if err := rcs.CheckRegistryBody(ContentTypeJSON, body); err != nil {
+		t.Fatalf("check nacos json body failed: %v", err)
+	}
+	if rcs.instanceSpec.Labels["team"] != "shop" {
+		t.Fatalf("want metadata of json body merged, got %v", rcs.instanceSpec.Labels)
+	}
+
+	for name, values := range map[string]url.Values{
+		"unknown service": {"serviceName": {"DEFAULT_GROUP@@payment"}, "ip": {"10.0.0.1"}, "port": {"8080"}},
+		"missing ip":      {"serviceName": {"order"}, "port": {"8080"}},
+		"invalid port":    {"serviceName": {"order"}, "ip": {"10.0.0.1"}, "port": {"http"}},
+		"invalid bool":    {"serviceName": {"order"}, "ip": {"10.0.0.1"}, "port": {"8080"}, "ephemeral": {"maybe"}},
+		"invalid meta":    {"serviceName": {"order"}, "ip": {"10.0.0.1"}, "port": {"8080"}, "metadata": {"{"}},
+	} {
+		if err := rcs.CheckRegistryBody(ContentTypeForm, []byte(values.Encode())); err == nil {
+			t.Fatalf("want error for %s", name)
+		}
+	}
+	err := rcs.CheckRegistryBody(ContentTypeForm, []byte("serviceName=payment&ip=10.0.0.1&port=8080"))
+	if err == nil || !strings.Contains(err.Error(), "unknown service payment") {
+		t.Fatalf("want descriptive error for unknown service, got %v", err)
+	}
+}
+
+func TestDecodeZookeeperBody(t *testing.T) {
+	rcs, _ := newTestServer(spec.RegistryTypeZookeeper)
+
+	provider := "dubbo://10.0.0.1:20880/com.foo.OrderService?application=order&version=1.0.0&side=provider&methods=get%2Clist"
+	ins, err := rcs.decodeByZookeeperFormat([]byte(provider))
+	if err != nil {
+		t.Fatalf("decode dubbo provider failed: %v", err)
+	}
+	if ins.ServiceName != "order" || ins.IP != "10.0.0.1" || ins.Port != 20880 {
+		t.Fatalf("want order at 10.0.0.1:20880, got %s at %s:%d", ins.ServiceName, ins.IP, ins.Port)
+	}
+	if ins.Labels["version"] != "1.0.0" || ins.Labels["methods"] != "get,list" {
+		t.Fatalf("want query parameters in labels, got %v", ins.Labels)
+	}
+	if _, ok := ins.Labels["application"]; ok {
+		t.Fatalf("application should not be a label")
+	}
+
+	escaped, err := rcs.decodeByZookeeperFormat([]byte(url.QueryEscape(provider)))
+	if err != nil {
+		t.Fatalf("decode escaped dubbo provider failed: %v", err)
+	}
+	if !reflect.DeepEqual(ins, escaped) {
+		t.Fatalf("want %+v from escaped provider, got %+v", ins, escaped)
+	}
+
+	if err := rcs.CheckRegistryBody(ContentTypeJSON, []byte(provider)); err != nil {
+		t.Fatalf("check zookeeper body failed: %v", err)
+	}
+	if rcs.instanceSpec.Labels["version"] != "1.0.0" || rcs.instanceSpec.RegistryType != spec.RegistryTypeZookeeper {
+		t.Fatalf("want labels and zookeeper origin, got %+v", rcs.instanceSpec)
+	}
+
+	specs, err := rcs.DecodeRegistryBatch(ContentTypeJSON, []byte(provider+"\n"+strings.Replace(provider, "10.0.0.1", "10.0.0.2", 1)))
+	if err != nil {
+		t.Fatalf("decode zookeeper batch failed: %v", err)
+	}
+	if len(specs) != 2 || specs[1].IP != "10.0.0.2" || specs[0].InstanceID == specs[1].InstanceID {
+		t.Fatalf("want 2 distinct providers, got %+v", specs)
+	}
+
+	err = rcs.CheckRegistryBody(ContentTypeJSON, []byte("http://10.0.0.1:8080/com.foo.OrderService?application=order"))
+	if err == nil || !strings.Contains(err.Error(), "want: dubbo://") {
+		t.Fatalf("want descriptive error for non-dubbo scheme, got %v", err)
+	}
+	for name, body := range map[string]string{
+		"unknown service": "dubbo://10.0.0.1:20880/com.foo.PayService?application=payment",
+		"no application":  "dubbo://10.0.0.1:20880/com.foo.OrderService?version=1.0.0",
+		"invalid port":    "dubbo://10.0.0.1:dubbo/com.foo.OrderService?application=order",
+		"no port":         "dubbo://10.0.0.1/com.foo.OrderService?application=order",
+	} {
+		if err := rcs.CheckRegistryBody(ContentTypeJSON, []byte(body)); err == nil {
+			t.Fatalf("want error for %s", name)
+		}
+	}
+}
+
+func TestCollisionPolicy(t *testing.T) {
+	newIns := func(ip string) *spec.ServiceInstanceSpec {
+		return &spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-01", IP: ip, Port: 8080}
+	}
+	register := func(rcs *Server, ip string) error {
+		return rcs.RegisterBatch([]*spec.ServiceInstanceSpec{newIns(ip)}, ready, ready)
+	}
+
+	rcs, svc := newTestServer(spec.RegistryTypeEureka)
+	if err := register(rcs, "10.0.0.1"); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if err := register(rcs, "10.0.0.2"); err != nil {
+		t.Fatalf("register colliding instance failed: %v", err)
+	}
+	instances := svc.ListServiceInstanceSpecs("order")
+	if len(instances) != 1 || instances[0].IP != "10.0.0.2" {
+		t.Fatalf("want the last writer wins, got %v", instances)
+	}
+
+	rcs, svc = newTestServer(spec.RegistryTypeEureka)
+	rcs.CollisionPolicy = CollisionPolicyReject
+	if err := register(rcs, "10.0.0.1"); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if err := register(rcs, "10.0.0.1"); err != nil {
+		t.Fatalf("re-register the same instance failed: %v", err)
+	}
+	err := register(rcs, "10.0.0.2")
+	if err == nil || !strings.Contains(err.Error(), spec.ErrInstanceIDTaken.Error()) {
+		t.Fatalf("want colliding instance rejected, got %v", err)
+	}
+	if ins := svc.GetServiceInstanceSpec("order", "order-01"); ins == nil || ins.IP != "10.0.0.1" {
+		t.Fatalf("want the first instance kept, got %v", ins)
+	}
+
+	rcs, svc = newTestServer(spec.RegistryTypeEureka)
+	rcs.CollisionPolicy = CollisionPolicyAutoSuffix
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.2", "10.0.0.3", "10.0.0.1"} {
+		if err := register(rcs, ip); err != nil {
+			t.Fatalf("register %s failed: %v", ip, err)
+		}
+	}
+	if n := len(svc.ListServiceInstanceSpecs("order")); n != 3 {
+		t.Fatalf("want 3 instances, got %d", n)
+	}
+	for instanceID, ip := range map[string]string{"order-01": "10.0.0.1", "order-01-2": "10.0.0.2", "order-01-3": "10.0.0.3"} {
+		if ins := svc.GetServiceInstanceSpec("order", instanceID); ins == nil || ins.IP != ip {
+			t.Fatalf("want %s at %s, got %v", instanceID, ip, ins)
+		}
+	}
+}
+
+func TestMigrateEurekaToConsul(t *testing.T) {
+	mc := clustertest.NewMemCluster()
+	rcs, svc := newTestServerOnCluster(spec.RegistryTypeEureka, mc)
+
+	body := `<instance><instanceId>order-09</instanceId><app>ORDER</app><vipAddress>order</vipAddress>` +
+		`<ipAddr>10.0.0.9</ipAddr><port enabled="true">8089</port>` +
+		`<metadata><management.port>9090</management.port><team>shop</team></metadata></instance>`
+	specs, err := rcs.DecodeRegistryBatch(ContentTypeXML, []byte(body))
+	if err != nil {
+		t.Fatalf("decode eureka body failed: %v", err)
+	}
+	if err := rcs.RegisterBatch(specs, ready, ready); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	svc.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-10",
+		IP: "10.0.0.10", Port: 8089, RegistryType: spec.RegistryTypeConsul, Labels: map[string]string{"a.b": "c"}})
+	key := layout.ServiceInstanceSpecKey("order", "order-09")
+	lease := mc.KeyValue(key).Lease
+
+	n, err := rcs.MigrateEurekaToConsul("order")
+	if err != nil || n != 1 {
+		t.Fatalf("want 1 instance migrated, got %d: %v", n, err)
+	}
+	if got := mc.KeyValue(key).Lease; got != lease {
+		t.Fatalf("want lease %x kept, got %x", lease, got)
+	}
+	if ins := svc.GetServiceInstanceSpec("order", "order-10"); ins.Labels["a.b"] != "c" {
+		t.Fatalf("consul-origin instance should be left as it is, got %v", ins.Labels)
+	}
+
+	ins := svc.GetServiceInstanceSpec("order", "order-09")
+	if ins.RegistryType != spec.RegistryTypeConsul || ins.Labels["management_port"] != "9090" || ins.Labels["team"] != "shop" {
+		t.Fatalf("unexpected migrated instance: %+v", ins)
+	}
+
+	buff, err := json.Marshal(rcs.ToConsulRegistration(ins))
+	if err != nil {
+		t.Fatalf("marshal consul registration failed: %v", err)
+	}
+	consulRCS, _ := newTestServer(spec.RegistryTypeConsul)
+	decoded, err := consulRCS.DecodeRegistryBody(ContentTypeJSON, buff)
+	if err != nil {
+		t.Fatalf("decode consul registration failed: %v", err)
+	}
+	if decoded.InstanceID != "order-09" || decoded.IP != "10.0.0.9" || decoded.Port != 8089 ||
+		!reflect.DeepEqual(decoded.Labels, map[string]string{"management_port": "9090", "team": "shop"}) {
+		t.Fatalf("unexpected consul registration: %s", buff)
+	}
+
+	// Migrating again changes nothing.
+	n, err = rcs.MigrateEurekaToConsul("order")
+	if err != nil || n != 0 {
+		t.Fatalf("want no instance migrated again, got %d: %v", n, err)
+	}
+	if again := svc.GetServiceInstanceSpec("order", "order-09"); !reflect.DeepEqual(again, ins) {
+		t.Fatalf("want %+v unchanged, got %+v", ins, again)
+	}
+
+	svc.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-11", IP: "10.0.0.11", Port: 8089,
+		RegistryType: spec.RegistryTypeEureka, Labels: map[string]string{"a.b": "1", "a_b": "2"}})
+	if _, err := rcs.MigrateEurekaToConsul("order"); err == nil {
+		t.Fatalf("want error for the conflicting meta keys")
+	}
+	if ins := svc.GetServiceInstanceSpec("order", "order-11"); ins.RegistryType != spec.RegistryTypeEureka {
+		t.Fatalf("instance failed to migrate should be left as it is")
+	}
+}
+
+func TestMaxInstances(t *testing.T) {
+	mc := clustertest.NewMemCluster()
+	rcs, svc := newTestServerOnCluster(spec.RegistryTypeEureka, mc)
+	rcs.MaxInstances = 2
+
+	specs := []*spec.ServiceInstanceSpec{
+		{ServiceName: "order", InstanceID: "order-01", IP: "10.0.0.1", Port: 8080},
+		{ServiceName: "order", InstanceID: "order-02", IP: "10.0.0.2", Port: 8080},
+	}
+	if err := rcs.RegisterBatch(specs, ready, ready); err != nil {
+		t.Fatalf("register batch failed: %v", err)
+	}
+
+	newIns := &spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-03", IP: "10.0.0.3", Port: 8080}
+	err := rcs.RegisterBatch([]*spec.ServiceInstanceSpec{newIns}, ready, ready)
+	if err == nil || !strings.Contains(err.Error(), spec.ErrRegistryFull.Error()) {
+		t.Fatalf("want registry full error, got %v", err)
+	}
+	if svc.GetServiceInstanceSpec("order", "order-03") != nil {
+		t.Fatalf("new instance should be rejected at the limit")
+	}
+	specs[0].Port = 8081
+	if err = rcs.RegisterBatch(specs[:1], ready, ready); err != nil {
+		t.Fatalf("existing instance should be updated at the limit: %v", err)
+	}
+
+	// order-01 is stale and older, order-02 keeps its heartbeat.
+	rcs.EvictionPolicy = EvictionPolicyEvictOldestStale
+	rcs.EvictionStaleThreshold = time.Minute
+	for i, id := range []string{"order-01", "order-02"} {
+		ins := svc.GetServiceInstanceSpec("order", id)
+		ins.RegistryTime = time.Now().Add(-time.Duration(10-i) * time.Minute).Format(time.RFC3339)
+		svc.PutServiceInstanceSpec(ins)
+	}
+	for id, heartbeat := range map[string]time.Time{"order-01": time.Now().Add(-5 * time.Minute), "order-02": time.Now()} {
+		buff, _ := json.Marshal(&spec.ServiceInstanceStatus{ServiceName: "order", InstanceID: id, LastHeartbeatTime: heartbeat.Format(time.RFC3339)})
+		mc.MockedPut(layout.ServiceInstanceStatusKey("order", id), string(buff))
+	}
+
+	if err = rcs.RegisterBatch([]*spec.ServiceInstanceSpec{newIns}, ready, ready); err != nil {
+		t.Fatalf("want stale instance evicted for the new one: %v", err)
+	}
+	if svc.GetServiceInstanceSpec("order", "order-01") != nil {
+		t.Fatalf("oldest stale instance should be evicted")
+	}
+	if svc.GetServiceInstanceSpec("order", "order-02") == nil || svc.GetServiceInstanceSpec("order", "order-03") == nil {
+		t.Fatalf("healthy and new instances should be kept")
+	}
+
+	// Neither the healthy one nor the one registered just now is evictable.
+	newIns = &spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-04", IP: "10.0.0.4", Port: 8080}
+	err = rcs.RegisterBatch([]*spec.ServiceInstanceSpec{newIns}, ready, ready)
+	if err == nil || !strings.Contains(err.Error(), spec.ErrRegistryFull.Error()) {
+		t.Fatalf("want registry full error without stale instances, got %v", err)
+	}
+}
+
+func TestEncodeForm(t *testing.T) {
+	type instance struct {
+		ID     string            `json:"id"`
+		Port   int               `json:"port"`
+		Tags   []string          `json:"tags"`
+		Meta   map[string]string `json:"meta,omitempty"`
+		Weight *int              `json:"weight"`
+	}
+	instances := []instance{
+		{ID: "order-01", Port: 8080, Tags: []string{"v1", "canary"}, Meta: map[string]string{"zone": "us-east"}},
+		{ID: "order-02", Port: 8081},
+	}
+
+	buff, err := EncodeForm(instances)
+	if err != nil {
+		t.Fatalf("encode form failed: %v", err)
+	}
+	want := "0.id=order-01&0.meta.zone=us-east&0.port=8080&0.tags=v1&0.tags=canary&1.id=order-02&1.port=8081"
+	if string(buff) != want {
+		t.Fatalf("want form %s, got %s", want, buff)
+	}
+
+	values, err := url.ParseQuery(string(buff))
+	if err != nil {
+		t.Fatalf("parse form failed: %v", err)
+	}
+	if tags := values["0.tags"]; !reflect.DeepEqual(tags, []string{"v1", "canary"}) {
+		t.Fatalf("want repeated tags, got %v", tags)
+	}
+
+	rcs, _ := newTestServer(spec.RegistryTypeConsul)
+	catalog := rcs.ToConsulCatalogService(&ServiceRegistryInfo{Ins: &spec.ServiceInstanceSpec{
+		ServiceName: "order", InstanceID: "order-01", IP: "10.0.0.1", Port: 8080,
+	}})
+	catalog[0].ServiceTags = []string{"v1", "canary"}
+	buff, err = EncodeForm(catalog)
+	if err != nil {
+		t.Fatalf("encode form failed: %v", err)
+	}
+	values, _ = url.ParseQuery(string(buff))
+	if values.Get("0.ServiceName") != "order" || values.Get("0.ServicePort") != "8080" ||
+		!reflect.DeepEqual(values["0.ServiceTags"], []string{"v1", "canary"}) {
+		t.Fatalf("unexpected form of consul catalog: %s", buff)
+	}
+}
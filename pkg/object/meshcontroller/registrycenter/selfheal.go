@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"fmt"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+)
+
+// SelfHeal verifies the records of the registered instances against the storage,
+// e.g. in a periodic job. The missing or mismatched records are put again, and the
+// orphaned records at the addresses of the instances, which are left with other
+// instanceIDs, are deleted. It returns the number of the repaired records, and
+// it's a no-op if nothing is registered, so it's safe to run repeatedly.
+func (rcs *Server) SelfHeal() (repaired int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("self heal failed: %v", r)
+		}
+	}()
+
+	rcs.registerMutex.Lock()
+	defer rcs.registerMutex.Unlock()
+
+	rcs.mutex.RLock()
+	var registered []*spec.ServiceInstanceSpec
+	for _, ins := range rcs.instances {
+		if rcs.registered[ins] {
+			registered = append(registered, ins)
+		}
+	}
+	rcs.mutex.RUnlock()
+
+	owned := make(map[string]bool, len(registered))
+	for _, ins := range registered {
+		owned[ins.ServiceName+"/"+ins.InstanceID] = true
+	}
+
+	for _, ins := range registered {
+		origin := rcs.service.GetServiceInstanceSpec(ins.ServiceName, ins.InstanceID)
+		if !needUpdateRecord(origin, ins) {
+			continue
+		}
+		if err := rcs.checkAddress(ins.IP); err != nil {
+			logger.Warnf("self heal: record of %s is not put again: %v", ins.Key(), err)
+			continue
+		}
+
+		logger.Warnf("self heal: record of %s is missing or mismatched, put it again", ins.Key())
+		if err := rcs.putInstanceSpec(ins); err != nil {
+			return repaired, err
+		}
+		repaired++
+	}
+
+	for _, ins := range registered {
+		address := instanceAddress(ins)
+		for _, origin := range rcs.service.ListServiceInstanceSpecs(ins.ServiceName) {
+			if owned[origin.ServiceName+"/"+origin.InstanceID] || instanceAddress(origin) != address {
+				continue
+			}
+
+			logger.Warnf("self heal: record of %s is orphaned at address %s, delete it", origin.Key(), address)
+			if err := rcs.deleteInstanceSpec(origin); err != nil {
+				return repaired, err
+			}
+			repaired++
+		}
+	}
+
+	return repaired, nil
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"github.com/ArthurHlt/go-eureka-client/eureka"
+	"github.com/hashicorp/consul/api"
+
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+)
+
+// statusMappings maps the internal instance statuses to the ones of registry types,
+// the unknown statuses are mapped to the one of key "".
+var statusMappings = map[string]map[string]string{
+	spec.RegistryTypeEureka: {
+		spec.ServiceStatusUp:           eureka.UP,
+		spec.ServiceStatusOutOfService: "OUT_OF_SERVICE",
+		spec.ServiceStatusStarting:     eureka.STARTING,
+		"":                             eureka.DOWN,
+	},
+	spec.RegistryTypeConsul: {
+		spec.ServiceStatusUp:           api.HealthPassing,
+		spec.ServiceStatusOutOfService: api.HealthCritical,
+		"":                             api.HealthCritical,
+	},
+}
+
+// ToRegistryStatus maps the internal instance status to the one of the registry type,
+// the empty status is treated as UP. It returns the status as it is for the registry
+// types without mapping.
+func ToRegistryStatus(registryType, status string) string {
+	mapping, exists := statusMappings[registryType]
+	if !exists {
+		return status
+	}
+
+	if status == "" {
+		status = spec.ServiceStatusUp
+	}
+
+	if registryStatus, exists := mapping[status]; exists {
+		return registryStatus
+	}
+	return mapping[""]
+}
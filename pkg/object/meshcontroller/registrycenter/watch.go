@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"time"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+)
+
+// DefaultReconcileInterval is the default interval of reconciling the
+// watched instance record, in case any event of the watch is missed.
+const DefaultReconcileInterval = 60 * time.Second
+
+// instanceWatch watches the record of the registered instance.
+type instanceWatch struct {
+	instanceID string
+	ch         <-chan *spec.ServiceInstanceSpec
+	stop       func()
+}
+
+func (rcs *Server) reconcileInterval() time.Duration {
+	if rcs.ReconcileInterval <= 0 {
+		return DefaultReconcileInterval
+	}
+	return rcs.ReconcileInterval
+}
+
+// watchInstance returns the watch on the record of the instance, the former watch
+// is reused unless the instanceID is changed. It returns nil if the record can't be
+// watched, then the record is polled instead.
+func (rcs *Server) watchInstance(w *instanceWatch, ins *spec.ServiceInstanceSpec) *instanceWatch {
+	if w != nil && w.instanceID == ins.InstanceID {
+		return w
+	}
+	w.close()
+
+	ch, stop, err := rcs.service.WatchServiceInstanceSpec(ins.ServiceName, ins.InstanceID)
+	if err != nil {
+		logger.Warnf("watch instance %s failed, poll it instead: %v", ins.Key(), err)
+		return nil
+	}
+
+	return &instanceWatch{instanceID: ins.InstanceID, ch: ch, stop: stop}
+}
+
+func (w *instanceWatch) close() {
+	if w != nil {
+		w.stop()
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrycenter
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+)
+
+// dubboScheme is the scheme of the Dubbo provider URLs.
+const dubboScheme = "dubbo"
+
+// decodeByZookeeperFormat decodes the Dubbo provider URL registered in Zookeeper, e.g.
+// dubbo://10.0.0.1:20880/com.foo.Service?application=order&version=1.0.0, which may be
+// URL-escaped as a whole like the Zookeeper node names. The application parameter is
+// the service name, and the other parameters are carried into the labels.
+func (rcs *Server) decodeByZookeeperFormat(body []byte) (*spec.ServiceInstanceSpec, error) {
+	provider := strings.TrimSpace(string(body))
+	if !strings.Contains(provider, "://") {
+		unescaped, err := url.QueryUnescape(provider)
+		if err != nil {
+			return nil, fmt.Errorf("unescape dubbo provider %s failed: %v", provider, err)
+		}
+		provider = unescaped
+	}
+
+	u, err := url.Parse(provider)
+	if err != nil {
+		return nil, fmt.Errorf("parse dubbo provider %s failed: %v", provider, err)
+	}
+	if u.Scheme != dubboScheme {
+		return nil, fmt.Errorf("invalid scheme %s of provider %s, want: %s://", u.Scheme, provider, dubboScheme)
+	}
+
+	params := u.Query()
+	serviceName := params.Get("application")
+	if serviceName == "" {
+		return nil, fmt.Errorf("no application parameter in dubbo provider %s", provider)
+	}
+	port, err := strconv.ParseUint(u.Port(), 10, 16)
+	if u.Hostname() == "" || err != nil {
+		return nil, fmt.Errorf("invalid address %s of dubbo provider %s", u.Host, provider)
+	}
+
+	labels := make(map[string]string, len(params))
+	for k, v := range params {
+		if k != "application" && len(v) != 0 {
+			labels[k] = v[0]
+		}
+	}
+
+	ins := &spec.ServiceInstanceSpec{
+		ServiceName: serviceName,
+		IP:          u.Hostname(),
+		Port:        uint32(port),
+		Labels:      labels,
+	}
+	ins.InstanceID = addressInstanceID(ins)
+
+	return ins, nil
+}
@@ -20,12 +20,20 @@ package service
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
+	"net"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
 
 	"github.com/megaease/easegress/v2/pkg/api"
+	"github.com/megaease/easegress/v2/pkg/cluster"
 	"github.com/megaease/easegress/v2/pkg/cluster/customdata"
 	"github.com/megaease/easegress/v2/pkg/logger"
 	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/layout"
@@ -35,6 +43,10 @@ import (
 	"github.com/megaease/easegress/v2/pkg/util/codectool"
 )
 
+// defaultTxnChunkSize keeps the transactions within the limit of etcd,
+// each record takes at most 2 operations of them.
+const defaultTxnChunkSize = cluster.MaxTxnOps / 2
+
 type (
 	// Service is the business layer between mesh and store.
 	// It is not concurrently safe, the users need to do it by themselves.
@@ -44,6 +56,35 @@ type (
 
 		store storage.Storage
 		cds   *customdata.Store
+
+		// txnChunkSize is the maximum number of the records written by a transaction.
+		txnChunkSize int
+	}
+
+	// guardedWrite is the writes of a record, which are applied only if cmps hold.
+	guardedWrite struct {
+		cmps []storage.Cmp
+		ops  []storage.Op
+	}
+
+	// AnnotatedInstanceSpecs are the service instance specs with their staleness.
+	AnnotatedInstanceSpecs struct {
+		storage.Staleness
+		Specs []*spec.ServiceInstanceSpec
+	}
+
+	// EndpointOption customizes the port picked by ServiceEndpoints.
+	EndpointOption func(*endpointOptions)
+
+	endpointOptions struct {
+		secure    bool
+		portLabel string
+	}
+
+	// annotatedStorage is the storage telling the staleness of the values,
+	// e.g. storage.CachingStorage.
+	annotatedStorage interface {
+		GetPrefixAnnotated(prefix string) (*storage.AnnotatedKVs, error)
 	}
 )
 
@@ -56,11 +97,22 @@ func New(superSpec *supervisor.Spec) *Service {
 		spec:      superSpec.ObjectSpec().(*spec.Admin),
 		store:     storage.New(superSpec.Name(), superSpec.Super().Cluster()),
 		cds:       customdata.NewStore(superSpec.Super().Cluster(), kindPrefix, dataPrefix),
+
+		txnChunkSize: defaultTxnChunkSize,
 	}
 
 	return s
 }
 
+// NewWithStorage creates a service on top of an existing storage,
+// custom resources are not available in it.
+func NewWithStorage(store storage.Storage) *Service {
+	return &Service{
+		store:        store,
+		txnChunkSize: defaultTxnChunkSize,
+	}
+}
+
 // Lock locks all store, it will do cluster panic if failed.
 func (s *Service) Lock() {
 	err := s.store.Lock()
@@ -116,6 +168,48 @@ func (s *Service) GetServiceSpecWithInfo(serviceName string) (*spec.Service, *mv
 	return serviceSpec, kv
 }
 
+// GetServiceWithInstances gets the service spec with its instance specs excluding
+// the tombstones. They are read at the same revision, so they are a consistent view.
+func (s *Service) GetServiceWithInstances(serviceName string) (*spec.Service, []*spec.ServiceInstanceSpec, error) {
+	revision, err := s.store.CurrentRevision()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serviceKey := layout.ServiceSpecKey(serviceName)
+	instancePrefix := layout.ServiceInstanceSpecPrefix(serviceName)
+	kvs, err := s.store.SnapshotAt(revision, []string{serviceKey, instancePrefix})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	value, exists := kvs[serviceKey]
+	if !exists {
+		return nil, nil, spec.ErrServiceNotFound
+	}
+	serviceSpec := &spec.Service{}
+	if err := codectool.Unmarshal([]byte(value), serviceSpec); err != nil {
+		return nil, nil, fmt.Errorf("unmarshal %s to json failed: %v", value, err)
+	}
+
+	instances := []*spec.ServiceInstanceSpec{}
+	for k, v := range kvs {
+		if !strings.HasPrefix(k, instancePrefix) {
+			continue
+		}
+		_spec := &spec.ServiceInstanceSpec{}
+		if err := codectool.Unmarshal([]byte(v), _spec); err != nil {
+			logger.Errorf("BUG: unmarshal %s to json failed: %v", v, err)
+			continue
+		}
+		if _spec.Status != spec.ServiceStatusDeleted {
+			instances = append(instances, _spec)
+		}
+	}
+
+	return serviceSpec, instances, nil
+}
+
 // DeleteServiceSpec deletes service spec by its name
 func (s *Service) DeleteServiceSpec(serviceName string) {
 	err := s.store.Delete(layout.ServiceSpecKey(serviceName))
@@ -145,6 +239,115 @@ func (s *Service) ListServiceSpecs() []*spec.Service {
 	return services
 }
 
+// RenameService moves the service spec, its instance specs including the tombstones,
+// and statuses to the new name in one transaction, the records keep their leases.
+// The certs of the instances are deleted, which are signed again for the new name.
+// It fails if the new name is taken, or any record is changed concurrently.
+func (s *Service) RenameService(oldName, newName string) error {
+	if oldName == newName {
+		return nil
+	}
+
+	oldKey, newKey := layout.ServiceSpecKey(oldName), layout.ServiceSpecKey(newName)
+	kv, err := s.store.GetRaw(oldKey)
+	if err != nil {
+		return err
+	}
+	if kv == nil {
+		return spec.ErrServiceNotFound
+	}
+
+	serviceSpec := &spec.Service{}
+	if err := codectool.Unmarshal(kv.Value, serviceSpec); err != nil {
+		return fmt.Errorf("unmarshal %s to json failed: %v", kv.Value, err)
+	}
+	serviceSpec.Name = newName
+	buff, err := codectool.MarshalJSON(serviceSpec)
+	if err != nil {
+		return fmt.Errorf("marshal %#v to json failed: %v", serviceSpec, err)
+	}
+
+	// NOTE: The guards fail the transaction if the new name is created,
+	// or any record read here is changed, since they're read.
+	cmps := []storage.Cmp{storage.CmpModRevision(oldKey, kv.ModRevision), storage.CmpExists(newKey, false)}
+	ops := []storage.Op{
+		storage.OpDelete(oldKey),
+		storage.OpPutWithLease(newKey, string(buff), clientv3.LeaseID(kv.Lease)),
+	}
+
+	// move moves the records of the prefix to the keys of the new name, rename
+	// renames the service of the record, nil rename means deleting the record.
+	move := func(prefix string, key func(serviceName, instanceID string) string, rename func([]byte) (interface{}, error)) error {
+		kvs, err := s.store.GetRawPrefix(prefix)
+		if err != nil {
+			return err
+		}
+
+		for k, kv := range kvs {
+			cmps = append(cmps, storage.CmpModRevision(k, kv.ModRevision))
+			ops = append(ops, storage.OpDelete(k))
+			if rename == nil {
+				continue
+			}
+
+			v, err := rename(kv.Value)
+			if err != nil {
+				return err
+			}
+			buff, err := codectool.MarshalJSON(v)
+			if err != nil {
+				return fmt.Errorf("marshal %#v to json failed: %v", v, err)
+			}
+			newKey := key(newName, strings.TrimPrefix(k, prefix))
+			ops = append(ops, storage.OpPutWithLease(newKey, string(buff), clientv3.LeaseID(kv.Lease)))
+		}
+
+		return nil
+	}
+
+	err = move(layout.ServiceInstanceSpecPrefix(oldName), layout.ServiceInstanceSpecKey, func(value []byte) (interface{}, error) {
+		ins := &spec.ServiceInstanceSpec{}
+		if err := codectool.Unmarshal(value, ins); err != nil {
+			return nil, fmt.Errorf("unmarshal %s to json failed: %v", value, err)
+		}
+		ins.ServiceName = newName
+		return ins, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = move(layout.ServiceInstanceStatusPrefix(oldName), layout.ServiceInstanceStatusKey, func(value []byte) (interface{}, error) {
+		status := &spec.ServiceInstanceStatus{}
+		if err := codectool.Unmarshal(value, status); err != nil {
+			return nil, fmt.Errorf("unmarshal %s to json failed: %v", value, err)
+		}
+		status.ServiceName = newName
+		return status, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = move(layout.ServiceInstanceCertPrefix(oldName), layout.ServiceInstanceCertKey, nil); err != nil {
+		return err
+	}
+
+	succeeded, err := s.store.Txn().If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+	if succeeded {
+		return nil
+	}
+
+	exists, err := s.store.Exists(newKey)
+	if err == nil && exists {
+		return fmt.Errorf("service %s already exists", newName)
+	}
+	return fmt.Errorf("rename service %s to %s failed: changed concurrently", oldName, newName)
+}
+
 // GetServiceInstanceCert gets one specified service instance's cert
 func (s *Service) GetServiceInstanceCert(serviceName, instanceID string) *spec.Certificate {
 	value, err := s.store.Get(layout.ServiceInstanceCertKey(serviceName, instanceID))
@@ -366,7 +569,7 @@ func (s *Service) listServiceInstanceStatuses(all bool, serviceName string) []*s
 	if all {
 		prefix = layout.AllServiceInstanceStatusPrefix()
 	} else {
-		prefix = layout.ServiceInstanceSpecPrefix(serviceName)
+		prefix = layout.ServiceInstanceStatusPrefix(serviceName)
 	}
 
 	kvs, err := s.store.GetRawPrefix(prefix)
@@ -387,14 +590,189 @@ func (s *Service) listServiceInstanceStatuses(all bool, serviceName string) []*s
 	return statuses
 }
 
-// ListAllServiceInstanceSpecs lists all service instance specs.
+// ListAllServiceInstanceSpecs lists all service instance specs, excluding the tombstones.
 func (s *Service) ListAllServiceInstanceSpecs() []*spec.ServiceInstanceSpec {
+	specs := []*spec.ServiceInstanceSpec{}
+	for _, ins := range s.listServiceInstanceSpecs(true, "") {
+		if ins.Status != spec.ServiceStatusDeleted {
+			specs = append(specs, ins)
+		}
+	}
+
+	return specs
+}
+
+// ListAllServiceInstanceSpecsWithTombstones lists all service instance specs, including the tombstones.
+func (s *Service) ListAllServiceInstanceSpecsWithTombstones() []*spec.ServiceInstanceSpec {
 	return s.listServiceInstanceSpecs(true, "")
 }
 
-// ListServiceInstanceSpecs lists service instance specs.
+// ListServiceInstanceSpecs lists service instance specs, excluding the tombstones.
 func (s *Service) ListServiceInstanceSpecs(serviceName string) []*spec.ServiceInstanceSpec {
-	return s.listServiceInstanceSpecs(false, serviceName)
+	specs := []*spec.ServiceInstanceSpec{}
+	for _, ins := range s.listServiceInstanceSpecs(false, serviceName) {
+		if ins.Status != spec.ServiceStatusDeleted {
+			specs = append(specs, ins)
+		}
+	}
+
+	return specs
+}
+
+// ListServiceInstanceSpecsAnnotated lists service instance specs excluding the tombstones
+// like ListServiceInstanceSpecs, and tells whether they are the last known ones served
+// while the backend failed, which happens only on top of a caching storage.
+func (s *Service) ListServiceInstanceSpecsAnnotated(serviceName string) (*AnnotatedInstanceSpecs, error) {
+	prefix := layout.ServiceInstanceSpecPrefix(serviceName)
+
+	var kvs *storage.AnnotatedKVs
+	if as, ok := s.store.(annotatedStorage); ok {
+		annotated, err := as.GetPrefixAnnotated(prefix)
+		if err != nil {
+			return nil, err
+		}
+		kvs = annotated
+	} else {
+		now := time.Now()
+		values, err := s.store.GetPrefix(prefix)
+		if err != nil {
+			return nil, err
+		}
+		kvs = &storage.AnnotatedKVs{Staleness: storage.Staleness{AsOf: now}, KVs: values}
+	}
+
+	result := &AnnotatedInstanceSpecs{Staleness: kvs.Staleness, Specs: []*spec.ServiceInstanceSpec{}}
+	for _, v := range kvs.KVs {
+		_spec := &spec.ServiceInstanceSpec{}
+		if err := codectool.Unmarshal([]byte(v), _spec); err != nil {
+			logger.Errorf("BUG: unmarshal %s to json failed: %v", v, err)
+			continue
+		}
+		if _spec.Status != spec.ServiceStatusDeleted {
+			result.Specs = append(result.Specs, _spec)
+		}
+	}
+
+	return result, nil
+}
+
+// ListActiveServiceInstanceSpecs lists service instance specs which are UP.
+func (s *Service) ListActiveServiceInstanceSpecs(serviceName string) []*spec.ServiceInstanceSpec {
+	specs := []*spec.ServiceInstanceSpec{}
+	for _, ins := range s.listServiceInstanceSpecs(false, serviceName) {
+		if ins.Status == spec.ServiceStatusUp {
+			specs = append(specs, ins)
+		}
+	}
+
+	return specs
+}
+
+// ServiceInstancesChecksum returns a stable checksum over the instance specs of the service,
+// the checksum changes only if any instance spec changes.
+func (s *Service) ServiceInstancesChecksum(serviceName string) (string, error) {
+	kvs, err := s.store.GetRawPrefix(layout.ServiceInstanceSpecPrefix(serviceName))
+	if err != nil {
+		return "", err
+	}
+
+	specs := make([]*spec.ServiceInstanceSpec, 0, len(kvs))
+	for _, v := range kvs {
+		_spec := &spec.ServiceInstanceSpec{}
+		if err = codectool.Unmarshal(v.Value, _spec); err != nil {
+			return "", fmt.Errorf("unmarshal %s to json failed: %v", v.Value, err)
+		}
+		specs = append(specs, _spec)
+	}
+	sort.Slice(specs, func(i, j int) bool {
+		return specs[i].InstanceID < specs[j].InstanceID
+	})
+
+	// NOTE: The json encoding sorts the keys of maps, so it's stable.
+	buff, err := codectool.MarshalJSON(specs)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(buff)), nil
+}
+
+// WithSecurePort picks the secure ports of the instances,
+// the instances without one are skipped.
+func WithSecurePort() EndpointOption {
+	return func(o *endpointOptions) {
+		o.secure = true
+	}
+}
+
+// WithPortLabel picks the extra ports of the instances held in the label,
+// the instances without the label are skipped.
+func WithPortLabel(label string) EndpointOption {
+	return func(o *endpointOptions) {
+		o.portLabel = label
+	}
+}
+
+// ServiceEndpoints returns the sorted host:port endpoints of the active instances of the service,
+// the plain ports are picked by default.
+func (s *Service) ServiceEndpoints(serviceName string, opts ...EndpointOption) ([]string, error) {
+	options := &endpointOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	kvs, err := s.store.GetRawPrefix(layout.ServiceInstanceSpecPrefix(serviceName))
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := []string{}
+	for _, kv := range kvs {
+		instanceSpec := &spec.ServiceInstanceSpec{}
+		if err := codectool.Unmarshal(kv.Value, instanceSpec); err != nil {
+			return nil, fmt.Errorf("unmarshal %s to json failed: %v", kv.Value, err)
+		}
+		if instanceSpec.Status != spec.ServiceStatusUp {
+			continue
+		}
+
+		port := instanceSpec.Port
+		switch {
+		case options.portLabel != "":
+			value, exists := instanceSpec.Labels[options.portLabel]
+			if !exists {
+				continue
+			}
+			labelPort, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %s in label %s of instance %s: %v",
+					value, options.portLabel, instanceSpec.Key(), err)
+			}
+			port = uint32(labelPort)
+		case options.secure:
+			port = instanceSpec.SecurePort
+		}
+		if port == 0 {
+			continue
+		}
+
+		endpoints = append(endpoints, net.JoinHostPort(instanceSpec.IP, strconv.FormatUint(uint64(port), 10)))
+	}
+	sort.Strings(endpoints)
+
+	return endpoints, nil
+}
+
+// ListServiceInstanceSpecsInGroup lists service instance specs in the group.
+func (s *Service) ListServiceInstanceSpecsInGroup(serviceName, group string) []*spec.ServiceInstanceSpec {
+	specs := []*spec.ServiceInstanceSpec{}
+	for _, ins := range s.ListServiceInstanceSpecs(serviceName) {
+		if ins.Group == group {
+			specs = append(specs, ins)
+		}
+	}
+
+	return specs
 }
 
 func (s *Service) listServiceInstanceSpecs(all bool, serviceName string) []*spec.ServiceInstanceSpec {
@@ -424,8 +802,18 @@ func (s *Service) listServiceInstanceSpecs(all bool, serviceName string) []*spec
 	return specs
 }
 
-// GetServiceInstanceSpec gets the service instance spec
+// GetServiceInstanceSpec gets the service instance spec, nil if it doesn't exist or is a tombstone.
 func (s *Service) GetServiceInstanceSpec(serviceName, instanceID string) *spec.ServiceInstanceSpec {
+	instanceSpec := s.GetServiceInstanceSpecWithTombstone(serviceName, instanceID)
+	if instanceSpec == nil || instanceSpec.Status == spec.ServiceStatusDeleted {
+		return nil
+	}
+
+	return instanceSpec
+}
+
+// GetServiceInstanceSpecWithTombstone gets the service instance spec, including the tombstone.
+func (s *Service) GetServiceInstanceSpecWithTombstone(serviceName, instanceID string) *spec.ServiceInstanceSpec {
 	value, err := s.store.Get(layout.ServiceInstanceSpecKey(serviceName, instanceID))
 	if err != nil {
 		api.ClusterPanic(err)
@@ -444,6 +832,80 @@ func (s *Service) GetServiceInstanceSpec(serviceName, instanceID string) *spec.S
 	return instanceSpec
 }
 
+// ServiceInstanceSpecExists checks whether the service instance spec exists without reading it.
+func (s *Service) ServiceInstanceSpecExists(serviceName, instanceID string) (bool, error) {
+	return s.store.Exists(layout.ServiceInstanceSpecKey(serviceName, instanceID))
+}
+
+// WatchServiceInstanceSpec watches the service instance spec, the channel receives the
+// spec once it changes, and nil once it's deleted. The returned function stops watching,
+// which closes the channel.
+func (s *Service) WatchServiceInstanceSpec(serviceName, instanceID string) (<-chan *spec.ServiceInstanceSpec, func(), error) {
+	syncer, err := s.store.Syncer()
+	if err != nil {
+		return nil, nil, err
+	}
+	if syncer == nil {
+		return nil, nil, fmt.Errorf("syncer of the storage is unavailable")
+	}
+
+	key := layout.ServiceInstanceSpecKey(serviceName, instanceID)
+	values, err := syncer.Sync(key)
+	if err != nil {
+		syncer.Close()
+		return nil, nil, err
+	}
+	if values == nil {
+		syncer.Close()
+		return nil, nil, fmt.Errorf("sync %s unavailable", key)
+	}
+
+	ch, done := make(chan *spec.ServiceInstanceSpec, 1), make(chan struct{})
+	go func() {
+		defer close(ch)
+		for value := range values {
+			var instanceSpec *spec.ServiceInstanceSpec
+			if value != nil {
+				instanceSpec = &spec.ServiceInstanceSpec{}
+				if err := codectool.Unmarshal([]byte(*value), instanceSpec); err != nil {
+					logger.Errorf("BUG: unmarshal %s to json failed: %v", *value, err)
+					continue
+				}
+			}
+
+			select {
+			case ch <- instanceSpec:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			syncer.Close()
+		})
+	}
+
+	return ch, stop, nil
+}
+
+// InstanceTenant returns the tenant which the service instance was registered into.
+func (s *Service) InstanceTenant(serviceName, instanceID string) (string, error) {
+	if s.GetServiceInstanceSpec(serviceName, instanceID) == nil {
+		return "", spec.ErrServiceInstanceNotFound
+	}
+
+	serviceSpec := s.GetServiceSpec(serviceName)
+	if serviceSpec == nil {
+		return "", spec.ErrServiceNotFound
+	}
+
+	return serviceSpec.RegisterTenant, nil
+}
+
 // PutServiceInstanceSpec writes the service instance spec
 func (s *Service) PutServiceInstanceSpec(_spec *spec.ServiceInstanceSpec) {
 	buff, err := codectool.MarshalJSON(_spec)
@@ -457,6 +919,153 @@ func (s *Service) PutServiceInstanceSpec(_spec *spec.ServiceInstanceSpec) {
 	}
 }
 
+// Ping checks whether the storage is reachable.
+func (s *Service) Ping() error {
+	return s.store.Ping()
+}
+
+// GrantLease grants a lease with ttl for service instance specs.
+func (s *Service) GrantLease(ttl time.Duration) (clientv3.LeaseID, error) {
+	return s.store.GrantLease(ttl)
+}
+
+// KeepAliveLease renews the lease once.
+func (s *Service) KeepAliveLease(leaseID clientv3.LeaseID) error {
+	return s.store.KeepAliveLease(leaseID)
+}
+
+// RevokeLease revokes the lease, the specs put with it are deleted.
+func (s *Service) RevokeLease(leaseID clientv3.LeaseID) error {
+	return s.store.RevokeLease(leaseID)
+}
+
+// PutServiceInstanceSpecWithLease writes the service instance spec with the lease,
+// the spec expires with the lease.
+func (s *Service) PutServiceInstanceSpecWithLease(_spec *spec.ServiceInstanceSpec, leaseID clientv3.LeaseID) {
+	buff, err := codectool.MarshalJSON(_spec)
+	if err != nil {
+		panic(fmt.Errorf("BUG: marshal %#v to json failed: %v", _spec, err))
+	}
+
+	err = s.store.PutWithLease(layout.ServiceInstanceSpecKey(_spec.ServiceName, _spec.InstanceID), string(buff), leaseID)
+	if err != nil {
+		api.ClusterPanic(err)
+	}
+}
+
+// RewriteServiceInstanceSpec rewrites the service instance spec in place,
+// the lease of the existing record is kept, so it expires as before.
+// It returns spec.ErrServiceInstanceNotFound if the record is gone, which
+// isn't recreated; a plain put would detach the record from its lease.
+func (s *Service) RewriteServiceInstanceSpec(_spec *spec.ServiceInstanceSpec) error {
+	buff, err := codectool.MarshalJSON(_spec)
+	if err != nil {
+		return fmt.Errorf("marshal %#v to json failed: %v", _spec, err)
+	}
+
+	key := layout.ServiceInstanceSpecKey(_spec.ServiceName, _spec.InstanceID)
+	kv, err := s.store.GetRaw(key)
+	if err != nil {
+		return err
+	}
+	if kv == nil {
+		return spec.ErrServiceInstanceNotFound
+	}
+
+	if kv.Lease == 0 {
+		return s.store.Put(key, string(buff))
+	}
+	return s.store.PutWithLease(key, string(buff), clientv3.LeaseID(kv.Lease))
+}
+
+// PutServiceInstanceTombstone writes the tombstone of the instance and deletes its status
+// in one transaction. The tombstone is put without the lease of the instance, so it's
+// retained until it's hard-deleted rather than expiring with the lease.
+func (s *Service) PutServiceInstanceTombstone(_spec *spec.ServiceInstanceSpec) error {
+	buff, err := codectool.MarshalJSON(_spec)
+	if err != nil {
+		return fmt.Errorf("marshal %#v to json failed: %v", _spec, err)
+	}
+
+	specKey := layout.ServiceInstanceSpecKey(_spec.ServiceName, _spec.InstanceID)
+	statusKey := layout.ServiceInstanceStatusKey(_spec.ServiceName, _spec.InstanceID)
+	succeeded, err := s.store.Txn().
+		If(storage.CmpExists(specKey, true)).
+		Then(storage.OpPut(specKey, string(buff)), storage.OpDelete(statusKey)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !succeeded {
+		return spec.ErrServiceInstanceNotFound
+	}
+	return nil
+}
+
+// RebalanceWeights distributes the total weight evenly across the active instances of the
+// service. The remainder goes one by one to the instances ordered by their instanceIDs,
+// and the instance records keep their leases. The records are written in transactions of
+// at most txnChunkSize records, so the weights may be rebalanced partly if it failed.
+func (s *Service) RebalanceWeights(serviceName string, total uint32) error {
+	kvs, err := s.store.GetRawPrefix(layout.ServiceInstanceSpecPrefix(serviceName))
+	if err != nil {
+		return err
+	}
+
+	type instanceKV struct {
+		spec *spec.ServiceInstanceSpec
+		kv   *mvccpb.KeyValue
+	}
+	instances := []instanceKV{}
+	for _, kv := range kvs {
+		instanceSpec := &spec.ServiceInstanceSpec{}
+		if err := codectool.Unmarshal(kv.Value, instanceSpec); err != nil {
+			return fmt.Errorf("unmarshal %s to json failed: %v", kv.Value, err)
+		}
+		if instanceSpec.Status == spec.ServiceStatusUp {
+			instances = append(instances, instanceKV{spec: instanceSpec, kv: kv})
+		}
+	}
+	if len(instances) == 0 {
+		return fmt.Errorf("rebalance weights of service %s: no active instances", serviceName)
+	}
+
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].spec.InstanceID < instances[j].spec.InstanceID
+	})
+
+	share, remainder := total/uint32(len(instances)), total%uint32(len(instances))
+	writes := make([]guardedWrite, 0, len(instances))
+	for i, ins := range instances {
+		ins.spec.Weight = share
+		if uint32(i) < remainder {
+			ins.spec.Weight++
+		}
+
+		buff, err := codectool.MarshalJSON(ins.spec)
+		if err != nil {
+			return fmt.Errorf("marshal %#v to json failed: %v", ins.spec, err)
+		}
+		key := string(ins.kv.Key)
+		writes = append(writes, guardedWrite{
+			cmps: []storage.Cmp{storage.CmpModRevision(key, ins.kv.ModRevision)},
+			ops:  []storage.Op{storage.OpPutWithLease(key, string(buff), clientv3.LeaseID(ins.kv.Lease))},
+		})
+	}
+
+	rebalanced, succeeded, err := s.commitInChunks(writes)
+	if err != nil {
+		return fmt.Errorf("rebalance weights of service %s: %d of %d instances rebalanced: %v",
+			serviceName, rebalanced, len(writes), err)
+	}
+	if !succeeded {
+		return fmt.Errorf("rebalance weights of service %s: %d of %d instances rebalanced, the others changed in the meantime",
+			serviceName, rebalanced, len(writes))
+	}
+
+	return nil
+}
+
 // DeleteServiceInstanceSpec deletes the service instance spec.
 func (s *Service) DeleteServiceInstanceSpec(serviceName, instanceID string) {
 	err := s.store.Delete(layout.ServiceInstanceSpecKey(serviceName, instanceID))
@@ -465,6 +1074,430 @@ func (s *Service) DeleteServiceInstanceSpec(serviceName, instanceID string) {
 	}
 }
 
+// CountServiceInstanceSpecs counts the instance specs of the service, including tombstones,
+// e.g. for the gauge of registered instances, which doesn't read the specs.
+func (s *Service) CountServiceInstanceSpecs(serviceName string) (int64, error) {
+	return s.store.CountPrefix(layout.ServiceInstanceSpecPrefix(serviceName))
+}
+
+// CountAllServiceInstanceSpecs counts the instance specs of all services, including tombstones.
+func (s *Service) CountAllServiceInstanceSpecs() (int64, error) {
+	return s.store.CountPrefix(layout.AllServiceInstanceSpecPrefix())
+}
+
+// DeleteServiceInstances deletes the instances along with their statuses in one transaction.
+func (s *Service) DeleteServiceInstances(specs []*spec.ServiceInstanceSpec) error {
+	deletions := make(map[string]*string, 2*len(specs))
+	for _, _spec := range specs {
+		deletions[layout.ServiceInstanceSpecKey(_spec.ServiceName, _spec.InstanceID)] = nil
+		deletions[layout.ServiceInstanceStatusKey(_spec.ServiceName, _spec.InstanceID)] = nil
+	}
+
+	return s.store.PutAndDelete(deletions)
+}
+
+// CampaignServiceLeader claims the leadership of the service for the instance,
+// the leadership is taken over once the instance spec of the former leader is gone.
+// It returns the instance ID of the current leader.
+func (s *Service) CampaignServiceLeader(serviceName, instanceID string) (string, error) {
+	key := layout.ServiceLeaderKey(serviceName)
+
+	leader, err := s.store.Get(key)
+	if err != nil {
+		return "", err
+	}
+	if leader != nil && *leader == instanceID {
+		return instanceID, nil
+	}
+
+	txn := s.store.Txn()
+	if leader == nil {
+		txn.If(storage.CmpExists(key, false))
+	} else {
+		txn.If(storage.CmpValue(key, *leader),
+			storage.CmpExists(layout.ServiceInstanceSpecKey(serviceName, *leader), false))
+	}
+	succeeded, err := txn.Then(storage.OpPut(key, instanceID)).Commit()
+	if err != nil {
+		return "", err
+	}
+	if succeeded {
+		return instanceID, nil
+	}
+
+	// NOTE: The leader may be changed by others in the meantime.
+	leader, err = s.store.Get(key)
+	if err != nil {
+		return "", err
+	}
+	if leader == nil {
+		return "", nil
+	}
+	return *leader, nil
+}
+
+// ResignServiceLeader gives up the leadership of the service if the instance holds it.
+func (s *Service) ResignServiceLeader(serviceName, instanceID string) error {
+	key := layout.ServiceLeaderKey(serviceName)
+	_, err := s.store.Txn().If(storage.CmpValue(key, instanceID)).Then(storage.OpDelete(key)).Commit()
+	return err
+}
+
+// PutServiceInstanceHistory records the deregistered service instance spec
+// into the history of its service, with its DeleteTime set to deleteTime.
+func (s *Service) PutServiceInstanceHistory(_spec *spec.ServiceInstanceSpec, deleteTime time.Time) error {
+	record := *_spec
+	record.DeleteTime = deleteTime.Format(time.RFC3339)
+
+	buff, err := codectool.MarshalJSON(&record)
+	if err != nil {
+		return fmt.Errorf("marshal %#v to json failed: %v", _spec, err)
+	}
+
+	key := layout.ServiceInstanceHistoryKey(_spec.ServiceName, _spec.InstanceID, deleteTime.UnixNano())
+	return s.store.Put(key, string(buff))
+}
+
+// ListServiceInstanceHistory lists the history of deregistered instances
+// of the service, sorted by the delete time.
+func (s *Service) ListServiceInstanceHistory(serviceName string) ([]*spec.ServiceInstanceSpec, error) {
+	kvs, err := s.store.GetPrefix(layout.ServiceInstanceHistoryPrefix(serviceName))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	specs := make([]*spec.ServiceInstanceSpec, 0, len(keys))
+	for _, k := range keys {
+		_spec := &spec.ServiceInstanceSpec{}
+		if err = codectool.Unmarshal([]byte(kvs[k]), _spec); err != nil {
+			logger.Errorf("BUG: unmarshal %s to json failed: %v", kvs[k], err)
+			continue
+		}
+		specs = append(specs, _spec)
+	}
+
+	return specs, nil
+}
+
+// TrimServiceInstanceHistory deletes the history of the service deregistered
+// before cutoff. It returns the number of trimmed records.
+func (s *Service) TrimServiceInstanceHistory(serviceName string, cutoff time.Time) (int, error) {
+	kvs, err := s.store.GetPrefix(layout.ServiceInstanceHistoryPrefix(serviceName))
+	if err != nil {
+		return 0, err
+	}
+
+	deletions := map[string]*string{}
+	for k, v := range kvs {
+		_spec := &spec.ServiceInstanceSpec{}
+		if err = codectool.Unmarshal([]byte(v), _spec); err != nil {
+			logger.Errorf("BUG: unmarshal %s to json failed: %v", v, err)
+			continue
+		}
+
+		deleteTime, err := time.Parse(time.RFC3339, _spec.DeleteTime)
+		if err != nil {
+			logger.Warnf("skip trimming %s: parse delete time %s failed: %v", k, _spec.DeleteTime, err)
+			continue
+		}
+
+		if deleteTime.Before(cutoff) {
+			deletions[k] = nil
+		}
+	}
+
+	if len(deletions) == 0 {
+		return 0, nil
+	}
+
+	if err = s.store.PutAndDelete(deletions); err != nil {
+		return 0, err
+	}
+
+	return len(deletions), nil
+}
+
+// PruneInstancesOlderThan deletes instances whose registry time is before cutoff,
+// along with their statuses, in batches of at most txnChunkSize instances. It returns
+// the number of pruned instances, which are the ones pruned before the failure if it failed.
+func (s *Service) PruneInstancesOlderThan(cutoff time.Time) (int, error) {
+	kvs, err := s.store.GetPrefix(layout.AllServiceInstanceSpecPrefix())
+	if err != nil {
+		return 0, err
+	}
+
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	writes := []guardedWrite{}
+	for _, k := range keys {
+		v := kvs[k]
+		_spec := &spec.ServiceInstanceSpec{}
+		if err = codectool.Unmarshal([]byte(v), _spec); err != nil {
+			logger.Errorf("BUG: unmarshal %s to json failed: %v", v, err)
+			continue
+		}
+
+		registryTime, err := time.Parse(time.RFC3339, _spec.RegistryTime)
+		if err != nil {
+			logger.Warnf("skip pruning %s: parse registry time %s failed: %v", k, _spec.RegistryTime, err)
+			continue
+		}
+
+		if !registryTime.Before(cutoff) {
+			continue
+		}
+
+		writes = append(writes, guardedWrite{
+			ops: []storage.Op{storage.OpDelete(k),
+				storage.OpDelete(layout.ServiceInstanceStatusKey(_spec.ServiceName, _spec.InstanceID))},
+		})
+	}
+
+	pruned, _, err := s.commitInChunks(writes)
+	return pruned, err
+}
+
+// ReconcileConflicts resolves the split-brain records of the service, which are the
+// records of the same address under different instanceIDs, e.g. written by two controllers.
+// The newest record by RegistryTime wins, ties are broken by the mod revision, and the stale
+// ones are removed along with their statuses, in transactions of at most txnChunkSize records.
+// The winners are untouched, so they keep their leases. It returns the number of the removed
+// stale records, which are the ones removed before the failure if it failed.
+func (s *Service) ReconcileConflicts(serviceName string) (int, error) {
+	kvs, err := s.store.GetRawPrefix(layout.ServiceInstanceSpecPrefix(serviceName))
+	if err != nil {
+		return 0, err
+	}
+
+	type record struct {
+		spec         *spec.ServiceInstanceSpec
+		kv           *mvccpb.KeyValue
+		registryTime time.Time
+	}
+	newer := func(a, b *record) bool {
+		if !a.registryTime.Equal(b.registryTime) {
+			return a.registryTime.After(b.registryTime)
+		}
+		return a.kv.ModRevision > b.kv.ModRevision
+	}
+
+	records := map[string][]*record{}
+	for _, kv := range kvs {
+		_spec := &spec.ServiceInstanceSpec{}
+		if err := codectool.Unmarshal(kv.Value, _spec); err != nil {
+			logger.Errorf("BUG: unmarshal %s to json failed: %v", kv.Value, err)
+			continue
+		}
+		if _spec.Status == spec.ServiceStatusDeleted {
+			continue
+		}
+
+		// NOTE: The unparsable registry time is older than any other.
+		registryTime, _ := time.Parse(time.RFC3339, _spec.RegistryTime)
+		address := fmt.Sprintf("%s:%d", _spec.IP, _spec.Port)
+		records[address] = append(records[address], &record{spec: _spec, kv: kv, registryTime: registryTime})
+	}
+
+	addresses := make([]string, 0, len(records))
+	for address := range records {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	writes := []guardedWrite{}
+	for _, address := range addresses {
+		conflicts := records[address]
+		if len(conflicts) < 2 {
+			continue
+		}
+
+		winner := conflicts[0]
+		for _, r := range conflicts[1:] {
+			if newer(r, winner) {
+				winner = r
+			}
+		}
+
+		for _, r := range conflicts {
+			if r == winner {
+				continue
+			}
+			logger.Infof("remove stale instance %s of %s, superseded by %s",
+				r.spec.InstanceID, address, winner.spec.InstanceID)
+			key := string(r.kv.Key)
+			writes = append(writes, guardedWrite{
+				cmps: []storage.Cmp{storage.CmpModRevision(key, r.kv.ModRevision)},
+				ops: []storage.Op{storage.OpDelete(key),
+					storage.OpDelete(layout.ServiceInstanceStatusKey(serviceName, r.spec.InstanceID))},
+			})
+		}
+	}
+
+	resolved, succeeded, err := s.commitInChunks(writes)
+	if err != nil {
+		return resolved, err
+	}
+	if !succeeded {
+		return resolved, fmt.Errorf("reconcile conflicts of service %s: instances changed in the meantime", serviceName)
+	}
+
+	return resolved, nil
+}
+
+// RehomeInstances moves all instances on oldIP to newIP, e.g. while replacing a node,
+// and the instance records keep their leases. The records are written in transactions
+// of at most txnChunkSize records. It returns the number of the moved instances, which
+// are the ones moved before the failure if it failed.
+func (s *Service) RehomeInstances(oldIP, newIP string) (int, error) {
+	if oldIP == "" || newIP == "" || oldIP == newIP {
+		return 0, fmt.Errorf("rehome instances from %q to %q: invalid IPs", oldIP, newIP)
+	}
+
+	kvs, err := s.store.GetRawPrefix(layout.AllServiceInstanceSpecPrefix())
+	if err != nil {
+		return 0, err
+	}
+
+	writes := []guardedWrite{}
+	for _, kv := range sortedKVs(kvs) {
+		_spec := &spec.ServiceInstanceSpec{}
+		if err := codectool.Unmarshal(kv.Value, _spec); err != nil {
+			return 0, fmt.Errorf("unmarshal %s to json failed: %v", kv.Value, err)
+		}
+		if _spec.IP != oldIP || _spec.Status == spec.ServiceStatusDeleted {
+			continue
+		}
+
+		_spec.IP = newIP
+		buff, err := codectool.MarshalJSON(_spec)
+		if err != nil {
+			return 0, fmt.Errorf("marshal %#v to json failed: %v", _spec, err)
+		}
+
+		key := string(kv.Key)
+		writes = append(writes, guardedWrite{
+			cmps: []storage.Cmp{storage.CmpModRevision(key, kv.ModRevision)},
+			ops:  []storage.Op{storage.OpPutWithLease(key, string(buff), clientv3.LeaseID(kv.Lease))},
+		})
+	}
+
+	rehomed, succeeded, err := s.commitInChunks(writes)
+	if rehomed != 0 {
+		logger.Infof("rehomed %d instances from %s to %s", rehomed, oldIP, newIP)
+	}
+	if err != nil {
+		return rehomed, err
+	}
+	if !succeeded {
+		return rehomed, fmt.Errorf("rehome instances from %s to %s: instances changed in the meantime", oldIP, newIP)
+	}
+
+	return rehomed, nil
+}
+
+// commitInChunks commits the writes in order, in transactions of at most txnChunkSize
+// writes. It stops at the first transaction failed or whose cmps don't hold, which is
+// reported by false, and returns the number of the writes committed before.
+func (s *Service) commitInChunks(writes []guardedWrite) (int, bool, error) {
+	committed := 0
+	for committed < len(writes) {
+		end := committed + s.txnChunkSize
+		if end > len(writes) {
+			end = len(writes)
+		}
+
+		txn := s.store.Txn()
+		for _, w := range writes[committed:end] {
+			txn.If(w.cmps...).Then(w.ops...)
+		}
+		succeeded, err := txn.Commit()
+		if err != nil || !succeeded {
+			return committed, succeeded, err
+		}
+		committed = end
+	}
+
+	return committed, true, nil
+}
+
+// sortedKVs returns the raw values ordered by their keys, so the writes of them
+// in chunks are applied in a stable order.
+func sortedKVs(kvs map[string]*mvccpb.KeyValue) []*mvccpb.KeyValue {
+	sorted := make([]*mvccpb.KeyValue, 0, len(kvs))
+	for _, kv := range kvs {
+		sorted = append(sorted, kv)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return string(sorted[i].Key) < string(sorted[j].Key)
+	})
+	return sorted
+}
+
+// StaleInstances lists the instances whose last heartbeat is older than threshold,
+// including the ones without any heartbeat, which are about to be reaped.
+func (s *Service) StaleInstances(threshold time.Duration) ([]*spec.ServiceInstanceSpec, error) {
+	specKVs, err := s.store.GetPrefix(layout.AllServiceInstanceSpecPrefix())
+	if err != nil {
+		return nil, err
+	}
+	statusKVs, err := s.store.GetPrefix(layout.AllServiceInstanceStatusPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-threshold)
+	specs := []*spec.ServiceInstanceSpec{}
+	for _, v := range specKVs {
+		_spec := &spec.ServiceInstanceSpec{}
+		if err = codectool.Unmarshal([]byte(v), _spec); err != nil {
+			logger.Errorf("BUG: unmarshal %s to json failed: %v", v, err)
+			continue
+		}
+		if _spec.Status == spec.ServiceStatusDeleted {
+			continue
+		}
+
+		statusValue, exists := statusKVs[layout.ServiceInstanceStatusKey(_spec.ServiceName, _spec.InstanceID)]
+		if !exists {
+			specs = append(specs, _spec)
+			continue
+		}
+
+		status := &spec.ServiceInstanceStatus{}
+		if err = codectool.Unmarshal([]byte(statusValue), status); err != nil {
+			logger.Errorf("BUG: unmarshal %s to json failed: %v", statusValue, err)
+			continue
+		}
+
+		lastHeartbeatTime, err := time.Parse(time.RFC3339, status.LastHeartbeatTime)
+		if err != nil {
+			logger.Warnf("skip %s: parse last heartbeat time %s failed: %v",
+				_spec.Key(), status.LastHeartbeatTime, err)
+			continue
+		}
+
+		if lastHeartbeatTime.Before(cutoff) {
+			specs = append(specs, _spec)
+		}
+	}
+
+	sort.Slice(specs, func(i, j int) bool {
+		return specs[i].Key() < specs[j].Key()
+	})
+
+	return specs, nil
+}
+
 // ListTenantSpecs lists tenant specs
 func (s *Service) ListTenantSpecs() []*spec.Tenant {
 	tenants := []*spec.Tenant{}
@@ -0,0 +1,739 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package service
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/megaease/easegress/v2/pkg/cluster/clustertest"
+	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/layout"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/storage"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func newTestService() *Service {
+	return NewWithStorage(storage.New("test", clustertest.NewMemCluster()))
+}
+
+// txnCountingStorage counts the transactions committed through it.
+type txnCountingStorage struct {
+	storage.Storage
+	commits int
+}
+
+type txnCountingTxn struct {
+	storage.Txn
+	store *txnCountingStorage
+}
+
+func (cs *txnCountingStorage) Txn() storage.Txn {
+	return &txnCountingTxn{Txn: cs.Storage.Txn(), store: cs}
+}
+
+func (txn *txnCountingTxn) Commit() (bool, error) {
+	txn.store.commits++
+	return txn.Txn.Commit()
+}
+
+func TestInstanceTenant(t *testing.T) {
+	s := newTestService()
+
+	s.PutServiceSpec(&spec.Service{
+		Name:           "order",
+		RegisterTenant: "shop",
+	})
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+		ServiceName: "order",
+		InstanceID:  "order-01",
+		IP:          "10.0.0.1",
+		Port:        8080,
+	})
+
+	tenant, err := s.InstanceTenant("order", "order-01")
+	if err != nil {
+		t.Fatalf("resolve tenant failed: %v", err)
+	}
+	if tenant != "shop" {
+		t.Fatalf("want tenant shop, got %s", tenant)
+	}
+
+	if _, err = s.InstanceTenant("order", "order-02"); err != spec.ErrServiceInstanceNotFound {
+		t.Fatalf("want %v, got %v", spec.ErrServiceInstanceNotFound, err)
+	}
+}
+
+func TestPruneInstancesOlderThan(t *testing.T) {
+	s := newTestService()
+
+	now := time.Now()
+	old := now.Add(-2 * time.Hour).Format(time.RFC3339)
+	fresh := now.Format(time.RFC3339)
+
+	for _, ins := range []*spec.ServiceInstanceSpec{
+		{ServiceName: "order", InstanceID: "order-01", RegistryTime: old},
+		{ServiceName: "order", InstanceID: "order-02", RegistryTime: fresh},
+		{ServiceName: "delivery", InstanceID: "delivery-01", RegistryTime: old},
+		{ServiceName: "delivery", InstanceID: "delivery-02", RegistryTime: "not-a-time"},
+	} {
+		s.PutServiceInstanceSpec(ins)
+	}
+
+	pruned, err := s.PruneInstancesOlderThan(now.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("prune failed: %v", err)
+	}
+	if pruned != 2 {
+		t.Fatalf("want 2 pruned instances, got %d", pruned)
+	}
+
+	if s.GetServiceInstanceSpec("order", "order-01") != nil {
+		t.Fatalf("order-01 should be pruned")
+	}
+	if s.GetServiceInstanceSpec("delivery", "delivery-01") != nil {
+		t.Fatalf("delivery-01 should be pruned")
+	}
+	if s.GetServiceInstanceSpec("order", "order-02") == nil {
+		t.Fatalf("order-02 should be kept")
+	}
+	if s.GetServiceInstanceSpec("delivery", "delivery-02") == nil {
+		t.Fatalf("delivery-02 with unparseable time should be kept")
+	}
+}
+
+func TestPruneInstancesInBatches(t *testing.T) {
+	mc := clustertest.NewMemCluster()
+	store := &txnCountingStorage{Storage: storage.New("test", mc)}
+	s := NewWithStorage(store)
+	s.txnChunkSize = 2
+
+	old := time.Now().Add(-2 * time.Hour).Format(time.RFC3339)
+	for _, id := range []string{"order-01", "order-02", "order-03", "order-04", "order-05"} {
+		s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: id, RegistryTime: old})
+	}
+
+	// The third batch fails, the instances pruned by the first two are counted.
+	txn := mc.MockedTxn
+	mc.MockedTxn = func(cmps []clientv3.Cmp, thenOps, elseOps []clientv3.Op) (bool, error) {
+		if store.commits == 3 {
+			return false, fmt.Errorf("etcd unavailable")
+		}
+		return txn(cmps, thenOps, elseOps)
+	}
+
+	pruned, err := s.PruneInstancesOlderThan(time.Now().Add(-time.Hour))
+	if err == nil || pruned != 4 {
+		t.Fatalf("want 4 instances pruned before the failure, got %d, %v", pruned, err)
+	}
+	if specs := s.ListServiceInstanceSpecs("order"); len(specs) != 1 || specs[0].InstanceID != "order-05" {
+		t.Fatalf("want order-05 left, got %v", specs)
+	}
+}
+
+func TestRenameService(t *testing.T) {
+	s := newTestService()
+
+	s.PutServiceSpec(&spec.Service{Name: "order", RegisterTenant: "shop"})
+	for _, id := range []string{"order-01", "order-02"} {
+		s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+			ServiceName: "order",
+			InstanceID:  id,
+			IP:          "10.0.0.1",
+			Port:        8080,
+		})
+	}
+
+	if err := s.RenameService("order", "orders"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+
+	if s.GetServiceSpec("order") != nil {
+		t.Fatalf("old service spec should be deleted")
+	}
+	if len(s.ListServiceInstanceSpecs("order")) != 0 {
+		t.Fatalf("old instances should be deleted")
+	}
+
+	serviceSpec := s.GetServiceSpec("orders")
+	if serviceSpec == nil || serviceSpec.Name != "orders" || serviceSpec.RegisterTenant != "shop" {
+		t.Fatalf("service spec not moved: %#v", serviceSpec)
+	}
+	instances := s.ListServiceInstanceSpecs("orders")
+	if len(instances) != 2 {
+		t.Fatalf("want 2 moved instances, got %d", len(instances))
+	}
+	for _, ins := range instances {
+		if ins.ServiceName != "orders" {
+			t.Fatalf("instance %s service name not updated", ins.InstanceID)
+		}
+	}
+
+	if err := s.RenameService("order", "orders"); err != spec.ErrServiceNotFound {
+		t.Fatalf("want %v, got %v", spec.ErrServiceNotFound, err)
+	}
+}
+
+func TestRenameServiceKeepsLeasesAndTombstones(t *testing.T) {
+	mc := clustertest.NewMemCluster()
+	s := NewWithStorage(storage.New("test", mc))
+
+	s.PutServiceSpec(&spec.Service{Name: "order"})
+	leaseID, _ := s.GrantLease(time.Minute)
+	s.PutServiceInstanceSpecWithLease(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-01"}, leaseID)
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+		ServiceName: "order", InstanceID: "order-02",
+		Status: spec.ServiceStatusDeleted, DeleteTime: time.Now().Format(time.RFC3339),
+	})
+	s.PutServiceInstanceCert("order", "order-01", &spec.Certificate{ServiceName: "order"})
+
+	if err := s.RenameService("order", "orders"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+
+	kv := mc.KeyValue(layout.ServiceInstanceSpecKey("orders", "order-01"))
+	if kv == nil || clientv3.LeaseID(kv.Lease) != leaseID {
+		t.Fatalf("want lease %x kept by the moved instance, got %+v", leaseID, kv)
+	}
+	tombstone := s.GetServiceInstanceSpecWithTombstone("orders", "order-02")
+	if tombstone == nil || tombstone.Status != spec.ServiceStatusDeleted || tombstone.ServiceName != "orders" {
+		t.Fatalf("want tombstone moved, got %+v", tombstone)
+	}
+	if s.GetServiceInstanceSpecWithTombstone("order", "order-02") != nil {
+		t.Fatalf("tombstone should not be left behind")
+	}
+	if s.GetServiceInstanceCert("order", "order-01") != nil {
+		t.Fatalf("cert of the old name should be deleted")
+	}
+
+	s.RevokeLease(leaseID)
+	if s.GetServiceInstanceSpec("orders", "order-01") != nil {
+		t.Fatalf("want moved instance expired with its lease")
+	}
+
+	s.PutServiceSpec(&spec.Service{Name: "delivery"})
+	if err := s.RenameService("delivery", "orders"); err == nil {
+		t.Fatalf("want error renaming to an existing service")
+	}
+	if s.GetServiceSpec("delivery") == nil {
+		t.Fatalf("service should be kept if renaming failed")
+	}
+}
+
+func TestGetServiceWithInstances(t *testing.T) {
+	s := newTestService()
+
+	if _, _, err := s.GetServiceWithInstances("order"); err != spec.ErrServiceNotFound {
+		t.Fatalf("want %v, got %v", spec.ErrServiceNotFound, err)
+	}
+
+	s.PutServiceSpec(&spec.Service{Name: "order", RegisterTenant: "shop"})
+	for _, id := range []string{"order-01", "order-02"} {
+		s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: id})
+	}
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "delivery", InstanceID: "delivery-01"})
+
+	serviceSpec, instances, err := s.GetServiceWithInstances("order")
+	if err != nil {
+		t.Fatalf("get service with instances failed: %v", err)
+	}
+	if serviceSpec.Name != "order" || serviceSpec.RegisterTenant != "shop" {
+		t.Fatalf("unexpected service spec: %#v", serviceSpec)
+	}
+	if len(instances) != 2 {
+		t.Fatalf("want 2 instances, got %d", len(instances))
+	}
+	for _, ins := range instances {
+		if ins.ServiceName != "order" {
+			t.Fatalf("unexpected instance of %s", ins.ServiceName)
+		}
+	}
+}
+
+func TestServiceInstancesChecksum(t *testing.T) {
+	s := newTestService()
+
+	empty, err := s.ServiceInstancesChecksum("order")
+	if err != nil {
+		t.Fatalf("checksum failed: %v", err)
+	}
+
+	for _, id := range []string{"order-01", "order-02"} {
+		s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+			ServiceName: "order",
+			InstanceID:  id,
+			IP:          "10.0.0.1",
+			Port:        8080,
+			Labels:      map[string]string{"version": "v1", "zone": "a"},
+		})
+	}
+
+	checksum, err := s.ServiceInstancesChecksum("order")
+	if err != nil {
+		t.Fatalf("checksum failed: %v", err)
+	}
+	if checksum == empty {
+		t.Fatalf("checksum should change after instances added")
+	}
+
+	for i := 0; i < 5; i++ {
+		again, _ := s.ServiceInstancesChecksum("order")
+		if again != checksum {
+			t.Fatalf("checksum should be stable")
+		}
+	}
+
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "delivery", InstanceID: "delivery-01"})
+	if again, _ := s.ServiceInstancesChecksum("order"); again != checksum {
+		t.Fatalf("checksum should not change by other services")
+	}
+
+	ins := s.GetServiceInstanceSpec("order", "order-02")
+	ins.Status = spec.ServiceStatusOutOfService
+	s.PutServiceInstanceSpec(ins)
+	changed, _ := s.ServiceInstancesChecksum("order")
+	if changed == checksum {
+		t.Fatalf("checksum should change after instance changed")
+	}
+}
+
+func TestStaleInstances(t *testing.T) {
+	s := newTestService()
+
+	now := time.Now()
+	heartbeats := map[string]string{
+		"order-01": now.Format(time.RFC3339),
+		"order-02": now.Add(-time.Minute).Format(time.RFC3339),
+		"order-03": "not-a-time",
+	}
+	for _, id := range []string{"order-01", "order-02", "order-03", "order-04"} {
+		s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: id})
+
+		heartbeat, exists := heartbeats[id]
+		if !exists {
+			continue
+		}
+		status := &spec.ServiceInstanceStatus{ServiceName: "order", InstanceID: id, LastHeartbeatTime: heartbeat}
+		buff, _ := codectool.MarshalJSON(status)
+		s.store.Put(layout.ServiceInstanceStatusKey("order", id), string(buff))
+	}
+
+	stale, err := s.StaleInstances(30 * time.Second)
+	if err != nil {
+		t.Fatalf("list stale instances failed: %v", err)
+	}
+	if len(stale) != 2 || stale[0].InstanceID != "order-02" || stale[1].InstanceID != "order-04" {
+		t.Fatalf("want stale order-02 and order-04, got %v", stale)
+	}
+
+	stale, _ = s.StaleInstances(time.Hour)
+	if len(stale) != 1 || stale[0].InstanceID != "order-04" {
+		t.Fatalf("want only order-04 without heartbeat, got %v", stale)
+	}
+}
+
+func TestListServiceInstanceSpecsInGroup(t *testing.T) {
+	s := newTestService()
+
+	for id, group := range map[string]string{"order-01": "east", "order-02": "east", "order-03": "west", "order-04": ""} {
+		s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: id, Group: group})
+	}
+
+	east := s.ListServiceInstanceSpecsInGroup("order", "east")
+	if len(east) != 2 {
+		t.Fatalf("want 2 instances in east, got %d", len(east))
+	}
+	for _, ins := range east {
+		if ins.Group != "east" {
+			t.Fatalf("instance %s of group %s should be excluded", ins.InstanceID, ins.Group)
+		}
+	}
+
+	if defaults := s.ListServiceInstanceSpecsInGroup("order", ""); len(defaults) != 1 || defaults[0].InstanceID != "order-04" {
+		t.Fatalf("want only order-04 in default group, got %v", defaults)
+	}
+}
+
+func TestCountServiceInstanceSpecs(t *testing.T) {
+	s := newTestService()
+
+	for _, id := range []string{"order-01", "order-02"} {
+		s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: id})
+	}
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order-v2", InstanceID: "order-v2-01"})
+
+	if count, err := s.CountServiceInstanceSpecs("order"); err != nil || count != 2 {
+		t.Fatalf("want 2 instances of order, got %d, %v", count, err)
+	}
+	if count, err := s.CountServiceInstanceSpecs("delivery"); err != nil || count != 0 {
+		t.Fatalf("want no instances of delivery, got %d, %v", count, err)
+	}
+}
+
+func TestListServiceInstanceSpecsAnnotated(t *testing.T) {
+	mc := clustertest.NewMemCluster()
+	getPrefix := mc.MockedGetPrefix
+	failing := false
+	mc.MockedGetPrefix = func(prefix string) (map[string]string, error) {
+		if failing {
+			return nil, fmt.Errorf("etcd unavailable")
+		}
+		return getPrefix(prefix)
+	}
+
+	s := NewWithStorage(storage.NewCaching(storage.New("test", mc), false))
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-01", Status: spec.ServiceStatusUp})
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-02", Status: spec.ServiceStatusDeleted})
+
+	annotated, err := s.ListServiceInstanceSpecsAnnotated("order")
+	if err != nil {
+		t.Fatalf("list instances failed: %v", err)
+	}
+	if annotated.Stale || annotated.AsOf.IsZero() || len(annotated.Specs) != 1 {
+		t.Fatalf("want 1 fresh instance, got %+v", annotated)
+	}
+	asOf := annotated.AsOf
+
+	failing = true
+	annotated, err = s.ListServiceInstanceSpecsAnnotated("order")
+	if err != nil {
+		t.Fatalf("list instances from cache failed: %v", err)
+	}
+	if !annotated.Stale || annotated.AsOf.After(asOf.Add(time.Second)) || len(annotated.Specs) != 1 {
+		t.Fatalf("want 1 stale instance as of the last read, got %+v", annotated)
+	}
+
+	plain := newTestService()
+	plain.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-01", Status: spec.ServiceStatusUp})
+	if annotated, err = plain.ListServiceInstanceSpecsAnnotated("order"); err != nil || annotated.Stale || len(annotated.Specs) != 1 {
+		t.Fatalf("want fresh instance without cache, got %+v: %v", annotated, err)
+	}
+}
+
+func TestListServiceInstanceSpecsExcludesTombstones(t *testing.T) {
+	s := newTestService()
+
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{ServiceName: "order", InstanceID: "order-01", Status: spec.ServiceStatusUp})
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+		ServiceName: "order", InstanceID: "order-02",
+		Status: spec.ServiceStatusDeleted, DeleteTime: time.Now().Format(time.RFC3339),
+	})
+
+	if specs := s.ListServiceInstanceSpecs("order"); len(specs) != 1 || specs[0].InstanceID != "order-01" {
+		t.Fatalf("want only order-01 listed, got %v", specs)
+	}
+	if specs := s.ListActiveServiceInstanceSpecs("order"); len(specs) != 1 {
+		t.Fatalf("tombstone should not be active, got %v", specs)
+	}
+	if specs := s.ListAllServiceInstanceSpecs(); len(specs) != 1 {
+		t.Fatalf("tombstone should be excluded from all instances, got %v", specs)
+	}
+	if specs := s.ListAllServiceInstanceSpecsWithTombstones(); len(specs) != 2 {
+		t.Fatalf("want tombstone kept in all instances with tombstones, got %v", specs)
+	}
+	if s.GetServiceInstanceSpec("order", "order-02") != nil {
+		t.Fatalf("tombstone should not be got")
+	}
+	if stale, _ := s.StaleInstances(time.Minute); len(stale) != 1 || stale[0].InstanceID != "order-01" {
+		t.Fatalf("tombstone should not be stale, got %v", stale)
+	}
+}
+
+func TestRebalanceWeights(t *testing.T) {
+	s := newTestService()
+
+	if err := s.RebalanceWeights("order", 100); err == nil {
+		t.Fatalf("want error of no active instances")
+	}
+
+	for _, id := range []string{"order-05", "order-03", "order-01", "order-04", "order-02"} {
+		s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+			ServiceName: "order", InstanceID: id, IP: "10.0.0.1", Port: 8080, Status: spec.ServiceStatusUp,
+		})
+	}
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+		ServiceName: "order", InstanceID: "order-06", IP: "10.0.0.1", Port: 8080, Status: spec.ServiceStatusOutOfService,
+	})
+
+	if err := s.RebalanceWeights("order", 17); err != nil {
+		t.Fatalf("rebalance weights failed: %v", err)
+	}
+
+	want := map[string]uint32{"order-01": 4, "order-02": 4, "order-03": 3, "order-04": 3, "order-05": 3, "order-06": 0}
+	var sum uint32
+	for _, ins := range s.ListServiceInstanceSpecs("order") {
+		if ins.Weight != want[ins.InstanceID] {
+			t.Errorf("want weight %d of %s, got %d", want[ins.InstanceID], ins.InstanceID, ins.Weight)
+		}
+		sum += ins.Weight
+	}
+	if sum != 17 {
+		t.Fatalf("want weights summing to 17, got %d", sum)
+	}
+
+	if err := s.RebalanceWeights("order", 100); err != nil {
+		t.Fatalf("rebalance weights failed: %v", err)
+	}
+	for _, ins := range s.ListActiveServiceInstanceSpecs("order") {
+		if ins.Weight != 20 {
+			t.Fatalf("want weight 20 of %s, got %d", ins.InstanceID, ins.Weight)
+		}
+	}
+}
+
+func TestRebalanceWeightsInChunks(t *testing.T) {
+	store := &txnCountingStorage{Storage: storage.New("test", clustertest.NewMemCluster())}
+	s := NewWithStorage(store)
+	s.txnChunkSize = 2
+
+	leaseID, err := s.GrantLease(time.Minute)
+	if err != nil {
+		t.Fatalf("grant lease failed: %v", err)
+	}
+	for _, id := range []string{"order-01", "order-02", "order-03", "order-04", "order-05"} {
+		s.PutServiceInstanceSpecWithLease(&spec.ServiceInstanceSpec{
+			ServiceName: "order", InstanceID: id, IP: "10.0.0.1", Port: 8080, Status: spec.ServiceStatusUp,
+		}, leaseID)
+	}
+
+	if err := s.RebalanceWeights("order", 100); err != nil {
+		t.Fatalf("rebalance weights failed: %v", err)
+	}
+	if store.commits != 3 {
+		t.Fatalf("want 3 transactions of at most 2 records, got %d", store.commits)
+	}
+
+	kvs, _ := store.GetRawPrefix(layout.ServiceInstanceSpecPrefix("order"))
+	for key, kv := range kvs {
+		if clientv3.LeaseID(kv.Lease) != leaseID {
+			t.Errorf("want lease %d of %s kept, got %d", leaseID, key, kv.Lease)
+		}
+	}
+	for _, ins := range s.ListActiveServiceInstanceSpecs("order") {
+		if ins.Weight != 20 {
+			t.Fatalf("want weight 20 of %s, got %d", ins.InstanceID, ins.Weight)
+		}
+	}
+}
+
+func TestServiceEndpoints(t *testing.T) {
+	s := newTestService()
+
+	for _, ins := range []*spec.ServiceInstanceSpec{
+		{InstanceID: "order-01", IP: "10.0.0.1", Port: 8080, SecurePort: 8443, Status: spec.ServiceStatusUp},
+		{InstanceID: "order-02", IP: "fd00::2", Port: 8080, Labels: map[string]string{"grpcPort": "9090"}, Status: spec.ServiceStatusUp},
+		{InstanceID: "order-03", IP: "10.0.0.3", Port: 8080, SecurePort: 8443, Status: spec.ServiceStatusOutOfService},
+	} {
+		ins.ServiceName = "order"
+		s.PutServiceInstanceSpec(ins)
+	}
+
+	cases := []struct {
+		name string
+		opts []EndpointOption
+		want []string
+	}{
+		{"plain", nil, []string{"10.0.0.1:8080", "[fd00::2]:8080"}},
+		{"secure", []EndpointOption{WithSecurePort()}, []string{"10.0.0.1:8443"}},
+		{"label", []EndpointOption{WithPortLabel("grpcPort")}, []string{"[fd00::2]:9090"}},
+	}
+	for _, c := range cases {
+		got, err := s.ServiceEndpoints("order", c.opts...)
+		if err != nil {
+			t.Fatalf("%s: get endpoints failed: %v", c.name, err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: want endpoints %v, got %v", c.name, c.want, got)
+		}
+	}
+
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+		ServiceName: "order", InstanceID: "order-04", IP: "10.0.0.4", Port: 8080,
+		Labels: map[string]string{"grpcPort": "grpc"}, Status: spec.ServiceStatusUp,
+	})
+	if _, err := s.ServiceEndpoints("order", WithPortLabel("grpcPort")); err == nil {
+		t.Fatalf("want error of invalid port label")
+	}
+}
+
+func TestReconcileConflicts(t *testing.T) {
+	s := newTestService()
+
+	put := func(id, ip string, registryTime time.Time) {
+		s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+			ServiceName: "order", InstanceID: id, IP: ip, Port: 8080,
+			Status: spec.ServiceStatusUp, RegistryTime: registryTime.Format(time.RFC3339),
+		})
+	}
+
+	now := time.Now()
+	put("order-new", "10.0.0.1", now)
+	put("order-old", "10.0.0.1", now.Add(-time.Hour))
+	put("order-02", "10.0.0.2", now.Add(-time.Hour))
+	// The same registry time, the later written one wins.
+	put("order-03a", "10.0.0.3", now)
+	put("order-03b", "10.0.0.3", now)
+	s.PutServiceInstanceSpec(&spec.ServiceInstanceSpec{
+		ServiceName: "order", InstanceID: "order-deleted", IP: "10.0.0.2", Port: 8080, Status: spec.ServiceStatusDeleted,
+	})
+
+	resolved, err := s.ReconcileConflicts("order")
+	if err != nil {
+		t.Fatalf("reconcile conflicts failed: %v", err)
+	}
+	if resolved != 2 {
+		t.Fatalf("want 2 conflicts resolved, got %d", resolved)
+	}
+
+	ids := []string{}
+	for _, ins := range s.ListServiceInstanceSpecs("order") {
+		ids = append(ids, ins.InstanceID)
+	}
+	sort.Strings(ids)
+	if want := []string{"order-02", "order-03b", "order-new"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("want instances %v, got %v", want, ids)
+	}
+
+	if s.GetServiceInstanceSpecWithTombstone("order", "order-deleted") == nil {
+		t.Fatalf("the tombstone should be kept")
+	}
+
+	if resolved, err = s.ReconcileConflicts("order"); err != nil || resolved != 0 {
+		t.Fatalf("want no conflicts left, got %d, %v", resolved, err)
+	}
+}
+
+func TestReconcileConflictsInChunks(t *testing.T) {
+	store := &txnCountingStorage{Storage: storage.New("test", clustertest.NewMemCluster())}
+	s := NewWithStorage(store)
+	s.txnChunkSize = 2
+
+	leaseID, err := s.GrantLease(time.Minute)
+	if err != nil {
+		t.Fatalf("grant lease failed: %v", err)
+	}
+	now := time.Now()
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		for i, registryTime := range []time.Time{now, now.Add(-time.Hour)} {
+			s.PutServiceInstanceSpecWithLease(&spec.ServiceInstanceSpec{
+				ServiceName: "order", InstanceID: fmt.Sprintf("order-%s-%d", ip, i), IP: ip, Port: 8080,
+				Status: spec.ServiceStatusUp, RegistryTime: registryTime.Format(time.RFC3339),
+			}, leaseID)
+		}
+	}
+
+	resolved, err := s.ReconcileConflicts("order")
+	if err != nil || resolved != 3 {
+		t.Fatalf("want 3 conflicts resolved, got %d, %v", resolved, err)
+	}
+	if store.commits != 2 {
+		t.Fatalf("want 2 transactions of at most 2 records, got %d", store.commits)
+	}
+
+	kvs, _ := store.GetRawPrefix(layout.ServiceInstanceSpecPrefix("order"))
+	if len(kvs) != 3 {
+		t.Fatalf("want 3 winners kept, got %d", len(kvs))
+	}
+	for key, kv := range kvs {
+		if clientv3.LeaseID(kv.Lease) != leaseID {
+			t.Errorf("want lease %d of %s kept, got %d", leaseID, key, kv.Lease)
+		}
+	}
+}
+
+func TestRehomeInstances(t *testing.T) {
+	s := newTestService()
+
+	if _, err := s.RehomeInstances("10.0.0.1", "10.0.0.1"); err == nil {
+		t.Fatalf("want error of rehoming to the same IP")
+	}
+
+	for _, ins := range []*spec.ServiceInstanceSpec{
+		{ServiceName: "order", InstanceID: "order-01", IP: "10.0.0.1", Port: 8080, Status: spec.ServiceStatusUp},
+		{ServiceName: "order", InstanceID: "order-02", IP: "10.0.0.2", Port: 8080, Status: spec.ServiceStatusUp},
+		{ServiceName: "payment", InstanceID: "payment-01", IP: "10.0.0.1", Port: 9090, Status: spec.ServiceStatusOutOfService},
+		{ServiceName: "payment", InstanceID: "payment-02", IP: "10.0.0.1", Port: 9090, Status: spec.ServiceStatusDeleted},
+	} {
+		s.PutServiceInstanceSpec(ins)
+	}
+
+	rehomed, err := s.RehomeInstances("10.0.0.1", "10.0.0.9")
+	if err != nil {
+		t.Fatalf("rehome instances failed: %v", err)
+	}
+	if rehomed != 2 {
+		t.Fatalf("want 2 instances rehomed, got %d", rehomed)
+	}
+
+	want := map[string]string{"order-01": "10.0.0.9", "order-02": "10.0.0.2", "payment-01": "10.0.0.9", "payment-02": "10.0.0.1"}
+	for instanceID, ip := range want {
+		serviceName := strings.Split(instanceID, "-")[0]
+		if got := s.GetServiceInstanceSpecWithTombstone(serviceName, instanceID); got == nil || got.IP != ip {
+			t.Errorf("want IP %s of %s, got %+v", ip, instanceID, got)
+		}
+	}
+
+	if rehomed, err := s.RehomeInstances("10.0.0.1", "10.0.0.9"); err != nil || rehomed != 0 {
+		t.Fatalf("want nothing rehomed again, got %d, %v", rehomed, err)
+	}
+}
+
+func TestRehomeInstancesInChunks(t *testing.T) {
+	store := &txnCountingStorage{Storage: storage.New("test", clustertest.NewMemCluster())}
+	s := NewWithStorage(store)
+	s.txnChunkSize = 2
+
+	leaseID, err := s.GrantLease(time.Minute)
+	if err != nil {
+		t.Fatalf("grant lease failed: %v", err)
+	}
+	for _, id := range []string{"order-01", "order-02", "order-03", "order-04", "order-05"} {
+		s.PutServiceInstanceSpecWithLease(&spec.ServiceInstanceSpec{
+			ServiceName: "order", InstanceID: id, IP: "10.0.0.1", Port: 8080, Status: spec.ServiceStatusUp,
+		}, leaseID)
+	}
+
+	rehomed, err := s.RehomeInstances("10.0.0.1", "10.0.0.9")
+	if err != nil || rehomed != 5 {
+		t.Fatalf("want 5 instances rehomed, got %d, %v", rehomed, err)
+	}
+	if store.commits != 3 {
+		t.Fatalf("want 3 transactions of at most 2 records, got %d", store.commits)
+	}
+
+	kvs, _ := store.GetRawPrefix(layout.ServiceInstanceSpecPrefix("order"))
+	for key, kv := range kvs {
+		if clientv3.LeaseID(kv.Lease) != leaseID {
+			t.Errorf("want lease %d of %s kept, got %d", leaseID, key, kv.Lease)
+		}
+	}
+}
@@ -252,8 +252,7 @@ func (b *pipelineSpecBuilder) appendProxyWithCanary(param *proxyParam) *pipeline
 
 		isCanary := false
 		for i, canary := range param.canaries {
-			if !canary.Selector.MatchInstance(instance.ServiceName,
-				instance.Labels) {
+			if !canary.Selector.MatchInstanceSpec(instance) {
 				continue
 			}
 
@@ -46,6 +46,12 @@ func (s *ServiceSelector) MatchInstance(serviceName string, instancelabels map[s
 	return true
 }
 
+// MatchInstanceSpec returns whether selecting the service instance by its service name and labels.
+// The annotations of the instance aren't matched.
+func (s *ServiceSelector) MatchInstanceSpec(ins *ServiceInstanceSpec) bool {
+	return s.MatchInstance(ins.ServiceName, ins.Labels)
+}
+
 // MatchService returns whether selecting the given service.
 func (s *ServiceSelector) MatchService(serviceName string) bool {
 	return stringtool.StrInSlice(serviceName, s.MatchServices)
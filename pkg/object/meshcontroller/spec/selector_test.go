@@ -43,3 +43,31 @@ func TestServiceSelector(t *testing.T) {
 		t.Fatalf("not match")
 	}
 }
+
+func TestServiceSelectorIgnoresAnnotations(t *testing.T) {
+	selector := &ServiceSelector{
+		MatchServices: []string{"order"},
+		MatchInstanceLabels: map[string]string{
+			"owner": "team-a",
+		},
+	}
+
+	ins := &ServiceInstanceSpec{
+		ServiceName: "order",
+		Annotations: map[string]string{"owner": "team-a"},
+	}
+	if selector.MatchInstanceSpec(ins) {
+		t.Fatalf("annotations should not be matched by the selector")
+	}
+
+	ins.Labels = map[string]string{"owner": "team-b"}
+	if selector.MatchInstanceSpec(ins) {
+		t.Fatalf("labels should be matched rather than annotations")
+	}
+
+	ins.Labels = map[string]string{"owner": "team-a"}
+	ins.Annotations = nil
+	if !selector.MatchInstanceSpec(ins) {
+		t.Fatalf("not match")
+	}
+}
@@ -38,8 +38,10 @@ const (
 	RegistryTypeConsul = "consul"
 	// RegistryTypeEureka is the eureka registry type.
 	RegistryTypeEureka = "eureka"
-	// RegistryTypeNacos is the eureka registry type.
+	// RegistryTypeNacos is the nacos registry type.
 	RegistryTypeNacos = "nacos"
+	// RegistryTypeZookeeper is the zookeeper registry type of Dubbo providers.
+	RegistryTypeZookeeper = "zookeeper"
 
 	// GlobalTenant is the reserved name of the system scope tenant,
 	// its services can be accessible in mesh wide.
@@ -51,6 +53,21 @@ const (
 	// ServiceStatusOutOfService indicates this service instance can't accept ingress traffic
 	ServiceStatusOutOfService = "OUT_OF_SERVICE"
 
+	// ServiceStatusStarting indicates this service instance is starting and can't accept ingress traffic yet
+	ServiceStatusStarting = "STARTING"
+
+	// ServiceStatusDown indicates this service instance failed its health checks
+	ServiceStatusDown = "DOWN"
+
+	// ServiceStatusDeleted indicates this service instance is a tombstone of the soft-deleted one
+	ServiceStatusDeleted = "DELETED"
+
+	// StatusHoldPreWarm holds the instance registered as OUT_OF_SERVICE for pre-warm.
+	StatusHoldPreWarm = "preWarm"
+
+	// StatusHoldAdmin holds the instance taken offline by the administrator.
+	StatusHoldAdmin = "admin"
+
 	// WorkerAPIPort is the default port for worker's API server
 	WorkerAPIPort = 13009
 
@@ -100,6 +117,12 @@ var (
 	ErrServiceNotFound = fmt.Errorf("can't find service in its tenant or in global tenant")
 	// ErrServiceNotavailable indicates could find target service's available instances.
 	ErrServiceNotavailable = fmt.Errorf("can't find service available instances")
+	// ErrServiceInstanceNotFound indicates could find target service instance
+	ErrServiceInstanceNotFound = fmt.Errorf("can't find service instance")
+	// ErrRegistryFull indicates the registry has reached its limit of instances
+	ErrRegistryFull = fmt.Errorf("registry reached its limit of instances")
+	// ErrInstanceIDTaken indicates the instanceID is taken by another instance
+	ErrInstanceIDTaken = fmt.Errorf("instanceID taken by another instance")
 )
 
 type (
@@ -108,6 +131,35 @@ type (
 		// HeartbeatInterval is the interval for one service instance reporting its heartbeat.
 		HeartbeatInterval string `json:"heartbeatInterval" jsonschema:"required,format=duration"`
 
+		// HealthyThreshold is the number of consecutive healthy checks to bring an instance up.
+		HealthyThreshold int `json:"healthyThreshold,omitempty" jsonschema:"minimum=0"`
+		// UnhealthyThreshold is the number of consecutive unhealthy checks to bring an instance down.
+		UnhealthyThreshold int `json:"unhealthyThreshold,omitempty" jsonschema:"minimum=0"`
+		// FailureGrace delays bringing a failing instance down, it's brought down only if
+		// it keeps failing beyond the grace since its first failed check.
+		FailureGrace string `json:"failureGrace,omitempty" jsonschema:"format=duration"`
+		// AutoUpStarting promotes the STARTING instances to UP once they pass the healthy
+		// threshold, and demotes them to DOWN once they reach the unhealthy threshold.
+		AutoUpStarting bool `json:"autoUpStarting,omitempty"`
+
+		// ProbeConcurrency is the number of instances checked in parallel, 8 by default.
+		ProbeConcurrency int `json:"probeConcurrency,omitempty" jsonschema:"minimum=0"`
+
+		// MaxClockSkew enables flagging instances whose registry time is ahead of
+		// the local clock beyond it, ClampClockSkew clamps their registry time to now.
+		MaxClockSkew   string `json:"maxClockSkew,omitempty" jsonschema:"format=duration"`
+		ClampClockSkew bool   `json:"clampClockSkew,omitempty"`
+
+		// TombstoneRetention enables soft-deleting instances, the deleted ones are kept
+		// as tombstones for the retention before being removed.
+		TombstoneRetention string `json:"tombstoneRetention,omitempty" jsonschema:"format=duration"`
+
+		// InstanceMetricsZoneLabel is the instance label holding the zone of instance metrics,
+		// "zone" by default. InstanceMetricsMaxZones bounds the distinct zones exported,
+		// the instances of the others are counted into zone "other", 10 by default.
+		InstanceMetricsZoneLabel string `json:"instanceMetricsZoneLabel,omitempty"`
+		InstanceMetricsMaxZones  int    `json:"instanceMetricsMaxZones,omitempty" jsonschema:"minimum=0"`
+
 		// RegistryTime indicates which protocol the registry center accepts.
 		RegistryType string `json:"registryType" jsonschema:"required"`
 
@@ -186,6 +238,14 @@ type (
 		RegistryName   string `json:"registryName,omitempty"`
 		Name           string `json:"name" jsonschema:"required"`
 		RegisterTenant string `json:"registerTenant" jsonschema:"required"`
+		// Group is the routing domain of the service, empty means the default one.
+		Group string `json:"group,omitempty"`
+		// StickyKey is the name of the session key, e.g. a header, which consumers
+		// use to keep the affinity to instances behind a shared VIP.
+		StickyKey string `json:"stickyKey,omitempty"`
+		// IngressOnly makes its instances registered once the ingress is ready,
+		// regardless of the egress, e.g. for services without outgoing traffic.
+		IngressOnly bool `json:"ingressOnly,omitempty"`
 
 		Sidecar       *Sidecar       `json:"sidecar" jsonschema:"required"`
 		Mock          *Mock          `json:"mock,omitempty"`
@@ -365,9 +425,26 @@ type (
 		Port         uint32            `json:"port" jsonschema:"required"`
 		RegistryTime string            `json:"registryTime,omitempty"`
 		Labels       map[string]string `json:"labels,omitempty"`
+		// SecurePort is the TLS port of the instance, 0 means none.
+		SecurePort uint32 `json:"securePort,omitempty"`
+		// Group is the routing domain of the instance, populated from its service.
+		Group string `json:"group,omitempty"`
+		// RegistryType is the registry protocol the instance registered with.
+		RegistryType string `json:"registryType,omitempty"`
+		// Weight is the relative weight of the instance, 0 means unset.
+		Weight uint32 `json:"weight,omitempty"`
+		// Annotations are the free-form operational notes of the instance, e.g. the
+		// owner and the runbook URL. Unlike Labels, they're never matched by selectors,
+		// nor exposed as the metadata to registry clients.
+		Annotations map[string]string `json:"annotations,omitempty"`
 
 		// Set by heartbeat timer event or API
 		Status string `json:"status"`
+		// StatusHold is the reason the OUT_OF_SERVICE status is held by, e.g. pre-warm,
+		// the held instance isn't promoted to UP by its heartbeats.
+		StatusHold string `json:"statusHold,omitempty"`
+		// DeleteTime is set for the tombstone.
+		DeleteTime string `json:"deleteTime,omitempty"`
 	}
 
 	// IngressPath is the path for a mesh ingress rule
@@ -0,0 +1,599 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+)
+
+// defaultCacheSize is the default maximum number of the keys cached.
+const defaultCacheSize = 10000
+
+type (
+	// CachingStorage wraps a storage to keep the last known values of the keys read
+	// through it, and serves them while the backend is unavailable. The least recently
+	// used keys are evicted once the cache is full.
+	// NOTE: Only Get, GetPrefix, GetKeys, GetRaw, GetRawPrefix and the annotated versions
+	// are served from the cache, the writes through it cache or drop the values of the keys
+	// they write. The raw reads are served only with the revisions read raw, so a key
+	// written or read by Get since then isn't served by them until it's read raw again.
+	CachingStorage struct {
+		Storage
+
+		mergeReads bool
+
+		// mutex makes the updates of several keys atomic, e.g. of a prefix.
+		mutex sync.RWMutex
+		// cache is of the keys to *cacheEntry.
+		cache *lru.Cache
+	}
+
+	cachingTxn struct {
+		Txn
+
+		cs   *CachingStorage
+		keys []string
+	}
+
+	cacheEntry struct {
+		value string
+		// kv is the key value read raw, which is nil if its revisions are unknown.
+		kv *mvccpb.KeyValue
+		// missing means the key is known not to exist.
+		missing   bool
+		fetchTime time.Time
+	}
+
+	// Staleness tells how stale the result read through the caching storage is.
+	Staleness struct {
+		// AsOf is the time the result was read from the backend,
+		// the earliest one for the result of several keys.
+		AsOf time.Time
+		// Stale means the result is served from the cache since the backend failed.
+		Stale bool
+	}
+
+	// AnnotatedValue is the value of a key with its staleness.
+	AnnotatedValue struct {
+		Staleness
+		Value *string
+	}
+
+	// AnnotatedKVs are the values of a prefix with their staleness.
+	AnnotatedKVs struct {
+		Staleness
+		KVs map[string]string
+	}
+)
+
+// NewCaching creates a caching storage on top of store. In merge reads mode, GetKeys
+// serves cached values only for the keys failed to read from the backend, otherwise
+// all keys are served from the cache once any of them failed.
+func NewCaching(store Storage, mergeReads bool) *CachingStorage {
+	return NewCachingWithSize(store, mergeReads, defaultCacheSize)
+}
+
+// NewCachingWithSize creates a caching storage like NewCaching, which caches at most size keys.
+func NewCachingWithSize(store Storage, mergeReads bool, size int) *CachingStorage {
+	cache, err := lru.New(size)
+	if err != nil {
+		panic(fmt.Errorf("BUG: create cache of size %d failed: %v", size, err))
+	}
+
+	return &CachingStorage{
+		Storage:    store,
+		mergeReads: mergeReads,
+		cache:      cache,
+	}
+}
+
+// Get gets the key from the backend, or from the cache if the backend failed.
+func (cs *CachingStorage) Get(key string) (*string, error) {
+	annotated, err := cs.GetAnnotated(key)
+	if err != nil {
+		return nil, err
+	}
+	return annotated.Value, nil
+}
+
+// GetAnnotated gets the key like Get, and tells whether it's served from the cache.
+func (cs *CachingStorage) GetAnnotated(key string) (*AnnotatedValue, error) {
+	now := time.Now()
+	value, err := cs.Storage.Get(key)
+	if err != nil {
+		cached, fetchTime, exists := cs.cachedAt(key)
+		if !exists {
+			return nil, err
+		}
+		logger.Warnf("get %s failed, serve it from cache: %v", key, err)
+		return &AnnotatedValue{Staleness: Staleness{AsOf: fetchTime, Stale: true}, Value: cached}, nil
+	}
+
+	cs.update(key, value)
+	return &AnnotatedValue{Staleness: Staleness{AsOf: now}, Value: value}, nil
+}
+
+// GetPrefix gets the prefix from the backend, or from the cache if the backend failed.
+func (cs *CachingStorage) GetPrefix(prefix string) (map[string]string, error) {
+	annotated, err := cs.GetPrefixAnnotated(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return annotated.KVs, nil
+}
+
+// GetPrefixAnnotated gets the prefix like GetPrefix, and tells whether it's served from the cache.
+func (cs *CachingStorage) GetPrefixAnnotated(prefix string) (*AnnotatedKVs, error) {
+	now := time.Now()
+	kvs, err := cs.Storage.GetPrefix(prefix)
+	if err != nil {
+		cached, fetchTime := cs.cachedPrefix(prefix)
+		if len(cached) == 0 {
+			return nil, err
+		}
+		logger.Warnf("get prefix %s failed, serve it from cache: %v", prefix, err)
+		return &AnnotatedKVs{Staleness: Staleness{AsOf: fetchTime, Stale: true}, KVs: cached}, nil
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.removePrefix(prefix, func(k string) bool {
+		_, exists := kvs[k]
+		return !exists
+	})
+	for k, v := range kvs {
+		cs.cache.Add(k, &cacheEntry{value: v, fetchTime: now})
+	}
+
+	return &AnnotatedKVs{Staleness: Staleness{AsOf: now}, KVs: kvs}, nil
+}
+
+// GetRaw gets the raw key from the backend, or from the cache if the backend failed.
+func (cs *CachingStorage) GetRaw(key string) (*mvccpb.KeyValue, error) {
+	now := time.Now()
+	kv, err := cs.Storage.GetRaw(key)
+	if err != nil {
+		cached, exists := cs.cachedRaw(key)
+		if !exists {
+			return nil, err
+		}
+		logger.Warnf("get raw %s failed, serve it from cache: %v", key, err)
+		return cached, nil
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if kv == nil {
+		cs.cache.Add(key, &cacheEntry{missing: true, fetchTime: now})
+	} else {
+		cs.cache.Add(key, &cacheEntry{value: string(kv.Value), kv: kv, fetchTime: now})
+	}
+
+	return kv, nil
+}
+
+// GetRawPrefix gets the raw prefix from the backend, or from the cache if the backend failed.
+func (cs *CachingStorage) GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, error) {
+	now := time.Now()
+	kvs, err := cs.Storage.GetRawPrefix(prefix)
+	if err != nil {
+		cached := cs.cachedRawPrefix(prefix)
+		if len(cached) == 0 {
+			return nil, err
+		}
+		logger.Warnf("get raw prefix %s failed, serve it from cache: %v", prefix, err)
+		return cached, nil
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.removePrefix(prefix, func(k string) bool {
+		_, exists := kvs[k]
+		return !exists
+	})
+	for k, kv := range kvs {
+		cs.cache.Add(k, &cacheEntry{value: string(kv.Value), kv: kv, fetchTime: now})
+	}
+
+	return kvs, nil
+}
+
+// GetKeys gets the keys, the missing keys are absent in the result.
+// It fails only if some failed keys have not been cached.
+func (cs *CachingStorage) GetKeys(keys ...string) (map[string]string, error) {
+	live := make(map[string]*string, len(keys))
+	var failed []string
+	var lastErr error
+
+	for _, key := range keys {
+		value, err := cs.Storage.Get(key)
+		if err != nil {
+			failed = append(failed, key)
+			lastErr = err
+			continue
+		}
+		live[key] = value
+	}
+
+	// NOTE: Without merging reads, the live values are dropped once any key
+	// failed, so that all values come from the same source.
+	fallback := failed
+	if len(failed) != 0 && !cs.mergeReads {
+		fallback = keys
+		live = map[string]*string{}
+	}
+
+	result := make(map[string]string, len(keys))
+	for key, value := range live {
+		cs.update(key, value)
+		if value != nil {
+			result[key] = *value
+		}
+	}
+
+	if len(failed) == 0 {
+		return result, nil
+	}
+
+	for _, key := range fallback {
+		cached, exists := cs.cached(key)
+		if !exists {
+			return nil, lastErr
+		}
+		if cached != nil {
+			result[key] = *cached
+		}
+	}
+	logger.Warnf("get %d of %d keys failed, serve %d keys from cache: %v",
+		len(failed), len(keys), len(fallback), lastErr)
+
+	return result, nil
+}
+
+// Put puts the key and caches it.
+func (cs *CachingStorage) Put(key, value string) error {
+	err := cs.Storage.Put(key, value)
+	if err == nil {
+		cs.update(key, &value)
+	}
+	return err
+}
+
+// PutAndDelete puts and deletes the keys and caches them.
+func (cs *CachingStorage) PutAndDelete(kvs map[string]*string) error {
+	err := cs.Storage.PutAndDelete(kvs)
+	if err == nil {
+		for k, v := range kvs {
+			cs.update(k, v)
+		}
+	}
+	return err
+}
+
+// Delete deletes the key and caches its absence.
+func (cs *CachingStorage) Delete(key string) error {
+	err := cs.Storage.Delete(key)
+	if err == nil {
+		cs.update(key, nil)
+	}
+	return err
+}
+
+// PutCtx puts the key with ctx and caches it.
+func (cs *CachingStorage) PutCtx(ctx context.Context, key, value string) error {
+	err := cs.Storage.PutCtx(ctx, key, value)
+	if err == nil {
+		cs.update(key, &value)
+	}
+	return err
+}
+
+// PutAndDeleteCtx puts and deletes the keys with ctx and caches them.
+func (cs *CachingStorage) PutAndDeleteCtx(ctx context.Context, kvs map[string]*string) error {
+	err := cs.Storage.PutAndDeleteCtx(ctx, kvs)
+	if err == nil {
+		for k, v := range kvs {
+			cs.update(k, v)
+		}
+	}
+	return err
+}
+
+// DeleteCtx deletes the key with ctx and caches its absence.
+func (cs *CachingStorage) DeleteCtx(ctx context.Context, key string) error {
+	err := cs.Storage.DeleteCtx(ctx, key)
+	if err == nil {
+		cs.update(key, nil)
+	}
+	return err
+}
+
+// CompareAndSwap swaps the value of key and caches it if swapped.
+func (cs *CachingStorage) CompareAndSwap(key, oldValue, newValue string) (bool, error) {
+	swapped, err := cs.Storage.CompareAndSwap(key, oldValue, newValue)
+	if err == nil && swapped {
+		cs.update(key, &newValue)
+	}
+	return swapped, err
+}
+
+// PutIfRevision puts the key and caches it if put.
+func (cs *CachingStorage) PutIfRevision(key, value string, rev int64) (bool, error) {
+	put, err := cs.Storage.PutIfRevision(key, value, rev)
+	if err == nil && put {
+		cs.update(key, &value)
+	}
+	return put, err
+}
+
+// Rename renames the key, caches the absence of oldKey and drops newKey
+// from the cache, whose value is read at the next time. Both keys are
+// dropped if it failed, since the failed renaming may have been applied.
+func (cs *CachingStorage) Rename(oldKey, newKey string) error {
+	err := cs.Storage.Rename(oldKey, newKey)
+	if err != nil {
+		cs.invalidate(oldKey, newKey)
+		return err
+	}
+
+	cs.update(oldKey, nil)
+	cs.invalidate(newKey)
+
+	return nil
+}
+
+// Append appends to the key and drops it from the cache,
+// whose value is read at the next time.
+func (cs *CachingStorage) Append(key, element string, maxLen int) error {
+	err := cs.Storage.Append(key, element, maxLen)
+	if err != nil {
+		return err
+	}
+
+	cs.invalidate(key)
+
+	return nil
+}
+
+// AppendCtx appends to the key with ctx and drops it from the cache.
+func (cs *CachingStorage) AppendCtx(ctx context.Context, key, element string, maxLen int) error {
+	err := cs.Storage.AppendCtx(ctx, key, element, maxLen)
+	if err != nil {
+		return err
+	}
+
+	cs.invalidate(key)
+
+	return nil
+}
+
+// PutUnderLease puts the key under the lease of the member and caches it.
+func (cs *CachingStorage) PutUnderLease(key, value string) error {
+	err := cs.Storage.PutUnderLease(key, value)
+	if err == nil {
+		cs.update(key, &value)
+	}
+	return err
+}
+
+// PutWithLease puts the key with the lease and caches it.
+func (cs *CachingStorage) PutWithLease(key, value string, leaseID clientv3.LeaseID) error {
+	err := cs.Storage.PutWithLease(key, value, leaseID)
+	if err == nil {
+		cs.update(key, &value)
+	}
+	return err
+}
+
+// PutAndDeleteUnderLease puts and deletes the keys under the lease of the member and caches them.
+func (cs *CachingStorage) PutAndDeleteUnderLease(kvs map[string]*string) error {
+	err := cs.Storage.PutAndDeleteUnderLease(kvs)
+	if err == nil {
+		for k, v := range kvs {
+			cs.update(k, v)
+		}
+	}
+	return err
+}
+
+// Txn creates a transaction dropping the keys it writes from the cache once committed,
+// whose values are read at the next time.
+func (cs *CachingStorage) Txn() Txn {
+	return &cachingTxn{Txn: cs.Storage.Txn(), cs: cs}
+}
+
+// DeletePrefix deletes the prefix and drops it from the cache.
+func (cs *CachingStorage) DeletePrefix(prefix string) error {
+	err := cs.Storage.DeletePrefix(prefix)
+	if err != nil {
+		return err
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.removePrefix(prefix, func(string) bool { return true })
+
+	return nil
+}
+
+// removePrefix drops the keys of the prefix chosen by remove from the cache,
+// the caller must hold the mutex.
+func (cs *CachingStorage) removePrefix(prefix string, remove func(key string) bool) {
+	for _, k := range cs.cache.Keys() {
+		if k := k.(string); strings.HasPrefix(k, prefix) && remove(k) {
+			cs.cache.Remove(k)
+		}
+	}
+}
+
+// invalidate drops the keys from the cache.
+func (cs *CachingStorage) invalidate(keys ...string) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	for _, key := range keys {
+		cs.cache.Remove(key)
+	}
+}
+
+// update caches the value of key, nil value means the key doesn't exist.
+func (cs *CachingStorage) update(key string, value *string) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if value == nil {
+		cs.cache.Add(key, &cacheEntry{missing: true, fetchTime: time.Now()})
+		return
+	}
+	cs.cache.Add(key, &cacheEntry{value: *value, fetchTime: time.Now()})
+}
+
+// cached returns the cached value of key, the nil value with true
+// means the key is known to be missing.
+func (cs *CachingStorage) cached(key string) (*string, bool) {
+	value, _, exists := cs.cachedAt(key)
+	return value, exists
+}
+
+// cachedAt returns the cached value of key like cached, with its fetch time.
+func (cs *CachingStorage) cachedAt(key string) (*string, time.Time, bool) {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+
+	cached, exists := cs.cache.Get(key)
+	if !exists {
+		return nil, time.Time{}, false
+	}
+	entry := cached.(*cacheEntry)
+	if entry.missing {
+		return nil, entry.fetchTime, true
+	}
+	value := entry.value
+	return &value, entry.fetchTime, true
+}
+
+// cachedPrefix returns the cached values of the prefix, with the earliest fetch time of them.
+func (cs *CachingStorage) cachedPrefix(prefix string) (map[string]string, time.Time) {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+
+	kvs := map[string]string{}
+	var fetchTime time.Time
+	for _, k := range cs.cache.Keys() {
+		k := k.(string)
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if entry := cs.peek(k); entry != nil && !entry.missing {
+			kvs[k] = entry.value
+			if fetchTime.IsZero() || entry.fetchTime.Before(fetchTime) {
+				fetchTime = entry.fetchTime
+			}
+		}
+	}
+	return kvs, fetchTime
+}
+
+// cachedRaw returns the cached raw value of key, the nil value with true
+// means the key is known to be missing.
+func (cs *CachingStorage) cachedRaw(key string) (*mvccpb.KeyValue, bool) {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+
+	cached, exists := cs.cache.Get(key)
+	if !exists {
+		return nil, false
+	}
+	entry := cached.(*cacheEntry)
+	if entry.missing {
+		return nil, true
+	}
+	return entry.kv, entry.kv != nil
+}
+
+// cachedRawPrefix returns the cached raw values of the prefix, which is empty
+// if any key of the prefix is cached without its revisions.
+func (cs *CachingStorage) cachedRawPrefix(prefix string) map[string]*mvccpb.KeyValue {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+
+	kvs := map[string]*mvccpb.KeyValue{}
+	for _, k := range cs.cache.Keys() {
+		k := k.(string)
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		entry := cs.peek(k)
+		switch {
+		case entry == nil, entry.missing:
+		case entry.kv == nil:
+			return nil
+		default:
+			kvs[k] = entry.kv
+		}
+	}
+	return kvs
+}
+
+// peek returns the cache entry of key without marking it used, nil if there is none.
+func (cs *CachingStorage) peek(key string) *cacheEntry {
+	cached, exists := cs.cache.Peek(key)
+	if !exists {
+		return nil
+	}
+	return cached.(*cacheEntry)
+}
+
+func (txn *cachingTxn) Then(ops ...Op) Txn {
+	for _, op := range ops {
+		txn.keys = append(txn.keys, op.key)
+	}
+	txn.Txn.Then(ops...)
+	return txn
+}
+
+func (txn *cachingTxn) Else(ops ...Op) Txn {
+	for _, op := range ops {
+		txn.keys = append(txn.keys, op.key)
+	}
+	txn.Txn.Else(ops...)
+	return txn
+}
+
+func (txn *cachingTxn) If(cmps ...Cmp) Txn {
+	txn.Txn.If(cmps...)
+	return txn
+}
+
+// Commit commits the transaction and drops its keys from the cache, even if it failed,
+// since the failed commit may have been applied.
+func (txn *cachingTxn) Commit() (bool, error) {
+	succeeded, err := txn.Txn.Commit()
+	txn.cs.invalidate(txn.keys...)
+	return succeeded, err
+}
@@ -0,0 +1,696 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/megaease/easegress/v2/pkg/cluster"
+	"github.com/megaease/easegress/v2/pkg/logger"
+)
+
+// compressedMarker prefixes the compressed values, which never
+// begins a plain JSON or YAML value.
+const compressedMarker = "\x00gzip\x00"
+
+type (
+	// CompressingStorage wraps a storage to gzip-compress the values over
+	// the threshold while writing, and decompress them while reading.
+	// The values written without it are read as they are. The watches and
+	// syncers decompress the values as well, and Rename moves the compressed
+	// values as they are.
+	CompressingStorage struct {
+		Storage
+
+		threshold int
+	}
+
+	compressingTxn struct {
+		Txn
+
+		cs *CompressingStorage
+		// err is the first failure of compressing, which fails the commit.
+		err error
+	}
+
+	compressingSyncer struct {
+		cluster.Syncer
+
+		// done is closed once the syncer is closed, so the decompressing
+		// goroutines aren't blocked by the receivers stopped.
+		done chan struct{}
+		once sync.Once
+	}
+)
+
+// NewCompressing creates a compressing storage on top of store,
+// the values longer than threshold bytes are compressed.
+func NewCompressing(store Storage, threshold int) *CompressingStorage {
+	return &CompressingStorage{
+		Storage:   store,
+		threshold: threshold,
+	}
+}
+
+func (cs *CompressingStorage) compress(value string) (string, error) {
+	if len(value) <= cs.threshold {
+		return value, nil
+	}
+
+	buff := bytes.NewBufferString(compressedMarker)
+	w := gzip.NewWriter(buff)
+	if _, err := w.Write([]byte(value)); err != nil {
+		return "", fmt.Errorf("compress value failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("compress value failed: %v", err)
+	}
+
+	return buff.String(), nil
+}
+
+func decompress(value string) (string, error) {
+	if !strings.HasPrefix(value, compressedMarker) {
+		return value, nil
+	}
+
+	r, err := gzip.NewReader(strings.NewReader(value[len(compressedMarker):]))
+	if err != nil {
+		return "", fmt.Errorf("decompress value failed: %v", err)
+	}
+	defer r.Close()
+
+	buff, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("decompress value failed: %v", err)
+	}
+
+	return string(buff), nil
+}
+
+func (cs *CompressingStorage) compressKVs(kvs map[string]*string) (map[string]*string, error) {
+	compressed := make(map[string]*string, len(kvs))
+	for k, v := range kvs {
+		if v == nil {
+			compressed[k] = nil
+			continue
+		}
+
+		value, err := cs.compress(*v)
+		if err != nil {
+			return nil, err
+		}
+		compressed[k] = &value
+	}
+
+	return compressed, nil
+}
+
+func decompressKV(kv *mvccpb.KeyValue) (*mvccpb.KeyValue, error) {
+	if kv == nil || !bytes.HasPrefix(kv.Value, []byte(compressedMarker)) {
+		return kv, nil
+	}
+
+	value, err := decompress(string(kv.Value))
+	if err != nil {
+		return nil, err
+	}
+
+	copied := *kv
+	copied.Value = []byte(value)
+	return &copied, nil
+}
+
+// Get gets the key and decompresses its value.
+func (cs *CompressingStorage) Get(key string) (*string, error) {
+	value, err := cs.Storage.Get(key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+
+	decompressed, err := decompress(*value)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %v", key, err)
+	}
+	return &decompressed, nil
+}
+
+// GetPrefix gets the prefix and decompresses the values.
+func (cs *CompressingStorage) GetPrefix(prefix string) (map[string]string, error) {
+	kvs, err := cs.Storage.GetPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range kvs {
+		value, err := decompress(v)
+		if err != nil {
+			return nil, fmt.Errorf("get %s: %v", k, err)
+		}
+		kvs[k] = value
+	}
+	return kvs, nil
+}
+
+// GetPrefixPaged gets the page of the prefix and decompresses the values.
+func (cs *CompressingStorage) GetPrefixPaged(prefix string, limit int64, fromKey string) (map[string]string, string, error) {
+	kvs, nextKey, err := cs.Storage.GetPrefixPaged(prefix, limit, fromKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for k, v := range kvs {
+		value, err := decompress(v)
+		if err != nil {
+			return nil, "", fmt.Errorf("get %s: %v", k, err)
+		}
+		kvs[k] = value
+	}
+	return kvs, nextKey, nil
+}
+
+// GetRaw gets the raw key and decompresses its value.
+func (cs *CompressingStorage) GetRaw(key string) (*mvccpb.KeyValue, error) {
+	kv, err := cs.Storage.GetRaw(key)
+	if err != nil {
+		return nil, err
+	}
+
+	kv, err = decompressKV(kv)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %v", key, err)
+	}
+	return kv, nil
+}
+
+// GetRawPrefix gets the raw prefix and decompresses the values.
+func (cs *CompressingStorage) GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, error) {
+	kvs, err := cs.Storage.GetRawPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range kvs {
+		kv, err := decompressKV(v)
+		if err != nil {
+			return nil, fmt.Errorf("get %s: %v", k, err)
+		}
+		kvs[k] = kv
+	}
+	return kvs, nil
+}
+
+// SnapshotAt reads the prefixes at the revision and decompresses the values.
+func (cs *CompressingStorage) SnapshotAt(revision int64, prefixes []string) (map[string]string, error) {
+	kvs, err := cs.Storage.SnapshotAt(revision, prefixes)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range kvs {
+		value, err := decompress(v)
+		if err != nil {
+			return nil, fmt.Errorf("get %s: %v", k, err)
+		}
+		kvs[k] = value
+	}
+	return kvs, nil
+}
+
+// Put compresses the value if needed and puts it.
+func (cs *CompressingStorage) Put(key, value string) error {
+	value, err := cs.compress(value)
+	if err != nil {
+		return err
+	}
+	return cs.Storage.Put(key, value)
+}
+
+// PutUnderLease compresses the value if needed and puts it under the lease of the member.
+func (cs *CompressingStorage) PutUnderLease(key, value string) error {
+	value, err := cs.compress(value)
+	if err != nil {
+		return err
+	}
+	return cs.Storage.PutUnderLease(key, value)
+}
+
+// PutWithLease compresses the value if needed and puts it with the lease.
+func (cs *CompressingStorage) PutWithLease(key, value string, leaseID clientv3.LeaseID) error {
+	value, err := cs.compress(value)
+	if err != nil {
+		return err
+	}
+	return cs.Storage.PutWithLease(key, value, leaseID)
+}
+
+// PutAndDelete compresses the values if needed, then puts and deletes the keys.
+func (cs *CompressingStorage) PutAndDelete(kvs map[string]*string) error {
+	compressed, err := cs.compressKVs(kvs)
+	if err != nil {
+		return err
+	}
+	return cs.Storage.PutAndDelete(compressed)
+}
+
+// PutAndDeleteUnderLease compresses the values if needed, then puts
+// and deletes the keys under the lease of the member.
+func (cs *CompressingStorage) PutAndDeleteUnderLease(kvs map[string]*string) error {
+	compressed, err := cs.compressKVs(kvs)
+	if err != nil {
+		return err
+	}
+	return cs.Storage.PutAndDeleteUnderLease(compressed)
+}
+
+// GetCtx gets the key with ctx and decompresses its value.
+func (cs *CompressingStorage) GetCtx(ctx context.Context, key string) (*string, error) {
+	value, err := cs.Storage.GetCtx(ctx, key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+
+	decompressed, err := decompress(*value)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %v", key, err)
+	}
+	return &decompressed, nil
+}
+
+// GetPrefixCtx gets the prefix with ctx and decompresses the values.
+func (cs *CompressingStorage) GetPrefixCtx(ctx context.Context, prefix string) (map[string]string, error) {
+	kvs, err := cs.Storage.GetPrefixCtx(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range kvs {
+		value, err := decompress(v)
+		if err != nil {
+			return nil, fmt.Errorf("get %s: %v", k, err)
+		}
+		kvs[k] = value
+	}
+	return kvs, nil
+}
+
+// PutCtx compresses the value if needed and puts it with ctx.
+func (cs *CompressingStorage) PutCtx(ctx context.Context, key, value string) error {
+	value, err := cs.compress(value)
+	if err != nil {
+		return err
+	}
+	return cs.Storage.PutCtx(ctx, key, value)
+}
+
+// PutAndDeleteCtx compresses the values if needed, then puts and deletes the keys with ctx.
+func (cs *CompressingStorage) PutAndDeleteCtx(ctx context.Context, kvs map[string]*string) error {
+	compressed, err := cs.compressKVs(kvs)
+	if err != nil {
+		return err
+	}
+	return cs.Storage.PutAndDeleteCtx(ctx, compressed)
+}
+
+// CompareAndSwap compresses the values if needed and swaps them,
+// the compressing output is stable for the same value.
+func (cs *CompressingStorage) CompareAndSwap(key, oldValue, newValue string) (bool, error) {
+	oldValue, err := cs.compress(oldValue)
+	if err != nil {
+		return false, err
+	}
+	newValue, err = cs.compress(newValue)
+	if err != nil {
+		return false, err
+	}
+	return cs.Storage.CompareAndSwap(key, oldValue, newValue)
+}
+
+// PutIfRevision compresses the value if needed and puts it if the revision matches.
+func (cs *CompressingStorage) PutIfRevision(key, value string, rev int64) (bool, error) {
+	value, err := cs.compress(value)
+	if err != nil {
+		return false, err
+	}
+	return cs.Storage.PutIfRevision(key, value, rev)
+}
+
+// Append appends the element to the decompressed array, and compresses it if needed.
+func (cs *CompressingStorage) Append(key, element string, maxLen int) error {
+	return cs.AppendCtx(context.Background(), key, element, maxLen)
+}
+
+// AppendCtx is like Append, it gives up once ctx is done.
+func (cs *CompressingStorage) AppendCtx(ctx context.Context, key, element string, maxLen int) error {
+	return appendElement(ctx, cs.GetRaw, cs.Txn, key, element, maxLen)
+}
+
+// Txn creates a transaction compressing the compared and put values if needed.
+func (cs *CompressingStorage) Txn() Txn {
+	return &compressingTxn{Txn: cs.Storage.Txn(), cs: cs}
+}
+
+// WaitForValue waits until the decompressed value of key equals to expected.
+// NOTE: The plain values are compared, so the value stored either compressed
+// or not, e.g. written by the storage of another threshold, matches.
+func (cs *CompressingStorage) WaitForValue(ctx context.Context, key, expected string) error {
+	// NOTE: Watch before getting the current value, so no change is missed in between.
+	ch, stop, err := cs.Watch(key)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	value, err := cs.Get(key)
+	if err != nil {
+		return err
+	}
+	if value != nil && *value == expected {
+		return nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("wait for %s to be %s failed: %v", key, expected, ctx.Err())
+		case value, ok := <-ch:
+			if !ok {
+				return fmt.Errorf("wait for %s to be %s failed: watch closed", key, expected)
+			}
+			if value != nil && *value == expected {
+				return nil
+			}
+		}
+	}
+}
+
+// Watch watches the key and decompresses the values.
+func (cs *CompressingStorage) Watch(key string) (<-chan *string, func(), error) {
+	source, stop, err := cs.Storage.Watch(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch, done := make(chan *string, 10), make(chan struct{})
+	go func() {
+		defer close(ch)
+
+		for value := range source {
+			value, ok := decompressEvent(key, value)
+			if ok {
+				select {
+				case ch <- value:
+				case <-done:
+				}
+			}
+		}
+	}()
+
+	return ch, stopWith(done, stop), nil
+}
+
+// WatchPrefix watches the prefix and decompresses the values.
+func (cs *CompressingStorage) WatchPrefix(prefix string) (<-chan map[string]*string, func(), error) {
+	source, stop, err := cs.Storage.WatchPrefix(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch, done := make(chan map[string]*string, 10), make(chan struct{})
+	go func() {
+		defer close(ch)
+
+		for kvs := range source {
+			for k, v := range kvs {
+				value, ok := decompressEvent(k, v)
+				if !ok {
+					delete(kvs, k)
+					continue
+				}
+				kvs[k] = value
+			}
+			select {
+			case ch <- kvs:
+			case <-done:
+			}
+		}
+	}()
+
+	return ch, stopWith(done, stop), nil
+}
+
+// WatchPrefixes watches the prefixes and decompresses the values.
+func (cs *CompressingStorage) WatchPrefixes(prefixes []string) (<-chan KVEvent, func(), error) {
+	source, stop, err := cs.Storage.WatchPrefixes(prefixes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch, done := make(chan KVEvent, 10), make(chan struct{})
+	go func() {
+		defer close(ch)
+
+		for event := range source {
+			value, ok := decompressEvent(event.Key, event.Value)
+			if ok {
+				event.Value = value
+				select {
+				case ch <- event:
+				case <-done:
+				}
+			}
+		}
+	}()
+
+	return ch, stopWith(done, stop), nil
+}
+
+// Syncer creates a syncer decompressing the values.
+func (cs *CompressingStorage) Syncer() (cluster.Syncer, error) {
+	syncer, err := cs.Storage.Syncer()
+	if err != nil {
+		return nil, err
+	}
+	return newCompressingSyncer(syncer), nil
+}
+
+// SyncerWithInterval creates a syncer decompressing the values.
+func (cs *CompressingStorage) SyncerWithInterval(pullInterval time.Duration) (cluster.Syncer, error) {
+	syncer, err := cs.Storage.SyncerWithInterval(pullInterval)
+	if err != nil {
+		return nil, err
+	}
+	return newCompressingSyncer(syncer), nil
+}
+
+func newCompressingSyncer(syncer cluster.Syncer) *compressingSyncer {
+	return &compressingSyncer{Syncer: syncer, done: make(chan struct{})}
+}
+
+// decompressEvent decompresses the value of the watched key, it reports
+// false if the value is broken, which is logged and skipped.
+func decompressEvent(key string, value *string) (*string, bool) {
+	if value == nil {
+		return nil, true
+	}
+
+	decompressed, err := decompress(*value)
+	if err != nil {
+		logger.Errorf("watch %s: %v", key, err)
+		return nil, false
+	}
+	return &decompressed, true
+}
+
+func (txn *compressingTxn) compress(value string) string {
+	compressed, err := txn.cs.compress(value)
+	if err != nil && txn.err == nil {
+		txn.err = err
+	}
+	return compressed
+}
+
+func (txn *compressingTxn) compressOps(ops []Op) []Op {
+	compressed := make([]Op, len(ops))
+	for i, op := range ops {
+		if op.value != nil {
+			value := txn.compress(*op.value)
+			op.value = &value
+		}
+		compressed[i] = op
+	}
+	return compressed
+}
+
+func (txn *compressingTxn) If(cmps ...Cmp) Txn {
+	compressed := make([]Cmp, len(cmps))
+	for i, cmp := range cmps {
+		if cmp.target == cmpTargetValue {
+			// NOTE: The compressing output is stable for the same value.
+			cmp.value = txn.compress(cmp.value)
+		}
+		compressed[i] = cmp
+	}
+	txn.Txn.If(compressed...)
+	return txn
+}
+
+func (txn *compressingTxn) Then(ops ...Op) Txn {
+	txn.Txn.Then(txn.compressOps(ops)...)
+	return txn
+}
+
+func (txn *compressingTxn) Else(ops ...Op) Txn {
+	txn.Txn.Else(txn.compressOps(ops)...)
+	return txn
+}
+
+// Commit commits the transaction, it fails if any value failed to be compressed.
+func (txn *compressingTxn) Commit() (bool, error) {
+	if txn.err != nil {
+		return false, txn.err
+	}
+	return txn.Txn.Commit()
+}
+
+func (s *compressingSyncer) Close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.Syncer.Close()
+	})
+}
+
+func (s *compressingSyncer) Sync(key string) (<-chan *string, error) {
+	source, err := s.Syncer.Sync(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, done := make(chan *string, 10), s.done
+	go func() {
+		defer close(ch)
+
+		for value := range source {
+			value, ok := decompressEvent(key, value)
+			if ok {
+				select {
+				case ch <- value:
+				case <-done:
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (s *compressingSyncer) SyncRaw(key string) (<-chan *mvccpb.KeyValue, error) {
+	source, err := s.Syncer.SyncRaw(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, done := make(chan *mvccpb.KeyValue, 10), s.done
+	go func() {
+		defer close(ch)
+
+		for kv := range source {
+			kv, err := decompressKV(kv)
+			if err != nil {
+				logger.Errorf("sync %s: %v", key, err)
+				continue
+			}
+			select {
+			case ch <- kv:
+			case <-done:
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (s *compressingSyncer) SyncPrefix(prefix string) (<-chan map[string]string, error) {
+	source, err := s.Syncer.SyncPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, done := make(chan map[string]string, 10), s.done
+	go func() {
+		defer close(ch)
+
+		for kvs := range source {
+			for k, v := range kvs {
+				value, err := decompress(v)
+				if err != nil {
+					logger.Errorf("sync %s: %v", k, err)
+					delete(kvs, k)
+					continue
+				}
+				kvs[k] = value
+			}
+			select {
+			case ch <- kvs:
+			case <-done:
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (s *compressingSyncer) SyncRawPrefix(prefix string) (<-chan map[string]*mvccpb.KeyValue, error) {
+	source, err := s.Syncer.SyncRawPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, done := make(chan map[string]*mvccpb.KeyValue, 10), s.done
+	go func() {
+		defer close(ch)
+
+		for kvs := range source {
+			for k, v := range kvs {
+				kv, err := decompressKV(v)
+				if err != nil {
+					logger.Errorf("sync %s: %v", k, err)
+					delete(kvs, k)
+					continue
+				}
+				kvs[k] = kv
+			}
+			select {
+			case ch <- kvs:
+			case <-done:
+			}
+		}
+	}()
+
+	return ch, nil
+}
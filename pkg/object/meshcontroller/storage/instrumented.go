@@ -0,0 +1,336 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const defaultThroughputWindow = time.Minute
+
+type (
+	// InstrumentedStorage wraps a storage to observe its operations.
+	InstrumentedStorage struct {
+		Storage
+
+		writes  *rollingCounter
+		deletes *rollingCounter
+
+		leaseMutex sync.Mutex
+		leases     map[clientv3.LeaseID]*LeaseDiagnostics
+	}
+
+	// StorageDiagnostics is a snapshot of the storage for troubleshooting.
+	StorageDiagnostics struct {
+		// Endpoints are stripped of user info.
+		Endpoints  []string           `json:"endpoints"`
+		MutexName  string             `json:"mutexName"`
+		Leases     []LeaseDiagnostics `json:"leases"`
+		Throughput Throughput         `json:"throughput"`
+	}
+
+	// LeaseDiagnostics is the state of a lease granted through the storage.
+	LeaseDiagnostics struct {
+		ID            clientv3.LeaseID `json:"id"`
+		TTL           time.Duration    `json:"ttl"`
+		GrantTime     time.Time        `json:"grantTime"`
+		KeepAliveTime time.Time        `json:"keepAliveTime,omitempty"`
+		// KeepAliveError is the error of the last keeping alive.
+		KeepAliveError string `json:"keepAliveError,omitempty"`
+	}
+
+	// Throughput is the average operation rate over the observing window.
+	Throughput struct {
+		Window           time.Duration `json:"window"`
+		WritesPerSecond  float64       `json:"writesPerSecond"`
+		DeletesPerSecond float64       `json:"deletesPerSecond"`
+	}
+
+	// rollingCounter counts events in per-second buckets over a window.
+	rollingCounter struct {
+		mutex   sync.Mutex
+		now     func() time.Time
+		buckets []int64
+		seconds []int64
+	}
+)
+
+// NewInstrumented creates an instrumented storage on top of store,
+// the throughput is observed over window, one minute by default.
+func NewInstrumented(store Storage, window time.Duration) *InstrumentedStorage {
+	if window < time.Second {
+		window = defaultThroughputWindow
+	}
+
+	return &InstrumentedStorage{
+		Storage: store,
+		writes:  newRollingCounter(window),
+		deletes: newRollingCounter(window),
+		leases:  map[clientv3.LeaseID]*LeaseDiagnostics{},
+	}
+}
+
+// Diagnostics returns the config, lease state and operation stats of the storage.
+func (is *InstrumentedStorage) Diagnostics() StorageDiagnostics {
+	diag := StorageDiagnostics{
+		Throughput: is.Throughput(),
+	}
+
+	if cs, ok := is.Storage.(*clusterStorage); ok {
+		diag.MutexName = cs.name
+		for _, endpoint := range cs.cls.Endpoints() {
+			diag.Endpoints = append(diag.Endpoints, redactEndpoint(endpoint))
+		}
+	}
+
+	is.leaseMutex.Lock()
+	defer is.leaseMutex.Unlock()
+	for _, lease := range is.leases {
+		diag.Leases = append(diag.Leases, *lease)
+	}
+	sort.Slice(diag.Leases, func(i, j int) bool {
+		return diag.Leases[i].ID < diag.Leases[j].ID
+	})
+
+	return diag
+}
+
+func redactEndpoint(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "<invalid endpoint>"
+	}
+	u.User = nil
+	return u.String()
+}
+
+// Throughput returns writes and deletes per second over the window.
+func (is *InstrumentedStorage) Throughput() Throughput {
+	return Throughput{
+		Window:           is.writes.window(),
+		WritesPerSecond:  is.writes.rate(),
+		DeletesPerSecond: is.deletes.rate(),
+	}
+}
+
+// Put puts the key and counts one write.
+func (is *InstrumentedStorage) Put(key, value string) error {
+	is.writes.add(1)
+	return is.Storage.Put(key, value)
+}
+
+// PutUnderLease puts the key under lease and counts one write.
+func (is *InstrumentedStorage) PutUnderLease(key, value string) error {
+	is.writes.add(1)
+	return is.Storage.PutUnderLease(key, value)
+}
+
+// GrantLease grants the lease and records its state.
+func (is *InstrumentedStorage) GrantLease(ttl time.Duration) (clientv3.LeaseID, error) {
+	leaseID, err := is.Storage.GrantLease(ttl)
+	if err != nil {
+		return 0, err
+	}
+
+	is.leaseMutex.Lock()
+	defer is.leaseMutex.Unlock()
+	is.leases[leaseID] = &LeaseDiagnostics{
+		ID:        leaseID,
+		TTL:       ttl,
+		GrantTime: time.Now(),
+	}
+
+	return leaseID, nil
+}
+
+// KeepAliveLease keeps alive the lease and records the result.
+func (is *InstrumentedStorage) KeepAliveLease(leaseID clientv3.LeaseID) error {
+	err := is.Storage.KeepAliveLease(leaseID)
+
+	is.leaseMutex.Lock()
+	defer is.leaseMutex.Unlock()
+	if lease := is.leases[leaseID]; lease != nil {
+		if err != nil {
+			lease.KeepAliveError = err.Error()
+		} else {
+			lease.KeepAliveTime = time.Now()
+			lease.KeepAliveError = ""
+		}
+	}
+
+	return err
+}
+
+// RevokeLease revokes the lease and forgets its state.
+func (is *InstrumentedStorage) RevokeLease(leaseID clientv3.LeaseID) error {
+	err := is.Storage.RevokeLease(leaseID)
+	if err != nil {
+		return err
+	}
+
+	is.leaseMutex.Lock()
+	defer is.leaseMutex.Unlock()
+	delete(is.leases, leaseID)
+
+	return nil
+}
+
+// PutWithLease puts the key with the lease and counts one write.
+func (is *InstrumentedStorage) PutWithLease(key, value string, leaseID clientv3.LeaseID) error {
+	is.writes.add(1)
+	return is.Storage.PutWithLease(key, value, leaseID)
+}
+
+// PutAndDelete counts the writes and deletes in kvs.
+func (is *InstrumentedStorage) PutAndDelete(kvs map[string]*string) error {
+	is.countKVs(kvs)
+	return is.Storage.PutAndDelete(kvs)
+}
+
+// PutAndDeleteUnderLease counts the writes and deletes in kvs.
+func (is *InstrumentedStorage) PutAndDeleteUnderLease(kvs map[string]*string) error {
+	is.countKVs(kvs)
+	return is.Storage.PutAndDeleteUnderLease(kvs)
+}
+
+// Delete deletes the key and counts one delete.
+func (is *InstrumentedStorage) Delete(key string) error {
+	is.deletes.add(1)
+	return is.Storage.Delete(key)
+}
+
+// DeletePrefix deletes the prefix and counts one delete.
+func (is *InstrumentedStorage) DeletePrefix(prefix string) error {
+	is.deletes.add(1)
+	return is.Storage.DeletePrefix(prefix)
+}
+
+// PutCtx puts the key with ctx and counts one write.
+func (is *InstrumentedStorage) PutCtx(ctx context.Context, key, value string) error {
+	is.writes.add(1)
+	return is.Storage.PutCtx(ctx, key, value)
+}
+
+// PutAndDeleteCtx counts the writes and deletes in kvs.
+func (is *InstrumentedStorage) PutAndDeleteCtx(ctx context.Context, kvs map[string]*string) error {
+	is.countKVs(kvs)
+	return is.Storage.PutAndDeleteCtx(ctx, kvs)
+}
+
+// DeleteCtx deletes the key with ctx and counts one delete.
+func (is *InstrumentedStorage) DeleteCtx(ctx context.Context, key string) error {
+	is.deletes.add(1)
+	return is.Storage.DeleteCtx(ctx, key)
+}
+
+// CompareAndSwap swaps the value of key and counts one write.
+func (is *InstrumentedStorage) CompareAndSwap(key, oldValue, newValue string) (bool, error) {
+	is.writes.add(1)
+	return is.Storage.CompareAndSwap(key, oldValue, newValue)
+}
+
+// PutIfRevision puts the key and counts one write.
+func (is *InstrumentedStorage) PutIfRevision(key, value string, rev int64) (bool, error) {
+	is.writes.add(1)
+	return is.Storage.PutIfRevision(key, value, rev)
+}
+
+// Append appends to the key and counts one write.
+func (is *InstrumentedStorage) Append(key, element string, maxLen int) error {
+	is.writes.add(1)
+	return is.Storage.Append(key, element, maxLen)
+}
+
+// AppendCtx appends to the key with ctx and counts one write.
+func (is *InstrumentedStorage) AppendCtx(ctx context.Context, key, element string, maxLen int) error {
+	is.writes.add(1)
+	return is.Storage.AppendCtx(ctx, key, element, maxLen)
+}
+
+// Rename renames the key and counts one write and one delete.
+func (is *InstrumentedStorage) Rename(oldKey, newKey string) error {
+	is.writes.add(1)
+	is.deletes.add(1)
+	return is.Storage.Rename(oldKey, newKey)
+}
+
+func (is *InstrumentedStorage) countKVs(kvs map[string]*string) {
+	var writes, deletes int64
+	for _, v := range kvs {
+		if v == nil {
+			deletes++
+		} else {
+			writes++
+		}
+	}
+	is.writes.add(writes)
+	is.deletes.add(deletes)
+}
+
+func newRollingCounter(window time.Duration) *rollingCounter {
+	n := int(window / time.Second)
+	return &rollingCounter{
+		now:     time.Now,
+		buckets: make([]int64, n),
+		seconds: make([]int64, n),
+	}
+}
+
+func (rc *rollingCounter) window() time.Duration {
+	return time.Duration(len(rc.buckets)) * time.Second
+}
+
+func (rc *rollingCounter) add(n int64) {
+	if n == 0 {
+		return
+	}
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	sec := rc.now().Unix()
+	i := int(sec % int64(len(rc.buckets)))
+	if rc.seconds[i] != sec {
+		rc.seconds[i] = sec
+		rc.buckets[i] = 0
+	}
+	rc.buckets[i] += n
+}
+
+func (rc *rollingCounter) rate() float64 {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	sec := rc.now().Unix()
+	n := int64(len(rc.buckets))
+
+	var total int64
+	for i, s := range rc.seconds {
+		if s > sec-n && s <= sec {
+			total += rc.buckets[i]
+		}
+	}
+
+	return float64(total) / float64(n)
+}
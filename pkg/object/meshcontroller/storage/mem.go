@@ -0,0 +1,623 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/megaease/easegress/v2/pkg/cluster"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+type (
+	// memStorage is the storage keeping the data in memory, e.g. for tests.
+	// The keys keep their revisions and leases like etcd, but the history
+	// isn't kept, and the leases never expire by themselves.
+	memStorage struct {
+		mutex  sync.RWMutex
+		kvs    map[string]*mvccpb.KeyValue
+		rev    int64
+		leases map[clientv3.LeaseID]time.Duration
+		lastID clientv3.LeaseID
+		// changed is closed and replaced at every write, for WaitForValue.
+		changed chan struct{}
+
+		// locker is the semaphore of Lock and Unlock.
+		locker chan struct{}
+		// holder is the one recorded by LockAs, it's accessed under mutex.
+		holder string
+	}
+
+	memTxn struct {
+		ms      *memStorage
+		cmps    []Cmp
+		thenOps []Op
+		elseOps []Op
+	}
+)
+
+// NewMem creates a storage keeping the data in memory, which needs no cluster.
+// The Syncer and watching methods aren't supported, they return errors,
+// and it publishes no metrics.
+func NewMem() Storage {
+	return &memStorage{
+		kvs:     map[string]*mvccpb.KeyValue{},
+		leases:  map[clientv3.LeaseID]time.Duration{},
+		changed: make(chan struct{}),
+		locker:  make(chan struct{}, 1),
+	}
+}
+
+// set puts the key at the current revision, the caller must hold the mutex.
+func (ms *memStorage) set(key, value string, leaseID clientv3.LeaseID) {
+	kv := &mvccpb.KeyValue{
+		Key:            []byte(key),
+		Value:          []byte(value),
+		CreateRevision: ms.rev,
+		ModRevision:    ms.rev,
+		Version:        1,
+		Lease:          int64(leaseID),
+	}
+	if old := ms.kvs[key]; old != nil {
+		kv.CreateRevision = old.CreateRevision
+		kv.Version = old.Version + 1
+	}
+	ms.kvs[key] = kv
+}
+
+// write applies the writes as one revision, the caller must hold the mutex.
+func (ms *memStorage) write(fn func()) {
+	ms.rev++
+	fn()
+	close(ms.changed)
+	ms.changed = make(chan struct{})
+}
+
+func (ms *memStorage) checkLease(leaseID clientv3.LeaseID) error {
+	if _, ok := ms.leases[leaseID]; !ok {
+		return fmt.Errorf("lease %x not found", leaseID)
+	}
+	return nil
+}
+
+func (ms *memStorage) Lock() error {
+	ms.locker <- struct{}{}
+	return nil
+}
+
+func (ms *memStorage) Unlock() error {
+	ms.mutex.Lock()
+	ms.holder = ""
+	ms.mutex.Unlock()
+
+	select {
+	case <-ms.locker:
+		return nil
+	default:
+		return fmt.Errorf("unlock failed: not locked")
+	}
+}
+
+func (ms *memStorage) TryLock(timeout time.Duration) (bool, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case ms.locker <- struct{}{}:
+		return true, nil
+	case <-timer.C:
+		return false, nil
+	}
+}
+
+func (ms *memStorage) LockAs(holder string) error {
+	ms.Lock()
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.holder = holder
+	return nil
+}
+
+// LockHolder tells the holder of the only lock of the mem storage whatever name is.
+func (ms *memStorage) LockHolder(name string) (string, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.holder, nil
+}
+
+func (ms *memStorage) Get(key string) (*string, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	kv := ms.kvs[key]
+	if kv == nil {
+		return nil, nil
+	}
+	value := string(kv.Value)
+	return &value, nil
+}
+
+func (ms *memStorage) GetPrefix(prefix string) (map[string]string, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	kvs := map[string]string{}
+	for k, kv := range ms.kvs {
+		if strings.HasPrefix(k, prefix) {
+			kvs[k] = string(kv.Value)
+		}
+	}
+	return kvs, nil
+}
+
+func (ms *memStorage) GetPrefixPaged(prefix string, limit int64, fromKey string) (map[string]string, string, error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	if fromKey != "" && !strings.HasPrefix(fromKey, prefix) {
+		return nil, "", fmt.Errorf("key %s out of prefix %s", fromKey, prefix)
+	}
+
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	keys := []string{}
+	for k := range ms.kvs {
+		if strings.HasPrefix(k, prefix) && k >= fromKey {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	nextKey := ""
+	if int64(len(keys)) > limit {
+		keys, nextKey = keys[:limit], keys[limit]
+	}
+
+	kvs := make(map[string]string, len(keys))
+	for _, k := range keys {
+		kvs[k] = string(ms.kvs[k].Value)
+	}
+	return kvs, nextKey, nil
+}
+
+func (ms *memStorage) GetRaw(key string) (*mvccpb.KeyValue, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.kvs[key], nil
+}
+
+func (ms *memStorage) GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	kvs := map[string]*mvccpb.KeyValue{}
+	for k, kv := range ms.kvs {
+		if strings.HasPrefix(k, prefix) {
+			kvs[k] = kv
+		}
+	}
+	return kvs, nil
+}
+
+func (ms *memStorage) CountPrefix(prefix string) (int64, error) {
+	kvs, _ := ms.GetRawPrefix(prefix)
+	return int64(len(kvs)), nil
+}
+
+func (ms *memStorage) Exists(key string) (bool, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	_, ok := ms.kvs[key]
+	return ok, nil
+}
+
+func (ms *memStorage) ListRevisions(prefix string) (map[string]int64, error) {
+	kvs, _ := ms.GetRawPrefix(prefix)
+	revisions := make(map[string]int64, len(kvs))
+	for k, kv := range kvs {
+		revisions[k] = kv.ModRevision
+	}
+	return revisions, nil
+}
+
+func (ms *memStorage) Ping() error {
+	return nil
+}
+
+func (ms *memStorage) CurrentRevision() (int64, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.rev, nil
+}
+
+// SnapshotAt reads the prefixes at the revision, only the current revision
+// is supported since the history isn't kept.
+func (ms *memStorage) SnapshotAt(revision int64, prefixes []string) (map[string]string, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	if revision != ms.rev {
+		return nil, fmt.Errorf("get prefixes at revision %d failed: only the current revision %d is kept",
+			revision, ms.rev)
+	}
+
+	kvs := make(map[string]string)
+	for k, kv := range ms.kvs {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(k, prefix) {
+				kvs[k] = string(kv.Value)
+				break
+			}
+		}
+	}
+	return kvs, nil
+}
+
+func (ms *memStorage) Put(key, value string) error {
+	return ms.PutWithLease(key, value, 0)
+}
+
+// PutUnderLease puts the key without any lease, since there's no member.
+func (ms *memStorage) PutUnderLease(key, value string) error {
+	return ms.Put(key, value)
+}
+
+func (ms *memStorage) PutAndDelete(kvs map[string]*string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.write(func() {
+		for k, v := range kvs {
+			if v == nil {
+				delete(ms.kvs, k)
+			} else {
+				ms.set(k, *v, 0)
+			}
+		}
+	})
+	return nil
+}
+
+// PutAndDeleteUnderLease puts and deletes the keys without any lease, since there's no member.
+func (ms *memStorage) PutAndDeleteUnderLease(kvs map[string]*string) error {
+	return ms.PutAndDelete(kvs)
+}
+
+func (ms *memStorage) GrantLease(ttl time.Duration) (clientv3.LeaseID, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.lastID++
+	ms.leases[ms.lastID] = ttl
+	return ms.lastID, nil
+}
+
+func (ms *memStorage) KeepAliveLease(leaseID clientv3.LeaseID) error {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.checkLease(leaseID)
+}
+
+// RevokeLease revokes the lease, and deletes the keys put with it.
+func (ms *memStorage) RevokeLease(leaseID clientv3.LeaseID) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if err := ms.checkLease(leaseID); err != nil {
+		return err
+	}
+	delete(ms.leases, leaseID)
+
+	ms.write(func() {
+		for k, kv := range ms.kvs {
+			if kv.Lease == int64(leaseID) {
+				delete(ms.kvs, k)
+			}
+		}
+	})
+	return nil
+}
+
+func (ms *memStorage) PutWithLease(key, value string, leaseID clientv3.LeaseID) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if leaseID != 0 {
+		if err := ms.checkLease(leaseID); err != nil {
+			return err
+		}
+	}
+
+	ms.write(func() {
+		ms.set(key, value, leaseID)
+	})
+	return nil
+}
+
+// ListLeases lists the leases with their granted ttl, since they never expire.
+func (ms *memStorage) ListLeases() ([]LeaseInfo, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	infos := make([]LeaseInfo, 0, len(ms.leases))
+	for leaseID, ttl := range ms.leases {
+		info := LeaseInfo{ID: leaseID, TTL: ttl, Keys: []string{}}
+		for k, kv := range ms.kvs {
+			if kv.Lease == int64(leaseID) {
+				info.Keys = append(info.Keys, k)
+			}
+		}
+		sort.Strings(info.Keys)
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+
+	return infos, nil
+}
+
+func (ms *memStorage) Delete(key string) error {
+	return ms.PutAndDelete(map[string]*string{key: nil})
+}
+
+func (ms *memStorage) DeletePrefix(prefix string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.write(func() {
+		for k := range ms.kvs {
+			if strings.HasPrefix(k, prefix) {
+				delete(ms.kvs, k)
+			}
+		}
+	})
+	return nil
+}
+
+// GetCtx gets the key unless ctx is done, the in-memory operations never block.
+func (ms *memStorage) GetCtx(ctx context.Context, key string) (*string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.Get(key)
+}
+
+func (ms *memStorage) GetPrefixCtx(ctx context.Context, prefix string) (map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ms.GetPrefix(prefix)
+}
+
+func (ms *memStorage) PutCtx(ctx context.Context, key, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.Put(key, value)
+}
+
+func (ms *memStorage) PutAndDeleteCtx(ctx context.Context, kvs map[string]*string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.PutAndDelete(kvs)
+}
+
+func (ms *memStorage) DeleteCtx(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.Delete(key)
+}
+
+func (ms *memStorage) Rename(oldKey, newKey string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	kv := ms.kvs[oldKey]
+	if kv == nil {
+		return fmt.Errorf("rename %s to %s failed: key not found", oldKey, newKey)
+	}
+	if oldKey == newKey {
+		return nil
+	}
+
+	ms.write(func() {
+		ms.set(newKey, string(kv.Value), clientv3.LeaseID(kv.Lease))
+		delete(ms.kvs, oldKey)
+	})
+	return nil
+}
+
+func (ms *memStorage) Append(key, element string, maxLen int) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	var list []string
+	if kv := ms.kvs[key]; kv != nil {
+		if err := codectool.UnmarshalJSON(kv.Value, &list); err != nil {
+			return fmt.Errorf("append to %s failed: value is not a JSON array of strings: %v", key, err)
+		}
+	}
+
+	list = append(list, element)
+	if maxLen > 0 && len(list) > maxLen {
+		list = list[len(list)-maxLen:]
+	}
+	buff, err := codectool.MarshalJSON(list)
+	if err != nil {
+		return fmt.Errorf("append to %s failed: %v", key, err)
+	}
+
+	ms.write(func() {
+		ms.set(key, string(buff), 0)
+	})
+	return nil
+}
+
+func (ms *memStorage) AppendCtx(ctx context.Context, key, element string, maxLen int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ms.Append(key, element, maxLen)
+}
+
+func (ms *memStorage) Txn() Txn {
+	return &memTxn{ms: ms}
+}
+
+func (ms *memStorage) CompareAndSwap(key, oldValue, newValue string) (bool, error) {
+	return ms.Txn().If(CmpValue(key, oldValue)).Then(OpPut(key, newValue)).Commit()
+}
+
+func (ms *memStorage) PutIfRevision(key, value string, rev int64) (bool, error) {
+	return ms.Txn().If(CmpModRevision(key, rev)).Then(OpPut(key, value)).Commit()
+}
+
+func (ms *memStorage) Syncer() (cluster.Syncer, error) {
+	return nil, fmt.Errorf("syncer is not supported by the mem storage")
+}
+
+func (ms *memStorage) SyncerWithInterval(pullInterval time.Duration) (cluster.Syncer, error) {
+	return ms.Syncer()
+}
+
+func (ms *memStorage) WaitForValue(ctx context.Context, key, expected string) error {
+	for {
+		ms.mutex.RLock()
+		kv, changed := ms.kvs[key], ms.changed
+		ms.mutex.RUnlock()
+
+		if kv != nil && string(kv.Value) == expected {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("wait for %s to be %s failed: %v", key, expected, ctx.Err())
+		case <-changed:
+		}
+	}
+}
+
+func (ms *memStorage) WatchPrefixes(prefixes []string) (<-chan KVEvent, func(), error) {
+	return nil, nil, fmt.Errorf("watching is not supported by the mem storage")
+}
+
+func (ms *memStorage) Watch(key string) (<-chan *string, func(), error) {
+	return nil, nil, fmt.Errorf("watching is not supported by the mem storage")
+}
+
+func (ms *memStorage) WatchPrefix(prefix string) (<-chan map[string]*string, func(), error) {
+	return nil, nil, fmt.Errorf("watching is not supported by the mem storage")
+}
+
+// LeaderChanged returns a channel which never fires, since the mem storage has no members,
+// it's closed once ctx is done.
+func (ms *memStorage) LeaderChanged(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch
+}
+
+func (txn *memTxn) If(cmps ...Cmp) Txn {
+	txn.cmps = append(txn.cmps, cmps...)
+	return txn
+}
+
+func (txn *memTxn) Then(ops ...Op) Txn {
+	txn.thenOps = append(txn.thenOps, ops...)
+	return txn
+}
+
+func (txn *memTxn) Else(ops ...Op) Txn {
+	txn.elseOps = append(txn.elseOps, ops...)
+	return txn
+}
+
+func (txn *memTxn) Commit() (bool, error) {
+	ms := txn.ms
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	succeeded := true
+	for _, cmp := range txn.cmps {
+		if !ms.compare(cmp) {
+			succeeded = false
+			break
+		}
+	}
+
+	ops := txn.thenOps
+	if !succeeded {
+		ops = txn.elseOps
+	}
+	for _, op := range ops {
+		if op.value != nil && op.leaseID != 0 {
+			if err := ms.checkLease(op.leaseID); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if len(ops) != 0 {
+		ms.write(func() {
+			for _, op := range ops {
+				if op.value == nil {
+					delete(ms.kvs, op.key)
+				} else {
+					ms.set(op.key, *op.value, op.leaseID)
+				}
+			}
+		})
+	}
+
+	return succeeded, nil
+}
+
+// compare checks the condition, the caller must hold the mutex.
+func (ms *memStorage) compare(cmp Cmp) bool {
+	kv := ms.kvs[cmp.key]
+	switch cmp.target {
+	case cmpTargetModRevision:
+		var revision int64
+		if kv != nil {
+			revision = kv.ModRevision
+		}
+		return revision == cmp.revision
+	case cmpTargetExists:
+		return (kv != nil) == cmp.exists
+	default:
+		return kv != nil && string(kv.Value) == cmp.value
+	}
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/megaease/easegress/v2/pkg/cluster"
+	"github.com/megaease/easegress/v2/pkg/util/prometheushelper"
+)
+
+// The operation names of the storage metrics, the Ctx variants share
+// the names of the plain ones.
+const (
+	opLock            = "lock"
+	opUnlock          = "unlock"
+	opLockHolder      = "lockholder"
+	opGet             = "get"
+	opGetPrefix       = "getprefix"
+	opGetPrefixPaged  = "getprefixpaged"
+	opGetRaw          = "getraw"
+	opGetRawPrefix    = "getrawprefix"
+	opCountPrefix     = "countprefix"
+	opExists          = "exists"
+	opListRevisions   = "listrevisions"
+	opCurrentRevision = "currentrevision"
+	opSnapshotAt      = "snapshotat"
+	opPut             = "put"
+	opPutAndDelete    = "putanddelete"
+	opGrantLease      = "grantlease"
+	opKeepAliveLease  = "keepalivelease"
+	opRevokeLease     = "revokelease"
+	opListLeases      = "listleases"
+	opDelete          = "delete"
+	opDeletePrefix    = "deleteprefix"
+	opRename          = "rename"
+	opAppend          = "append"
+	opTxn             = "txn"
+)
+
+// storageDurationBuckets are the buckets of the operation durations in milliseconds,
+// which are finer than the default ones, since most etcd operations finish in a few.
+var storageDurationBuckets = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
+
+// storageMetrics publishes the latencies and errors of the storage operations,
+// the nil one publishes nothing.
+type storageMetrics struct {
+	name      string
+	durations *prometheus.HistogramVec
+	errors    *prometheus.CounterVec
+}
+
+func newStorageMetrics(name string) *storageMetrics {
+	labels := []string{"storage", "operation"}
+	return &storageMetrics{
+		name: name,
+		durations: prometheushelper.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "mesh_storage_operation_duration_milliseconds",
+				Help:    "the duration histogram of the mesh storage operations, including the retries",
+				Buckets: storageDurationBuckets,
+			},
+			labels),
+		errors: prometheushelper.NewCounter("mesh_storage_operation_errors_total",
+			"the total count of the failed mesh storage operations",
+			labels),
+	}
+}
+
+// observe records the operation started at start, it's called as
+// defer sm.observe(op, time.Now(), &err) to see the returned error.
+func (sm *storageMetrics) observe(op string, start time.Time, err *error) {
+	if sm == nil {
+		return
+	}
+
+	if sm.durations != nil {
+		sm.durations.WithLabelValues(sm.name, op).Observe(float64(time.Since(start)) / float64(time.Millisecond))
+	}
+	if sm.errors != nil && *err != nil {
+		sm.errors.WithLabelValues(sm.name, op).Inc()
+	}
+}
+
+// NewWithoutMetrics creates a storage like New, but publishes no metrics,
+// e.g. on top of the in-memory fake clusters of tests.
+func NewWithoutMetrics(name string, cls cluster.Cluster) Storage {
+	return newClusterStorage(name, cls, nil)
+}
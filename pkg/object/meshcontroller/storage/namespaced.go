@@ -0,0 +1,519 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/megaease/easegress/v2/pkg/cluster"
+)
+
+type (
+	// namespacedStorage prepends the prefix to the keys, lock names and watches of
+	// the storage, and strips it from the returned keys, so the ones sharing a cluster
+	// can't touch the keys of each other. NOTE: It implements every method rather than
+	// embedding Storage, so no method added later reaches the cluster unprefixed.
+	namespacedStorage struct {
+		store  *clusterStorage
+		prefix string
+	}
+
+	namespacedTxn struct {
+		txn    Txn
+		prefix string
+	}
+
+	namespacedSyncer struct {
+		syncer cluster.Syncer
+		prefix string
+
+		once sync.Once
+		done chan struct{}
+	}
+)
+
+// NewNamespaced creates a storage like New, which isolates its keys under prefix.
+// The prefix is prepended as it is, e.g. "/tenant-a" turns "/mesh/x" into "/tenant-a/mesh/x",
+// and the lock name into "/tenant-a/mesh" for the name "mesh".
+func NewNamespaced(name string, cls cluster.Cluster, prefix string) Storage {
+	return &namespacedStorage{
+		store:  New(namespacedName(prefix, name), cls).(*clusterStorage),
+		prefix: prefix,
+	}
+}
+
+// namespacedName joins prefix and the storage name with "/", which can't be in
+// the name of an object, so no other pair of them is joined into the same name.
+func namespacedName(prefix, name string) string {
+	return prefix + "/" + name
+}
+
+func (ns *namespacedStorage) key(key string) string {
+	return ns.prefix + key
+}
+
+func (ns *namespacedStorage) keys(keys []string) []string {
+	prefixed := make([]string, 0, len(keys))
+	for _, key := range keys {
+		prefixed = append(prefixed, ns.key(key))
+	}
+	return prefixed
+}
+
+func stripKVs(prefix string, kvs map[string]string) map[string]string {
+	stripped := make(map[string]string, len(kvs))
+	for k, v := range kvs {
+		stripped[strings.TrimPrefix(k, prefix)] = v
+	}
+	return stripped
+}
+
+func stripRawKV(prefix string, kv *mvccpb.KeyValue) *mvccpb.KeyValue {
+	if kv == nil {
+		return nil
+	}
+
+	copied := *kv
+	copied.Key = []byte(strings.TrimPrefix(string(kv.Key), prefix))
+	return &copied
+}
+
+func stripRawKVs(prefix string, kvs map[string]*mvccpb.KeyValue) map[string]*mvccpb.KeyValue {
+	stripped := make(map[string]*mvccpb.KeyValue, len(kvs))
+	for k, kv := range kvs {
+		stripped[strings.TrimPrefix(k, prefix)] = stripRawKV(prefix, kv)
+	}
+	return stripped
+}
+
+func stripValues(prefix string, kvs map[string]*string) map[string]*string {
+	stripped := make(map[string]*string, len(kvs))
+	for k, v := range kvs {
+		stripped[strings.TrimPrefix(k, prefix)] = v
+	}
+	return stripped
+}
+
+func (ns *namespacedStorage) prefixValues(kvs map[string]*string) map[string]*string {
+	prefixed := make(map[string]*string, len(kvs))
+	for k, v := range kvs {
+		prefixed[ns.key(k)] = v
+	}
+	return prefixed
+}
+
+func (ns *namespacedStorage) Lock() error {
+	return ns.store.Lock()
+}
+
+func (ns *namespacedStorage) Unlock() error {
+	return ns.store.Unlock()
+}
+
+func (ns *namespacedStorage) LockAs(holder string) error {
+	return ns.store.LockAs(holder)
+}
+
+func (ns *namespacedStorage) LockHolder(name string) (string, error) {
+	return ns.store.LockHolder(namespacedName(ns.prefix, name))
+}
+
+func (ns *namespacedStorage) TryLock(timeout time.Duration) (bool, error) {
+	return ns.store.TryLock(timeout)
+}
+
+func (ns *namespacedStorage) Get(key string) (*string, error) {
+	return ns.store.Get(ns.key(key))
+}
+
+func (ns *namespacedStorage) GetPrefix(prefix string) (map[string]string, error) {
+	kvs, err := ns.store.GetPrefix(ns.key(prefix))
+	if err != nil {
+		return nil, err
+	}
+	return stripKVs(ns.prefix, kvs), nil
+}
+
+func (ns *namespacedStorage) GetPrefixPaged(prefix string, limit int64, fromKey string) (map[string]string, string, error) {
+	if fromKey != "" {
+		fromKey = ns.key(fromKey)
+	}
+
+	kvs, nextKey, err := ns.store.GetPrefixPaged(ns.key(prefix), limit, fromKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return stripKVs(ns.prefix, kvs), strings.TrimPrefix(nextKey, ns.prefix), nil
+}
+
+func (ns *namespacedStorage) GetRaw(key string) (*mvccpb.KeyValue, error) {
+	kv, err := ns.store.GetRaw(ns.key(key))
+	if err != nil {
+		return nil, err
+	}
+	return stripRawKV(ns.prefix, kv), nil
+}
+
+func (ns *namespacedStorage) GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, error) {
+	kvs, err := ns.store.GetRawPrefix(ns.key(prefix))
+	if err != nil {
+		return nil, err
+	}
+	return stripRawKVs(ns.prefix, kvs), nil
+}
+
+func (ns *namespacedStorage) CountPrefix(prefix string) (int64, error) {
+	return ns.store.CountPrefix(ns.key(prefix))
+}
+
+func (ns *namespacedStorage) Exists(key string) (bool, error) {
+	return ns.store.Exists(ns.key(key))
+}
+
+func (ns *namespacedStorage) ListRevisions(prefix string) (map[string]int64, error) {
+	revisions, err := ns.store.ListRevisions(ns.key(prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	stripped := make(map[string]int64, len(revisions))
+	for k, rev := range revisions {
+		stripped[strings.TrimPrefix(k, ns.prefix)] = rev
+	}
+	return stripped, nil
+}
+
+func (ns *namespacedStorage) Ping() error {
+	return ns.store.Ping()
+}
+
+func (ns *namespacedStorage) CurrentRevision() (int64, error) {
+	return ns.store.CurrentRevision()
+}
+
+func (ns *namespacedStorage) SnapshotAt(revision int64, prefixes []string) (map[string]string, error) {
+	kvs, err := ns.store.SnapshotAt(revision, ns.keys(prefixes))
+	if err != nil {
+		return nil, err
+	}
+	return stripKVs(ns.prefix, kvs), nil
+}
+
+func (ns *namespacedStorage) Put(key, value string) error {
+	return ns.store.Put(ns.key(key), value)
+}
+
+func (ns *namespacedStorage) PutUnderLease(key, value string) error {
+	return ns.store.PutUnderLease(ns.key(key), value)
+}
+
+func (ns *namespacedStorage) PutAndDelete(kvs map[string]*string) error {
+	return ns.store.PutAndDelete(ns.prefixValues(kvs))
+}
+
+func (ns *namespacedStorage) PutAndDeleteUnderLease(kvs map[string]*string) error {
+	return ns.store.PutAndDeleteUnderLease(ns.prefixValues(kvs))
+}
+
+func (ns *namespacedStorage) GrantLease(ttl time.Duration) (clientv3.LeaseID, error) {
+	return ns.store.GrantLease(ttl)
+}
+
+func (ns *namespacedStorage) KeepAliveLease(leaseID clientv3.LeaseID) error {
+	return ns.store.KeepAliveLease(leaseID)
+}
+
+func (ns *namespacedStorage) RevokeLease(leaseID clientv3.LeaseID) error {
+	return ns.store.RevokeLease(leaseID)
+}
+
+func (ns *namespacedStorage) PutWithLease(key, value string, leaseID clientv3.LeaseID) error {
+	return ns.store.PutWithLease(ns.key(key), value, leaseID)
+}
+
+// ListLeases lists the leases of the cluster, which are shared by the namespaces,
+// but only the attached keys in the namespace are reported.
+func (ns *namespacedStorage) ListLeases() ([]LeaseInfo, error) {
+	leases, err := ns.store.ListLeases()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range leases {
+		keys := []string{}
+		for _, key := range leases[i].Keys {
+			if strings.HasPrefix(key, ns.prefix) {
+				keys = append(keys, strings.TrimPrefix(key, ns.prefix))
+			}
+		}
+		leases[i].Keys = keys
+	}
+	return leases, nil
+}
+
+func (ns *namespacedStorage) Delete(key string) error {
+	return ns.store.Delete(ns.key(key))
+}
+
+func (ns *namespacedStorage) DeletePrefix(prefix string) error {
+	return ns.store.DeletePrefix(ns.key(prefix))
+}
+
+func (ns *namespacedStorage) GetCtx(ctx context.Context, key string) (*string, error) {
+	return ns.store.GetCtx(ctx, ns.key(key))
+}
+
+func (ns *namespacedStorage) GetPrefixCtx(ctx context.Context, prefix string) (map[string]string, error) {
+	kvs, err := ns.store.GetPrefixCtx(ctx, ns.key(prefix))
+	if err != nil {
+		return nil, err
+	}
+	return stripKVs(ns.prefix, kvs), nil
+}
+
+func (ns *namespacedStorage) PutCtx(ctx context.Context, key, value string) error {
+	return ns.store.PutCtx(ctx, ns.key(key), value)
+}
+
+func (ns *namespacedStorage) PutAndDeleteCtx(ctx context.Context, kvs map[string]*string) error {
+	return ns.store.PutAndDeleteCtx(ctx, ns.prefixValues(kvs))
+}
+
+func (ns *namespacedStorage) DeleteCtx(ctx context.Context, key string) error {
+	return ns.store.DeleteCtx(ctx, ns.key(key))
+}
+
+func (ns *namespacedStorage) Rename(oldKey, newKey string) error {
+	return ns.store.Rename(ns.key(oldKey), ns.key(newKey))
+}
+
+func (ns *namespacedStorage) Append(key, element string, maxLen int) error {
+	return ns.store.Append(ns.key(key), element, maxLen)
+}
+
+func (ns *namespacedStorage) AppendCtx(ctx context.Context, key, element string, maxLen int) error {
+	return ns.store.AppendCtx(ctx, ns.key(key), element, maxLen)
+}
+
+func (ns *namespacedStorage) Txn() Txn {
+	return &namespacedTxn{txn: ns.store.Txn(), prefix: ns.prefix}
+}
+
+func (ns *namespacedStorage) CompareAndSwap(key, oldValue, newValue string) (bool, error) {
+	return ns.store.CompareAndSwap(ns.key(key), oldValue, newValue)
+}
+
+func (ns *namespacedStorage) PutIfRevision(key, value string, rev int64) (bool, error) {
+	return ns.store.PutIfRevision(ns.key(key), value, rev)
+}
+
+func (ns *namespacedStorage) Syncer() (cluster.Syncer, error) {
+	return ns.SyncerWithInterval(defaultSyncInterval)
+}
+
+func (ns *namespacedStorage) SyncerWithInterval(pullInterval time.Duration) (cluster.Syncer, error) {
+	syncer, err := ns.store.SyncerWithInterval(pullInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	return &namespacedSyncer{
+		syncer: syncer,
+		prefix: ns.prefix,
+		done:   make(chan struct{}),
+	}, nil
+}
+
+func (ns *namespacedStorage) WaitForValue(ctx context.Context, key, expected string) error {
+	return ns.store.WaitForValue(ctx, ns.key(key), expected)
+}
+
+func (ns *namespacedStorage) WatchPrefixes(prefixes []string) (<-chan KVEvent, func(), error) {
+	source, stop, err := ns.store.WatchPrefixes(ns.keys(prefixes))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch, done := make(chan KVEvent, 10), make(chan struct{})
+	go func() {
+		defer close(ch)
+
+		for event := range source {
+			event.Prefix = strings.TrimPrefix(event.Prefix, ns.prefix)
+			event.Key = strings.TrimPrefix(event.Key, ns.prefix)
+			select {
+			case ch <- event:
+			case <-done:
+			}
+		}
+	}()
+
+	return ch, stopWith(done, stop), nil
+}
+
+func (ns *namespacedStorage) Watch(key string) (<-chan *string, func(), error) {
+	return ns.store.Watch(ns.key(key))
+}
+
+func (ns *namespacedStorage) WatchPrefix(prefix string) (<-chan map[string]*string, func(), error) {
+	source, stop, err := ns.store.WatchPrefix(ns.key(prefix))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch, done := make(chan map[string]*string, 10), make(chan struct{})
+	go func() {
+		defer close(ch)
+
+		for kvs := range source {
+			select {
+			case ch <- stripValues(ns.prefix, kvs):
+			case <-done:
+			}
+		}
+	}()
+
+	return ch, stopWith(done, stop), nil
+}
+
+// stopWith returns the function closing done before stop, so the relaying
+// goroutines drain the source instead of blocking on the unread channel.
+func stopWith(done chan struct{}, stop func()) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			stop()
+		})
+	}
+}
+
+func (ns *namespacedStorage) LeaderChanged(ctx context.Context) <-chan struct{} {
+	return ns.store.LeaderChanged(ctx)
+}
+
+func (txn *namespacedTxn) If(cmps ...Cmp) Txn {
+	for _, cmp := range cmps {
+		cmp.key = txn.prefix + cmp.key
+		txn.txn.If(cmp)
+	}
+	return txn
+}
+
+func (txn *namespacedTxn) Then(ops ...Op) Txn {
+	for _, op := range ops {
+		op.key = txn.prefix + op.key
+		txn.txn.Then(op)
+	}
+	return txn
+}
+
+func (txn *namespacedTxn) Else(ops ...Op) Txn {
+	for _, op := range ops {
+		op.key = txn.prefix + op.key
+		txn.txn.Else(op)
+	}
+	return txn
+}
+
+func (txn *namespacedTxn) Commit() (bool, error) {
+	return txn.txn.Commit()
+}
+
+func (s *namespacedSyncer) Sync(key string) (<-chan *string, error) {
+	return s.syncer.Sync(s.prefix + key)
+}
+
+func (s *namespacedSyncer) SyncRaw(key string) (<-chan *mvccpb.KeyValue, error) {
+	source, err := s.syncer.SyncRaw(s.prefix + key)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *mvccpb.KeyValue, 10)
+	go func() {
+		defer close(ch)
+
+		for kv := range source {
+			select {
+			case ch <- stripRawKV(s.prefix, kv):
+			case <-s.done:
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (s *namespacedSyncer) SyncPrefix(prefix string) (<-chan map[string]string, error) {
+	source, err := s.syncer.SyncPrefix(s.prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan map[string]string, 10)
+	go func() {
+		defer close(ch)
+
+		for kvs := range source {
+			select {
+			case ch <- stripKVs(s.prefix, kvs):
+			case <-s.done:
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (s *namespacedSyncer) SyncRawPrefix(prefix string) (<-chan map[string]*mvccpb.KeyValue, error) {
+	source, err := s.syncer.SyncRawPrefix(s.prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan map[string]*mvccpb.KeyValue, 10)
+	go func() {
+		defer close(ch)
+
+		for kvs := range source {
+			select {
+			case ch <- stripRawKVs(s.prefix, kvs):
+			case <-s.done:
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (s *namespacedSyncer) Close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.syncer.Close()
+	})
+}
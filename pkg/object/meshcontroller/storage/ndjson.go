@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"io"
+	"sort"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
+)
+
+const (
+	// ChangeOpPut is the op of the put change record.
+	ChangeOpPut = "put"
+	// ChangeOpDelete is the op of the delete change record.
+	ChangeOpDelete = "delete"
+)
+
+// ChangeRecord is one storage change for external tooling.
+type ChangeRecord struct {
+	Op       string `json:"op"`
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	Revision int64  `json:"revision"`
+}
+
+// WriteNDJSON writes the events as newline-delimited JSON change records,
+// in the order of revisions. It's suitable for streaming the events from
+// the watcher to the HTTP response, and the caller should flush it if needed.
+func WriteNDJSON(w io.Writer, events []*clientv3.Event) error {
+	records := make([]*ChangeRecord, 0, len(events))
+	for _, event := range events {
+		if event == nil || event.Kv == nil {
+			continue
+		}
+
+		record := &ChangeRecord{
+			Key:      string(event.Kv.Key),
+			Revision: event.Kv.ModRevision,
+		}
+		switch event.Type {
+		case mvccpb.DELETE:
+			record.Op = ChangeOpDelete
+		default:
+			record.Op = ChangeOpPut
+			record.Value = string(event.Kv.Value)
+		}
+		records = append(records, record)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Revision < records[j].Revision
+	})
+
+	for _, record := range records {
+		buff, err := codectool.MarshalJSON(record)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(append(buff, '\n')); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
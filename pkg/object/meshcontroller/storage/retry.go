@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"time"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+)
+
+const (
+	defaultRetries      = 3
+	defaultRetryBackoff = 100 * time.Millisecond
+)
+
+// isTransientError tells whether the error is a transient failure of etcd, e.g. no leader,
+// the leader changed or the connection lost, which are all reported as unavailable.
+func isTransientError(err error) bool {
+	if etcdErr, ok := err.(rpctypes.EtcdError); ok {
+		return etcdErr.Code() == codes.Unavailable
+	}
+	return status.Code(err) == codes.Unavailable
+}
+
+// retry calls fn until it succeeds or fails permanently, the transient failures are
+// retried for cs.retries times, backed off exponentially from cs.retryBackoff.
+func (cs *clusterStorage) retry(fn func() error) error {
+	backoff := cs.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !isTransientError(err) || attempt >= cs.retries {
+			return err
+		}
+
+		logger.Warnf("storage %s failed transiently at attempt %d, retry after %v: %v",
+			cs.name, attempt+1, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
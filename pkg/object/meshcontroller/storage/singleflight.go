@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"golang.org/x/sync/singleflight"
+)
+
+type (
+	// SingleflightStorage wraps a storage to collapse the identical concurrent
+	// reads into one backend call, whose result is shared by all callers.
+	// NOTE: The raw key values are shared, callers must not modify them.
+	SingleflightStorage struct {
+		Storage
+
+		group singleflight.Group
+	}
+)
+
+// NewSingleflight creates a singleflight storage on top of store.
+func NewSingleflight(store Storage) *SingleflightStorage {
+	return &SingleflightStorage{Storage: store}
+}
+
+// Get gets the key, sharing the in-flight read of the same key.
+func (ss *SingleflightStorage) Get(key string) (*string, error) {
+	v, err, _ := ss.group.Do("get:"+key, func() (interface{}, error) {
+		return ss.Storage.Get(key)
+	})
+
+	value, _ := v.(*string)
+	if err != nil || value == nil {
+		return nil, err
+	}
+
+	copied := *value
+	return &copied, nil
+}
+
+// GetPrefix gets the prefix, sharing the in-flight read of the same prefix.
+func (ss *SingleflightStorage) GetPrefix(prefix string) (map[string]string, error) {
+	v, err, _ := ss.group.Do("getPrefix:"+prefix, func() (interface{}, error) {
+		return ss.Storage.GetPrefix(prefix)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	kvs := v.(map[string]string)
+	copied := make(map[string]string, len(kvs))
+	for k, v := range kvs {
+		copied[k] = v
+	}
+	return copied, nil
+}
+
+// GetRaw gets the raw key, sharing the in-flight read of the same key.
+func (ss *SingleflightStorage) GetRaw(key string) (*mvccpb.KeyValue, error) {
+	v, err, _ := ss.group.Do("getRaw:"+key, func() (interface{}, error) {
+		return ss.Storage.GetRaw(key)
+	})
+
+	kv, _ := v.(*mvccpb.KeyValue)
+	return kv, err
+}
+
+// GetRawPrefix gets the raw prefix, sharing the in-flight read of the same prefix.
+func (ss *SingleflightStorage) GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, error) {
+	v, err, _ := ss.group.Do("getRawPrefix:"+prefix, func() (interface{}, error) {
+		return ss.Storage.GetRawPrefix(prefix)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	kvs := v.(map[string]*mvccpb.KeyValue)
+	copied := make(map[string]*mvccpb.KeyValue, len(kvs))
+	for k, v := range kvs {
+		copied[k] = v
+	}
+	return copied, nil
+}
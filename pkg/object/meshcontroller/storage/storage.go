@@ -19,13 +19,19 @@
 package storage
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
 	"time"
 
 	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
 
 	"github.com/megaease/easegress/v2/pkg/cluster"
 	"github.com/megaease/easegress/v2/pkg/logger"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
 )
 
 type (
@@ -33,35 +39,184 @@ type (
 	Storage interface {
 		Lock() error
 		Unlock() error
+		// LockAs locks like Lock, and records the holder, e.g. the hostname,
+		// until Unlock. LockHolder tells the holder of the lock of name,
+		// which is empty if it's not locked by LockAs.
+		LockAs(holder string) error
+		LockHolder(name string) (string, error)
+		// TryLock locks like Lock, but it gives up once timeout elapses,
+		// which reports false without error.
+		TryLock(timeout time.Duration) (bool, error)
 
 		Get(key string) (*string, error)
 		GetPrefix(prefix string) (map[string]string, error)
+		// GetPrefixPaged gets a page of at most limit keys of the prefix from fromKey,
+		// e.g. for the large prefixes. It returns the fromKey of the next page, which
+		// is empty once exhausted, so callers loop from the empty fromKey until it's empty.
+		GetPrefixPaged(prefix string, limit int64, fromKey string) (map[string]string, string, error)
 		GetRaw(key string) (*mvccpb.KeyValue, error)
 		GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, error)
+		// CountPrefix counts the keys of the prefix.
+		CountPrefix(prefix string) (int64, error)
+		// Exists checks whether the key exists, which doesn't transfer its value.
+		Exists(key string) (bool, error)
+		// ListRevisions lists the mod revisions of the keys of the prefix,
+		// e.g. for incremental sync to find out the changed keys.
+		ListRevisions(prefix string) (map[string]int64, error)
+
+		// Ping checks whether the store is reachable.
+		Ping() error
+
+		// CurrentRevision returns the current revision of the store.
+		CurrentRevision() (int64, error)
+		// SnapshotAt reads all prefixes at the same revision,
+		// so the result is consistent across them.
+		SnapshotAt(revision int64, prefixes []string) (map[string]string, error)
 
 		Put(key, value string) error
 		PutUnderLease(key, value string) error
 		PutAndDelete(map[string]*string) error
 		PutAndDeleteUnderLease(map[string]*string) error
 
+		// GrantLease grants a lease with ttl, the data put with it expires
+		// unless the lease is kept alive within ttl.
+		GrantLease(ttl time.Duration) (clientv3.LeaseID, error)
+		KeepAliveLease(leaseID clientv3.LeaseID) error
+		RevokeLease(leaseID clientv3.LeaseID) error
+		PutWithLease(key, value string, leaseID clientv3.LeaseID) error
+		// ListLeases lists the alive leases of the store, including the ones
+		// not granted through the storage, e.g. for debugging disappeared keys.
+		ListLeases() ([]LeaseInfo, error)
+
 		Delete(key string) error
 		DeletePrefix(prefix string) error
 
+		// The Ctx variants honor the cancellation and deadline of ctx,
+		// e.g. for bounding the storage operations while shutting down.
+		GetCtx(ctx context.Context, key string) (*string, error)
+		GetPrefixCtx(ctx context.Context, prefix string) (map[string]string, error)
+		PutCtx(ctx context.Context, key, value string) error
+		PutAndDeleteCtx(ctx context.Context, kvs map[string]*string) error
+		DeleteCtx(ctx context.Context, key string) error
+
+		// Rename moves the value of oldKey to newKey atomically, newKey is put
+		// with the lease of oldKey if any, so it expires as oldKey would.
+		// It fails if oldKey doesn't exist.
+		Rename(oldKey, newKey string) error
+
+		// Append appends the element to the JSON array of strings at key atomically,
+		// and trims the array to the latest maxLen elements, 0 means unlimited.
+		Append(key, element string, maxLen int) error
+		// AppendCtx is like Append, it gives up once ctx is done.
+		AppendCtx(ctx context.Context, key, element string, maxLen int) error
+
+		// Txn creates a transaction for multi-key conditional writes.
+		Txn() Txn
+
+		// CompareAndSwap puts newValue to key only if its value is oldValue, it fails
+		// if the key doesn't exist. PutIfRevision puts value to key only if its mod
+		// revision is rev, 0 rev means the key doesn't exist. Both of them report
+		// false without error if the precondition doesn't hold.
+		CompareAndSwap(key, oldValue, newValue string) (bool, error)
+		PutIfRevision(key, value string, rev int64) (bool, error)
+
+		// Syncer creates a syncer pulling the full data every minute,
+		// SyncerWithInterval creates the one pulling every pullInterval.
 		Syncer() (cluster.Syncer, error)
+		SyncerWithInterval(pullInterval time.Duration) (cluster.Syncer, error)
+
+		// WaitForValue waits until the value of key equals to expected,
+		// or the context is done.
+		WaitForValue(ctx context.Context, key, expected string) error
+
+		// WatchPrefixes watches the prefixes in one subscription, the events of
+		// them are sent to the channel tagged with the matched prefix. The returned
+		// function stops watching, which closes the channel.
+		WatchPrefixes(prefixes []string) (<-chan KVEvent, func(), error)
+
+		// Watch watches the key, the channel receives the value once it changes,
+		// and nil once it's deleted. The channel is closed once the returned function
+		// is called, or the watch is broken, e.g. disconnected from the cluster.
+		Watch(key string) (<-chan *string, func(), error)
+
+		// WatchPrefix watches the prefix, every event of the channel carries
+		// the changed keys, with nil values for the deleted ones. It's closed
+		// in the same way as the one of Watch.
+		WatchPrefix(prefix string) (<-chan map[string]*string, func(), error)
+
+		// LeaderChanged watches the leader of the cluster until ctx is done,
+		// which closes the returned channel. The channel fires once the leader
+		// changes, including the handoffs between the other members and the
+		// local member losing and regaining the leadership. The changes before
+		// the former notification is received are coalesced into one, so the
+		// receivers check the current leader by themselves. It never fires on
+		// the members without embedded etcd server, e.g. the secondary ones.
+		LeaderChanged(ctx context.Context) <-chan struct{}
+	}
+
+	// KVEvent is the event of a changed key, nil Value means the key is deleted.
+	KVEvent struct {
+		// Prefix is the watched prefix which the key matched.
+		Prefix string
+		Key    string
+		Value  *string
+	}
+
+	// LeaseInfo is an alive lease and the keys attached to it.
+	LeaseInfo struct {
+		ID clientv3.LeaseID `json:"id"`
+		// TTL is the remaining time to live of the lease.
+		TTL  time.Duration `json:"ttl"`
+		Keys []string      `json:"keys"`
 	}
 
 	clusterStorage struct {
 		name  string
 		cls   cluster.Cluster
 		mutex cluster.Mutex
+		// holder is the one recorded by LockAs, it's accessed under mutex.
+		holder string
+
+		// leaderRetryInterval is the interval of retrying watching the leader
+		// while the embedded etcd server is not ready.
+		leaderRetryInterval time.Duration
+
+		// retries is the max retries of the transient failures of reading and
+		// writing the keys, which are backed off exponentially from retryBackoff.
+		retries      int
+		retryBackoff time.Duration
+
+		metrics *storageMetrics
 	}
 )
 
+const defaultLeaderRetryInterval = time.Second
+
+const defaultSyncInterval = time.Minute
+
+const (
+	// maxAppendAttempts limits the compare-and-swap attempts of Append under contention,
+	// the failed attempts are backed off exponentially with jitter from appendBackoff.
+	maxAppendAttempts = 8
+	appendBackoff     = 10 * time.Millisecond
+)
+
 // New creates a storage.
 func New(name string, cls cluster.Cluster) Storage {
+	return newClusterStorage(name, cls, newStorageMetrics(name))
+}
+
+func newClusterStorage(name string, cls cluster.Cluster, metrics *storageMetrics) *clusterStorage {
 	cs := &clusterStorage{
 		name: name,
 		cls:  cls,
+
+		leaderRetryInterval: defaultLeaderRetryInterval,
+
+		retries:      defaultRetries,
+		retryBackoff: defaultRetryBackoff,
+
+		metrics: metrics,
 	}
 
 	err := cs.mutexGoReady()
@@ -87,8 +242,10 @@ func (cs *clusterStorage) mutexGoReady() error {
 	return nil
 }
 
-func (cs *clusterStorage) Lock() error {
-	err := cs.mutexGoReady()
+func (cs *clusterStorage) Lock() (err error) {
+	defer cs.metrics.observe(opLock, time.Now(), &err)
+
+	err = cs.mutexGoReady()
 	if err != nil {
 		return err
 	}
@@ -96,55 +253,614 @@ func (cs *clusterStorage) Lock() error {
 	return cs.mutex.Lock()
 }
 
-func (cs *clusterStorage) Unlock() error {
-	err := cs.mutexGoReady()
+func (cs *clusterStorage) Unlock() (err error) {
+	defer cs.metrics.observe(opUnlock, time.Now(), &err)
+
+	err = cs.mutexGoReady()
 	if err != nil {
 		return err
 	}
 
+	if cs.holder != "" {
+		if err := cs.cls.Delete(lockHolderKey(cs.name)); err != nil {
+			logger.Errorf("delete holder %s of lock %s failed: %v", cs.holder, cs.name, err)
+		}
+		cs.holder = ""
+	}
+
 	return cs.mutex.Unlock()
 }
 
-func (cs *clusterStorage) Get(key string) (*string, error) {
-	return cs.cls.Get(key)
+func (cs *clusterStorage) TryLock(timeout time.Duration) (_ bool, err error) {
+	defer cs.metrics.observe(opLock, time.Now(), &err)
+
+	err = cs.mutexGoReady()
+	if err != nil {
+		return false, err
+	}
+
+	return cs.mutex.TryLock(timeout)
+}
+
+// lockHolderKey is the sidecar key of the holder of the lock, which
+// is out of the prefix of the lock keys.
+func lockHolderKey(name string) string {
+	return name + ".holder"
+}
+
+func (cs *clusterStorage) LockAs(holder string) error {
+	if err := cs.Lock(); err != nil {
+		return err
+	}
+
+	// NOTE: The holder is put under the member lease,
+	// so it's gone with the lock if the member dies.
+	if err := cs.cls.PutUnderLease(lockHolderKey(cs.name), holder); err != nil {
+		cs.Unlock()
+		return fmt.Errorf("record holder %s of lock %s failed: %v", holder, cs.name, err)
+	}
+	cs.holder = holder
+
+	return nil
+}
+
+func (cs *clusterStorage) LockHolder(name string) (_ string, err error) {
+	defer cs.metrics.observe(opLockHolder, time.Now(), &err)
+
+	holder, err := cs.cls.Get(lockHolderKey(name))
+	if err != nil || holder == nil {
+		return "", err
+	}
+	return *holder, nil
+}
+
+func (cs *clusterStorage) Get(key string) (value *string, err error) {
+	defer cs.metrics.observe(opGet, time.Now(), &err)
+
+	err = cs.retry(func() error {
+		value, err = cs.cls.Get(key)
+		return err
+	})
+	return value, err
+}
+
+func (cs *clusterStorage) GetPrefix(prefix string) (kvs map[string]string, err error) {
+	defer cs.metrics.observe(opGetPrefix, time.Now(), &err)
+
+	err = cs.retry(func() error {
+		kvs, err = cs.cls.GetPrefix(prefix)
+		return err
+	})
+	return kvs, err
+}
+
+func (cs *clusterStorage) Ping() error {
+	_, err := cs.cls.CurrentRevision()
+	return err
+}
+
+func (cs *clusterStorage) CurrentRevision() (_ int64, err error) {
+	defer cs.metrics.observe(opCurrentRevision, time.Now(), &err)
+
+	return cs.cls.CurrentRevision()
+}
+
+func (cs *clusterStorage) SnapshotAt(revision int64, prefixes []string) (_ map[string]string, err error) {
+	defer cs.metrics.observe(opSnapshotAt, time.Now(), &err)
+
+	kvs := make(map[string]string)
+	for _, prefix := range prefixes {
+		m, err := cs.cls.GetPrefixAt(prefix, revision)
+		if err != nil {
+			return nil, fmt.Errorf("get prefix %s at revision %d failed: %v", prefix, revision, err)
+		}
+		for k, v := range m {
+			kvs[k] = v
+		}
+	}
+
+	return kvs, nil
+}
+
+func (cs *clusterStorage) Put(key, value string) (err error) {
+	defer cs.metrics.observe(opPut, time.Now(), &err)
+
+	return cs.retry(func() error {
+		return cs.cls.Put(key, value)
+	})
+}
+
+func (cs *clusterStorage) PutUnderLease(key, value string) (err error) {
+	defer cs.metrics.observe(opPut, time.Now(), &err)
+
+	return cs.retry(func() error {
+		return cs.cls.PutUnderLease(key, value)
+	})
+}
+
+func (cs *clusterStorage) PutAndDelete(kvs map[string]*string) (err error) {
+	defer cs.metrics.observe(opPutAndDelete, time.Now(), &err)
+
+	return cs.retry(func() error {
+		return cs.cls.PutAndDelete(kvs)
+	})
+}
+
+func (cs *clusterStorage) PutAndDeleteUnderLease(kvs map[string]*string) (err error) {
+	defer cs.metrics.observe(opPutAndDelete, time.Now(), &err)
+
+	return cs.retry(func() error {
+		return cs.cls.PutAndDeleteUnderLease(kvs)
+	})
+}
+
+func (cs *clusterStorage) GrantLease(ttl time.Duration) (_ clientv3.LeaseID, err error) {
+	defer cs.metrics.observe(opGrantLease, time.Now(), &err)
+
+	return cs.cls.GrantLease(ttl)
+}
+
+func (cs *clusterStorage) KeepAliveLease(leaseID clientv3.LeaseID) (err error) {
+	defer cs.metrics.observe(opKeepAliveLease, time.Now(), &err)
+
+	return cs.cls.KeepAliveLease(leaseID)
+}
+
+func (cs *clusterStorage) RevokeLease(leaseID clientv3.LeaseID) (err error) {
+	defer cs.metrics.observe(opRevokeLease, time.Now(), &err)
+
+	return cs.cls.RevokeLease(leaseID)
+}
+
+func (cs *clusterStorage) PutWithLease(key, value string, leaseID clientv3.LeaseID) (err error) {
+	defer cs.metrics.observe(opPut, time.Now(), &err)
+
+	return cs.retry(func() error {
+		return cs.cls.PutWithLease(key, value, leaseID)
+	})
+}
+
+func (cs *clusterStorage) ListLeases() (_ []LeaseInfo, err error) {
+	defer cs.metrics.observe(opListLeases, time.Now(), &err)
+
+	leases, err := cs.cls.ListLeases()
+	if err != nil {
+		return nil, fmt.Errorf("list leases failed: %v", err)
+	}
+
+	infos := make([]LeaseInfo, 0, len(leases))
+	for _, lease := range leases {
+		info := LeaseInfo{
+			ID:   lease.ID,
+			TTL:  time.Duration(lease.TTL) * time.Second,
+			Keys: make([]string, 0, len(lease.Keys)),
+		}
+		for _, key := range lease.Keys {
+			info.Keys = append(info.Keys, string(key))
+		}
+		sort.Strings(info.Keys)
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+
+	return infos, nil
+}
+
+func (cs *clusterStorage) Rename(oldKey, newKey string) (err error) {
+	defer cs.metrics.observe(opRename, time.Now(), &err)
+
+	kv, err := cs.cls.GetRaw(oldKey)
+	if err != nil {
+		return err
+	}
+	if kv == nil {
+		return fmt.Errorf("rename %s to %s failed: key not found", oldKey, newKey)
+	}
+	if oldKey == newKey {
+		return nil
+	}
+
+	// NOTE: The mod revision protects the value from changing since read.
+	succeeded, err := cs.Txn().
+		If(CmpModRevision(oldKey, kv.ModRevision)).
+		Then(OpPutWithLease(newKey, string(kv.Value), clientv3.LeaseID(kv.Lease)), OpDelete(oldKey)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !succeeded {
+		return fmt.Errorf("rename %s to %s failed: key changed or deleted concurrently", oldKey, newKey)
+	}
+
+	return nil
+}
+
+func (cs *clusterStorage) Append(key, element string, maxLen int) error {
+	return cs.AppendCtx(context.Background(), key, element, maxLen)
+}
+
+func (cs *clusterStorage) AppendCtx(ctx context.Context, key, element string, maxLen int) (err error) {
+	defer cs.metrics.observe(opAppend, time.Now(), &err)
+
+	getRaw := func(key string) (*mvccpb.KeyValue, error) {
+		return cs.cls.GetRawCtx(ctx, key)
+	}
+	return appendElement(ctx, getRaw, cs.Txn, key, element, maxLen)
+}
+
+// appendElement appends the element with compare-and-swap, getRaw and txn are
+// the ones of the storage appended to, so the values are read and written by it.
+func appendElement(ctx context.Context, getRaw func(key string) (*mvccpb.KeyValue, error), txn func() Txn,
+	key, element string, maxLen int,
+) error {
+	backoff := appendBackoff
+	for attempt := 1; attempt <= maxAppendAttempts; attempt++ {
+		if attempt > 1 {
+			// NOTE: The jitter spreads the contended appenders out, so they
+			// don't collide again at the next attempt.
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("append to %s failed: %v", key, ctx.Err())
+			case <-time.After(backoff/2 + time.Duration(rand.Int63n(int64(backoff)))):
+			}
+			backoff *= 2
+		}
+
+		kv, err := getRaw(key)
+		if err != nil {
+			return err
+		}
+
+		var list []string
+		cmp := CmpExists(key, false)
+		if kv != nil {
+			if err := codectool.UnmarshalJSON(kv.Value, &list); err != nil {
+				return fmt.Errorf("append to %s failed: value is not a JSON array of strings: %v", key, err)
+			}
+			cmp = CmpModRevision(key, kv.ModRevision)
+		}
+
+		list = append(list, element)
+		if maxLen > 0 && len(list) > maxLen {
+			list = list[len(list)-maxLen:]
+		}
+		buff, err := codectool.MarshalJSON(list)
+		if err != nil {
+			return fmt.Errorf("append to %s failed: %v", key, err)
+		}
+
+		// NOTE: The mod revision protects the list from the concurrent appends.
+		succeeded, err := txn().If(cmp).Then(OpPut(key, string(buff))).Commit()
+		if err != nil {
+			return err
+		}
+		if succeeded {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("append to %s failed: changed concurrently in %d attempts", key, maxAppendAttempts)
 }
 
-func (cs *clusterStorage) GetPrefix(prefix string) (map[string]string, error) {
-	return cs.cls.GetPrefix(prefix)
+func (cs *clusterStorage) Delete(key string) (err error) {
+	defer cs.metrics.observe(opDelete, time.Now(), &err)
+
+	return cs.retry(func() error {
+		return cs.cls.Delete(key)
+	})
 }
 
-func (cs *clusterStorage) Put(key, value string) error {
-	return cs.cls.Put(key, value)
+func (cs *clusterStorage) DeletePrefix(prefix string) (err error) {
+	defer cs.metrics.observe(opDeletePrefix, time.Now(), &err)
+
+	return cs.retry(func() error {
+		return cs.cls.DeletePrefix(prefix)
+	})
 }
 
-func (cs *clusterStorage) PutUnderLease(key, value string) error {
-	return cs.cls.PutUnderLease(key, value)
+func (cs *clusterStorage) GetCtx(ctx context.Context, key string) (_ *string, err error) {
+	defer cs.metrics.observe(opGet, time.Now(), &err)
+
+	kv, err := cs.cls.GetRawCtx(ctx, key)
+	if err != nil || kv == nil {
+		return nil, err
+	}
+
+	value := string(kv.Value)
+	return &value, nil
 }
 
-func (cs *clusterStorage) PutAndDelete(kvs map[string]*string) error {
-	return cs.cls.PutAndDelete(kvs)
+func (cs *clusterStorage) GetPrefixCtx(ctx context.Context, prefix string) (_ map[string]string, err error) {
+	defer cs.metrics.observe(opGetPrefix, time.Now(), &err)
+
+	rawKVs, err := cs.cls.GetRawPrefixCtx(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	kvs := make(map[string]string, len(rawKVs))
+	for k, kv := range rawKVs {
+		kvs[k] = string(kv.Value)
+	}
+	return kvs, nil
 }
 
-func (cs *clusterStorage) PutAndDeleteUnderLease(kvs map[string]*string) error {
-	return cs.cls.PutAndDeleteUnderLease(kvs)
+func (cs *clusterStorage) PutCtx(ctx context.Context, key, value string) (err error) {
+	defer cs.metrics.observe(opPut, time.Now(), &err)
+
+	return cs.cls.PutCtx(ctx, key, value)
+}
+
+func (cs *clusterStorage) PutAndDeleteCtx(ctx context.Context, kvs map[string]*string) (err error) {
+	defer cs.metrics.observe(opPutAndDelete, time.Now(), &err)
+
+	return cs.cls.PutAndDeleteCtx(ctx, kvs)
+}
+
+func (cs *clusterStorage) DeleteCtx(ctx context.Context, key string) (err error) {
+	defer cs.metrics.observe(opDelete, time.Now(), &err)
+
+	return cs.cls.DeleteCtx(ctx, key)
+}
+
+func (cs *clusterStorage) GetRaw(key string) (kv *mvccpb.KeyValue, err error) {
+	defer cs.metrics.observe(opGetRaw, time.Now(), &err)
+
+	err = cs.retry(func() error {
+		kv, err = cs.cls.GetRaw(key)
+		return err
+	})
+	return kv, err
+}
+
+func (cs *clusterStorage) GetPrefixPaged(prefix string, limit int64, fromKey string) (_ map[string]string, _ string, err error) {
+	defer cs.metrics.observe(opGetPrefixPaged, time.Now(), &err)
+
+	return cs.cls.GetPrefixPaged(prefix, limit, fromKey)
+}
+
+func (cs *clusterStorage) GetRawPrefix(prefix string) (kvs map[string]*mvccpb.KeyValue, err error) {
+	defer cs.metrics.observe(opGetRawPrefix, time.Now(), &err)
+
+	err = cs.retry(func() error {
+		kvs, err = cs.cls.GetRawPrefix(prefix)
+		return err
+	})
+	return kvs, err
+}
+
+func (cs *clusterStorage) CountPrefix(prefix string) (_ int64, err error) {
+	defer cs.metrics.observe(opCountPrefix, time.Now(), &err)
+
+	return cs.cls.CountPrefix(prefix)
+}
+
+func (cs *clusterStorage) Exists(key string) (_ bool, err error) {
+	defer cs.metrics.observe(opExists, time.Now(), &err)
+
+	return cs.cls.Exists(key)
+}
+
+func (cs *clusterStorage) ListRevisions(prefix string) (_ map[string]int64, err error) {
+	defer cs.metrics.observe(opListRevisions, time.Now(), &err)
+
+	return cs.cls.ListRevisions(prefix)
 }
 
-func (cs *clusterStorage) Delete(key string) error {
-	return cs.cls.Delete(key)
+func (cs *clusterStorage) WaitForValue(ctx context.Context, key, expected string) error {
+	watcher, err := cs.cls.Watcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// NOTE: Watch before getting the current value, so no change is missed in between.
+	ch, err := watcher.Watch(key)
+	if err != nil {
+		return err
+	}
+
+	value, err := cs.cls.Get(key)
+	if err != nil {
+		return err
+	}
+	if value != nil && *value == expected {
+		return nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("wait for %s to be %s failed: %v", key, expected, ctx.Err())
+		case value, ok := <-ch:
+			if !ok {
+				return fmt.Errorf("wait for %s to be %s failed: watch closed", key, expected)
+			}
+			if value != nil && *value == expected {
+				return nil
+			}
+		}
+	}
 }
 
-func (cs *clusterStorage) DeletePrefix(prefix string) error {
-	return cs.cls.DeletePrefix(prefix)
+func (cs *clusterStorage) WatchPrefixes(prefixes []string) (<-chan KVEvent, func(), error) {
+	watcher, err := cs.cls.Watcher()
+	if err != nil {
+		return nil, nil, err
+	}
+	if watcher == nil {
+		return nil, nil, fmt.Errorf("watcher of the cluster is unavailable")
+	}
+
+	sources := make([]<-chan map[string]*string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		ch, err := watcher.WatchPrefix(prefix)
+		if err != nil {
+			watcher.Close()
+			return nil, nil, fmt.Errorf("watch prefix %s failed: %v", prefix, err)
+		}
+		sources = append(sources, ch)
+	}
+
+	ch, done := make(chan KVEvent, 10), make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for i := range sources {
+		wg.Add(1)
+		go func(prefix string, source <-chan map[string]*string) {
+			defer wg.Done()
+
+			// NOTE: The source is drained after stopped until it's closed,
+			// so the watcher isn't blocked by sending to it.
+			for kvs := range source {
+				for k, v := range kvs {
+					select {
+					case ch <- KVEvent{Prefix: prefix, Key: k, Value: v}:
+					case <-done:
+					}
+				}
+			}
+		}(prefixes[i], sources[i])
+	}
+
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			watcher.Close()
+		})
+	}
+
+	return ch, stop, nil
 }
 
-func (cs *clusterStorage) GetRaw(key string) (*mvccpb.KeyValue, error) {
-	return cs.cls.GetRaw(key)
+func (cs *clusterStorage) Watch(key string) (<-chan *string, func(), error) {
+	watcher, err := cs.cls.Watcher()
+	if err != nil {
+		return nil, nil, err
+	}
+	if watcher == nil {
+		return nil, nil, fmt.Errorf("watcher of the cluster is unavailable")
+	}
+
+	source, err := watcher.Watch(key)
+	if err != nil {
+		watcher.Close()
+		return nil, nil, fmt.Errorf("watch %s failed: %v", key, err)
+	}
+
+	ch, done := make(chan *string, 10), make(chan struct{})
+	go func() {
+		defer close(ch)
+
+		for value := range source {
+			select {
+			case ch <- value:
+			case <-done:
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			watcher.Close()
+		})
+	}
+
+	return ch, stop, nil
 }
 
-func (cs *clusterStorage) GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, error) {
-	return cs.cls.GetRawPrefix(prefix)
+func (cs *clusterStorage) WatchPrefix(prefix string) (<-chan map[string]*string, func(), error) {
+	watcher, err := cs.cls.Watcher()
+	if err != nil {
+		return nil, nil, err
+	}
+	if watcher == nil {
+		return nil, nil, fmt.Errorf("watcher of the cluster is unavailable")
+	}
+
+	source, err := watcher.WatchPrefix(prefix)
+	if err != nil {
+		watcher.Close()
+		return nil, nil, fmt.Errorf("watch prefix %s failed: %v", prefix, err)
+	}
+
+	ch, done := make(chan map[string]*string, 10), make(chan struct{})
+	go func() {
+		defer close(ch)
+
+		for kvs := range source {
+			select {
+			case ch <- kvs:
+			case <-done:
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			watcher.Close()
+		})
+	}
+
+	return ch, stop, nil
 }
 
 func (cs *clusterStorage) Syncer() (cluster.Syncer, error) {
-	return cs.cls.Syncer(time.Minute)
+	return cs.SyncerWithInterval(defaultSyncInterval)
+}
+
+func (cs *clusterStorage) SyncerWithInterval(pullInterval time.Duration) (cluster.Syncer, error) {
+	if pullInterval <= 0 {
+		return nil, fmt.Errorf("invalid pull interval of syncer: %s", pullInterval)
+	}
+	return cs.cls.Syncer(pullInterval)
+}
+
+// LeaderChanged watches the notifications of the leader changes of the cluster,
+// the watching lasts until ctx is done.
+func (cs *clusterStorage) LeaderChanged(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	go cs.watchLeader(ctx, ch)
+	return ch
+}
+
+func (cs *clusterStorage) watchLeader(ctx context.Context, ch chan struct{}) {
+	defer close(ch)
+
+	for {
+		changed, err := cs.cls.LeaderChangedNotify()
+		if err != nil {
+			logger.Debugf("watch leader of %s failed: %v", cs.name, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(cs.leaderRetryInterval):
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+
+		// NOTE: Drop the notification if the former one has not been consumed,
+		// the receivers only need to know something changed.
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
 }
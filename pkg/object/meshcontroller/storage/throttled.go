@@ -0,0 +1,576 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/megaease/easegress/v2/pkg/logger"
+)
+
+type (
+	// ThrottledStorage wraps a storage to limit the rate of writes per key.
+	// The puts of a key arriving within the minimum interval after its last
+	// write are coalesced, and only the latest value is written when the
+	// interval passes. The pending values are served by Get and GetPrefix, and
+	// the other reads, e.g. the raw ones with revisions, write them first.
+	// The other writes drop the pending values of the keys they overwrite, and
+	// the conditional ones, e.g. Txn and CompareAndSwap, write them first.
+	// The failures of the writes later than the puts are reported by Flush.
+	ThrottledStorage struct {
+		Storage
+
+		minInterval time.Duration
+
+		mutex sync.Mutex
+		keys  map[string]*throttledKey
+		// failed is the failures of the later writes by keys since the last Flush.
+		failed map[string]error
+	}
+
+	// throttledKey is the state of a key written within the minimum interval,
+	// which is pruned once the interval passes without pending value.
+	throttledKey struct {
+		lastWrite time.Time
+		pending   *string
+		timer     *time.Timer
+		// writing is closed once the write in flight is done, nil if none.
+		writing chan struct{}
+	}
+
+	throttledTxn struct {
+		Txn
+
+		ts   *ThrottledStorage
+		keys []string
+	}
+)
+
+// NewThrottled creates a throttled storage on top of store.
+func NewThrottled(store Storage, minInterval time.Duration) *ThrottledStorage {
+	return &ThrottledStorage{
+		Storage:     store,
+		minInterval: minInterval,
+		keys:        map[string]*throttledKey{},
+		failed:      map[string]error{},
+	}
+}
+
+// Put writes the key at once if the minimum interval has passed since its last write,
+// otherwise the value is kept to be written later, and the returned error is nil.
+func (ts *ThrottledStorage) Put(key, value string) error {
+	return ts.put(key, value, ts.Storage.Put)
+}
+
+// PutCtx is like Put, ctx is used if the key is written at once.
+func (ts *ThrottledStorage) PutCtx(ctx context.Context, key, value string) error {
+	return ts.put(key, value, func(key, value string) error {
+		return ts.Storage.PutCtx(ctx, key, value)
+	})
+}
+
+func (ts *ThrottledStorage) put(key, value string, write func(key, value string) error) error {
+	ts.mutex.Lock()
+
+	if tk := ts.keys[key]; tk != nil {
+		tk.pending = &value
+		ts.mutex.Unlock()
+		return nil
+	}
+
+	tk := &throttledKey{lastWrite: time.Now(), writing: make(chan struct{})}
+	tk.timer = ts.afterInterval(key, tk)
+	ts.keys[key] = tk
+	ts.mutex.Unlock()
+
+	err := write(key, value)
+	ts.doneWriting(tk)
+	return err
+}
+
+// Get gets the pending value of the key if any, otherwise the one of the backend.
+func (ts *ThrottledStorage) Get(key string) (*string, error) {
+	if value, ok := ts.pending(key); ok {
+		return value, nil
+	}
+	return ts.Storage.Get(key)
+}
+
+// GetCtx is like Get with ctx.
+func (ts *ThrottledStorage) GetCtx(ctx context.Context, key string) (*string, error) {
+	if value, ok := ts.pending(key); ok {
+		return value, nil
+	}
+	return ts.Storage.GetCtx(ctx, key)
+}
+
+// GetPrefix gets the prefix, the pending values override the ones of the backend.
+func (ts *ThrottledStorage) GetPrefix(prefix string) (map[string]string, error) {
+	kvs, err := ts.Storage.GetPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return ts.overlayPending(prefix, kvs), nil
+}
+
+// GetPrefixCtx is like GetPrefix with ctx.
+func (ts *ThrottledStorage) GetPrefixCtx(ctx context.Context, prefix string) (map[string]string, error) {
+	kvs, err := ts.Storage.GetPrefixCtx(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return ts.overlayPending(prefix, kvs), nil
+}
+
+// GetPrefixPaged writes the pending values of the prefix first, then gets the page.
+func (ts *ThrottledStorage) GetPrefixPaged(prefix string, limit int64, fromKey string) (map[string]string, string, error) {
+	if err := ts.flushPendingPrefix(prefix); err != nil {
+		return nil, "", err
+	}
+	return ts.Storage.GetPrefixPaged(prefix, limit, fromKey)
+}
+
+// GetRaw writes the pending value of the key first, so its revisions are up to date.
+func (ts *ThrottledStorage) GetRaw(key string) (*mvccpb.KeyValue, error) {
+	if err := ts.flushPendingKey(key); err != nil {
+		return nil, err
+	}
+	return ts.Storage.GetRaw(key)
+}
+
+// GetRawPrefix writes the pending values of the prefix first, then gets it.
+func (ts *ThrottledStorage) GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, error) {
+	if err := ts.flushPendingPrefix(prefix); err != nil {
+		return nil, err
+	}
+	return ts.Storage.GetRawPrefix(prefix)
+}
+
+// CountPrefix writes the pending values of the prefix first, then counts it.
+func (ts *ThrottledStorage) CountPrefix(prefix string) (int64, error) {
+	if err := ts.flushPendingPrefix(prefix); err != nil {
+		return 0, err
+	}
+	return ts.Storage.CountPrefix(prefix)
+}
+
+// Exists writes the pending value of the key first, then checks it.
+func (ts *ThrottledStorage) Exists(key string) (bool, error) {
+	if err := ts.flushPendingKey(key); err != nil {
+		return false, err
+	}
+	return ts.Storage.Exists(key)
+}
+
+// ListRevisions writes the pending values of the prefix first, then lists it.
+func (ts *ThrottledStorage) ListRevisions(prefix string) (map[string]int64, error) {
+	if err := ts.flushPendingPrefix(prefix); err != nil {
+		return nil, err
+	}
+	return ts.Storage.ListRevisions(prefix)
+}
+
+// CurrentRevision writes all pending values first, so the revision covers the puts before.
+func (ts *ThrottledStorage) CurrentRevision() (int64, error) {
+	if err := ts.flushPendingPrefix(""); err != nil {
+		return 0, err
+	}
+	return ts.Storage.CurrentRevision()
+}
+
+// SnapshotAt writes the pending values of the prefixes first, so the ones put
+// before revision is taken are in the snapshot.
+func (ts *ThrottledStorage) SnapshotAt(revision int64, prefixes []string) (map[string]string, error) {
+	for _, prefix := range prefixes {
+		if err := ts.flushPendingPrefix(prefix); err != nil {
+			return nil, err
+		}
+	}
+	return ts.Storage.SnapshotAt(revision, prefixes)
+}
+
+// WaitForValue writes the pending value of the key first, then waits for it.
+func (ts *ThrottledStorage) WaitForValue(ctx context.Context, key, expected string) error {
+	if err := ts.flushPendingKey(key); err != nil {
+		return err
+	}
+	return ts.Storage.WaitForValue(ctx, key, expected)
+}
+
+// Delete deletes the key and drops its pending write.
+func (ts *ThrottledStorage) Delete(key string) error {
+	ts.drop(key)
+	return ts.Storage.Delete(key)
+}
+
+// DeleteCtx deletes the key with ctx and drops its pending write.
+func (ts *ThrottledStorage) DeleteCtx(ctx context.Context, key string) error {
+	ts.drop(key)
+	return ts.Storage.DeleteCtx(ctx, key)
+}
+
+// DeletePrefix deletes the prefix and drops the pending writes of its keys.
+func (ts *ThrottledStorage) DeletePrefix(prefix string) error {
+	ts.dropPrefix(prefix)
+	return ts.Storage.DeletePrefix(prefix)
+}
+
+// PutUnderLease writes the key at once, and drops its pending write.
+func (ts *ThrottledStorage) PutUnderLease(key, value string) error {
+	ts.drop(key)
+	return ts.Storage.PutUnderLease(key, value)
+}
+
+// PutWithLease writes the key at once, and drops its pending write.
+func (ts *ThrottledStorage) PutWithLease(key, value string, leaseID clientv3.LeaseID) error {
+	ts.drop(key)
+	return ts.Storage.PutWithLease(key, value, leaseID)
+}
+
+// PutAndDelete writes the keys at once, and drops their pending writes.
+func (ts *ThrottledStorage) PutAndDelete(kvs map[string]*string) error {
+	ts.drop(kvsKeys(kvs)...)
+	return ts.Storage.PutAndDelete(kvs)
+}
+
+// PutAndDeleteUnderLease writes the keys at once, and drops their pending writes.
+func (ts *ThrottledStorage) PutAndDeleteUnderLease(kvs map[string]*string) error {
+	ts.drop(kvsKeys(kvs)...)
+	return ts.Storage.PutAndDeleteUnderLease(kvs)
+}
+
+// PutAndDeleteCtx writes the keys with ctx at once, and drops their pending writes.
+func (ts *ThrottledStorage) PutAndDeleteCtx(ctx context.Context, kvs map[string]*string) error {
+	ts.drop(kvsKeys(kvs)...)
+	return ts.Storage.PutAndDeleteCtx(ctx, kvs)
+}
+
+// Rename writes the pending values of the keys first, then renames oldKey to newKey.
+func (ts *ThrottledStorage) Rename(oldKey, newKey string) error {
+	if err := ts.flushKeys(oldKey, newKey); err != nil {
+		return err
+	}
+	return ts.Storage.Rename(oldKey, newKey)
+}
+
+// Append writes the pending value of the key first, then appends to it.
+func (ts *ThrottledStorage) Append(key, element string, maxLen int) error {
+	if err := ts.flushKeys(key); err != nil {
+		return err
+	}
+	return ts.Storage.Append(key, element, maxLen)
+}
+
+// AppendCtx is like Append with ctx.
+func (ts *ThrottledStorage) AppendCtx(ctx context.Context, key, element string, maxLen int) error {
+	if err := ts.flushKeys(key); err != nil {
+		return err
+	}
+	return ts.Storage.AppendCtx(ctx, key, element, maxLen)
+}
+
+// CompareAndSwap writes the pending value of the key first, so it's compared.
+func (ts *ThrottledStorage) CompareAndSwap(key, oldValue, newValue string) (bool, error) {
+	if err := ts.flushKeys(key); err != nil {
+		return false, err
+	}
+	return ts.Storage.CompareAndSwap(key, oldValue, newValue)
+}
+
+// PutIfRevision writes the pending value of the key first, so its revision is compared.
+func (ts *ThrottledStorage) PutIfRevision(key, value string, rev int64) (bool, error) {
+	if err := ts.flushKeys(key); err != nil {
+		return false, err
+	}
+	return ts.Storage.PutIfRevision(key, value, rev)
+}
+
+// Txn creates a transaction writing the pending values of its keys before committing.
+func (ts *ThrottledStorage) Txn() Txn {
+	return &throttledTxn{Txn: ts.Storage.Txn(), ts: ts}
+}
+
+// Flush writes all pending values at once, and waits for the writes in flight.
+// It returns the failures of the writes, including the ones later than the puts
+// since the last Flush.
+func (ts *ThrottledStorage) Flush() error {
+	ts.mutex.Lock()
+	keys := make([]string, 0, len(ts.keys))
+	for key := range ts.keys {
+		keys = append(keys, key)
+	}
+	ts.mutex.Unlock()
+
+	err := ts.flushKeys(keys...)
+
+	ts.mutex.Lock()
+	failed := ts.failed
+	ts.failed = map[string]error{}
+	ts.mutex.Unlock()
+
+	if err != nil || len(failed) == 0 {
+		return err
+	}
+
+	keys = keys[:0]
+	for key := range failed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	msgs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", key, failed[key]))
+	}
+	return fmt.Errorf("write coalesced values failed: %s", strings.Join(msgs, "; "))
+}
+
+func kvsKeys(kvs map[string]*string) []string {
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (ts *ThrottledStorage) pending(key string) (*string, bool) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	if tk := ts.keys[key]; tk != nil && tk.pending != nil {
+		value := *tk.pending
+		return &value, true
+	}
+	return nil, false
+}
+
+func (ts *ThrottledStorage) overlayPending(prefix string, kvs map[string]string) map[string]string {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	for key, tk := range ts.keys {
+		if tk.pending != nil && strings.HasPrefix(key, prefix) {
+			kvs[key] = *tk.pending
+		}
+	}
+	return kvs
+}
+
+// afterInterval handles the key once the minimum interval passes, the caller must hold the mutex.
+func (ts *ThrottledStorage) afterInterval(key string, tk *throttledKey) *time.Timer {
+	return time.AfterFunc(ts.minInterval-time.Since(tk.lastWrite), func() {
+		if err := ts.flush(key, tk); err != nil {
+			logger.Errorf("%v", err)
+
+			ts.mutex.Lock()
+			ts.failed[key] = err
+			ts.mutex.Unlock()
+		}
+	})
+}
+
+func (ts *ThrottledStorage) doneWriting(tk *throttledKey) {
+	ts.mutex.Lock()
+	writing := tk.writing
+	tk.writing = nil
+	ts.mutex.Unlock()
+
+	close(writing)
+}
+
+// waitWriting waits for the write in flight of tk, the caller must hold the mutex,
+// which is released while waiting. It reports false if tk is dropped meanwhile.
+func (ts *ThrottledStorage) waitWriting(key string, tk *throttledKey) bool {
+	for tk.writing != nil {
+		writing := tk.writing
+		ts.mutex.Unlock()
+		<-writing
+		ts.mutex.Lock()
+	}
+	return ts.keys[key] == tk
+}
+
+// flush writes the pending value of tk, or prunes it if there is none.
+// The write runs without the mutex, and the later write of the key
+// waits for it, so the writes of a key keep their order.
+func (ts *ThrottledStorage) flush(key string, tk *throttledKey) error {
+	ts.mutex.Lock()
+	if !ts.waitWriting(key, tk) {
+		ts.mutex.Unlock()
+		return nil
+	}
+
+	tk.timer.Stop()
+	if tk.pending == nil {
+		delete(ts.keys, key)
+		ts.mutex.Unlock()
+		return nil
+	}
+
+	value := *tk.pending
+	tk.pending = nil
+	tk.lastWrite = time.Now()
+	tk.writing = make(chan struct{})
+	tk.timer = ts.afterInterval(key, tk)
+	ts.mutex.Unlock()
+
+	err := ts.Storage.Put(key, value)
+	ts.doneWriting(tk)
+	if err != nil {
+		return fmt.Errorf("write coalesced value of %s failed: %v", key, err)
+	}
+	return nil
+}
+
+// flushKeys writes the pending values of the keys, it returns the first failure.
+func (ts *ThrottledStorage) flushKeys(keys ...string) error {
+	var firstErr error
+	for _, key := range keys {
+		ts.mutex.Lock()
+		tk := ts.keys[key]
+		ts.mutex.Unlock()
+
+		if tk == nil {
+			continue
+		}
+		if err := ts.flush(key, tk); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// flushPendingKey writes the pending value of the key, or waits for its write in flight,
+// unlike flushKeys, the key is kept throttled rather than pruned.
+func (ts *ThrottledStorage) flushPendingKey(key string) error {
+	return ts.flushPending(func(k string) bool { return k == key }, key)
+}
+
+// flushPendingPrefix is like flushPendingKey for the keys of the prefix.
+func (ts *ThrottledStorage) flushPendingPrefix(prefix string) error {
+	return ts.flushPending(func(k string) bool { return strings.HasPrefix(k, prefix) })
+}
+
+// flushPending flushes the keys matched, the candidates are looked up directly if given.
+func (ts *ThrottledStorage) flushPending(match func(key string) bool, candidates ...string) error {
+	ts.mutex.Lock()
+	var keys []string
+	var writings []chan struct{}
+	check := func(key string, tk *throttledKey) {
+		switch {
+		case tk == nil || !match(key):
+		case tk.pending != nil:
+			keys = append(keys, key)
+		case tk.writing != nil:
+			writings = append(writings, tk.writing)
+		}
+	}
+	if len(candidates) != 0 {
+		for _, key := range candidates {
+			check(key, ts.keys[key])
+		}
+	} else {
+		for key, tk := range ts.keys {
+			check(key, tk)
+		}
+	}
+	ts.mutex.Unlock()
+
+	for _, writing := range writings {
+		<-writing
+	}
+	return ts.flushKeys(keys...)
+}
+
+// drop drops the pending writes of the keys, and waits for their writes in flight,
+// so they don't land after the following writes.
+func (ts *ThrottledStorage) drop(keys ...string) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	for _, key := range keys {
+		ts.dropKey(key)
+	}
+}
+
+func (ts *ThrottledStorage) dropPrefix(prefix string) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	for key := range ts.keys {
+		if strings.HasPrefix(key, prefix) {
+			ts.dropKey(key)
+		}
+	}
+}
+
+// dropKey drops the key, the caller must hold the mutex.
+func (ts *ThrottledStorage) dropKey(key string) {
+	tk := ts.keys[key]
+	if tk == nil {
+		return
+	}
+
+	tk.timer.Stop()
+	delete(ts.keys, key)
+	for tk.writing != nil {
+		writing := tk.writing
+		ts.mutex.Unlock()
+		<-writing
+		ts.mutex.Lock()
+	}
+}
+
+func (txn *throttledTxn) If(cmps ...Cmp) Txn {
+	for _, cmp := range cmps {
+		txn.keys = append(txn.keys, cmp.key)
+	}
+	txn.Txn.If(cmps...)
+	return txn
+}
+
+func (txn *throttledTxn) Then(ops ...Op) Txn {
+	for _, op := range ops {
+		txn.keys = append(txn.keys, op.key)
+	}
+	txn.Txn.Then(ops...)
+	return txn
+}
+
+func (txn *throttledTxn) Else(ops ...Op) Txn {
+	for _, op := range ops {
+		txn.keys = append(txn.keys, op.key)
+	}
+	txn.Txn.Else(ops...)
+	return txn
+}
+
+// Commit writes the pending values of the keys of the transaction, then commits it.
+func (txn *throttledTxn) Commit() (bool, error) {
+	if err := txn.ts.flushKeys(txn.keys...); err != nil {
+		return false, err
+	}
+	return txn.Txn.Commit()
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2017, The Easegress Authors
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	cmpTargetValue cmpTarget = iota
+	cmpTargetModRevision
+	cmpTargetExists
+)
+
+type (
+	// Txn builds a transaction: the Then operations are applied
+	// if all If conditions hold, otherwise the Else operations.
+	Txn interface {
+		If(cmps ...Cmp) Txn
+		Then(ops ...Op) Txn
+		Else(ops ...Op) Txn
+
+		// Commit commits the transaction, it reports whether the conditions hold.
+		Commit() (bool, error)
+	}
+
+	// Cmp is a condition of transaction.
+	Cmp struct {
+		key      string
+		target   cmpTarget
+		value    string
+		revision int64
+		exists   bool
+	}
+
+	// Op is an operation of transaction, nil value means deleting the key.
+	Op struct {
+		key     string
+		value   *string
+		leaseID clientv3.LeaseID
+	}
+
+	cmpTarget int
+
+	clusterTxn struct {
+		cs      *clusterStorage
+		cmps    []Cmp
+		thenOps []Op
+		elseOps []Op
+	}
+)
+
+// CmpValue is the condition that the value of key equals to value.
+func CmpValue(key, value string) Cmp {
+	return Cmp{key: key, target: cmpTargetValue, value: value}
+}
+
+// CmpModRevision is the condition that the mod revision of key equals to revision,
+// the mod revision of a missing key is 0.
+func CmpModRevision(key string, revision int64) Cmp {
+	return Cmp{key: key, target: cmpTargetModRevision, revision: revision}
+}
+
+// CmpExists is the condition that the key exists or not.
+func CmpExists(key string, exists bool) Cmp {
+	return Cmp{key: key, target: cmpTargetExists, exists: exists}
+}
+
+// OpPut is the operation putting value to key.
+func OpPut(key, value string) Op {
+	return Op{key: key, value: &value}
+}
+
+// OpPutWithLease is the operation putting value to key with the lease,
+// 0 leaseID means without any lease.
+func OpPutWithLease(key, value string, leaseID clientv3.LeaseID) Op {
+	return Op{key: key, value: &value, leaseID: leaseID}
+}
+
+// OpDelete is the operation deleting key.
+func OpDelete(key string) Op {
+	return Op{key: key}
+}
+
+func (cmp Cmp) toEtcd() clientv3.Cmp {
+	switch cmp.target {
+	case cmpTargetModRevision:
+		return clientv3.Compare(clientv3.ModRevision(cmp.key), "=", cmp.revision)
+	case cmpTargetExists:
+		if cmp.exists {
+			return clientv3.Compare(clientv3.CreateRevision(cmp.key), ">", 0)
+		}
+		return clientv3.Compare(clientv3.CreateRevision(cmp.key), "=", 0)
+	default:
+		return clientv3.Compare(clientv3.Value(cmp.key), "=", cmp.value)
+	}
+}
+
+func (op Op) toEtcd() clientv3.Op {
+	if op.value == nil {
+		return clientv3.OpDelete(op.key)
+	}
+	if op.leaseID != 0 {
+		return clientv3.OpPut(op.key, *op.value, clientv3.WithLease(op.leaseID))
+	}
+	return clientv3.OpPut(op.key, *op.value)
+}
+
+func (cs *clusterStorage) Txn() Txn {
+	return &clusterTxn{cs: cs}
+}
+
+func (cs *clusterStorage) CompareAndSwap(key, oldValue, newValue string) (bool, error) {
+	return cs.Txn().If(CmpValue(key, oldValue)).Then(OpPut(key, newValue)).Commit()
+}
+
+func (cs *clusterStorage) PutIfRevision(key, value string, rev int64) (bool, error) {
+	return cs.Txn().If(CmpModRevision(key, rev)).Then(OpPut(key, value)).Commit()
+}
+
+func (txn *clusterTxn) If(cmps ...Cmp) Txn {
+	txn.cmps = append(txn.cmps, cmps...)
+	return txn
+}
+
+func (txn *clusterTxn) Then(ops ...Op) Txn {
+	txn.thenOps = append(txn.thenOps, ops...)
+	return txn
+}
+
+func (txn *clusterTxn) Else(ops ...Op) Txn {
+	txn.elseOps = append(txn.elseOps, ops...)
+	return txn
+}
+
+func (txn *clusterTxn) Commit() (_ bool, err error) {
+	defer txn.cs.metrics.observe(opTxn, time.Now(), &err)
+
+	cmps := make([]clientv3.Cmp, 0, len(txn.cmps))
+	for _, cmp := range txn.cmps {
+		cmps = append(cmps, cmp.toEtcd())
+	}
+
+	toEtcdOps := func(ops []Op) []clientv3.Op {
+		etcdOps := make([]clientv3.Op, 0, len(ops))
+		for _, op := range ops {
+			etcdOps = append(etcdOps, op.toEtcd())
+		}
+		return etcdOps
+	}
+
+	return txn.cs.cls.Txn(cmps, toEtcdOps(txn.thenOps), toEtcdOps(txn.elseOps))
+}
@@ -19,8 +19,12 @@ package worker
 
 import (
 	"net/http"
+	"strings"
 
+	"github.com/megaease/easegress/v2/pkg/api"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/registrycenter"
 	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
+	"github.com/megaease/easegress/v2/pkg/util/codectool"
 )
 
 const (
@@ -55,3 +59,30 @@ func (worker *Worker) writeJSONBody(w http.ResponseWriter, buff []byte) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(buff)
 }
+
+// writeNoContentOnEmpty responds 204 for the empty discovery result if the registry
+// type of the worker is in EmptyResultModeNoContent, and reports whether it did.
+func (worker *Worker) writeNoContentOnEmpty(w http.ResponseWriter) bool {
+	if worker.registryServer.EmptyResultMode(worker.registryType) != registrycenter.EmptyResultModeNoContent {
+		return false
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// writeListingBody writes the instance listing in form encoding
+// if the request accepts it, otherwise in JSON.
+func (worker *Worker) writeListingBody(w http.ResponseWriter, r *http.Request, listing interface{}) {
+	if !strings.Contains(r.Header.Get("Accept"), registrycenter.ContentTypeForm) {
+		worker.writeJSONBody(w, codectool.MustMarshalJSON(listing))
+		return
+	}
+
+	buff, err := registrycenter.EncodeForm(listing)
+	if err != nil {
+		api.HandleAPIError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", registrycenter.ContentTypeForm)
+	w.Write(buff)
+}
@@ -27,6 +27,7 @@ import (
 	"github.com/megaease/easegress/v2/pkg/api"
 	"github.com/megaease/easegress/v2/pkg/logger"
 	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/registrycenter"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
 	"github.com/megaease/easegress/v2/pkg/util/codectool"
 )
 
@@ -107,15 +108,19 @@ func (worker *Worker) healthService(w http.ResponseWriter, r *http.Request) {
 		serviceInfo *registrycenter.ServiceRegistryInfo
 	)
 
-	if serviceInfo, err = worker.registryServer.DiscoveryService(serviceName); err != nil {
+	// NOTE: Consul lists nothing rather than failing for the unknown service.
+	serviceInfo, err = worker.registryServer.DiscoveryService(serviceName)
+	if err != nil && err != spec.ErrServiceNotFound {
 		api.HandleAPIError(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	if serviceInfo == nil && worker.writeNoContentOnEmpty(w) {
+		return
+	}
 
 	serviceEntry := worker.registryServer.ToConsulHealthService(serviceInfo)
 
-	buff := codectool.MustMarshalJSON(serviceEntry)
-	worker.writeJSONBody(w, buff)
+	worker.writeListingBody(w, r, serviceEntry)
 }
 
 func (worker *Worker) catalogService(w http.ResponseWriter, r *http.Request) {
@@ -129,16 +134,19 @@ func (worker *Worker) catalogService(w http.ResponseWriter, r *http.Request) {
 		serviceInfo *registrycenter.ServiceRegistryInfo
 	)
 
-	if serviceInfo, err = worker.registryServer.DiscoveryService(serviceName); err != nil {
+	serviceInfo, err = worker.registryServer.DiscoveryService(serviceName)
+	if err != nil && err != spec.ErrServiceNotFound {
 		logger.Errorf("discovery service: %s, err: %v ", serviceName, err)
 		api.HandleAPIError(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	if serviceInfo == nil && worker.writeNoContentOnEmpty(w) {
+		return
+	}
 
 	catalogService := worker.registryServer.ToConsulCatalogService(serviceInfo)
 
-	buff := codectool.MustMarshalJSON(catalogService)
-	worker.writeJSONBody(w, buff)
+	worker.writeListingBody(w, r, catalogService)
 }
 
 func (worker *Worker) catalogServices(w http.ResponseWriter, r *http.Request) {
@@ -151,6 +159,9 @@ func (worker *Worker) catalogServices(w http.ResponseWriter, r *http.Request) {
 		api.HandleAPIError(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	if len(serviceInfos) == 0 && worker.writeNoContentOnEmpty(w) {
+		return
+	}
 	catalogServices := worker.registryServer.ToConsulServices(serviceInfos)
 
 	buff := codectool.MustMarshalJSON(catalogServices)
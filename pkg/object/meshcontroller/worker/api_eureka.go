@@ -31,6 +31,7 @@ import (
 	"github.com/megaease/easegress/v2/pkg/api"
 	"github.com/megaease/easegress/v2/pkg/logger"
 	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/registrycenter"
+	"github.com/megaease/easegress/v2/pkg/object/meshcontroller/spec"
 	"github.com/megaease/easegress/v2/pkg/util/codectool"
 )
 
@@ -132,6 +133,9 @@ func (worker *Worker) detectedAccept(accept string) string {
 		if v == registrycenter.ContentTypeXML {
 			return registrycenter.ContentTypeXML
 		}
+		if v == registrycenter.ContentTypeForm {
+			return registrycenter.ContentTypeForm
+		}
 	}
 
 	return registrycenter.ContentTypeXML
@@ -174,11 +178,15 @@ func (worker *Worker) apps(w http.ResponseWriter, r *http.Request) {
 		api.HandleAPIError(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	if len(serviceInfos) == 0 && worker.writeNoContentOnEmpty(w) {
+		return
+	}
 	xmlAPPs := worker.registryServer.ToEurekaApps(serviceInfos)
 	jsonAPPs := eurekaJSONApps{
 		APPs: eurekaAPPs{
 			VersionDelta: strconv.Itoa(xmlAPPs.VersionsDelta),
 			AppHashCode:  xmlAPPs.AppsHashcode,
+			Application:  []eurekaAPP{},
 		},
 	}
 
@@ -219,6 +227,9 @@ func (worker *Worker) app(w http.ResponseWriter, r *http.Request) {
 	)
 
 	if serviceInfo, err = worker.registryServer.DiscoveryService(serviceName); err != nil {
+		if err == spec.ErrServiceNotFound && worker.writeNoContentOnEmpty(w) {
+			return
+		}
 		logger.Errorf("discovery service: %s, err: %v ", serviceName, err)
 		api.HandleAPIError(w, r, http.StatusInternalServerError, err)
 		return
@@ -313,6 +324,8 @@ func (worker *Worker) encodeByAcceptType(accept string, jsonSt interface{}, xmlS
 	switch accept {
 	case registrycenter.ContentTypeJSON:
 		return codectool.MarshalJSON(jsonSt)
+	case registrycenter.ContentTypeForm:
+		return registrycenter.EncodeForm(jsonSt)
 	default:
 		return xml.Marshal(xmlSt)
 	}
@@ -19,7 +19,9 @@ package worker
 
 import (
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
 
@@ -77,8 +79,20 @@ func (worker *Worker) nacosAPIs() []*apiEntry {
 }
 
 func (worker *Worker) nacosRegister(w http.ResponseWriter, r *http.Request) {
-	err := worker.registryServer.CheckRegistryURL(w, r)
-	if err != nil {
+	// NOTE: Nacos clients send the registration in the form-encoded body.
+	contentType := r.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, registrycenter.ContentTypeForm) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			api.HandleAPIError(w, r, http.StatusBadRequest,
+				fmt.Errorf("read body failed: %v", err))
+			return
+		}
+		if err := worker.registryServer.CheckRegistryBody(contentType, body); err != nil {
+			api.HandleAPIError(w, r, http.StatusBadRequest, err)
+			return
+		}
+	} else if err := worker.registryServer.CheckRegistryURL(w, r); err != nil {
 		api.HandleAPIError(w, r, http.StatusBadRequest,
 			fmt.Errorf("parse request url parameters failed: %v", err))
 		return
@@ -124,7 +124,7 @@ func New(superSpec *supervisor.Spec) *Worker {
 	}
 
 	registryCenterServer := registrycenter.NewRegistryCenterServer(_spec.RegistryType,
-		instanceSpec, _service, _informer, observabilityManager.agentClient)
+		instanceSpec, _service, _informer, observabilityManager.agentClient, nil)
 
 	ingressServer := NewIngressServer(superSpec, super, serviceName, instanceID, _service)
 	egressServer := NewEgressServer(superSpec, super, serviceName, instanceID, _service)
@@ -210,6 +210,9 @@ func (worker *Worker) run() {
 	if err := worker.validate(); err != nil {
 		return
 	}
+	if !worker.preflight() {
+		return
+	}
 	startUpRoutine := func() bool {
 		defer func() {
 			if err := recover(); err != nil {
@@ -241,6 +244,31 @@ func (worker *Worker) run() {
 	go worker.updateAgentConfig()
 }
 
+// preflight retries the preflight of the registry center with backoff until
+// it passes, it reports false if the worker is closed before that.
+func (worker *Worker) preflight() bool {
+	backoff := &registrycenter.ExponentialBackoff{
+		Base:   time.Second,
+		Max:    registrycenter.DefaultBackoffMax,
+		Jitter: registrycenter.DefaultBackoffJitter,
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := worker.registryServer.Preflight()
+		if err == nil {
+			return true
+		}
+
+		interval := backoff.Next(attempt)
+		logger.Errorf("registry center preflight failed: %v, retry in %v", err, interval)
+		select {
+		case <-worker.done:
+			return false
+		case <-time.After(interval):
+		}
+	}
+}
+
 func (worker *Worker) heartbeat() {
 	trafficGateReady := false
 
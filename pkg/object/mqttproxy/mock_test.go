@@ -18,6 +18,7 @@
 package mqttproxy
 
 import (
+	stdcontext "context"
 	"fmt"
 	"reflect"
 	"strings"
@@ -43,9 +44,11 @@ type mockCluster struct {
 
 var _ cluster.Cluster = (*mockCluster)(nil)
 
-func (m *mockCluster) IsLeader() bool                              { return false }
-func (m *mockCluster) Layout() *cluster.Layout                     { return nil }
-func (m *mockCluster) GetRaw(key string) (*mvccpb.KeyValue, error) { return nil, nil }
+func (m *mockCluster) IsLeader() bool                                { return false }
+func (m *mockCluster) LeaderChangedNotify() (<-chan struct{}, error) { return nil, nil }
+func (m *mockCluster) Layout() *cluster.Layout                       { return nil }
+func (m *mockCluster) Endpoints() []string                           { return nil }
+func (m *mockCluster) GetRaw(key string) (*mvccpb.KeyValue, error)   { return nil, nil }
 func (m *mockCluster) GetRawPrefix(prefix string) (map[string]*mvccpb.KeyValue, error) {
 	return nil, nil
 }
@@ -62,6 +65,82 @@ func (m *mockCluster) StartServer() (chan struct{}, chan struct{}, error)
 func (m *mockCluster) Close(wg *sync.WaitGroup)                                       {}
 func (m *mockCluster) PurgeMember(member string) error                                { return nil }
 
+func (m *mockCluster) Txn(cmps []clientv3.Cmp, thenOps, elseOps []clientv3.Op) (bool, error) {
+	return true, nil
+}
+
+func (m *mockCluster) GetPrefixPaged(prefix string, limit int64, fromKey string) (map[string]string, string, error) {
+	kvs, err := m.GetPrefix(prefix)
+	return kvs, "", err
+}
+
+func (m *mockCluster) GetPrefixAt(prefix string, revision int64) (map[string]string, error) {
+	return m.GetPrefix(prefix)
+}
+
+func (m *mockCluster) CurrentRevision() (int64, error) {
+	return 0, nil
+}
+
+func (m *mockCluster) CountPrefix(prefix string) (int64, error) {
+	kvs, err := m.GetPrefix(prefix)
+	return int64(len(kvs)), err
+}
+
+func (m *mockCluster) Exists(key string) (bool, error) {
+	value, err := m.Get(key)
+	return value != nil, err
+}
+
+func (m *mockCluster) ListRevisions(prefix string) (map[string]int64, error) {
+	kvs, err := m.GetPrefix(prefix)
+	revisions := make(map[string]int64, len(kvs))
+	for k := range kvs {
+		revisions[k] = 0
+	}
+	return revisions, err
+}
+
+func (m *mockCluster) GrantLease(ttl time.Duration) (clientv3.LeaseID, error) {
+	return 1, nil
+}
+
+func (m *mockCluster) KeepAliveLease(leaseID clientv3.LeaseID) error {
+	return nil
+}
+
+func (m *mockCluster) RevokeLease(leaseID clientv3.LeaseID) error {
+	return nil
+}
+
+func (m *mockCluster) PutWithLease(key, value string, leaseID clientv3.LeaseID) error {
+	return m.Put(key, value)
+}
+
+func (m *mockCluster) ListLeases() ([]*clientv3.LeaseTimeToLiveResponse, error) {
+	return nil, nil
+}
+
+func (m *mockCluster) GetRawCtx(ctx stdcontext.Context, key string) (*mvccpb.KeyValue, error) {
+	return m.GetRaw(key)
+}
+
+func (m *mockCluster) GetRawPrefixCtx(ctx stdcontext.Context, prefix string) (map[string]*mvccpb.KeyValue, error) {
+	return m.GetRawPrefix(prefix)
+}
+
+func (m *mockCluster) PutCtx(ctx stdcontext.Context, key, value string) error {
+	return m.Put(key, value)
+}
+
+func (m *mockCluster) PutAndDeleteCtx(ctx stdcontext.Context, kvs map[string]*string) error {
+	return m.PutAndDelete(kvs)
+}
+
+func (m *mockCluster) DeleteCtx(ctx stdcontext.Context, key string) error {
+	return m.Delete(key)
+}
+
 func (m *mockCluster) Watcher() (cluster.Watcher, error) {
 	m.Lock()
 	defer m.Unlock()
@@ -19,6 +19,7 @@
 package codectool
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -72,6 +73,13 @@ func UnmarshalJSON(data []byte, v interface{}) error {
 	return json.Unmarshal(data, v)
 }
 
+// UnmarshalJSONStrict is like UnmarshalJSON, but rejects the unknown fields.
+func UnmarshalJSONStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
 // MustUnmarshalJSON wraps json.Unmarshal.
 // It panics if an error occurs.
 func MustUnmarshalJSON(data []byte, v interface{}) {